@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	rice "github.com/GeertJohan/go.rice"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -40,48 +46,91 @@ type jsonError struct {
 
 // API Type
 type API struct {
+	*liveConfig
+
 	app       *Cave
-	config    *Config
 	log       *Log
 	terminate chan bool
 	kv        *KV
 	http      *echo.Echo
+	// cluster queries running on this node
+	clusterQueries chan bool
 }
 
-//NewAPI function
+// NewAPI function
 func NewAPI(app *Cave) (*API, error) {
 	a := &API{
-		app:    app,
-		config: app.Config,
-		log:    app.Logger,
-		kv:     app.KV,
+		app:        app,
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		kv:         app.KV,
 	}
 	a.terminate = make(chan bool)
+	a.clusterQueries = make(chan bool, maxClusterQueries)
 	a.http = echo.New()
 	a.http.HideBanner = true
 	a.http.HidePort = true
 	a.http.Debug = false
+	a.http.IPExtractor = clientIPExtractor(a.config().API.TrustedProxies)
 	//a.http.Use(middleware.Recover())
+	a.http.Use(a.requestID)
+	if a.config().Tracing.Enable {
+		a.http.Use(a.trace)
+	}
 	a.http.Use(a.log.EchoLogger("/api/v1/perf/metrics", "/api/v1/perf/logs"))
-	// UI
-	fs := rice.MustFindBox("./ui/").HTTPBox()
-	a.http.GET("/", echo.WrapHandler(http.FileServer(fs)))
-	a.http.GET("/ui/*", echo.WrapHandler(http.StripPrefix("/ui/", http.FileServer(fs))))
+	// UI, unless it's turned off or has its own port. Without the
+	// routes UI paths get the usual 404.
+	if a.config().UI.Enable && a.config().UI.Port == a.config().API.Port {
+		uiRoutes(a.http)
+	}
 	a.http.Any("/api/v1/plugin/*", a.PluginHandler)
 	a.http.Any("/api/v1/kv/", a.kvHandler)
 	a.http.Any("/api/v1/kv/*", a.kvHandler)
+	a.http.GET(APIPREFIX+"locks", a.routeListLocks)
+	a.http.GET(APIPREFIX+"search", a.routeSearch)
+	a.http.GET(APIPREFIX+"ns", a.routeListNamespaces)
+	a.http.DELETE(APIPREFIX+"ns/:ns", a.routeDeleteNamespace, a.writable)
+	a.http.Any(APIPREFIX+"ns/:ns/kv/", a.kvHandler)
+	a.http.Any(APIPREFIX+"ns/:ns/kv/*", a.kvHandler)
 	a.http.POST(APIPREFIX+"login", a.routeLogin)
 	a.http.GET(APIPREFIX+"cluster/nodes", a.routeClusterNodes)
+	a.http.GET(APIPREFIX+"cluster/health", a.routeClusterHealth)
+	a.http.GET(APIPREFIX+"cluster/leader", a.routeClusterLeader)
+	a.http.POST(APIPREFIX+"cluster/query", a.routeClusterQuery, a.authenticate)
+	a.http.POST(APIPREFIX+"cluster/leave", a.routeClusterLeave, a.authenticate)
 	a.http.POST("/api/v1/query", a.multiQueryHandler)
+	a.http.GET(APIPREFIX+"discovery/:service", a.routeDiscovery)
+	a.http.GET(APIPREFIX+"openapi.json", a.routeOpenAPI)
 	// PERF GROUP
 	perf := a.http.Group(APIPREFIX + "perf")
 	perf.GET("/logs", a.routeLogs)
-	perf.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
-	perf.GET("/dashboard", a.routeDashboard)
+	if a.config().API.EnableMetrics {
+		perf.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+		perf.GET("/dashboard", a.routeDashboard)
+	}
 
 	system := a.http.Group("/api/v1/system")
-	system.GET("/config", a.routeSystemConfig)
-	system.GET("/info", a.routeSystemInfo)
+	system.GET("/config", a.routeSystemConfig, a.authenticate)
+	system.GET("/info", a.routeSystemInfo, a.authenticate)
+	system.GET("/stats", a.routeSystemStats)
+	system.GET("/version", a.routeSystemVersion)
+	system.GET("/backup", a.routeSystemBackup, a.authenticate)
+	system.POST("/restore", a.routeSystemRestore, a.authenticate, a.writable)
+	system.GET("/healthz", a.routeHealthz)
+	system.GET("/readyz", a.routeReadyz)
+	system.POST("/rotate-key", a.routeRotateKey, a.authenticate, a.writable)
+	system.GET("/crypto", a.routeSystemCrypto, a.authenticate)
+	system.POST("/crypto/:ns/init", a.routeInitNamespaceKey, a.authenticate, a.writable)
+	system.POST("/crypto/:ns/unseal", a.routeUnsealNamespace, a.authenticate)
+	system.POST("/crypto/:ns/seal", a.routeSealNamespace, a.authenticate)
+	system.POST("/init", a.routeInitUnseal, a.authenticate)
+	system.POST("/unseal", a.routeUnseal, a.authenticate)
+	system.POST("/seal", a.routeSeal, a.authenticate)
+	system.POST("/compact", a.routeCompact, a.authenticate)
+	system.GET("/audit", a.routeSystemAudit, a.authenticate)
+	system.GET("/schemas", a.routeGetSchemas)
+	system.POST("/schemas/*", a.routePutSchema, a.authenticate, a.writable)
+	system.DELETE("/schemas/*", a.routeDeleteSchema, a.authenticate, a.writable)
 	return a, nil
 }
 
@@ -89,14 +138,95 @@ func NewAPI(app *Cave) (*API, error) {
 func (a *API) Start() {
 	go a.watch()
 	scheme := "http://"
-	if a.config.SSL.Enable {
+	addr := net.JoinHostPort(a.config().API.BindAddress, strconv.Itoa(int(a.config().API.Port)))
+	if a.config().SSL.Enable {
 		scheme = "https://"
-		a.log.InfoF(nil, "API listening on %s0.0.0.0:%v", scheme, a.config.API.Port)
-		a.log.Error(nil, a.http.StartTLS(fmt.Sprintf("0.0.0.0:%v", a.config.API.Port), a.config.SSL.Certificate, a.config.SSL.Key))
+		a.log.InfoF(nil, "API listening on %s%s", scheme, addr)
+		config, err := apiTLSConfig(a.config().SSL)
+		if err != nil {
+			a.log.Error(nil, err)
+			return
+		}
+		s := a.http.TLSServer
+		s.Addr = addr
+		s.TLSConfig = config
+		a.log.Error(nil, a.http.StartServer(s))
 	} else {
-		a.log.InfoF(nil, "API listening on %s0.0.0.0:%v", scheme, a.config.API.Port)
-		a.log.Error(nil, a.http.Start(fmt.Sprintf("0.0.0.0:%v", a.config.API.Port)))
+		a.log.InfoF(nil, "API listening on %s%s", scheme, addr)
+		a.log.Error(nil, a.http.Start(addr))
+	}
+}
+
+// parseTrustedProxy parses a trusted proxy given as an IP or a CIDR
+// range
+func parseTrustedProxy(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not an IP address or CIDR range", s)
+	}
+	return n, nil
+}
+
+// clientIPExtractor finds the client address of a request. It's the
+// address the request came from, unless that's one of the trusted
+// proxies, in which case it's taken from X-Forwarded-For, skipping
+// any other trusted proxies in it, or else X-Real-IP. With no trusted
+// proxies the headers are ignored, since anyone can send them.
+func clientIPExtractor(proxies []string) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, p := range proxies {
+		n, err := parseTrustedProxy(p)
+		if err != nil {
+			// caught by Validate
+			continue
+		}
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	xff := echo.ExtractIPFromXFFHeader(opts...)
+	realIP := echo.ExtractIPFromRealIPHeader(opts...)
+	return func(req *http.Request) string {
+		if req.Header.Get(echo.HeaderXForwardedFor) != "" {
+			return xff(req)
+		}
+		return realIP(req)
+	}
+}
+
+// apiTLSConfig loads the API's certificate, and when a CA is configured
+// requires clients to present a certificate signed by it
+func apiTLSConfig(ssl SSLConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(ssl.Certificate, ssl.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if ssl.CACertificate == "" {
+		return config, nil
 	}
+	pem, err := ioutil.ReadFile(ssl.CACertificate)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", ssl.CACertificate)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
 }
 
 func (a *API) watch() {
@@ -121,17 +251,210 @@ func (a *API) routeLogin(c echo.Context) error {
 	return c.JSON(200, map[string]string{"message": "ok"})
 }
 
+// authenticate checks the request's bearer token against the token
+// store when API authentication is enabled
+func (a *API) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !a.config().API.Authentication {
+			return next(c)
+		}
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return c.JSON(401, jsonError{Message: "Missing bearer token"})
+		}
+		tok, err := a.app.TokenStore.Find(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil || time.Now().Before(tok.IssueTime) || time.Now().After(tok.ExpireTime) {
+			return c.JSON(401, jsonError{Message: "Invalid or expired token"})
+		}
+		c.Set("identity", tok.UID)
+		return next(c)
+	}
+}
+
+// errReadOnly is sent for writes made to a read-only replica
+var errReadOnly = jsonError{Message: "This node is a read-only replica and does not accept writes"}
+
+// writable rejects requests to a read-only replica
+func (a *API) writable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.app.Cluster.ReadOnly() {
+			return c.JSON(503, errReadOnly)
+		}
+		return next(c)
+	}
+}
+
+// forwardKV passes a KV write on to the cluster leader and relays
+// its answer
+func (a *API) forwardKV(c echo.Context) error {
+	path, prefix, err := kvTarget(c)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	q := QueryObject{Key: path, Verb: c.Request().Method}
+	if q.Verb == "DELETE" && c.QueryParam("lock") != "" {
+		// locks are held by the node that took them
+		return c.JSON(503, errReadOnly)
+	}
+	if q.Verb == "POST" {
+		if c.QueryParam("rollback") != "" || c.QueryParam("incr") != "" || c.QueryParam("append") != "" ||
+			c.QueryParam("set_add") != "" || c.QueryParam("set_remove") != "" || c.QueryParam("lock") != "" {
+			return c.JSON(503, errReadOnly)
+		}
+		buf, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+		q.Value = string(buf)
+		q.Secret = c.QueryParam("secret") != ""
+	}
+	res, err := a.app.Cluster.forwardWrite(ForwardedWrite{
+		Prefix:    prefix,
+		Query:     q,
+		Requester: a.requester(c),
+		RequestID: requestIDFrom(c.Request().Context()),
+	})
+	if err == ErrNoLeader {
+		return c.JSON(503, errReadOnly)
+	}
+	if errors.Is(err, ErrSealed) {
+		return c.JSON(503, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(502, jsonError{Message: err.Error()})
+	}
+	if res.Error != "" {
+		return c.JSON(res.Status, jsonError{Message: res.Error})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+// identity returns who made the request, if it was authenticated
+func identity(c echo.Context) string {
+	if id, ok := c.Get("identity").(string); ok {
+		return id
+	}
+	return ""
+}
+
+// requester names who made the request for the audit trail. Routes
+// that don't require authentication still pick up a valid bearer
+// token if one was sent, otherwise the client address is used.
+func (a *API) requester(c echo.Context) string {
+	if id := a.tokenIdentity(c); id != "" {
+		return id
+	}
+	return "anonymous@" + c.RealIP()
+}
+
+// tokenIdentity returns the identity of the request's bearer token, or
+// an empty string if it has no valid token
+func (a *API) tokenIdentity(c echo.Context) string {
+	if id := identity(c); id != "" {
+		return id
+	}
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if strings.HasPrefix(auth, "Bearer ") && a.app.TokenStore != nil {
+		tok, err := a.app.TokenStore.Find(strings.TrimPrefix(auth, "Bearer "))
+		if err == nil && time.Now().After(tok.IssueTime) && time.Now().Before(tok.ExpireTime) {
+			return tok.UID
+		}
+	}
+	return ""
+}
+
+// canDecrypt reports whether the request may read secrets in
+// plaintext. With authentication on, that takes a valid token whose
+// identity is in api.secret_readers, or any valid token if the list is
+// empty.
+func (a *API) canDecrypt(c echo.Context) bool {
+	if !a.config().API.Authentication {
+		return true
+	}
+	return secretReader(a.config().API, a.tokenIdentity(c))
+}
+
+// secretReader reports whether a token identity is allowed to read
+// secrets in plaintext
+func secretReader(config APIConfig, id string) bool {
+	if id == "" {
+		return false
+	}
+	if len(config.SecretReaders) == 0 {
+		return true
+	}
+	for _, r := range config.SecretReaders {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+const decryptKey ctxKey = "decrypt"
+
+// errNoDecrypt is sent when a secret is asked for in plaintext by a
+// client that isn't allowed to read it
+var errNoDecrypt = jsonError{Message: "Not authorized to decrypt secrets"}
+
+// kvContext returns the request context tagged with the requester and
+// whether it may decrypt secrets
+func (a *API) kvContext(c echo.Context) context.Context {
+	ctx := withRequester(c.Request().Context(), a.requester(c))
+	// writes hand back their index so clients can read them elsewhere
+	w := &writeIndex{}
+	ctx = withWriteIndex(ctx, w)
+	c.Response().Before(func() {
+		if w.committed > 0 {
+			c.Response().Header().Set("X-Cave-Write-Index", formatIndex(a.app.Cluster.node.Addr(), w.committed))
+		}
+	})
+	return context.WithValue(ctx, decryptKey, a.canDecrypt(c))
+}
+
+// mayDecrypt reports whether the request behind ctx may read secrets
+// in plaintext
+func mayDecrypt(ctx context.Context) bool {
+	ok, _ := ctx.Value(decryptKey).(bool)
+	return ok
+}
+
 func trimPath(path string, prefix string) string {
 	return path[len(prefix):]
 }
 
+// kvTarget returns the key path of a KV request and the top-level
+// bucket it's in, which is either the default key space or the
+// namespace named in the URL
+func kvTarget(c echo.Context) (string, string, error) {
+	ns := c.Param("ns")
+	if ns == "" {
+		return trimPath(c.Request().URL.Path, KVPREFIX), "kv", nil
+	}
+	prefix, err := namespaceBucket(ns)
+	if err != nil {
+		return "", "", err
+	}
+	return trimPath(c.Request().URL.Path, APIPREFIX+"ns/"+ns+"/kv/"), prefix, nil
+}
+
 func (a *API) kvHandler(c echo.Context) error {
 	switch c.Request().Method {
 	case "GET":
 		return a.kvGetHandler(c)
 	case "POST":
+		if a.app.Cluster.ReadOnly() {
+			return a.forwardKV(c)
+		}
 		return a.kvPutHandler(c)
 	case "DELETE":
+		if _, _, ok := lockTarget(c.Request().URL.Path); ok {
+			return a.authenticate(a.writable(a.forceUnlockHandler))(c)
+		}
+		if a.app.Cluster.ReadOnly() {
+			return a.forwardKV(c)
+		}
 		return a.kvDeleteHandler(c)
 	default:
 		return c.JSON(405, jsonError{Message: "Method " + c.Request().Method + " is not allowed"})
@@ -153,14 +476,31 @@ func (a *API) PluginHandler(c echo.Context) error {
 			URL:       c.Request().URL,
 			Body:      b,
 			Headers:   c.Request().Header,
-			Host:      c.Request().RemoteAddr,
+			Host:      c.RealIP(),
 			UserAgent: c.Request().UserAgent(),
 			Cookies:   c.Request().Cookies(),
 		}
 		urn := fmt.Sprintf("api:%s:http_%s", pathParts[0], strings.ToLower(c.Request().Method))
-		err = a.app.Plugins.mgr.Call(urn, &dst, req)
+		ctx, cancel := context.WithTimeout(c.Request().Context(), a.app.Plugins.callTimeout(pathParts[0]))
+		defer cancel()
+		// buffered so the call can always finish, even after we've timed out
+		done := make(chan error, 1)
+		go func() {
+			var res interface{}
+			err := a.app.Plugins.mgr.Call(urn, &res, req)
+			if err == nil {
+				dst = res
+			}
+			done <- err
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			a.log.ErrorF("PLUGIN", "Call to %s timed out", urn)
+			return c.JSON(504, map[string]interface{}{"error": "plugin " + pathParts[0] + " did not respond in time"})
+		}
 		if err != nil {
-			return c.JSON(500, map[string]interface{}{"error": err.Error})
+			return c.JSON(500, map[string]interface{}{"error": err.Error()})
 		}
 		return c.JSON(200, dst)
 	}
@@ -170,21 +510,168 @@ func (a *API) PluginHandler(c echo.Context) error {
 
 }
 
-func (a *API) treeHandler(c echo.Context, path string) error {
-	tree, err := a.kv.GetTree("kv")
+func (a *API) treeHandler(c echo.Context, path string, prefix string) error {
+	format := "json"
+	if c.QueryParam("stream") == "ndjson" {
+		format = "ndjson"
+	}
+	gen, modified := a.kv.Generation()
+	// the same generation is a different body for each key space and
+	// format, so both are part of the tag
+	etag := fmt.Sprintf("\"%d-%s-%s\"", gen, prefix, format)
+	modified = modified.UTC().Truncate(time.Second)
+	c.Response().Header().Set(echo.HeaderLastModified, modified.Format(http.TimeFormat))
+	c.Response().Header().Set("ETag", etag)
+	if match := c.Request().Header.Get("If-None-Match"); match != "" {
+		if match == etag || match == "*" {
+			return c.NoContent(304)
+		}
+	} else if since, err := http.ParseTime(c.Request().Header.Get(echo.HeaderIfModifiedSince)); err == nil && !modified.After(since) {
+		return c.NoContent(304)
+	}
+	if format == "ndjson" {
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(200)
+		err := a.kv.StreamTreeCtx(c.Request().Context(), prefix, c.Response())
+		if err != nil {
+			// the status has already been sent, so all we can do is log
+			a.log.Error(nil, err)
+		}
+		return nil
+	}
+	tree, truncated, err := a.kv.GetTreeCtx(c.Request().Context(), prefix)
 	if err != nil {
 		return c.JSON(500, jsonError{Message: err.Error()})
 	}
+	if truncated {
+		c.Response().Header().Set("Warning", fmt.Sprintf("199 cave \"Buckets nested deeper than %d levels were truncated\"", a.config().KV.MaxTreeDepth))
+	}
 	return c.JSON(200, tree)
 }
 
+func (a *API) countHandler(c echo.Context, path string, prefix string) error {
+	recursive := c.Request().URL.Query().Get("recursive") != ""
+	n, err := a.kv.CountKeysCtx(c.Request().Context(), path, prefix, recursive)
+	if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return c.JSON(404, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, map[string]interface{}{
+		"key":   path,
+		"count": n,
+	})
+}
+
 func (a *API) kvGetHandler(c echo.Context) error {
-	path := trimPath(c.Request().URL.Path, KVPREFIX)
+	path, prefix, err := kvTarget(c)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	if token := c.QueryParam("min_index"); token != "" {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), maxIndexWait)
+		err = a.kv.WaitIndex(ctx, token)
+		cancel()
+		if errors.Is(err, ErrBadIndex) {
+			return c.JSON(400, jsonError{Message: "min_index must be an X-Cave-Write-Index from an earlier write"})
+		}
+		if err != nil {
+			c.Response().Header().Set("Retry-After", "1")
+			return c.JSON(503, jsonError{Message: "This node hasn't applied write " + token + " yet"})
+		}
+	}
 	if c.Request().URL.Query().Get("tree") != "" {
-		return a.treeHandler(c, path)
+		return a.treeHandler(c, path, prefix)
+	}
+	if c.Request().URL.Query().Get("count") != "" {
+		return a.countHandler(c, path, prefix)
+	}
+	if c.Request().URL.Query().Get("history") != "" {
+		return a.historyHandler(c, path, prefix)
+	}
+	if c.QueryParam("wait") != "" {
+		return a.waitHandler(c, path, prefix)
+	}
+	return a.readKey(c, path, prefix)
+}
+
+// maxWait caps how long a blocking read waits for a change
+const maxWait = 5 * time.Minute
+
+// maxIndexWait is how long a read with min_index waits for this node to
+// catch up
+const maxIndexWait = 10 * time.Second
+
+// waitHandler answers a blocking read. When the store's generation is
+// already past the index the client sent the key is read right away,
+// otherwise it waits up to wait seconds for the key to change and
+// returns 304 if it doesn't. Clients pass the X-Cave-Index of their
+// last read as the index. Writes to other keys move the index too, so
+// a read can come back with the value unchanged.
+func (a *API) waitHandler(c echo.Context, path string, prefix string) error {
+	secs, err := strconv.Atoi(c.QueryParam("wait"))
+	if err != nil || secs < 0 {
+		return c.JSON(400, jsonError{Message: "wait must be a number of seconds"})
+	}
+	wait := time.Duration(secs) * time.Second
+	if wait > maxWait {
+		wait = maxWait
+	}
+	var index uint64
+	if s := c.QueryParam("index"); s != "" {
+		index, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: "index must be an X-Cave-Index from an earlier read"})
+		}
+	}
+	// subscribe before checking the index so a write in between
+	// isn't missed
+	updates, cancel := a.kv.Watch(path, prefix)
+	defer cancel()
+	gen, _ := a.kv.Generation()
+	if gen > index {
+		return a.readKey(c, path, prefix)
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	for {
+		select {
+		case kvu := <-updates:
+			if kvu.Key == path || (kvu.UpdateType == "delete:bucket" && strings.HasPrefix(path, kvu.Key)) {
+				return a.readKey(c, path, prefix)
+			}
+		case <-t.C:
+			gen, _ = a.kv.Generation()
+			c.Response().Header().Set("X-Cave-Index", strconv.FormatUint(gen, 10))
+			return c.NoContent(304)
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// readKey answers a GET for a single key or a bucket's keys
+func (a *API) readKey(c echo.Context, path string, prefix string) error {
+	gen, _ := a.kv.Generation()
+	c.Response().Header().Set("X-Cave-Index", strconv.FormatUint(gen, 10))
+	quorum := false
+	switch c.QueryParam("consistency") {
+	case "", "local":
+	case "quorum":
+		quorum = true
+	default:
+		return c.JSON(400, jsonError{Message: "consistency must be local or quorum"})
 	}
 	if strings.HasSuffix(path, "/") || path == "" {
-		k, err := a.kv.GetKeys(path, "kv")
+		if quorum {
+			return c.JSON(400, jsonError{Message: "Quorum reads are only supported for keys"})
+		}
+		k, err := a.kv.GetKeysCtx(c.Request().Context(), path, prefix)
+		if errors.Is(err, bbolt.ErrBucketNotFound) {
+			return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
+		}
 		if err != nil {
 			a.log.Error(nil, err)
 			return c.JSON(500, jsonError{Message: err.Error()})
@@ -196,200 +683,744 @@ func (a *API) kvGetHandler(c echo.Context) error {
 		}
 		return c.JSON(200, k)
 	}
-	b, err := a.kv.Get(path, "kv")
+	var obj KVObject
+	var err error
+	if quorum {
+		obj, err = a.kv.QuorumGetObjectCtx(a.kvContext(c), path, prefix)
+	} else {
+		obj, err = a.kv.GetObjectCtx(a.kvContext(c), path, prefix)
+	}
+	if err == ErrReadQuorum || errors.Is(err, ErrSealed) || errors.Is(err, ErrNamespaceSealed) {
+		return c.JSON(503, jsonError{Message: err.Error()})
+	}
 	if err != nil {
 		a.log.Error(nil, err)
 		return c.JSON(500, jsonError{Message: err.Error()})
 	}
+	b := obj.Data
 	if len(b) == 0 {
 		return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
 	}
+	meta := c.QueryParam("meta") != ""
 	if c.Request().URL.Query().Get("secret") != "" {
-		data, err := decryptJSON(a.kv.sharedkey, b)
+		if !a.canDecrypt(c) {
+			return c.JSON(403, errNoDecrypt)
+		}
+		data, err := a.kv.Decrypt(obj)
+		if errors.Is(err, ErrSealed) || errors.Is(err, ErrNamespaceSealed) {
+			return c.JSON(503, jsonError{Message: err.Error()})
+		}
 		if err != nil {
-			return c.Blob(200, "application/json", b)
+			a.log.Error(nil, err)
+			return c.JSON(500, jsonError{Message: "Unable to decrypt " + path + ": " + err.Error()})
 		}
-		return c.Blob(200, "application/json", data)
+		if meta {
+			obj.Data = data
+			return c.JSON(200, obj)
+		}
+		return c.Blob(200, blobType(obj.ContentType, data), data)
+	}
+	if meta {
+		return c.JSON(200, obj)
 	}
-	return c.Blob(200, "application/json", b)
+	if obj.Secret {
+		// still encrypted, so this is the JSON secret envelope
+		return c.Blob(200, "application/json", b)
+	}
+	return c.Blob(200, blobType(obj.ContentType, b), b)
 }
 
-func (a *API) kvPutHandler(c echo.Context) error {
-	path := trimPath(c.Request().URL.Path, KVPREFIX)
-	buf, err := ioutil.ReadAll(c.Request().Body)
-	if err != nil {
-		a.log.Error(nil, err)
-		return c.JSON(400, jsonError{Message: err.Error()})
-	}
-	secret := false
-	if c.Request().URL.Query().Get("secret") != "" {
-		secret = true
-		data, err := encrytJSON(a.kv.sharedkey, buf)
-		if err != nil {
-			return c.JSON(400, jsonError{Message: err.Error()})
-		}
-		buf = data
+// blobType returns the stored content type of a value, detecting it
+// for values stored before content types were recorded
+func blobType(stored string, b []byte) string {
+	if stored != "" {
+		return stored
 	}
-	err = a.kv.Put(path, buf, "kv", secret)
+	return contentType(b)
+}
+
+func (a *API) historyHandler(c echo.Context, path string, prefix string) error {
+	versions, err := a.kv.GetHistory(path, prefix)
 	if err != nil {
 		a.log.Error(nil, err)
 		return c.JSON(500, jsonError{Message: err.Error()})
 	}
-	return c.JSON(200, jsonError{Message: "ok"})
+	return c.JSON(200, versions)
 }
 
-func (a *API) kvDeleteHandler(c echo.Context) error {
-	path := trimPath(c.Request().URL.Path, KVPREFIX)
-	if strings.HasSuffix(path, "/") {
-		err := a.kv.DeleteBucket(path, "kv")
-		if err != nil {
-			if err == bbolt.ErrBucketNotFound {
-				return c.JSON(404, jsonError{Message: err.Error()})
-			}
-			return c.JSON(500, jsonError{Message: err.Error()})
-		}
+func (a *API) rollbackHandler(c echo.Context, path string, prefix string) error {
+	version, err := time.Parse(time.RFC3339Nano, c.QueryParam("rollback"))
+	if err != nil {
+		return c.JSON(400, jsonError{Message: "rollback must be an RFC 3339 timestamp from the key's history"})
+	}
+	err = a.kv.Rollback(path, prefix, version)
+	if errors.Is(err, ErrVersionNotFound) {
+		return c.JSON(404, jsonError{Message: err.Error()})
 	}
-	err := a.kv.DeleteKey(path, "kv")
 	if err != nil {
+		a.log.Error(nil, err)
 		return c.JSON(500, jsonError{Message: err.Error()})
 	}
 	return c.JSON(200, jsonError{Message: "ok"})
 }
 
-func (a *API) multiQueryHandler(c echo.Context) error {
-	buf, err := ioutil.ReadAll(c.Request().Body)
+func (a *API) kvPutHandler(c echo.Context) error {
+	path, prefix, err := kvTarget(c)
 	if err != nil {
 		return c.JSON(400, jsonError{Message: err.Error()})
 	}
-	mq := MultiQuery{}
-	err = json.Unmarshal(buf, &mq)
+	if c.QueryParam("rollback") != "" {
+		return a.rollbackHandler(c, path, prefix)
+	}
+	if c.QueryParam("heartbeat") != "" {
+		return a.heartbeatHandler(c, path, prefix)
+	}
+	if c.QueryParam("incr") != "" {
+		return a.incrHandler(c, path, prefix)
+	}
+	if c.QueryParam("append") != "" {
+		return a.appendHandler(c, path, prefix)
+	}
+	if c.QueryParam("set_add") != "" || c.QueryParam("set_remove") != "" {
+		return a.setHandler(c, path, prefix)
+	}
+	if c.QueryParam("lock") != "" {
+		return a.lockHandler(c, path, prefix)
+	}
+	buf, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
+		a.log.Error(nil, err)
 		return c.JSON(400, jsonError{Message: err.Error()})
 	}
-	result := make(chan QueryObject, len(mq.Query))
-	for _, q := range mq.Query {
-		switch strings.ToUpper(q.Verb) {
-		case "GET":
-			go a.doGET(q, result)
-		case "PUT":
-			go a.doPOST(q, result)
-		case "POST":
-			go a.doPOST(q, result)
-		case "DELETE":
-			go a.doDELETE(q, result)
-		default:
-			q.Error = fmt.Sprintf("Verb %s is not a valid operation", q.Verb)
-			result <- q
+	secret := c.Request().URL.Query().Get("secret") != ""
+	ctx, diff := a.diffContext(c)
+	if ttl := c.QueryParam("ttl"); ttl != "" {
+		d, perr := time.ParseDuration(ttl)
+		if perr != nil || d <= 0 {
+			return c.JSON(400, jsonError{Message: "ttl must be a positive duration, e.g. 30s"})
 		}
+		err = a.kv.PutTTLCtx(ctx, path, buf, prefix, secret, d)
+	} else {
+		err = a.kv.PutCtx(ctx, path, buf, prefix, secret)
 	}
-	for {
-		if len(result) >= len(mq.Query) {
-			close(result)
-			break
-		}
-		time.Sleep(1 * time.Millisecond)
+	var serr *SchemaError
+	if errors.As(err, &serr) {
+		return c.JSON(422, map[string]interface{}{
+			"message": serr.Error(),
+			"prefix":  serr.Prefix,
+			"details": serr.Details,
+		})
 	}
-	rq := MultiQuery{
-		ID:          uuid.New().String(),
-		Query:       []QueryObject{},
-		QueryErrors: false,
+	if errors.Is(err, ErrNoNamespaceKey) {
+		return c.JSON(409, jsonError{Message: err.Error()})
 	}
-	for r := range result {
-		if r.Error != "" {
-			rq.QueryErrors = true
-		}
-		rq.Query = append(rq.Query, r)
+	if errors.Is(err, ErrWriteContention) || errors.Is(err, ErrNamespaceSealed) {
+		return c.JSON(503, jsonError{Message: err.Error()})
 	}
-	blob, err := json.Marshal(rq)
-	rq.Error = err
-	if rq.QueryErrors || err != nil {
-		return c.Blob(400, "application/json", blob)
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
 	}
-	return c.Blob(200, "application/json", blob)
+	if diff != nil {
+		return c.JSON(200, diff)
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
 }
 
-func (a *API) doGET(q QueryObject, result chan QueryObject) {
-	b, err := a.kv.Get(q.Key, "kv")
-	if err != nil {
-		q.Error = err.Error()
-		result <- q
-		return
+// diffContext is kvContext for a write, set up to record what the write
+// changes when ?diff=true is given, and for a dry run when ?dry_run=true
+// is. The diff is nil when neither is.
+func (a *API) diffContext(c echo.Context) (context.Context, *ValueDiff) {
+	ctx := a.kvContext(c)
+	dry := c.QueryParam("dry_run") == "true"
+	if !dry && c.QueryParam("diff") != "true" {
+		return ctx, nil
 	}
-	if len(b) == 0 {
-		q.Error = fmt.Sprintf("Key %s does not exist", q.Key)
-		result <- q
-		return
+	d := &ValueDiff{}
+	ctx = withDiff(ctx, d)
+	if dry {
+		ctx = withDryRun(ctx)
 	}
-	if q.Secret {
-		data, err := decryptJSON(a.kv.sharedkey, b)
-		if err != nil {
-			q.Value = string(b[:])
-		}
-		q.Value = string(data[:])
+	return ctx, d
+}
+
+func (a *API) incrHandler(c echo.Context, path string, prefix string) error {
+	delta, err := strconv.ParseInt(c.QueryParam("incr"), 10, 64)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: "incr must be an integer"})
 	}
-	q.Value = string(b)
-	result <- q
-	return
+	n, err := a.kv.IncrementCtx(a.kvContext(c), path, prefix, delta)
+	var serr *SchemaError
+	switch {
+	case errors.Is(err, ErrNotInteger), errors.Is(err, ErrModifySecret):
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.As(err, &serr):
+		return c.JSON(422, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, map[string]interface{}{
+		"key":   path,
+		"value": n,
+	})
 }
 
-func (a *API) doPOST(q QueryObject, result chan QueryObject) {
-	buf := q.Value
-	if q.Secret {
-		data, err := encrytJSON(a.kv.sharedkey, q.Value)
-		if err != nil {
-			q.Error = err.Error()
-			result <- q
-			return
+func (a *API) appendHandler(c echo.Context, path string, prefix string) error {
+	max := 0
+	if s := c.QueryParam("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return c.JSON(400, jsonError{Message: "max must be a positive number"})
 		}
-		buf = string(data[:])
+		max = n
 	}
-	err := a.kv.Put(q.Key, []byte(buf), "kv", q.Secret)
+	buf, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		q.Error = err.Error()
-		result <- q
-		return
+		return c.JSON(400, jsonError{Message: err.Error()})
 	}
-	result <- q
-	return
+	err = a.kv.AppendCtx(a.kvContext(c), path, prefix, buf, max)
+	var serr *SchemaError
+	switch {
+	case errors.Is(err, ErrBadElement):
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrNotList), errors.Is(err, ErrModifySecret):
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.As(err, &serr):
+		return c.JSON(422, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
 }
 
-func (a *API) doDELETE(q QueryObject, result chan QueryObject) {
-	err := a.kv.DeleteKey(q.Key, "kv")
+func (a *API) setHandler(c echo.Context, path string, prefix string) error {
+	buf, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		q.Error = err.Error()
-		result <- q
-		return
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	var changed bool
+	if c.QueryParam("set_add") != "" {
+		changed, err = a.kv.SetAddCtx(a.kvContext(c), path, prefix, buf)
+	} else {
+		changed, err = a.kv.SetRemoveCtx(a.kvContext(c), path, prefix, buf)
+	}
+	var serr *SchemaError
+	switch {
+	case errors.Is(err, ErrBadElement):
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrNotList), errors.Is(err, ErrModifySecret):
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.As(err, &serr):
+		return c.JSON(422, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, map[string]interface{}{
+		"key":     path,
+		"changed": changed,
+	})
+}
+
+// heartbeatHandler extends a TTL key's life without changing its value
+func (a *API) heartbeatHandler(c echo.Context, path string, prefix string) error {
+	err := a.kv.Heartbeat(path, prefix)
+	switch {
+	case err == ErrKeyNotFound, errors.Is(err, bbolt.ErrBucketNotFound):
+		return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
+	case err == ErrNoTTL:
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) kvDeleteHandler(c echo.Context) error {
+	path, prefix, err := kvTarget(c)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	if id := c.QueryParam("lock"); id != "" {
+		return a.unlockHandler(c, path, prefix, id)
+	}
+	ctx, diff := a.diffContext(c)
+	if strings.HasSuffix(path, "/") {
+		err = a.kv.DeleteBucketCtx(ctx, path, prefix)
+	} else {
+		err = a.kv.DeleteKeyCtx(ctx, path, prefix)
+	}
+	if err == ErrKeyNotFound {
+		return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
+	}
+	if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return c.JSON(404, jsonError{Message: err.Error()})
+	}
+	if errors.Is(err, ErrWriteContention) {
+		return c.JSON(503, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	if diff != nil {
+		return c.JSON(200, diff)
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+// lockTarget splits a path ending in /lock/<lockID> into the locked
+// key and the lock ID
+func lockTarget(path string) (string, string, bool) {
+	i := strings.LastIndex(path, "/lock/")
+	if i < 0 {
+		return "", "", false
+	}
+	id := path[i+len("/lock/"):]
+	if _, err := uuid.Parse(id); err != nil {
+		return "", "", false
+	}
+	return path[:i], id, true
+}
+
+// lockHandler takes a lock on a key and returns it. The lock expires
+// after ?ttl=, or kv.lock_ttl when that isn't given.
+func (a *API) lockHandler(c echo.Context, path string, prefix string) error {
+	var ttl time.Duration
+	if s := c.QueryParam("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return c.JSON(400, jsonError{Message: "ttl must be a positive duration, e.g. 30s"})
+		}
+		ttl = d
+	}
+	l, err := a.kv.LockTTL(path, prefix, ttl)
+	switch {
+	case errors.Is(err, ErrLockTTL):
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrKeyNotFound), errors.Is(err, bbolt.ErrBucketNotFound):
+		return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
+	case errors.Is(err, ErrLocked):
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrLockQuorum), errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, l)
+}
+
+// unlockHandler releases a lock taken with lockHandler
+func (a *API) unlockHandler(c echo.Context, path string, prefix string, id string) error {
+	err := a.kv.Unlock(Lock{Key: path, Prefix: prefix, LockID: id})
+	var serr *json.SyntaxError
+	switch {
+	case err == ErrUnknownLock:
+		return c.JSON(404, jsonError{Message: err.Error()})
+	case errors.As(err, &serr), errors.Is(err, bbolt.ErrBucketNotFound):
+		return c.JSON(404, jsonError{Message: "Key " + path + " does not exist"})
+	case errors.Is(err, ErrWriteContention):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) forceUnlockHandler(c echo.Context) error {
+	path, prefix, err := kvTarget(c)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	key, id, _ := lockTarget(path)
+	a.log.WarnF(nil, "%s is force releasing lock %s on %s", a.requester(c), id, key)
+	err = a.kv.ForceUnlock(key, prefix, id)
+	if err == ErrUnknownLock || err == ErrKeyNotFound {
+		return c.JSON(404, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) multiQueryHandler(c echo.Context) error {
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	mq := MultiQuery{}
+	err = json.Unmarshal(buf, &mq)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	prefix := "kv"
+	if mq.Namespace != "" {
+		prefix, err = namespaceBucket(mq.Namespace)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+	}
+	if a.app.Cluster.ReadOnly() && mq.Atomic {
+		// a batch can't be split across nodes, so it isn't forwarded
+		for _, q := range mq.Query {
+			if !readVerb(q.Verb) {
+				return c.JSON(503, errReadOnly)
+			}
+		}
+	}
+	if len(mq.Query) > a.config().API.MaxQueries {
+		return c.JSON(413, jsonError{Message: fmt.Sprintf("A query can have at most %d operations", a.config().API.MaxQueries)})
+	}
+	ctx := a.kvContext(c)
+	if c.QueryParam("dry_run") == "true" {
+		ctx = withDryRun(ctx)
+	}
+	results := make([]QueryObject, len(mq.Query))
+	pending := []QueryObject{}
+	writes := []QueryObject{}
+	for i, q := range mq.Query {
+		q.Index = i
+		if mq.Atomic && !readVerb(q.Verb) {
+			writes = append(writes, q)
+			continue
+		}
+		pending = append(pending, q)
+	}
+	if len(writes) > 0 {
+		err = a.kv.Batch(ctx, writes, prefix)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: "Batch rejected, no changes were made: " + err.Error()})
+		}
+		for _, q := range writes {
+			results[q.Index] = q
+		}
+	}
+	result := make(chan QueryObject, len(pending))
+	jobs := make(chan QueryObject)
+	workers := a.config().API.QueryWorkers
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range jobs {
+				a.doQuery(ctx, prefix, q, result)
+			}
+		}()
+	}
+	for _, q := range pending {
+		jobs <- q
+	}
+	close(jobs)
+	wg.Wait()
+	close(result)
+	for r := range result {
+		results[r.Index] = r
+	}
+	rq := MultiQuery{
+		ID:          uuid.New().String(),
+		Query:       results,
+		QueryErrors: false,
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			rq.QueryErrors = true
+		}
+	}
+	blob, err := json.Marshal(rq)
+	rq.Error = err
+	if rq.QueryErrors || err != nil {
+		return c.Blob(400, "application/json", blob)
+	}
+	return c.Blob(200, "application/json", blob)
+}
+
+// doQuery runs a single operation from a multi-query and sends
+// exactly one result for it, even if the operation panics. The result
+// channel is sized to the number of operations, so a missing or extra
+// send would lose a result or block the worker forever.
+func (a *API) doQuery(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	out := make(chan QueryObject, 1)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				a.log.ErrorF(nil, "Query operation %s %s panicked: %v", q.Verb, q.Key, r)
+			}
+		}()
+		verb := strings.ToUpper(q.Verb)
+		switch {
+		case !readVerb(verb) && a.app.Cluster.ReadOnly():
+			a.doForward(ctx, prefix, q, out)
+		case verb == "GET":
+			a.doGET(ctx, prefix, q, out)
+		case verb == "SCAN":
+			a.doSCAN(ctx, prefix, q, out)
+		case verb == "COUNT":
+			a.doCOUNT(ctx, prefix, q, out)
+		case verb == "PUT" || verb == "POST":
+			a.doPOST(ctx, prefix, q, out)
+		case verb == "DELETE":
+			a.doDELETE(ctx, prefix, q, out)
+		default:
+			q.Error = fmt.Sprintf("Verb %s is not a valid operation", q.Verb)
+			out <- q
+		}
+	}()
+	select {
+	case r := <-out:
+		result <- r
+	default:
+		q.Error = fmt.Sprintf("Operation %s %s failed unexpectedly", q.Verb, q.Key)
+		result <- q
+	}
+}
+
+func (a *API) doGET(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	obj, err := a.kv.GetObjectCtx(ctx, q.Key, prefix)
+	if err != nil {
+		q.Error = err.Error()
+		result <- q
+		return
+	}
+	b := obj.Data
+	if len(b) == 0 {
+		q.Error = fmt.Sprintf("Key %s does not exist", q.Key)
+		result <- q
+		return
+	}
+	if q.Secret {
+		if !mayDecrypt(ctx) {
+			q.Error = errNoDecrypt.Message
+			result <- q
+			return
+		}
+		data, err := a.kv.Decrypt(obj)
+		if err != nil {
+			q.Error = fmt.Sprintf("Unable to decrypt %s: %v", q.Key, err)
+			result <- q
+			return
+		}
+		b = data
+	}
+	q.Value = string(b)
+	result <- q
+	return
+}
+
+// readVerb reports whether a multi-query verb only reads
+func readVerb(verb string) bool {
+	switch strings.ToUpper(verb) {
+	case "GET", "SCAN", "COUNT":
+		return true
+	}
+	return false
+}
+
+func (a *API) doSCAN(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	objs, err := a.kv.ScanCtx(ctx, q.Prefix, prefix)
+	if err != nil {
+		q.Error = err.Error()
+		result <- q
+		return
+	}
+	q.Results = map[string]string{}
+	for k, obj := range objs {
+		b := obj.Data
+		if q.Secret && obj.Secret {
+			if !mayDecrypt(ctx) {
+				q.Error = errNoDecrypt.Message
+				result <- q
+				return
+			}
+			b, err = a.kv.Decrypt(obj)
+			if err != nil {
+				q.Error = fmt.Sprintf("Unable to decrypt %s: %v", k, err)
+				result <- q
+				return
+			}
+		}
+		q.Results[k] = string(b)
+	}
+	result <- q
+}
+
+func (a *API) doCOUNT(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	objs, err := a.kv.scan(ctx, q.Prefix, prefix)
+	if err != nil {
+		q.Error = err.Error()
+		result <- q
+		return
+	}
+	count := len(objs)
+	q.Count = &count
+	result <- q
+}
+
+func (a *API) doPOST(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	err := a.kv.PutCtx(ctx, q.Key, []byte(q.Value), prefix, q.Secret)
+	if err != nil {
+		q.Error = err.Error()
+		result <- q
+		return
 	}
 	result <- q
 	return
 }
 
+func (a *API) doForward(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	res, err := a.app.Cluster.forwardWrite(ForwardedWrite{
+		Prefix:    prefix,
+		Query:     q,
+		Requester: requesterFrom(ctx),
+	})
+	if err == ErrNoLeader {
+		err = errors.New(errReadOnly.Message)
+	}
+	if err != nil {
+		q.Error = err.Error()
+	} else {
+		q.Error = res.Error
+	}
+	result <- q
+}
+
+func (a *API) doDELETE(ctx context.Context, prefix string, q QueryObject, result chan QueryObject) {
+	err := a.kv.DeleteKeyCtx(ctx, q.Key, prefix)
+	if err != nil {
+		q.Error = err.Error()
+		result <- q
+		return
+	}
+	result <- q
+	return
+}
+
+func (a *API) routeListNamespaces(c echo.Context) error {
+	names, err := a.kv.ListNamespaces()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, names)
+}
+
+func (a *API) routeDeleteNamespace(c echo.Context) error {
+	err := a.kv.DeleteNamespace(c.Param("ns"))
+	if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return c.JSON(404, jsonError{Message: "Namespace " + c.Param("ns") + " does not exist"})
+	}
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) routeListLocks(c echo.Context) error {
+	locks, err := a.kv.ListLocks()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	node := c.QueryParam("node")
+	if node == "" {
+		return c.JSON(200, locks)
+	}
+	held := []Lock{}
+	for _, l := range locks {
+		if l.NodeID == node || l.NodeAddress == node {
+			held = append(held, l)
+		}
+	}
+	return c.JSON(200, held)
+}
+
 func (a *API) routeClusterNodes(c echo.Context) error {
-	if a.config.Mode == "dev" {
+	if a.config().Mode == "dev" {
 		m := map[string]interface{}{}
 		m["mode"] = "dev"
 		m["nodes"] = append([]map[string]string{}, map[string]string{"Address": a.app.Cluster.advertiseHost, "public_key": ""})
 		return c.JSON(200, m)
 	}
 	m := map[string]interface{}{}
-	peers := a.app.Cluster.peers
+	peers := a.app.Cluster.Peers()
 	self := a.app.Cluster.node.ID()
 	m["nodes"] = append(peers, self)
 	m["mode"] = "cluster"
 	return c.JSON(200, m)
 }
 
+func (a *API) routeClusterHealth(c echo.Context) error {
+	m := map[string]interface{}{}
+	m["mode"] = "cluster"
+	if a.config().Mode == "dev" {
+		m["mode"] = "dev"
+	}
+	m["protocol"] = protocolVersion
+	m["peers"] = a.app.Cluster.PeerHealth()
+	return c.JSON(200, m)
+}
+
+func (a *API) routeClusterLeader(c echo.Context) error {
+	info := a.app.Cluster.LeaderInfo()
+	if info.Address == "" {
+		return c.JSON(503, jsonError{Message: "No cluster leader has been elected"})
+	}
+	return c.JSON(200, info)
+}
+
 func (a *API) routeLogs(c echo.Context) error {
-	logs := []string{}
-	for i := 0; i <= 100; i++ {
-		select {
-		case m := <-a.log.logQueue:
-			logs = append(logs, m)
-		default:
-			break
+	min := 0
+	if lvl := c.QueryParam("level"); lvl != "" {
+		sev, ok := logLevels[strings.ToLower(lvl)]
+		if !ok {
+			return c.JSON(400, jsonError{Message: "level must be one of debug, info, warn or error"})
 		}
+		min = sev
 	}
-	return c.JSON(200, logs)
+	var since time.Time
+	if s := c.QueryParam("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			d, derr := time.ParseDuration(s)
+			if derr != nil || d <= 0 {
+				return c.JSON(400, jsonError{Message: "since must be an RFC 3339 timestamp or a positive duration, e.g. 5m"})
+			}
+			t = time.Now().Add(-d)
+		}
+		since = t
+	}
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return c.JSON(400, jsonError{Message: "limit must be a positive number"})
+		}
+		limit = n
+	}
+	id := c.QueryParam("request_id")
+	if a.log.logQueue == nil {
+		return c.JSON(200, []LogEntry{})
+	}
+	return c.JSON(200, a.log.logQueue.latest(limit, func(e LogEntry) bool {
+		return severity(e.Level) >= min && !e.Time.Before(since) && (id == "" || e.RequestID == id)
+	}))
 }
 
 func (a *API) routeDashboard(c echo.Context) error {
@@ -397,7 +1428,13 @@ func (a *API) routeDashboard(c echo.Context) error {
 }
 
 func (a *API) routeSystemConfig(c echo.Context) error {
-	return c.JSON(200, a.app.Config)
+	if c.QueryParam("full") != "true" {
+		return c.JSON(200, a.app.config().Redacted())
+	}
+	if !a.canDecrypt(c) {
+		return c.JSON(403, jsonError{Message: "Not authorized to read the full config"})
+	}
+	return c.JSON(200, a.app.config())
 }
 
 func (a *API) routeSystemInfo(c echo.Context) error {
@@ -405,9 +1442,330 @@ func (a *API) routeSystemInfo(c echo.Context) error {
 
 	info, err := host.Info()
 	if err != nil {
-		return c.JSON(500, err.Error)
+		return c.JSON(500, jsonError{Message: err.Error()})
 	}
 	i["os"] = info
-	i["env"] = os.Environ()
+	i["sealed"] = a.kv.crypto.Sealed()
+	if a.config().API.ExposeEnv {
+		i["env"] = redactEnv(os.Environ())
+	}
 	return c.JSON(200, i)
 }
+
+// redactEnv hides the values of variables that look like they hold
+// credentials
+func redactEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		name := strings.SplitN(e, "=", 2)[0]
+		upper := strings.ToUpper(name)
+		if strings.HasSuffix(upper, "_KEY") || strings.HasSuffix(upper, "_SECRET") ||
+			strings.HasSuffix(upper, "_TOKEN") || strings.Contains(upper, "PASSWORD") {
+			e = name + "=[REDACTED]"
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func (a *API) routeSystemVersion(c echo.Context) error {
+	return c.JSON(200, buildInfo())
+}
+
+func (a *API) routeSystemStats(c echo.Context) error {
+	stats, err := a.kv.Stats()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, stats)
+}
+
+func (a *API) routeSystemAudit(c echo.Context) error {
+	prefix := "kv"
+	if ns := c.QueryParam("namespace"); ns != "" {
+		var err error
+		prefix, err = namespaceBucket(ns)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+	}
+	entries, err := a.kv.AuditTrail(prefix, c.QueryParam("key"))
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, entries)
+}
+
+func (a *API) routeGetSchemas(c echo.Context) error {
+	schemas, err := a.kv.GetSchemas()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, schemas)
+}
+
+func (a *API) routePutSchema(c echo.Context) error {
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	err = a.kv.PutSchema(c.Param("*"), buf)
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) routeDeleteSchema(c echo.Context) error {
+	err := a.kv.DeleteSchema(c.Param("*"))
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) routeSystemBackup(c echo.Context) error {
+	// bbolt read transactions are a consistent snapshot, so the
+	// database can be streamed out while writes continue.
+	err := a.kv.db.View(func(tx *bbolt.Tx) error {
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+		res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"cave-%s.db\"", time.Now().Format("20060102-150405")))
+		res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(tx.Size(), 10))
+		res.WriteHeader(200)
+		_, err := tx.WriteTo(res)
+		return err
+	})
+	if err != nil {
+		a.log.Error(nil, err)
+		if !c.Response().Committed {
+			return c.JSON(500, jsonError{Message: err.Error()})
+		}
+	}
+	return nil
+}
+
+func (a *API) routeSystemRestore(c echo.Context) error {
+	var r io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+		defer f.Close()
+		r = f
+	}
+	err := a.kv.Restore(r)
+	if err != nil {
+		a.log.Error(nil, err)
+		if errors.Is(err, ErrInvalidBackup) {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+		if errors.Is(err, ErrSealed) {
+			return c.JSON(503, jsonError{Message: err.Error()})
+		}
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+func (a *API) routeHealthz(c echo.Context) error {
+	return c.JSON(200, map[string]string{"status": "ok"})
+}
+
+func (a *API) routeReadyz(c echo.Context) error {
+	reasons := []string{}
+	if a.kv.db.View(func(tx *bbolt.Tx) error { return nil }) != nil {
+		reasons = append(reasons, "database is not open")
+	}
+	if shared, _ := a.kv.keys(); shared == nil {
+		reasons = append(reasons, "shared key is sealed")
+	}
+	if a.config().Mode != "dev" && len(a.app.Cluster.node.Inbound())+len(a.app.Cluster.node.Outbound()) == 0 {
+		reasons = append(reasons, "no peer connections established")
+	}
+	if len(reasons) > 0 {
+		return c.JSON(503, map[string]interface{}{
+			"status":  "unavailable",
+			"reasons": reasons,
+		})
+	}
+	return c.JSON(200, map[string]string{"status": "ok"})
+}
+
+func (a *API) routeCompact(c echo.Context) error {
+	a.log.InfoF(nil, "Compaction requested by '%s'", identity(c))
+	before, after, err := a.kv.Compact()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, map[string]int64{"before": before, "after": after})
+}
+
+func (a *API) routeRotateKey(c echo.Context) error {
+	a.log.WarnF(nil, "Shared key rotation requested by '%s'", identity(c))
+	err := a.kv.RotateSharedKey()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
+
+// InitResponse carries the unseal shares, which are only handed out
+// once
+type InitResponse struct {
+	Shares    []string `json:"shares"`
+	Threshold int      `json:"threshold"`
+}
+
+func (a *API) routeInitUnseal(c echo.Context) error {
+	a.log.WarnF(nil, "Unseal shares requested by '%s'", identity(c))
+	shares, err := a.kv.InitUnseal()
+	switch {
+	case err == nil:
+		return c.JSON(200, InitResponse{Shares: shares, Threshold: a.config().KV.UnsealThreshold})
+	case errors.Is(err, ErrSharesOff):
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrInitialised):
+		return c.JSON(409, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrSealed):
+		return c.JSON(503, jsonError{Message: err.Error()})
+	default:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+}
+
+// UnsealRequest carries one unseal share
+type UnsealRequest struct {
+	Share string `json:"share"`
+}
+
+func (a *API) routeUnseal(c echo.Context) error {
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	req := UnsealRequest{}
+	err = json.Unmarshal(buf, &req)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	status, err := a.kv.Unseal(req.Share)
+	switch err {
+	case nil:
+		return c.JSON(200, status)
+	case ErrBadShare, ErrBadShares:
+		a.log.WarnF(nil, "Unseal share from '%s' rejected: %v", identity(c), err)
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case ErrNotInitialised:
+		return c.JSON(409, jsonError{Message: err.Error()})
+	default:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+}
+
+func (a *API) routeSeal(c echo.Context) error {
+	a.log.WarnF(nil, "Seal requested by '%s'", identity(c))
+	status, err := a.kv.Seal()
+	if errors.Is(err, ErrNotInitialised) {
+		return c.JSON(409, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, status)
+}
+
+func (a *API) routeSystemCrypto(c echo.Context) error {
+	status, err := a.kv.CryptoStatus()
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, status)
+}
+
+// NamespaceKeyResponse carries the unseal key of a new namespace key
+type NamespaceKeyResponse struct {
+	Namespace string `json:"namespace"`
+	UnsealKey string `json:"unseal_key"`
+}
+
+// NamespaceUnsealRequest carries a namespace's unseal key
+type NamespaceUnsealRequest struct {
+	UnsealKey string `json:"unseal_key"`
+}
+
+func (a *API) routeInitNamespaceKey(c echo.Context) error {
+	name := c.Param("ns")
+	if _, err := namespaceBucket(name); err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	unsealKey, err := a.kv.InitNamespaceKey(name)
+	if errors.Is(err, ErrNamespaceKeyExists) {
+		return c.JSON(409, jsonError{Message: err.Error()})
+	}
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	a.log.WarnF(nil, "Key for namespace %s created by '%s'", name, identity(c))
+	return c.JSON(200, NamespaceKeyResponse{Namespace: name, UnsealKey: unsealKey})
+}
+
+func (a *API) routeUnsealNamespace(c echo.Context) error {
+	name := c.Param("ns")
+	if _, err := namespaceBucket(name); err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	req := NamespaceUnsealRequest{}
+	err = json.Unmarshal(buf, &req)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	err = a.kv.UnsealNamespace(name, req.UnsealKey)
+	switch {
+	case err == nil:
+		return c.JSON(200, jsonError{Message: "ok"})
+	case errors.Is(err, ErrBadNamespaceKey):
+		a.log.WarnF(nil, "Unseal key for namespace %s from '%s' rejected", name, identity(c))
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrNoNamespaceKey):
+		return c.JSON(404, jsonError{Message: err.Error()})
+	default:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+}
+
+func (a *API) routeSealNamespace(c echo.Context) error {
+	name := c.Param("ns")
+	if _, err := namespaceBucket(name); err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	a.log.WarnF(nil, "Seal of namespace %s requested by '%s'", name, identity(c))
+	err := a.kv.SealNamespace(name)
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, jsonError{Message: "ok"})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMultiQueryStress fires several large multi-queries at once and
+// checks every one gets exactly one result per operation, in order
+func TestMultiQueryStress(t *testing.T) {
+	const queries = 8
+	const ops = 400
+	// operations in a query run in any order, so the GETs read keys
+	// written beforehand
+	for i := 0; i < ops; i++ {
+		err := testApp.KV.Put(fmt.Sprintf("stress/seed/%d", i), []byte("v"), "kv", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, queries)
+	for n := 0; n < queries; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			mq := MultiQuery{}
+			for i := 0; i < ops; i++ {
+				q := QueryObject{Key: fmt.Sprintf("stress/%d/%d", n, i), Value: "v"}
+				switch i % 3 {
+				case 0:
+					q.Verb = "PUT"
+				case 1:
+					q.Verb = "GET"
+					q.Key = fmt.Sprintf("stress/seed/%d", i)
+				case 2:
+					q.Verb = "BOGUS"
+				}
+				mq.Query = append(mq.Query, q)
+			}
+			body, err := json.Marshal(mq)
+			if err != nil {
+				errs <- err
+				return
+			}
+			rec := request("POST", "/api/v1/query", bytes.NewReader(body))
+			res := MultiQuery{}
+			err = json.Unmarshal(rec.Body.Bytes(), &res)
+			if err != nil {
+				errs <- fmt.Errorf("query %d: %v: %s", n, err, rec.Body)
+				return
+			}
+			if len(res.Query) != ops {
+				errs <- fmt.Errorf("query %d: got %d results, want %d", n, len(res.Query), ops)
+				return
+			}
+			for i, r := range res.Query {
+				if r.Index != i || r.Key != mq.Query[i].Key || r.Verb != mq.Query[i].Verb {
+					errs <- fmt.Errorf("query %d: result %d is for operation %d (%s %s)", n, i, r.Index, r.Verb, r.Key)
+					return
+				}
+				if (r.Error != "") != (r.Verb == "BOGUS") {
+					errs <- fmt.Errorf("query %d: %s %s: unexpected error %q", n, r.Verb, r.Key, r.Error)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestListLocks(t *testing.T) {
+	rec := request("GET", "/api/v1/locks", nil)
+	if rec.Code != 200 {
+		t.Fatalf("GET /api/v1/locks: %d %s", rec.Code, rec.Body.String())
+	}
+	locks := []Lock{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &locks); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForceUnlockMissing(t *testing.T) {
+	rec := request("POST", "/api/v1/kv/forceunlock/held", bytes.NewBufferString("v"))
+	if rec.Code != 200 {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{"forceunlock/missing", "forceunlock/nobucket/key", "forceunlock/held"} {
+		rec := request("DELETE", "/api/v1/kv/"+path+"/lock/0000", nil)
+		if rec.Code != 404 {
+			t.Errorf("force unlock of %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestGetKeysMissingBucket(t *testing.T) {
+	rec := request("POST", "/api/v1/kv/getkeys/parent/key", bytes.NewBufferString("v"))
+	if rec.Code != 200 {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{"getkeys/parent/missing/", "getkeys/nobucket/missing/"} {
+		rec := request("GET", "/api/v1/kv/"+path, nil)
+		if rec.Code != 404 {
+			t.Errorf("keys under %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestDeleteShapes(t *testing.T) {
+	for _, key := range []string{"deleteshapes/bucket/a", "deleteshapes/bucket/b", "deleteshapes/key", "deleteshapes/kept/a"} {
+		rec := request("POST", "/api/v1/kv/"+key, bytes.NewBufferString("v"))
+		if rec.Code != 200 {
+			t.Fatalf("PUT %s: %d %s", key, rec.Code, rec.Body.String())
+		}
+	}
+	rec := request("DELETE", "/api/v1/kv/deleteshapes/bucket/", nil)
+	if rec.Code != 200 {
+		t.Errorf("DELETE bucket: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = request("GET", "/api/v1/kv/deleteshapes/bucket/", nil)
+	if rec.Code != 404 {
+		t.Errorf("bucket left after DELETE: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = request("DELETE", "/api/v1/kv/deleteshapes/key", nil)
+	if rec.Code != 200 {
+		t.Errorf("DELETE key: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = request("GET", "/api/v1/kv/deleteshapes/", nil)
+	keys := []string{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "kept/" {
+		t.Errorf("keys left under deleteshapes/: %v, want only kept/", keys)
+	}
+	for _, path := range []string{"deleteshapes/missing/", "deleteshapes/nobucket/key"} {
+		rec := request("DELETE", "/api/v1/kv/"+path, nil)
+		if rec.Code != 404 {
+			t.Errorf("DELETE %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestScanNestedBuckets(t *testing.T) {
+	kv := testApp.KV
+	for key, secret := range map[string]bool{
+		"scan/app/db":        false,
+		"scan/app/dbx/host":  false,
+		"scan/app/dbx/a/b/c": true,
+		"scan/app/web":       false,
+	} {
+		if err := kv.Put(key, []byte("v"), "kv", secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, _ := json.Marshal(MultiQuery{Query: []QueryObject{
+		{Verb: "SCAN", Prefix: "scan/app/db"},
+		{Verb: "COUNT", Prefix: "scan/app/"},
+	}})
+	rec := request("POST", "/api/v1/query", bytes.NewReader(body))
+	if rec.Code != 200 {
+		t.Fatalf("query: %d %s", rec.Code, rec.Body.String())
+	}
+	mq := MultiQuery{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &mq); err != nil {
+		t.Fatal(err)
+	}
+	scan := mq.Query[0]
+	if scan.Error != "" || len(scan.Results) != 3 {
+		t.Errorf("scan found %v %s", scan.Results, scan.Error)
+	}
+	for _, k := range []string{"scan/app/db", "scan/app/dbx/host", "scan/app/dbx/a/b/c"} {
+		if _, ok := scan.Results[k]; !ok {
+			t.Errorf("scan missed %s", k)
+		}
+	}
+	if c := mq.Query[1].Count; c == nil || *c != 4 {
+		t.Errorf("count %v, want 4", c)
+	}
+	trail, err := kv.AuditTrail("kv", "scan/app/dbx/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	for _, e := range trail {
+		if e.Operation == "get:key" {
+			reads++
+		}
+	}
+	if reads != 1 {
+		t.Errorf("%d audited reads of the scanned secret, want 1", reads)
+	}
+}
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1, good
+// for both ends of a connection, to name.pem and name.key
+func writeSelfSigned(t *testing.T, name string) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := name + ".pem"
+	keyFile := name + ".key"
+	err = ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, keyFile
+}
+
+func TestHTTPS(t *testing.T) {
+	cert, key := writeSelfSigned(t, "api")
+	clientCert, clientKey := writeSelfSigned(t, "client")
+	for _, mutual := range []bool{false, true} {
+		ssl := SSLConfig{Enable: true, Certificate: cert, Key: key}
+		if mutual {
+			ssl.CACertificate = clientCert
+		}
+		config, err := apiTLSConfig(ssl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewUnstartedServer(testApp.API.http)
+		srv.TLS = config
+		srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		srv.StartTLS()
+		roots := x509.NewCertPool()
+		b, _ := ioutil.ReadFile(cert)
+		roots.AppendCertsFromPEM(b)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		if mutual {
+			res, err := client.Get(srv.URL + "/api/v1/system/version")
+			if err == nil {
+				res.Body.Close()
+				t.Error("a client without a certificate was let in")
+			}
+			pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{pair}
+		}
+		res, err := client.Get(srv.URL + "/api/v1/system/version")
+		if err != nil {
+			t.Errorf("mutual %v: %v", mutual, err)
+		} else {
+			if res.StatusCode != 200 {
+				t.Errorf("mutual %v: %s", mutual, res.Status)
+			}
+			res.Body.Close()
+		}
+		srv.Close()
+	}
+}
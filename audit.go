@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// AuditEntry records a single read or write of a secret. Namespace
+// is empty for the default key space.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key"`
+	Requester string    `json:"requester"`
+	NodeID    string    `json:"node_id"`
+}
+
+// auditPruneInterval is how often entries older than
+// kv.audit_retention are dropped
+const auditPruneInterval = time.Hour
+
+// auditPruneBatch is how many entries are dropped per transaction
+const auditPruneBatch = 1000
+
+type ctxKey string
+
+const requesterKey ctxKey = "requester"
+
+// systemRequester is recorded for accesses made by the node itself,
+// e.g. lock handling or updates replicated from a peer
+const systemRequester = "system"
+
+// withRequester returns a context carrying who is making a KV call
+func withRequester(ctx context.Context, requester string) context.Context {
+	return context.WithValue(ctx, requesterKey, requester)
+}
+
+// requesterFrom returns the requester stored in ctx
+func requesterFrom(ctx context.Context) string {
+	if r, ok := ctx.Value(requesterKey).(string); ok && r != "" {
+		return r
+	}
+	return systemRequester
+}
+
+// auditBucket returns the append-only audit bucket, creating it if needed
+func auditBucket(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	return tx.Bucket([]byte("_system")).CreateBucketIfNotExists([]byte("audit"))
+}
+
+// auditIndexBucket returns the bucket indexing audit entries by prefix
+// and key, creating it if needed. Each index entry is the prefix, the
+// key and the entry's sequence number, with no value, so a key's trail
+// is a range scan.
+func auditIndexBucket(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	return tx.Bucket([]byte("_system")).CreateBucketIfNotExists([]byte("audit_index"))
+}
+
+// auditIndexKey returns the start of the index entries for key under
+// prefix
+func auditIndexKey(prefix string, key string) []byte {
+	return []byte(prefix + "\x00" + key + "\x00")
+}
+
+// appendAudit writes an audit entry for key under prefix in the given
+// write transaction. Entries are keyed by sequence number so they keep
+// their order and are never overwritten.
+func (kv *KV) appendAudit(tx *bbolt.Tx, op string, prefix string, key string, requester string) error {
+	return kv.putAudit(tx, kv.auditEntry(op, prefix, key, requester))
+}
+
+func (kv *KV) auditEntry(op string, prefix string, key string, requester string) AuditEntry {
+	namespace := ""
+	if strings.HasPrefix(prefix, nsPrefix) {
+		namespace = strings.TrimPrefix(prefix, nsPrefix)
+	}
+	return AuditEntry{
+		Time:      time.Now().UTC(),
+		Operation: op,
+		Namespace: namespace,
+		Key:       key,
+		Requester: requester,
+		NodeID:    kv.crypto.id,
+	}
+}
+
+func (kv *KV) putAudit(tx *bbolt.Tx, e AuditEntry) error {
+	b, err := auditBucket(tx)
+	if err != nil {
+		return err
+	}
+	idx, err := auditIndexBucket(tx)
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, seq)
+	err = b.Put(id, entry)
+	if err != nil {
+		return err
+	}
+	return idx.Put(append(auditIndexKey(auditPrefix(e.Namespace), e.Key), id...), []byte{})
+}
+
+// indexAudit builds the audit index for a trail written before there
+// was one
+func indexAudit(tx *bbolt.Tx) error {
+	sys := tx.Bucket([]byte("_system"))
+	b := sys.Bucket([]byte("audit"))
+	if b == nil || sys.Bucket([]byte("audit_index")) != nil {
+		return nil
+	}
+	idx, err := auditIndexBucket(tx)
+	if err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		e := AuditEntry{}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		return idx.Put(append(auditIndexKey(auditPrefix(e.Namespace), e.Key), k...), []byte{})
+	})
+}
+
+// auditPrefix returns the top-level bucket an entry's namespace is in
+func auditPrefix(namespace string) string {
+	if namespace == "" {
+		return "kv"
+	}
+	return nsPrefix + namespace
+}
+
+type auditJob struct {
+	entry AuditEntry
+	done  chan error
+}
+
+// audit records a secret read and returns once it's committed. Reads
+// made while a batch of entries is being written are collected and
+// written together by the next transaction, so a burst of secret reads
+// costs a few commits instead of one each.
+func (kv *KV) audit(op string, prefix string, key string, requester string) error {
+	job := auditJob{entry: kv.auditEntry(op, prefix, key, requester), done: make(chan error, 1)}
+	kv.auditLock.Lock()
+	kv.auditQueue = append(kv.auditQueue, job)
+	if !kv.auditing {
+		kv.auditing = true
+		go kv.writeAudit()
+	}
+	kv.auditLock.Unlock()
+	return <-job.done
+}
+
+// writeAudit writes queued audit entries until there are none left
+func (kv *KV) writeAudit() {
+	for {
+		kv.auditLock.Lock()
+		jobs := kv.auditQueue
+		kv.auditQueue = nil
+		if len(jobs) == 0 {
+			kv.auditing = false
+			kv.auditLock.Unlock()
+			return
+		}
+		kv.auditLock.Unlock()
+		err := kv.update(context.Background(), "audit", func(tx *bbolt.Tx) error {
+			for _, job := range jobs {
+				err := kv.putAudit(tx, job.entry)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		for _, job := range jobs {
+			job.done <- err
+		}
+	}
+}
+
+// AuditTrail returns the audit entries for key under prefix, oldest
+// first. An empty key returns the whole trail.
+func (kv *KV) AuditTrail(prefix string, key string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("audit"))
+		if b == nil {
+			return nil
+		}
+		add := func(v []byte) error {
+			e := AuditEntry{}
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		}
+		if key == "" {
+			return b.ForEach(func(k, v []byte) error {
+				return add(v)
+			})
+		}
+		idx := tx.Bucket([]byte("_system")).Bucket([]byte("audit_index"))
+		if idx == nil {
+			return nil
+		}
+		start := auditIndexKey(prefix, key)
+		c := idx.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, _ = c.Next() {
+			// pruned entries are dropped from the index with them, but
+			// skip any that are missing anyway
+			if v := b.Get(k[len(start):]); v != nil {
+				if err := add(v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// auditPruner drops audit entries older than kv.audit_retention
+func (kv *KV) auditPruner(stop chan bool) {
+	t := time.NewTicker(auditPruneInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			n, err := kv.pruneAudit(time.Now())
+			if err != nil {
+				kv.log.Error(nil, err)
+			}
+			if n > 0 {
+				kv.log.DebugF(nil, "Dropped %d audit entries past kv.audit_retention", n)
+			}
+		}
+	}
+}
+
+// pruneAudit drops the entries written more than kv.audit_retention
+// before now, along with their index entries, and returns how many it
+// dropped. Entries are in the order they were written, so it stops at
+// the first one that's new enough.
+func (kv *KV) pruneAudit(now time.Time) (int, error) {
+	retention := kv.config().KV.AuditRetention
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-retention)
+	total := 0
+	for {
+		n := 0
+		done := false
+		err := kv.update(context.Background(), "audit:prune", func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte("_system")).Bucket([]byte("audit"))
+			if b == nil {
+				done = true
+				return nil
+			}
+			idx, err := auditIndexBucket(tx)
+			if err != nil {
+				return err
+			}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.First() {
+				e := AuditEntry{}
+				if json.Unmarshal(v, &e) == nil && !e.Time.Before(cutoff) {
+					done = true
+					return nil
+				}
+				if n == auditPruneBatch {
+					return nil
+				}
+				err := idx.Delete(append(auditIndexKey(auditPrefix(e.Namespace), e.Key), k...))
+				if err == nil {
+					err = c.Delete()
+				}
+				if err != nil {
+					return err
+				}
+				n++
+			}
+			done = true
+			return nil
+		})
+		total += n
+		if err != nil || done {
+			return total, err
+		}
+	}
+}
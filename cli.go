@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const kvUsage = `Usage:
+  cave kv get <path> [flags]
+  cave kv put <path> [value] [flags]
+  cave kv delete <path> [flags]
+
+put reads the value from stdin when it isn't given or is "-".
+Paths ending in "/" get or delete a whole bucket.
+
+Flags:
+`
+
+// runKVCommand runs a `cave kv` subcommand against a running node's
+// REST API and returns the process exit code
+func runKVCommand(args []string) int {
+	fs := pflag.NewFlagSet("cave kv", pflag.ContinueOnError)
+	fs.SortFlags = true
+	fs.StringP("addr", "a", "https://127.0.0.1:2001", "Address of the node's REST API")
+	fs.StringP("namespace", "n", "", "Namespace to use instead of the default key space")
+	fs.BoolP("secret", "s", false, "Store the value as a secret on put, or decrypt it on get")
+	fs.StringP("token", "t", os.Getenv("CAVE_TOKEN"), "Bearer token to authenticate with (default $CAVE_TOKEN)")
+	fs.String("cacert", "", "Path to a CA certificate to verify the node's certificate with")
+	fs.String("cert", "", "Path to a client certificate, for nodes that require one")
+	fs.String("key", "", "Path to the client certificate's private key")
+	fs.Bool("insecure", false, "Don't verify the node's TLS certificate")
+	fs.Duration("timeout", 30*time.Second, "How long to wait for a response")
+	fs.Usage = func() {
+		os.Stderr.WriteString(kvUsage)
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err == pflag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	cmd := fs.Args()
+	if len(cmd) < 2 {
+		fs.Usage()
+		return 2
+	}
+	client, err := cliClient(fs)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	addr, _ := fs.GetString("addr")
+	ns, _ := fs.GetString("namespace")
+	secret, _ := fs.GetBool("secret")
+	token, _ := fs.GetString("token")
+	u := strings.TrimSuffix(addr, "/") + KVPREFIX
+	if ns != "" {
+		u = strings.TrimSuffix(addr, "/") + APIPREFIX + "ns/" + url.PathEscape(ns) + "/kv/"
+	}
+	u += escapePath(strings.TrimPrefix(cmd[1], "/"))
+	if secret {
+		u += "?secret=true"
+	}
+	var req *http.Request
+	switch cmd[0] {
+	case "get":
+		req, err = http.NewRequest("GET", u, nil)
+	case "put":
+		var body io.Reader = os.Stdin
+		if len(cmd) > 2 && cmd[2] != "-" {
+			body = strings.NewReader(cmd[2])
+		}
+		req, err = http.NewRequest("POST", u, body)
+	case "delete":
+		req, err = http.NewRequest("DELETE", u, nil)
+	default:
+		os.Stderr.WriteString("Unknown command '" + cmd[0] + "'\n\n")
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	out := os.Stdout
+	if res.StatusCode >= 300 {
+		out = os.Stderr
+		fmt.Fprintf(out, "%s\n", res.Status)
+	}
+	out.Write(prettyJSON(body))
+	if res.StatusCode >= 300 {
+		return 1
+	}
+	return 0
+}
+
+// escapePath escapes each segment of a key path for use in a URL, so
+// keys with characters like ? or # in them reach the server intact
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// cliClient builds the HTTP client for the kv subcommands from the
+// TLS flags
+func cliClient(fs *pflag.FlagSet) (*http.Client, error) {
+	insecure, _ := fs.GetBool("insecure")
+	cacert, _ := fs.GetString("cacert")
+	timeout, _ := fs.GetDuration("timeout")
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	cert, _ := fs.GetString("cert")
+	key, _ := fs.GetString("key")
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if cacert != "" {
+		pem, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cacert)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}, nil
+}
+
+// prettyJSON indents b if it's JSON and makes sure it ends in a newline
+func prettyJSON(b []byte) []byte {
+	var buf bytes.Buffer
+	if json.Indent(&buf, b, "", "  ") == nil {
+		b = buf.Bytes()
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		b = append(b, '\n')
+	}
+	return b
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEscapePath(t *testing.T) {
+	key := "cli/a b/what?#100%"
+	u := KVPREFIX + escapePath(key)
+	if want := KVPREFIX + "cli/a%20b/what%3F%23100%25"; u != want {
+		t.Fatalf("escaped to %s, want %s", u, want)
+	}
+	if rec := request("POST", u, bytes.NewBufferString("v")); rec.Code != 200 {
+		t.Fatalf("PUT %s: %d %s", u, rec.Code, rec.Body.String())
+	}
+	obj, err := testApp.KV.GetObject(key, "kv")
+	if err != nil || string(obj.Data) != "v" {
+		t.Errorf("%s wasn't written: %v", key, err)
+	}
+	if got := escapePath("cli/bucket/"); got != "cli/bucket/" {
+		t.Errorf("bucket path escaped to %s", got)
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,40 +22,96 @@ import (
 	"github.com/perlin-network/noise/kademlia"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 //Cluster type
 type Cluster struct {
+	// epoch numbers the messages this node emits. It's updated
+	// atomically and kept first so it stays 64-bit aligned.
+	epoch uint64
+
+	*liveConfig
+
 	app           *Cave
 	terminate     chan bool
-	config        *Config
 	node          *noise.Node
 	network       *kademlia.Protocol
-	epoch         uint64
 	updates       chan Message
 	tokens        chan Message
 	synced        chan bool
 	peers         []noise.ID
+	peerLock      sync.RWMutex
 	log           *Log
 	locationTable []node
 	genRSA        bool
 	metrics       map[string]interface{}
 	advertiseHost string
+	health        map[string]PeerHealth
+	healthLock    sync.Mutex
+	leader        string
+	leaderID      string
+	candidates    map[string]candidate
+	leaderLock    sync.RWMutex
+	auth          *peerAuth
+	leaving       int32
+	departed      map[string]time.Time
+	departedLock  sync.Mutex
+	// messages waiting to be sent to each peer, in order
+	sendQueues map[string]chan []byte
+	queueLock  sync.Mutex
+}
+
+// Peers returns the peers this node knows of
+func (c *Cluster) Peers() []noise.ID {
+	c.peerLock.RLock()
+	defer c.peerLock.RUnlock()
+	return append([]noise.ID{}, c.peers...)
+}
+
+// setPeers replaces the peers this node knows of with found, leaving out
+// the ones that recently left
+func (c *Cluster) setPeers(found []noise.ID) {
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	c.peers = c.withoutDeparted(found)
 }
 
+// updateQueueTimeout is how long an update from a peer waits for room
+// in a full KV update queue before it's dropped
+const updateQueueTimeout = 5 * time.Second
+
+// maxForwardHops limits how many nodes a write can be passed through
+// before it's rejected, so misconfigured leaders can't loop forever
+const maxForwardHops = 3
+
+// ErrNoLeader is returned when a write has to be forwarded but no
+// leader is known
+var ErrNoLeader = errors.New("No cluster leader is known to forward the write to")
+
 func newCluster(app *Cave) (*Cluster, error) {
-	config := app.Config
+	config := app.config()
 	c := &Cluster{
 		app:           app,
-		config:        config,
+		liveConfig:    app.liveConfig,
 		log:           app.Logger,
 		terminate:     make(chan bool),
 		synced:        make(chan bool),
 		genRSA:        false,
 		metrics:       metrics(),
 		advertiseHost: fmt.Sprintf("%s:%v", config.Cluster.Host, config.Cluster.Port),
+		health:        map[string]PeerHealth{},
+		leader:        config.Cluster.Leader,
+		candidates:    map[string]candidate{},
+		departed:      map[string]time.Time{},
+		sendQueues:    map[string]chan []byte{},
 	}
-	if c.config.Mode == "dev" {
+	// start from the clock so peers don't see a restarted node's
+	// epochs as replays
+	c.epoch = uint64(time.Now().UnixNano())
+	if c.config().Mode == "dev" {
 		return c, nil
 	}
 	node, err := noise.NewNode(
@@ -65,6 +125,12 @@ func newCluster(app *Cave) (*Cluster, error) {
 		return c, err
 	}
 	c.node = node
+	if config.Cluster.CACertificate != "" {
+		c.auth, err = newPeerAuth(config.Cluster, node.ID().ID)
+		if err != nil {
+			return c, err
+		}
+	}
 	c.network = kademlia.New()
 	c.node.Bind(c.network.Protocol())
 	return c, nil
@@ -104,16 +170,76 @@ func metrics() map[string]interface{} {
 			Name: "cave_cluster_connections_outbound",
 			Help: "Number of outbound cluster connections",
 		}),
+		"peers_total": promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_cluster_peers_total",
+			Help: "Number of peers this node has seen",
+		}),
+		"peers_alive": promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_cluster_peers_alive",
+			Help: "Number of peers that answered the last liveness check",
+		}),
+		"updates_dropped": promauto.NewCounter(prometheus.CounterOpts{
+			Name: "cave_cluster_updates_dropped_total",
+			Help: "Number of KV updates from peers dropped because the update queue stayed full",
+		}),
+		"auth_failures": promauto.NewCounter(prometheus.CounterOpts{
+			Name: "cave_cluster_peer_auth_failures_total",
+			Help: "Number of peers that failed the cluster certificate handshake",
+		}),
+		"peer_up": promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cave_cluster_peer_up",
+			Help: "Whether a peer answered the last liveness check (1) or not (0)",
+		}, []string{"node_id"}),
+		"protocol_mismatch": promauto.NewCounter(prometheus.CounterOpts{
+			Name: "cave_cluster_protocol_mismatch_total",
+			Help: "Number of messages dropped because the peer's protocol version isn't compatible",
+		}),
 	}
 	return m
 }
 
+// unsignedMessages are the messages a node sends or answers before it
+// has the shared key to sign or check them with
+var unsignedMessages = map[string]bool{
+	"sync:request":       true,
+	"sync:sharedkey":     true,
+	"sync:sendsharedkey": true,
+	"sync:sendsealedkey": true,
+	// answered with data that's checked against the unseal shares
+	"unseal:marker": true,
+}
+
+// sign signs a message for the cluster once the KV is up
+func (c *Cluster) sign(msg *Message) {
+	if c.app.KVInit {
+		c.app.KV.sign(msg)
+	}
+}
+
+// verified checks that a message from a peer was signed with the
+// cluster's key. A node that's still starting or is sealed can't check
+// and drops it.
+func (c *Cluster) verified(msg Message) bool {
+	if !c.app.KVInit {
+		return false
+	}
+	err := c.app.KV.verify(msg)
+	if err != nil {
+		c.log.Error(nil, err)
+		return false
+	}
+	return true
+}
+
 func (c *Cluster) registerHandlers(updates chan Message, sync chan Message, tokens chan Message) error {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
 	c.node.Handle(func(ctx noise.HandlerContext) error {
 		if ctx.IsRequest() {
+			return c.handleRequest(ctx)
+		}
+		if !c.authorize(ctx.ID()) {
 			return nil
 		}
 		var msg Message
@@ -121,10 +247,20 @@ func (c *Cluster) registerHandlers(updates chan Message, sync chan Message, toke
 		if err != nil {
 			return err
 		}
+		err = decompressMessage(&msg)
+		if err != nil {
+			return err
+		}
 		go c.metrics["messages_rx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+		if !c.checkProtocol(ctx.ID(), msg) {
+			return nil
+		}
+		if !unsignedMessages[msg.DataType] && !c.verified(msg) {
+			return nil
+		}
 		switch msg.Type {
 		case "update":
-			updates <- msg
+			c.enqueueUpdate(updates, msg)
 		case "sync":
 			if msg.DataType == "sync:request" {
 				go func() {
@@ -142,7 +278,23 @@ func (c *Cluster) registerHandlers(updates chan Message, sync chan Message, toke
 					}
 				}()
 			}
-			if msg.DataType == "sync:sendsharedkey" {
+			if msg.DataType == "sync:nextkey" || msg.DataType == "sync:rotatekey" {
+				go func() {
+					err := c.HandleKeyRotation(msg)
+					if err != nil {
+						c.log.Error(nil, err)
+					}
+				}()
+			}
+			if msg.DataType == "sync:resync" {
+				go func() {
+					err := c.HandleResync(msg)
+					if err != nil {
+						c.log.Error(nil, err)
+					}
+				}()
+			}
+			if msg.DataType == "sync:sendsharedkey" || msg.DataType == "sync:sendsealedkey" {
 				go func() {
 					err := c.HandleSharedKey(msg)
 					if err != nil {
@@ -150,6 +302,28 @@ func (c *Cluster) registerHandlers(updates chan Message, sync chan Message, toke
 					}
 				}()
 			}
+		case "cluster":
+			if msg.DataType == "leader:heartbeat" {
+				err := c.handleHeartbeat(msg)
+				if err != nil {
+					c.log.Error(nil, err)
+				}
+			}
+			if msg.DataType == "lock:withdraw" {
+				err := c.handleWithdraw(msg)
+				if err != nil {
+					c.log.Error(nil, err)
+				}
+			}
+			if msg.DataType == "cluster:leave" {
+				c.handleLeave(ctx.ID())
+			}
+			if msg.DataType == "update:ack" && c.app.KVInit {
+				err := c.app.KV.handleAck(ctx.ID().Address, msg)
+				if err != nil {
+					c.log.Error(nil, err)
+				}
+			}
 		case "token":
 			tokens <- msg
 		default:
@@ -162,7 +336,7 @@ func (c *Cluster) registerHandlers(updates chan Message, sync chan Message, toke
 
 //Start starts the cluster
 func (c *Cluster) Start(clusterReady chan bool) {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		c.genRSA = true
 		clusterReady <- true
 		go func() {
@@ -176,7 +350,11 @@ func (c *Cluster) Start(clusterReady chan bool) {
 	if err := c.node.Listen(); err != nil {
 		panic(err)
 	}
+	stop := make(chan bool)
+	defer close(stop)
+	go c.elect(stop)
 	c.log.Debug(nil, "Start clustering")
+	known := c.loadKnownPeers()
 	peered := false
 	for peered == false {
 		c.log.Debug(nil, "waiting for peers")
@@ -184,14 +362,19 @@ func (c *Cluster) Start(clusterReady chan bool) {
 		case <-c.terminate:
 			return
 		default:
-			// Wait for connection to our discovery host
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-			if _, err := c.node.Ping(ctx, c.config.Cluster.DiscoveryHost); err == nil {
+			// Wait for connection to one of our seeds
+			method, seeds := c.findSeeds()
+			if addr := c.firstAnswer(seeds); addr != "" {
+				c.log.InfoF(nil, "Joined the cluster through %s, found by %s discovery", addr, method)
+				peered = true
+				break
+			}
+			// or to any peer we knew before restarting
+			if addr := c.rejoinKnownPeer(known); addr != "" {
+				c.log.InfoF(nil, "No seeds are reachable, rejoining through %s", addr)
 				peered = true
-				cancel()
 				break
 			}
-			cancel()
 			time.Sleep(1 * time.Second)
 			firstNode = true
 		}
@@ -206,24 +389,31 @@ func (c *Cluster) Start(clusterReady chan bool) {
 			return
 		default:
 			//c.log.Debug(nil, "Discovering network")
-			c.peers = c.network.Discover()
+			if !c.Leaving() {
+				// a node that left stops looking for peers so they
+				// don't pick it up again
+				c.setPeers(c.network.Discover())
+			}
+			peers := c.Peers()
 			go func() {
-				c.metrics["peers"].(prometheus.Gauge).Set(float64(len(c.peers) + 1))
+				c.metrics["peers"].(prometheus.Gauge).Set(float64(len(peers) + 1))
 				c.metrics["in"].(prometheus.Gauge).Set(float64(len(c.node.Inbound())))
 				c.metrics["out"].(prometheus.Gauge).Set(float64(len(c.node.Outbound())))
 			}()
 			if index == 60 || index == 0 { // every 30 seconds or so
 				ltab := []node{}
-				for _, p := range c.peers {
+				for _, p := range peers {
 					ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 					start := time.Now()
 					_, err := c.node.Ping(ctx, p.Address)
 					if err != nil {
 						c.log.Error(nil, err)
+						c.markPeer(p, false, 0)
 						cancel()
 						continue
 					}
 					diff := time.Now().Sub(start)
+					c.markPeer(p, true, diff)
 					ltab = append(ltab, node{
 						ID:       p.ID.String(),
 						Address:  p.Address,
@@ -233,6 +423,8 @@ func (c *Cluster) Start(clusterReady chan bool) {
 					cancel()
 				}
 				c.locationTable = ltab
+				c.healthMetrics()
+				c.saveKnownPeers(ltab)
 				index = 0
 			}
 			if startup && !firstNode {
@@ -257,58 +449,467 @@ func (c *Cluster) Start(clusterReady chan bool) {
 	}
 }
 
-// Emit sends a message to the cluster
-func (c *Cluster) Emit(typ string, data []byte, dtype string) error {
-	if c.config.Mode == "dev" {
+func (c *Cluster) markPeer(p noise.ID, alive bool, latency time.Duration) {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	id := p.ID.String()
+	h := c.health[id]
+	h.ID = id
+	h.Address = p.Address
+	h.Alive = alive
+	if alive {
+		h.LastSeen = time.Now()
+		h.Latency = latency
+	}
+	c.health[id] = h
+}
+
+func (c *Cluster) healthMetrics() {
+	alive := 0
+	peers := c.PeerHealth()
+	for _, h := range peers {
+		up := 0.0
+		if h.Alive {
+			alive++
+			up = 1.0
+		}
+		c.metrics["peer_up"].(*prometheus.GaugeVec).WithLabelValues(h.ID).Set(up)
+	}
+	c.metrics["peers_total"].(prometheus.Gauge).Set(float64(len(peers)))
+	c.metrics["peers_alive"].(prometheus.Gauge).Set(float64(alive))
+}
+
+// PeerHealth returns the last liveness check result for every peer
+// this node has seen
+func (c *Cluster) PeerHealth() []PeerHealth {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	peers := []PeerHealth{}
+	for _, h := range c.health {
+		peers = append(peers, h)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+// enqueueUpdate queues an update for the KV store. When the queue is
+// full it waits up to updateQueueTimeout for room before dropping the
+// update, so a slow store can't stall the cluster handler forever.
+func (c *Cluster) enqueueUpdate(updates chan Message, msg Message) {
+	select {
+	case updates <- msg:
+		return
+	default:
+	}
+	c.log.WarnF(nil, "KV update queue is full (%v messages), waiting for room", cap(updates))
+	t := time.NewTimer(updateQueueTimeout)
+	defer t.Stop()
+	select {
+	case updates <- msg:
+	case <-t.C:
+		c.metrics["updates_dropped"].(prometheus.Counter).Inc()
+		c.log.ErrorF(nil, "Dropped update %s from %s, the KV update queue stayed full", msg.ID, msg.Origin)
+	}
+}
+
+// Leader returns the address of the current cluster leader, if known
+func (c *Cluster) Leader() string {
+	c.leaderLock.RLock()
+	defer c.leaderLock.RUnlock()
+	return c.leader
+}
+
+func (c *Cluster) setLeader(addr string) {
+	c.leaderLock.Lock()
+	defer c.leaderLock.Unlock()
+	c.leader = addr
+}
+
+// handleRequest answers messages sent with Request, which expect
+// a reply
+func (c *Cluster) handleRequest(ctx noise.HandlerContext) error {
+	var msg Message
+	err := json.Unmarshal(ctx.Data(), &msg)
+	if err != nil {
+		return err
+	}
+	err = decompressMessage(&msg)
+	if err != nil {
+		return err
+	}
+	go c.metrics["messages_rx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+	var res interface{}
+	if msg.DataType != "auth:hello" && !c.authorize(ctx.ID()) {
 		return nil
 	}
-	id := uuid.New()
+	if !c.checkProtocol(ctx.ID(), msg) {
+		return nil
+	}
+	if msg.DataType != "auth:hello" && !unsignedMessages[msg.DataType] && !c.verified(msg) {
+		return nil
+	}
+	switch msg.DataType {
+	case "auth:hello":
+		if c.auth == nil {
+			return nil
+		}
+		res = c.auth.hello
+	case "forward:write":
+		var fw ForwardedWrite
+		err = json.Unmarshal(msg.Data, &fw)
+		if err != nil {
+			return err
+		}
+		res = c.applyForward(fw)
+	case "lock:propose":
+		var l Lock
+		err = json.Unmarshal(msg.Data, &l)
+		if err != nil {
+			return err
+		}
+		res = LockVote{}
+		if c.app.KVInit {
+			res = c.app.KV.voteLock(l)
+		}
+	case "unseal:marker":
+		res = json.RawMessage("null")
+		if c.app.KVInit {
+			res = c.app.KV.unsealMarker()
+		}
+	case "kv:read":
+		var r PeerRead
+		err = json.Unmarshal(msg.Data, &r)
+		if err != nil {
+			return err
+		}
+		res = PeerValue{Error: "KV is not ready"}
+		if c.app.KVInit {
+			res = c.app.KV.storedValue(r.Prefix, r.Key)
+		}
+	default:
+		c.log.ErrorF(nil, "No handler for request type %s", msg.DataType)
+		return nil
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return ctx.Send(b)
+}
+
+// unsealMarkers asks the peers for their record of the unseal shares
+// being handed out, for a sealed node that missed it
+func (c *Cluster) unsealMarkers() [][]byte {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	msg := &Message{
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
+		DataType: "unseal:marker",
+		Type:     "unseal",
+		ID:       uuid.New().String(),
+		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Error(nil, err)
+		return nil
+	}
+	markers := [][]byte{}
+	for _, p := range c.Peers() {
+		if !c.compatible(p) {
+			continue
+		}
+		go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := c.node.Request(ctx, p.Address, b)
+		cancel()
+		if err != nil {
+			c.log.Error(nil, err)
+			continue
+		}
+		if len(reply) > 0 && string(reply) != "null" {
+			markers = append(markers, reply)
+		}
+	}
+	return markers
+}
+
+// applyForward applies a write forwarded by another node, or passes it
+// on again if this node can't apply it either
+func (c *Cluster) applyForward(fw ForwardedWrite) ForwardResult {
+	if c.ReadOnly() {
+		res, err := c.forwardWrite(fw)
+		if err != nil {
+			return ForwardResult{Status: 502, Error: err.Error()}
+		}
+		return res
+	}
+	ctx := withRequestID(withRequester(context.Background(), fw.Requester), fw.RequestID)
+	c.log.DebugF(forRequest("API", fw.RequestID), "Applying %s %s forwarded for %s", fw.Query.Verb, fw.Query.Key, fw.Requester)
+	err := c.app.KV.ApplyWrite(ctx, fw.Prefix, fw.Query)
+	var serr *SchemaError
+	switch {
+	case err == nil:
+		return ForwardResult{Status: 200}
+	case errors.As(err, &serr):
+		return ForwardResult{Status: 422, Error: err.Error()}
+	case errors.Is(err, bbolt.ErrBucketNotFound), errors.Is(err, ErrKeyNotFound):
+		return ForwardResult{Status: 404, Error: err.Error()}
+	default:
+		return ForwardResult{Status: 500, Error: err.Error()}
+	}
+}
+
+// forwardWrite sends a write to the leader and returns its result
+func (c *Cluster) forwardWrite(fw ForwardedWrite) (ForwardResult, error) {
+	res := ForwardResult{}
+	if fw.Hops >= maxForwardHops {
+		return res, fmt.Errorf("Write to %s was forwarded %d times without reaching a writable node", fw.Query.Key, fw.Hops)
+	}
+	leader := c.Leader()
+	if c.config().Mode == "dev" || leader == "" || leader == c.node.Addr() {
+		return res, ErrNoLeader
+	}
+	fw.Hops++
+	data, err := json.Marshal(fw)
+	if err != nil {
+		return res, err
+	}
 	msg := &Message{
-		Epoch:    c.epoch + 1,
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
 		Data:     data,
-		DataType: dtype,
-		Type:     typ,
-		ID:       id.String(),
+		DataType: "forward:write",
+		Type:     "forward",
+		ID:       uuid.New().String(),
 		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
+	}
+	c.sign(msg)
+	if len(msg.Signature) == 0 {
+		// the leader only takes writes it can check came from a peer
+		return res, ErrSealed
 	}
 	go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
-	msg.Epoch = c.epoch + 1
 	b, err := json.Marshal(msg)
+	if err != nil {
+		return res, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reply, err := c.node.Request(ctx, leader, b)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(reply, &res)
+	return res, err
+}
+
+// Emit sends a message to the cluster
+func (c *Cluster) Emit(typ string, data []byte, dtype string) error {
+	return c.EmitCtx(context.Background(), typ, data, dtype)
+}
+
+// EmitCtx is Emit for the API request in ctx
+func (c *Cluster) EmitCtx(ctx context.Context, typ string, data []byte, dtype string) error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	b, err := c.encode(ctx, typ, data, dtype)
 	if err != nil {
 		return err
 	}
-	for _, p := range c.peers {
-		go func(b []byte, p string) {
+	for _, p := range c.Peers() {
+		if !c.compatible(p) {
+			continue
+		}
+		if !c.queueSend(p.Address, b) {
+			c.log.ErrorF(nil, "Dropped a %s message for %s, too many are waiting to be sent to it", dtype, p.Address)
+		}
+	}
+	return nil
+}
+
+// EmitTo queues a message for the peer at addr, behind the others
+// emitted to it
+func (c *Cluster) EmitTo(ctx context.Context, addr string, typ string, data []byte, dtype string) error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	b, err := c.encode(ctx, typ, data, dtype)
+	if err != nil {
+		return err
+	}
+	if !c.queueSend(addr, b) {
+		return fmt.Errorf("Dropped a %s message for %s, too many are waiting to be sent to it", dtype, addr)
+	}
+	return nil
+}
+
+// peerAddrs returns the addresses of the peers updates are sent to
+func (c *Cluster) peerAddrs() []string {
+	addrs := []string{}
+	if c.config().Mode == "dev" {
+		return addrs
+	}
+	for _, p := range c.Peers() {
+		if c.compatible(p) {
+			addrs = append(addrs, p.Address)
+		}
+	}
+	return addrs
+}
+
+// sendQueueSize is how many emitted messages can wait to be sent to a
+// peer before more are dropped
+const sendQueueSize = 1024
+
+// queueSend adds b to the messages waiting to be sent to addr, starting
+// the queue if there isn't one, and reports whether there was room.
+// Each peer's messages are sent one at a time, so they arrive in the
+// order they were emitted.
+func (c *Cluster) queueSend(addr string, b []byte) bool {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	q, ok := c.sendQueues[addr]
+	if !ok {
+		q = make(chan []byte, sendQueueSize)
+		c.sendQueues[addr] = q
+		go c.sendQueued(addr, q)
+	}
+	select {
+	case q <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendQueued sends the messages in q to addr until q is closed
+func (c *Cluster) sendQueued(addr string, q chan []byte) {
+	for b := range q {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.node.Send(ctx, addr, b)
+		cancel()
+		if err != nil {
+			c.log.Error(nil, err)
+		}
+	}
+}
+
+// dropSendQueue stops the queue for a peer that left once what's
+// already waiting in it has been tried
+func (c *Cluster) dropSendQueue(addr string) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	if q, ok := c.sendQueues[addr]; ok {
+		close(q)
+		delete(c.sendQueues, addr)
+	}
+}
+
+// SendTo sends a message to the given peers, or to every peer when
+// there are none, and waits for the sends to finish. It returns the
+// peers it couldn't be sent to that are still part of the cluster.
+func (c *Cluster) SendTo(ctx context.Context, peers []string, typ string, data []byte, dtype string) []string {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	current := map[string]bool{}
+	for _, p := range c.Peers() {
+		if c.compatible(p) {
+			current[p.Address] = true
+		}
+	}
+	if len(peers) == 0 {
+		for addr := range current {
+			peers = append(peers, addr)
+		}
+	}
+	b, err := c.encode(ctx, typ, data, dtype)
+	if err != nil {
+		c.log.Error(nil, err)
+		return peers
+	}
+	failed := []string{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		if !current[p] {
+			continue
+		}
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
 			err := c.node.Send(ctx, p, b)
 			if err != nil {
-				c.log.Error(nil, err)
+				c.log.ErrorF(nil, "Unable to send %s to %s, will retry: %v", dtype, p, err)
+				lock.Lock()
+				failed = append(failed, p)
+				lock.Unlock()
 			}
-		}(b, p.Address)
+		}(p)
 	}
-	c.epoch++
-	return nil
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
+
+// encode builds a message for the API request in ctx, signed and
+// compressed for sending
+func (c *Cluster) encode(ctx context.Context, typ string, data []byte, dtype string) ([]byte, error) {
+	id := uuid.New()
+	msg := &Message{
+		Epoch:     atomic.AddUint64(&c.epoch, 1),
+		Data:      data,
+		DataType:  dtype,
+		Type:      typ,
+		ID:        id.String(),
+		Origin:    c.node.Addr(),
+		Protocol:  protocolVersion,
+		RequestID: requestIDFrom(ctx),
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		msg.Trace = carrier
+	}
+	go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+	c.sign(msg)
+	err := c.compressMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(msg)
 }
 
 //SyncResponse syncs a cluster's kv store
 func (c *Cluster) SyncResponse(msg Message) error {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
 	exist := true
-	if _, err := os.Stat(c.config.KV.DBPath); os.IsNotExist(err) {
+	if _, err := os.Stat(dbFile(c.config())); os.IsNotExist(err) {
 		c.log.Warn(nil, "DB is empty, sending no data")
 		exist = false
 	}
-	conn, err := tls.Dial("tcp", string(msg.Data), &tls.Config{InsecureSkipVerify: true})
+	config := &tls.Config{InsecureSkipVerify: true}
+	if c.auth != nil {
+		config = c.auth.tlsConfig()
+	}
+	conn, err := tls.Dial("tcp", string(msg.Data), config)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 	var db io.Reader
 	if exist {
-		db, err = os.OpenFile(c.config.KV.DBPath, os.O_RDONLY, 0755)
+		db, err = os.OpenFile(dbFile(c.config()), os.O_RDONLY, 0755)
 		if err != nil {
 			return err
 		}
@@ -329,24 +930,66 @@ func (c *Cluster) SyncResponse(msg Message) error {
 // nearest is determined by the locationTable
 func (c *Cluster) SyncRequest(clusterReady chan bool) error {
 	c.log.Debug(nil, "New sync request")
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
 	if len(c.locationTable) == 0 {
 		return fmt.Errorf("No peers available to sync with")
 	}
 	c.log.Debug(nil, "At least 1 peer to sync with")
+	if len(c.locationTable) > 1 {
+		sort.Slice(c.locationTable, func(i, j int) bool {
+			return c.locationTable[i].Distance < c.locationTable[j].Distance
+		})
+	}
+	return c.syncFrom(c.locationTable[0].Address, clusterReady)
+}
+
+// Resync asks every peer to pull a fresh copy of this node's database
+func (c *Cluster) Resync() error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	return c.Emit("sync", []byte{}, "sync:resync")
+}
+
+// HandleResync pulls the database from the peer that asked for a
+// resync. The request's signature has already been checked, and the
+// database is only pulled from an address that's one of this node's
+// peers, so a resync can't point the node at some other host.
+func (c *Cluster) HandleResync(msg Message) error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	known := false
+	for _, addr := range c.peerAddrs() {
+		if addr == msg.Origin {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("Resync requested by unknown peer %s", msg.Origin)
+	}
+	c.log.DebugF(nil, "Resync requested by %s", msg.Origin)
+	return c.syncFrom(msg.Origin, make(chan bool, 1))
+}
+
+// syncFrom opens the sync socket and asks the given peer to
+// send its database to it
+func (c *Cluster) syncFrom(addr string, clusterReady chan bool) error {
 	id := uuid.New()
-	syncAddress := fmt.Sprintf("%s:%v", strings.Split(c.node.ID().Address, ":")[0], c.config.Cluster.SyncPort)
+	syncAddress := fmt.Sprintf("%s:%v", strings.Split(c.node.ID().Address, ":")[0], c.config().Cluster.SyncPort)
 	ready := make(chan error)
 	go c.SyncHandle(syncAddress, ready, clusterReady)
 	res := &Message{
-		Epoch:    c.epoch + 1,
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
 		Data:     []byte(syncAddress),
 		DataType: "sync:request",
 		Type:     "sync",
 		ID:       id.String(),
 		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
 	}
 	go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(res.Type, res.DataType).Inc()
 	b, err := json.Marshal(res)
@@ -360,13 +1003,8 @@ func (c *Cluster) SyncRequest(clusterReady chan bool) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if len(c.locationTable) > 1 {
-		sort.Slice(c.locationTable, func(i, j int) bool {
-			return c.locationTable[i].Distance < c.locationTable[j].Distance
-		})
-	}
-	c.log.DebugF(nil, "Sending request to %s", c.locationTable[0].Address)
-	err = c.node.Send(ctx, c.locationTable[0].Address, b)
+	c.log.DebugF(nil, "Sending request to %s", addr)
+	err = c.node.Send(ctx, addr, b)
 	if err != nil {
 		return err
 	}
@@ -377,14 +1015,17 @@ func (c *Cluster) SyncRequest(clusterReady chan bool) error {
 // writes the db to disk
 func (c *Cluster) SyncHandle(addr string, ready chan error, clusterReady chan bool) {
 	defer func() { clusterReady <- true }()
-	cer, err := tls.LoadX509KeyPair(c.config.SSL.Certificate, c.config.SSL.Key)
+	cer, err := tls.LoadX509KeyPair(c.config().SSL.Certificate, c.config().SSL.Key)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	config := &tls.Config{Certificates: []tls.Certificate{cer}}
-	srv, err := tls.Listen("tcp", fmt.Sprintf(":%v", c.config.Cluster.SyncPort), config)
+	if c.auth != nil {
+		config = c.auth.tlsConfig()
+	}
+	srv, err := tls.Listen("tcp", fmt.Sprintf(":%v", c.config().Cluster.SyncPort), config)
 	if err != nil {
 		ready <- err
 		return
@@ -411,25 +1052,21 @@ func (c *Cluster) SyncHandle(addr string, ready chan error, clusterReady chan bo
 	go c.metrics["sync_rx"].(prometheus.Counter).Add(float64(n1))
 	c.log.DebugF(nil, "Got %v bytes in sync operation", n1)
 	conn.Close()
-	if c.app.KVInit {
-		err := dbClose(c.app.KV.db)
-		if err != nil {
-			c.log.Error(nil, err)
-			return
-		}
-	}
-	db, err := os.OpenFile(c.config.KV.DBPath, os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0755)
+	// written next to the database and swapped in, so a short or
+	// unreadable copy never replaces it
+	path := dbFile(c.config())
+	tmp := path + ".sync"
+	db, err := os.OpenFile(tmp, os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		c.log.Error(nil, err)
 		return
 	}
-	defer db.Close()
+	defer os.Remove(tmp)
 	n2, err := io.Copy(db, &buf)
-	if err != nil {
-		c.log.Error(nil, err)
-		return
+	if err == nil {
+		err = db.Sync()
 	}
-	err = db.Sync()
+	db.Close()
 	if err != nil {
 		c.log.Error(nil, err)
 		return
@@ -440,11 +1077,13 @@ func (c *Cluster) SyncHandle(addr string, ready chan error, clusterReady chan bo
 		return
 	}
 	if c.app.KVInit {
-		c.app.KV.db, err = dbOpen(c.app.KV.dbPath, c.app.KV.options)
-		if err != nil {
-			c.log.Error(nil, err)
-			return
-		}
+		err = c.app.KV.swapDB(tmp)
+	} else {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		c.log.Error(nil, err)
+		return
 	}
 	c.log.Debug(nil, "Synced database")
 	return
@@ -452,7 +1091,7 @@ func (c *Cluster) SyncHandle(addr string, ready chan error, clusterReady chan bo
 
 // RequestSharedKey function
 func (c *Cluster) RequestSharedKey() error {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
 	if len(c.locationTable) == 0 {
@@ -461,12 +1100,13 @@ func (c *Cluster) RequestSharedKey() error {
 	c.log.Debug(nil, "At least 1 peer to sync with")
 	id := uuid.New()
 	res := &Message{
-		Epoch:    c.epoch + 1,
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
 		Data:     []byte{},
 		DataType: "sync:sharedkey",
 		Type:     "sync",
 		ID:       id.String(),
 		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
 	}
 	go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(res.Type, res.DataType).Inc()
 	b, err := json.Marshal(res)
@@ -490,21 +1130,45 @@ func (c *Cluster) RequestSharedKey() error {
 
 // SendSharedKey function
 func (c *Cluster) SendSharedKey(msg Message) error {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
+	if !c.app.KVInit {
+		return fmt.Errorf("Not sending the shared key to %s, this node is still starting", msg.Origin)
+	}
+	shared, _ := c.app.KV.keys()
+	if shared == nil && !c.app.Crypto.initialised {
+		// the node starts sealed, but until the unseal shares are
+		// handed out the key is still sealed with the machine ID
+		var err error
+		shared, err = c.app.Crypto.unsealKey(sharedKeyPath, c.app.Crypto.privkey)
+		if err != nil {
+			return fmt.Errorf("%w, can't send it to %s: %v", ErrSealed, msg.Origin, err)
+		}
+	}
 	id := uuid.New()
-	data, err := json.Marshal(c.app.sharedKey)
+	data, err := json.Marshal(shared)
 	if err != nil {
 		return err
 	}
+	dtype := "sync:sendsharedkey"
+	if c.app.Crypto.initialised {
+		// the key is passed on still sealed, and the new node is
+		// unsealed with the same shares
+		data, err = ioutil.ReadFile(sharedKeyPath)
+		if err != nil {
+			return err
+		}
+		dtype = "sync:sendsealedkey"
+	}
 	res := &Message{
-		Epoch:    c.epoch + 1,
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
 		Data:     data,
-		DataType: "sync:sendsharedkey",
+		DataType: dtype,
 		Type:     "sync",
 		ID:       id.String(),
 		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
 	}
 	go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(res.Type, res.DataType).Inc()
 	b, err := json.Marshal(res)
@@ -523,18 +1187,77 @@ func (c *Cluster) SendSharedKey(msg Message) error {
 
 //HandleSharedKey function
 func (c *Cluster) HandleSharedKey(msg Message) error {
-	if c.config.Mode == "dev" {
+	if c.config().Mode == "dev" {
 		return nil
 	}
+	if msg.DataType == "sync:sendsealedkey" {
+		if _, err := os.Stat(sharedKeyPath); !os.IsNotExist(err) {
+			return nil
+		}
+		c.log.Debug(nil, "Got sealed shared key from "+msg.Origin)
+		return ioutil.WriteFile(sharedKeyPath, msg.Data, 0600)
+	}
 	var key *AESKey
 	err := json.Unmarshal(msg.Data, &key)
 	if err != nil {
 		return err
 	}
-	err = c.app.Crypto.SealSharedKey(key, c.app.Crypto.privkey, false)
+	err = c.app.Crypto.SealSharedKey(key, c.app.Crypto.sealingKey(), false)
 	if err != nil {
 		return err
 	}
 	c.log.Debug(nil, "Got shared key from "+msg.Origin)
 	return nil
 }
+
+// SendKey sends a shared key to every peer during a key rotation
+func (c *Cluster) SendKey(key *AESKey, dtype string) error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return c.Emit("sync", data, dtype)
+}
+
+// HandleKeyRotation stores the replacement key sent by a rotating
+// peer, and swaps it in once the rotation is done
+func (c *Cluster) HandleKeyRotation(msg Message) error {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	var key *AESKey
+	err := json.Unmarshal(msg.Data, &key)
+	if err != nil {
+		return err
+	}
+	if c.app.Crypto.Sealed() {
+		return fmt.Errorf("%w, missed a shared key rotation from %s", ErrSealed, msg.Origin)
+	}
+	if msg.DataType == "sync:nextkey" {
+		err = c.app.Crypto.sealKey(pendingKeyPath, key, c.app.Crypto.sealingKey())
+		if err != nil {
+			return err
+		}
+		if c.app.KVInit {
+			c.app.KV.setNextKey(key)
+		}
+		c.log.Debug(nil, "Got replacement shared key from "+msg.Origin)
+		return nil
+	}
+	err = c.app.Crypto.SealSharedKey(key, c.app.Crypto.sealingKey(), true)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(pendingKeyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if c.app.KVInit {
+		c.app.KV.setKeys(key, nil)
+	}
+	c.log.Debug(nil, "Rotated shared key from "+msg.Origin)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// maxClusterQueryKeys is the most keys one cluster query can compare
+	maxClusterQueryKeys = 100
+	// maxClusterQueries is how many cluster queries a node runs at once
+	maxClusterQueries = 4
+	// clusterQueryTimeout bounds a whole cluster query. Keys that aren't
+	// reached in time are reported with an error for every peer.
+	clusterQueryTimeout = 10 * time.Second
+)
+
+// ClusterQuery asks every node for its copy of some keys
+type ClusterQuery struct {
+	Keys      []string `json:"keys"`
+	Namespace string   `json:"namespace,omitempty"`
+}
+
+// NodeValue is one node's copy of a key. Secrets are only shown by
+// their digest.
+type NodeValue struct {
+	Found       bool       `json:"found"`
+	Value       string     `json:"value,omitempty"`
+	Digest      string     `json:"digest,omitempty"`
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// KeyComparison is every node's copy of a key. Diverged is set when the
+// nodes that answered don't all have the same value.
+type KeyComparison struct {
+	Key      string               `json:"key"`
+	Nodes    map[string]NodeValue `json:"nodes"`
+	Diverged bool                 `json:"diverged"`
+}
+
+// ClusterQueryResult is the answer to a ClusterQuery, with the keys
+// that diverged listed on their own
+type ClusterQueryResult struct {
+	Keys     []KeyComparison `json:"keys"`
+	Diverged []string        `json:"diverged"`
+}
+
+// compareKey reads key from every node and compares the copies
+func (kv *KV) compareKey(ctx context.Context, key string, prefix string) KeyComparison {
+	answers := map[string]PeerValue{}
+	self := "local"
+	if kv.config().Mode != "dev" {
+		answers = kv.app.Cluster.readPeers(ctx, PeerRead{Prefix: prefix, Key: key})
+		self = kv.app.Cluster.node.Addr()
+	}
+	answers[self] = kv.storedValue(prefix, key)
+	res := KeyComparison{Key: key, Nodes: map[string]NodeValue{}}
+	seen := map[string]bool{}
+	for node, a := range answers {
+		v := kv.nodeValue(a)
+		res.Nodes[node] = v
+		if v.Error == "" {
+			seen[v.Digest] = true
+		}
+	}
+	res.Diverged = len(seen) > 1
+	return res
+}
+
+// nodeValue describes a node's answer. Values are compared by the
+// digest of their plaintext, or of their stored form for secrets.
+func (kv *KV) nodeValue(a PeerValue) NodeValue {
+	if a.Error != "" || !a.Found {
+		return NodeValue{Error: a.Error}
+	}
+	v := NodeValue{Found: true, LastUpdated: &a.Value.LastUpdated}
+	data := a.Value.Data
+	if !a.Value.Secret {
+		obj, err := kv.unseal(a.Value)
+		if err != nil {
+			return NodeValue{Error: err.Error()}
+		}
+		data = obj.Data
+		v.Value = string(data)
+	}
+	sum := sha256.Sum256(data)
+	v.Digest = hex.EncodeToString(sum[:])
+	return v
+}
+
+// routeClusterQuery reads keys from every node so their copies can be
+// compared
+func (a *API) routeClusterQuery(c echo.Context) error {
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	q := ClusterQuery{}
+	err = json.Unmarshal(buf, &q)
+	if err != nil {
+		return c.JSON(400, jsonError{Message: err.Error()})
+	}
+	if len(q.Keys) == 0 || len(q.Keys) > maxClusterQueryKeys {
+		return c.JSON(400, jsonError{Message: "keys must list between 1 and 100 keys"})
+	}
+	prefix := "kv"
+	if q.Namespace != "" {
+		prefix, err = namespaceBucket(q.Namespace)
+		if err != nil {
+			return c.JSON(400, jsonError{Message: err.Error()})
+		}
+	}
+	select {
+	case a.clusterQueries <- true:
+		defer func() { <-a.clusterQueries }()
+	default:
+		return c.JSON(429, jsonError{Message: "Too many cluster queries are running, try again later"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), clusterQueryTimeout)
+	defer cancel()
+	res := ClusterQueryResult{Keys: []KeyComparison{}, Diverged: []string{}}
+	for _, key := range q.Keys {
+		cmp := a.kv.compareKey(ctx, key, prefix)
+		res.Keys = append(res.Keys, cmp)
+		if cmp.Diverged {
+			res.Diverged = append(res.Diverged, key)
+		}
+	}
+	return c.JSON(200, res)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// coalescedUpdate is an update to apply, along with the updates to
+// the same key that it replaced
+type coalescedUpdate struct {
+	msg      Message
+	replaced []Message
+}
+
+// coalesce collects the updates that arrive within kv.coalesce_window
+// of first and drops each put or delete of a key that a later put or
+// delete of the same key in the batch replaces, so a hot key is only
+// written once per window. The dropped updates go with the one that
+// replaced them, so they count as applied when it is. The rest keep
+// their order, so a put followed by a delete still ends deleted.
+func (kv *KV) coalesce(first Message) []coalescedUpdate {
+	window := kv.config().KV.CoalesceWindow
+	if window <= 0 {
+		return []coalescedUpdate{{msg: first}}
+	}
+	batch := []Message{first}
+	t := time.NewTimer(window)
+	defer t.Stop()
+collect:
+	for len(batch) < cap(kv.updates) {
+		select {
+		case msg := <-kv.updates:
+			batch = append(batch, msg)
+		case <-t.C:
+			break collect
+		}
+	}
+	if len(batch) == 1 {
+		return []coalescedUpdate{{msg: first}}
+	}
+	keys := make([]string, len(batch))
+	last := map[string]int{}
+	for i, msg := range batch {
+		keys[i] = kv.coalesceKey(msg)
+		if keys[i] != "" {
+			last[keys[i]] = i
+		}
+	}
+	replaced := map[int][]Message{}
+	for i, msg := range batch {
+		if keys[i] != "" && last[keys[i]] != i {
+			kv.metrics["updates_coalesced"].(prometheus.Counter).Inc()
+			replaced[last[keys[i]]] = append(replaced[last[keys[i]]], msg)
+		}
+	}
+	kept := []coalescedUpdate{}
+	for i, msg := range batch {
+		if keys[i] == "" || last[keys[i]] == i {
+			kept = append(kept, coalescedUpdate{msg: msg, replaced: replaced[i]})
+		}
+	}
+	return kept
+}
+
+// coalesceKey returns the prefix and key a put or delete is for, or ""
+// for any other update. Updates that fail verification are never
+// coalesced, so a forged update can't replace a real one; they're
+// rejected and counted when they're handled.
+func (kv *KV) coalesceKey(msg Message) string {
+	shared, next := kv.keys()
+	if !verifyMessage(shared, &msg) && !verifyMessage(next, &msg) {
+		return ""
+	}
+	var kvu KVUpdate
+	if json.Unmarshal(msg.Data, &kvu) != nil {
+		return ""
+	}
+	if kvu.UpdateType != "put:key" && kvu.UpdateType != "delete:key" {
+		return ""
+	}
+	prefix := kvu.Prefix
+	if prefix == "" {
+		prefix = "kv"
+	}
+	return prefix + "\x00" + kvu.Key
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// compactCheckInterval is how often the free page ratio is checked
+	// against kv.compact_threshold
+	compactCheckInterval = time.Minute
+	// compactMinSize keeps small databases from being compacted over
+	// and over, since even a fresh file has a few free pages
+	compactMinSize = 1 << 20
+	// compactTxSize is how many bytes are copied per transaction
+	compactTxSize = 1 << 20
+)
+
+// Compact rewrites the database into a fresh file without its free
+// pages and swaps it in, returning the file size before and after.
+// Writes wait for it to finish, retrying as they do when the database
+// is busy, and reads wait while the files are swapped, the same as
+// during a restore.
+func (kv *KV) Compact() (before int64, after int64, err error) {
+	start := time.Now()
+	defer kv.doMetrics("system:compact", start)
+	defer func() { kv.countError("system:compact", err) }()
+	kv.writer <- true
+	defer func() { <-kv.writer }()
+	f, err := os.Stat(kv.dbPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = f.Size()
+	tmp := kv.dbPath + ".compact"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	dst, err := bbolt.Open(tmp, 0600, &bbolt.Options{
+		Timeout:      time.Second,
+		FreelistType: kv.options.FreelistType,
+		NoSync:       true,
+	})
+	if err != nil {
+		return before, 0, err
+	}
+	// copied in a write transaction so writes that don't go through
+	// kv.update can't land in the old file while it's being copied
+	err = kv.db.Update(func(tx *bbolt.Tx) error {
+		return compactDB(dst, tx, compactTxSize)
+	})
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err != nil {
+		return before, 0, err
+	}
+	if cerr != nil {
+		return before, 0, cerr
+	}
+	f, err = os.Stat(tmp)
+	if err != nil {
+		return before, 0, err
+	}
+	after = f.Size()
+	err = kv.swapDB(tmp)
+	if err != nil {
+		return before, 0, err
+	}
+	kv.metrics["compactions"].(prometheus.Counter).Inc()
+	kv.log.InfoF(nil, "Compacted database from %d to %d bytes in %s", before, after, time.Since(start))
+	return before, after, nil
+}
+
+// compactDB copies every bucket in src into dst, committing every
+// txSize bytes. It's bbolt.Compact, which isn't in the bbolt version
+// this is built with, reading from an open transaction.
+func compactDB(dst *bbolt.DB, src *bbolt.Tx, txSize int64) error {
+	var size int64
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+	err = walkBuckets(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+		size += int64(len(k) + len(v))
+		if size > txSize {
+			err := tx.Commit()
+			if err != nil {
+				return err
+			}
+			tx, err = dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			size = int64(len(k) + len(v))
+		}
+		if len(keys) == 0 {
+			// only buckets live at the top level
+			b, err := tx.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return b.SetSequence(seq)
+		}
+		b := tx.Bucket(keys[0])
+		for _, name := range keys[1:] {
+			b = b.Bucket(name)
+		}
+		// keys are copied in order, so pack the pages full
+		b.FillPercent = 1.0
+		if v == nil {
+			nested, err := b.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return nested.SetSequence(seq)
+		}
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// walkBuckets calls fn for every bucket and key in tx, parents first.
+// keys is the path of buckets holding k, and v is nil for buckets.
+func walkBuckets(tx *bbolt.Tx, fn func(keys [][]byte, k, v []byte, seq uint64) error) error {
+	return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		return walkBucket(b, nil, name, nil, b.Sequence(), fn)
+	})
+}
+
+func walkBucket(b *bbolt.Bucket, keys [][]byte, k, v []byte, seq uint64, fn func([][]byte, []byte, []byte, uint64) error) error {
+	err := fn(keys, k, v, seq)
+	if err != nil || v != nil {
+		return err
+	}
+	keys = append(keys, append([]byte(nil), k...))
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested := b.Bucket(k)
+			return walkBucket(nested, keys, k, nil, nested.Sequence(), fn)
+		}
+		return walkBucket(b, keys, k, v, b.Sequence(), fn)
+	})
+}
+
+// compactor compacts the database when free pages make up more than
+// kv.compact_threshold of the file. Each node compacts its own file.
+func (kv *KV) compactor(stop chan bool) {
+	t := time.NewTicker(compactCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if kv.config().KV.CompactThreshold <= 0 || kv.freeRatio() < kv.config().KV.CompactThreshold {
+				continue
+			}
+			_, _, err := kv.Compact()
+			if err != nil {
+				kv.log.Error(nil, err)
+			}
+		}
+	}
+}
+
+// freeRatio is the share of the database file taken up by free pages,
+// from the same stats as the freelist metrics
+func (kv *KV) freeRatio() float64 {
+	f, err := os.Stat(kv.dbPath)
+	if err != nil || f.Size() < compactMinSize {
+		return 0
+	}
+	stats := kv.db.Stats()
+	free := float64(stats.FreePageN+stats.PendingPageN) * float64(kv.db.Info().PageSize)
+	return free / float64(f.Size())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// messageCodecs are the values cluster.compression can be set to
+var messageCodecs = map[string]bool{
+	"none":   true,
+	"gzip":   true,
+	"snappy": true,
+}
+
+// compressMessage compresses the data of a message about to be sent
+// with the configured codec, once it's signed. Data under the
+// threshold is sent as-is, as is data that doesn't get any smaller.
+func (c *Cluster) compressMessage(msg *Message) error {
+	codec := c.config().Cluster.Compression
+	if codec == "" || codec == "none" || len(msg.Data) < c.config().Cluster.CompressionThreshold {
+		return nil
+	}
+	var data []byte
+	switch codec {
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(msg.Data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	case "snappy":
+		data = snappy.Encode(nil, msg.Data)
+	default:
+		return fmt.Errorf("Unknown message codec %s", codec)
+	}
+	if len(data) >= len(msg.Data) {
+		return nil
+	}
+	msg.Data = data
+	msg.Encoding = codec
+	return nil
+}
+
+// decompressMessage restores the data of a received message to what
+// was signed. Messages from peers that don't compress have no encoding
+// and are left alone.
+func decompressMessage(msg *Message) error {
+	var data []byte
+	var err error
+	switch msg.Encoding {
+	case "":
+		return nil
+	case "gzip":
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(msg.Data))
+		if err == nil {
+			data, err = ioutil.ReadAll(r)
+		}
+	case "snappy":
+		data, err = snappy.Decode(nil, msg.Data)
+	default:
+		err = fmt.Errorf("Unknown message encoding %s", msg.Encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to decompress %s %s from %s: %w", msg.DataType, msg.ID, msg.Origin, err)
+	}
+	msg.Data = data
+	msg.Encoding = ""
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const writeIndexKey ctxKey = "write_index"
+
+// ErrBadIndex is returned for a min_index that isn't a write index
+var ErrBadIndex = errors.New("Not a write index")
+
+// writeIndex holds the index of the last write a request made. Pending
+// is set when the write is queued for peers, and only becomes the
+// committed index once its transaction commits.
+type writeIndex struct {
+	pending   uint64
+	committed uint64
+}
+
+// withWriteIndex returns a context for writes that record their index
+// in w
+func withWriteIndex(ctx context.Context, w *writeIndex) context.Context {
+	return context.WithValue(ctx, writeIndexKey, w)
+}
+
+// writeIndexFrom returns where the write made with ctx should record its
+// index, or nil if nobody asked
+func writeIndexFrom(ctx context.Context) *writeIndex {
+	w, _ := ctx.Value(writeIndexKey).(*writeIndex)
+	return w
+}
+
+// formatIndex makes the token for write index n made on the node at
+// origin
+func formatIndex(origin string, n uint64) string {
+	return fmt.Sprintf("%d@%s", n, origin)
+}
+
+// parseIndex splits a token made by formatIndex
+func parseIndex(s string) (string, uint64, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", 0, fmt.Errorf("%w: %q", ErrBadIndex, s)
+	}
+	n, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || n == 0 {
+		return "", 0, fmt.Errorf("%w: %q", ErrBadIndex, s)
+	}
+	return parts[1], n, nil
+}
+
+// appliedIndexes tracks how far this node has got through the writes
+// of each peer. Each update from a peer names the one it sent before
+// it, and a peer's index only counts as applied once the update and
+// every one before it in that chain have been applied without error.
+// Updates applied after one that's missing or failed wait in next
+// until the peer sends it again.
+type appliedIndexes struct {
+	lock    sync.Mutex
+	origins map[string]*originIndex
+	// closed and replaced whenever an index moves forward
+	advanced chan struct{}
+}
+
+type originIndex struct {
+	applied uint64
+	// the updates applied past a gap, by the index before them
+	next map[uint64]uint64
+}
+
+func newAppliedIndexes() *appliedIndexes {
+	return &appliedIndexes{
+		origins:  map[string]*originIndex{},
+		advanced: make(chan struct{}),
+	}
+}
+
+// origin returns what's been applied from origin. The first update
+// seen from a peer starts its chain, since nothing before it can be
+// asked for again. It must be called with the lock held.
+func (a *appliedIndexes) origin(origin string, previous uint64) *originIndex {
+	o, ok := a.origins[origin]
+	if !ok {
+		o = &originIndex{applied: previous, next: map[uint64]uint64{}}
+		a.origins[origin] = o
+	}
+	return o
+}
+
+// done reports whether update n from origin, sent after previous, has
+// already been applied
+func (a *appliedIndexes) done(origin string, previous uint64, n uint64) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	o := a.origin(origin, previous)
+	return n <= o.applied || o.next[previous] == n
+}
+
+// finish marks update n from origin, sent after previous, as applied,
+// moving the origin's index forward if it was the next one
+func (a *appliedIndexes) finish(origin string, previous uint64, n uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	o := a.origin(origin, previous)
+	if n <= o.applied {
+		return
+	}
+	if previous > o.applied {
+		o.next[previous] = n
+		return
+	}
+	o.applied = n
+	for {
+		after, ok := o.next[o.applied]
+		if !ok {
+			break
+		}
+		delete(o.next, o.applied)
+		o.applied = after
+	}
+	for prev := range o.next {
+		if prev < o.applied {
+			delete(o.next, prev)
+		}
+	}
+	close(a.advanced)
+	a.advanced = make(chan struct{})
+}
+
+// applied returns the highest index from origin that's been applied
+// along with everything before it, and a channel that's closed when
+// that might have changed
+func (a *appliedIndexes) applied(origin string) (uint64, chan struct{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	o, ok := a.origins[origin]
+	if !ok {
+		return 0, a.advanced
+	}
+	return o.applied, a.advanced
+}
+
+// WaitIndex waits until this node has applied the write with the given
+// token, made by itself or a peer, or until ctx is done
+func (kv *KV) WaitIndex(ctx context.Context, token string) error {
+	origin, n, err := parseIndex(token)
+	if err != nil {
+		return err
+	}
+	if kv.config().Mode == "dev" || origin == kv.app.Cluster.node.Addr() {
+		// our own writes are applied before their token is handed out
+		return nil
+	}
+	for {
+		done, advanced := kv.applied.applied(origin)
+		if done >= n {
+			return nil
+		}
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
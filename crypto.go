@@ -4,22 +4,50 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/denisbrodbeck/machineid"
 )
 
+const (
+	// sharedKeyPath is where the sealed shared key is kept
+	sharedKeyPath = "cluster.key"
+
+	// pendingKeyPath holds the sealed replacement key while a
+	// key rotation is in progress
+	pendingKeyPath = "cluster.key.next"
+)
+
 //Crypto struct
 type Crypto struct {
 	sharedkey *AESKey
 	privkey   *AESKey
 	id        string
+	keyring   map[string]*AESKey
+	keyLock   sync.Mutex
+	// threshold is how many unseal shares rebuild the master key the
+	// shared key is sealed with. With 0, or until the shares have been
+	// handed out, the shared key is sealed with privkey, which is
+	// derived from the machine ID.
+	threshold   int
+	initialised bool
+	masterkey   *AESKey
+	// shares holds the unseal shares given so far
+	shares [][]byte
+	// sealed is set when the keys have been dropped from memory on
+	// purpose, and stays set until the node is unsealed again
+	sealed   bool
+	sealLock sync.Mutex
 }
 
 //AESKey type
@@ -52,7 +80,8 @@ func newCrypto() (*Crypto, error) {
 		return nil, err
 	}
 	c := &Crypto{
-		id: id,
+		id:      id,
+		keyring: map[string]*AESKey{},
 	}
 	err = c.GenerateSystemAES()
 	if err != nil {
@@ -61,6 +90,37 @@ func newCrypto() (*Crypto, error) {
 	return c, nil
 }
 
+func (c *Crypto) cachedKey(name string) *AESKey {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	return c.keyring[name]
+}
+
+// forgetKeys drops every key in the keyring held in memory
+func (c *Crypto) forgetKeys() {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	c.keyring = map[string]*AESKey{}
+}
+
+// forgetKey drops a key from the keyring held in memory
+func (c *Crypto) forgetKey(name string) {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	delete(c.keyring, name)
+}
+
+// unsealedKeys returns the names of the keyring keys held in memory
+func (c *Crypto) unsealedKeys() map[string]bool {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	names := map[string]bool{}
+	for name := range c.keyring {
+		names[name] = true
+	}
+	return names
+}
+
 func (c *Crypto) createHash(key string) string {
 	hasher := md5.New()
 	_, err := hasher.Write([]byte(key))
@@ -72,28 +132,36 @@ func (c *Crypto) createHash(key string) string {
 
 // GenerateSharedKey function
 func (c *Crypto) GenerateSharedKey() error {
+	key, err := newAESKey()
+	if err != nil {
+		return err
+	}
+	c.sharedkey = key
+	return nil
+}
+
+func newAESKey() (*AESKey, error) {
 	pass := make([]byte, 32) // new random 12-byte passphrase
 	if _, err := io.ReadFull(rand.Reader, pass); err != nil {
-		return err
+		return nil, err
 	}
 	block, err := aes.NewCipher(pass)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return err
+		return nil, err
 	}
-	c.sharedkey = &AESKey{
+	return &AESKey{
 		Key:       nonce,
 		NonceSize: gcm.NonceSize(),
 		Pass:      pass,
-	}
-	return nil
+	}, nil
 }
 
 // GenerateSystemAES function
@@ -123,38 +191,88 @@ func (c *Crypto) GenerateSystemAES() error {
 	return nil
 }
 
+// Sealed reports whether the shared key is waiting to be unsealed
+func (c *Crypto) Sealed() bool {
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	return c.isSealed()
+}
+
+// isSealed must be called with the seal lock held
+func (c *Crypto) isSealed() bool {
+	return c.sealed || c.currentSealingKey() == nil
+}
+
+// sealingKey returns the key the shared key is sealed with, or nil
+// while the node is sealed
+func (c *Crypto) sealingKey() *AESKey {
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	return c.currentSealingKey()
+}
+
+// currentSealingKey must be called with the seal lock held
+func (c *Crypto) currentSealingKey() *AESKey {
+	if c.threshold == 0 || !c.initialised {
+		return c.privkey
+	}
+	return c.masterkey
+}
+
 //SealSharedKey function
 func (c *Crypto) SealSharedKey(sharedkey *AESKey, privkey *AESKey, overwrite bool) error {
-	if _, err := os.Stat("cluster.key"); !os.IsNotExist(err) && !overwrite {
+	if _, err := os.Stat(sharedKeyPath); !os.IsNotExist(err) && !overwrite {
 		// dont overwrite key if it exists
 		return nil
 	}
-	n := privkey.Key
-	f, err := os.OpenFile("cluster.key", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	return c.sealKey(sharedKeyPath, sharedkey, privkey)
+}
+
+// UnsealSharedKey opens the sealed shared key, or returns ErrSealed if
+// the key it's sealed with hasn't been unsealed yet
+func (c *Crypto) UnsealSharedKey() (*AESKey, error) {
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	if c.isSealed() {
+		return nil, ErrSealed
+	}
+	return c.unsealKey(sharedKeyPath, c.currentSealingKey())
+}
+
+func (c *Crypto) sealKey(path string, key *AESKey, privkey *AESKey) error {
+	b, err := sealAESKey(key, privkey)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	bkey, err := json.Marshal(sharedkey)
-	if err != nil {
-		return err
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func (c *Crypto) unsealKey(path string, privkey *AESKey) (*AESKey, error) {
+	if privkey == nil {
+		return nil, ErrSealed
 	}
-	gcm, err := privkey.newGCM()
+	f, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	txt := gcm.Seal(n, privkey.Key, bkey, nil)
-	_, err = f.Write(txt)
-	if err != nil {
-		return err
+	if len(f) < privkey.NonceSize {
+		return nil, fmt.Errorf("Sealed key %s is truncated", path)
 	}
-	return nil
+	return openAESKey(f, privkey)
 }
 
-//UnsealSharedKey function
-func (c *Crypto) UnsealSharedKey(privkey *AESKey) (*AESKey, error) {
-	var b []byte
-	f, err := ioutil.ReadFile("cluster.key")
+// sealAESKey encrypts a key with privkey
+func sealAESKey(key *AESKey, privkey *AESKey) ([]byte, error) {
+	if privkey == nil {
+		return nil, ErrSealed
+	}
+	// a fresh nonce every time, since a key can be sealed more than
+	// once with the same privkey
+	n := make([]byte, privkey.NonceSize)
+	if _, err := io.ReadFull(rand.Reader, n); err != nil {
+		return nil, err
+	}
+	bkey, err := json.Marshal(key)
 	if err != nil {
 		return nil, err
 	}
@@ -162,22 +280,39 @@ func (c *Crypto) UnsealSharedKey(privkey *AESKey) (*AESKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	n, text := f[:privkey.NonceSize], f[privkey.NonceSize:]
+	return gcm.Seal(n, n, bkey, nil), nil
+}
+
+// openAESKey decrypts a key sealed with sealAESKey
+func openAESKey(b []byte, privkey *AESKey) (*AESKey, error) {
+	if len(b) < privkey.NonceSize {
+		return nil, fmt.Errorf("Sealed key is truncated")
+	}
+	gcm, err := privkey.newGCM()
+	if err != nil {
+		return nil, err
+	}
+	n, text := b[:privkey.NonceSize], b[privkey.NonceSize:]
 	b, err = gcm.Open(nil, n, text, nil)
 	if err != nil {
 		return nil, err
 	}
-	var sharedkey *AESKey
-	err = json.Unmarshal(b, &sharedkey)
+	var key *AESKey
+	err = json.Unmarshal(b, &key)
 	if err != nil {
 		return nil, err
 	}
-	return sharedkey, nil
+	return key, nil
 }
 
 func encrytJSON(key *AESKey, data interface{}) ([]byte, error) {
 	var secret []byte
-	n := key.Key
+	// a fresh nonce for every value, stored in front of it for
+	// decryptJSON, since GCM mustn't reuse one with the same key
+	n := make([]byte, key.NonceSize)
+	if _, err := io.ReadFull(rand.Reader, n); err != nil {
+		return secret, err
+	}
 	b, err := json.Marshal(data)
 	if err != nil {
 		return secret, err
@@ -186,7 +321,7 @@ func encrytJSON(key *AESKey, data interface{}) ([]byte, error) {
 	if err != nil {
 		return secret, err
 	}
-	txt := gcm.Seal(n, key.Key, b, nil)
+	txt := gcm.Seal(n, n, b, nil)
 	s := &Secret{
 		Secret: txt,
 	}
@@ -201,6 +336,12 @@ func decryptJSON(key *AESKey, data []byte) ([]byte, error) {
 	var secret []byte
 	var obj Secret
 	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Secret) < key.NonceSize {
+		return nil, fmt.Errorf("Value is not an encrypted secret")
+	}
 	gcm, err := key.newGCM()
 	if err != nil {
 		return nil, err
@@ -216,3 +357,35 @@ func decryptJSON(key *AESKey, data []byte) ([]byte, error) {
 	}
 	return secret, nil
 }
+
+// signingKey derives the key used to sign cluster messages from an AES
+// key's secret, so the encryption key itself is never used as a MAC
+// key. The nonce in Key is stored in clear and can't be used.
+func signingKey(key *AESKey) []byte {
+	mac := hmac.New(sha256.New, key.Pass)
+	mac.Write([]byte("cave message signing"))
+	return mac.Sum(nil)
+}
+
+// messageMAC computes the signature of a message over its epoch, ID,
+// type, origin and data. The origin is covered so a replayed message
+// can't dodge the epoch check by claiming to come from another node.
+func messageMAC(key *AESKey, msg *Message) []byte {
+	mac := hmac.New(sha256.New, signingKey(key))
+	fmt.Fprintf(mac, "%d|%s|%s|%s|", msg.Epoch, msg.ID, msg.Type, msg.Origin)
+	mac.Write(msg.Data)
+	return mac.Sum(nil)
+}
+
+// signMessage sets the message's signature
+func signMessage(key *AESKey, msg *Message) {
+	msg.Signature = messageMAC(key, msg)
+}
+
+// verifyMessage reports whether the message was signed with key
+func verifyMessage(key *AESKey, msg *Message) bool {
+	if key == nil || len(msg.Signature) == 0 {
+		return false
+	}
+	return hmac.Equal(msg.Signature, messageMAC(key, msg))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	dryRunKey ctxKey = "dry_run"
+	diffKey   ctxKey = "diff"
+)
+
+// errDryRun rolls back the transaction of a dry run write
+var errDryRun = errors.New("Dry run")
+
+// ValueDiff is what a write changes about a key
+type ValueDiff struct {
+	Key string `json:"key"`
+	// Op is create, update or delete, or none when a delete finds
+	// nothing to remove
+	Op      string       `json:"op"`
+	Changes []DiffChange `json:"changes"`
+}
+
+// DiffChange is one changed value. Path points into JSON values like a
+// JSON Pointer, and is empty when the whole value changed. Old and New
+// are left out for secrets.
+type DiffChange struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// withDryRun returns a context for a write that's checked and diffed
+// but rolled back instead of committed and sent to the cluster
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey, true)
+}
+
+// isDryRun reports whether the write made with ctx is a dry run
+func isDryRun(ctx context.Context) bool {
+	ok, _ := ctx.Value(dryRunKey).(bool)
+	return ok
+}
+
+// withDiff returns a context for a write that stores what it changed
+// in d, worked out in the write's own transaction
+func withDiff(ctx context.Context, d *ValueDiff) context.Context {
+	return context.WithValue(ctx, diffKey, d)
+}
+
+// diffFrom returns where the write made with ctx should store its diff,
+// or nil if it wasn't asked for
+func diffFrom(ctx context.Context) *ValueDiff {
+	d, _ := ctx.Value(diffKey).(*ValueDiff)
+	return d
+}
+
+// diffObjects compares the stored object old, which is nil for a new
+// key, with next, which is nil for a delete
+func (kv *KV) diffObjects(key string, old []byte, next *KVObject) (ValueDiff, error) {
+	d := ValueDiff{Key: key, Changes: []DiffChange{}}
+	var prev *KVObject
+	if old != nil {
+		obj := KVObject{}
+		err := json.Unmarshal(old, &obj)
+		if err != nil {
+			return d, err
+		}
+		obj, err = kv.unseal(obj)
+		if err != nil {
+			return d, err
+		}
+		prev = &obj
+	}
+	switch {
+	case prev == nil && next == nil:
+		d.Op = "none"
+		return d, nil
+	case prev == nil:
+		d.Op = "create"
+	case next == nil:
+		d.Op = "delete"
+	default:
+		d.Op = "update"
+	}
+	if (prev != nil && prev.Secret) || (next != nil && next.Secret) {
+		d.Changes = append(d.Changes, DiffChange{Path: ""})
+		return d, nil
+	}
+	var a, b interface{}
+	if prev != nil {
+		a = diffValue(prev.Data)
+	}
+	if next != nil {
+		b = diffValue(next.Data)
+	}
+	diffJSON("", a, b, &d.Changes)
+	return d, nil
+}
+
+// diffValue decodes a stored value for diffing. Values that aren't
+// JSON are compared as strings.
+func diffValue(data []byte) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil || dec.More() {
+		return string(data)
+	}
+	return v
+}
+
+// diffJSON appends the differences between a and b to changes,
+// descending into objects so only the fields that changed are listed.
+// Arrays are compared as a whole.
+func diffJSON(path string, a, b interface{}, changes *[]DiffChange) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		names := []string{}
+		for name := range am {
+			names = append(names, name)
+		}
+		for name := range bm {
+			if _, ok := am[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			av, ain := am[name]
+			bv, bin := bm[name]
+			p := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			switch {
+			case !ain:
+				*changes = append(*changes, DiffChange{Path: p, New: diffRaw(bv)})
+			case !bin:
+				*changes = append(*changes, DiffChange{Path: p, Old: diffRaw(av)})
+			default:
+				diffJSON(p, av, bv, changes)
+			}
+		}
+		return
+	}
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+	c := DiffChange{Path: path}
+	if a != nil {
+		c.Old = diffRaw(a)
+	}
+	if b != nil {
+		c.New = diffRaw(b)
+	}
+	*changes = append(*changes, c)
+}
+
+func diffRaw(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.etcd.io/bbolt"
+)
+
+// servicesBucket is the bucket in the default key space that services
+// register themselves under, one bucket per service and one key per
+// instance. Instances are expected to write their entry with a TTL and
+// heartbeat it.
+const servicesBucket = "_services"
+
+// ServiceEntry is a registered instance of a service
+type ServiceEntry struct {
+	ID          string          `json:"id"`
+	Value       json.RawMessage `json:"value"`
+	LastUpdated time.Time       `json:"last_updated"`
+	ExpiresAt   *time.Time      `json:"expires_at,omitempty"`
+}
+
+// Discover returns the unexpired instances registered for a service.
+// Secrets are left encrypted.
+func (kv *KV) Discover(service string) ([]ServiceEntry, error) {
+	start := time.Now()
+	defer kv.doMetrics("get:discovery", start)
+	entries := []ServiceEntry{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte("kv"))
+		for _, name := range []string{servicesBucket, service} {
+			if bkt == nil {
+				return nil
+			}
+			bkt = bkt.Bucket([]byte(name))
+		}
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			obj := KVObject{}
+			err := json.Unmarshal(v, &obj)
+			if err != nil {
+				return err
+			}
+			if obj.expired(start) {
+				return nil
+			}
+			obj, err = kv.unseal(obj)
+			if err != nil {
+				return err
+			}
+			value := json.RawMessage(obj.Data)
+			if !json.Valid(obj.Data) {
+				value, err = json.Marshal(string(obj.Data))
+				if err != nil {
+					return err
+				}
+			}
+			entries = append(entries, ServiceEntry{
+				ID:          string(k),
+				Value:       value,
+				LastUpdated: obj.LastUpdated,
+				ExpiresAt:   obj.ExpiresAt,
+			})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// healthy reports whether an entry's metadata marks it as healthy
+func (e ServiceEntry) healthy() bool {
+	var meta struct {
+		Healthy *bool `json:"healthy"`
+	}
+	if json.Unmarshal(e.Value, &meta) != nil || meta.Healthy == nil {
+		return false
+	}
+	return *meta.Healthy
+}
+
+func (a *API) routeDiscovery(c echo.Context) error {
+	service := c.Param("service")
+	if service == "" || strings.Contains(service, "/") {
+		return c.JSON(400, jsonError{Message: "Invalid service name"})
+	}
+	entries, err := a.kv.Discover(service)
+	if err != nil {
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	if c.QueryParam("healthy") == "" {
+		return c.JSON(200, entries)
+	}
+	healthy := []ServiceEntry{}
+	for _, e := range entries {
+		if e.healthy() {
+			healthy = append(healthy, e)
+		}
+	}
+	return c.JSON(200, healthy)
+}
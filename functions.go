@@ -4,58 +4,368 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/denisbrodbeck/machineid"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
 )
 
 // getConfig loads config from its various sources
 func getConfig() (*Config, error) {
-	id, err := machineid.ID()
+	c, err := readConfig()
 	if err != nil {
-		return &Config{}, err
+		return c, err
+	}
+	err = c.Validate()
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(2)
+	}
+	fmt.Printf("%+v\n", c)
+	return c, nil
+}
+
+// ConfigErrors holds every problem found while validating a config
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid config:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// Validate checks the config for missing or conflicting settings
+// and reports all of them at once
+func (c *Config) Validate() error {
+	errs := ConfigErrors{}
+	fail := func(s string, v ...interface{}) {
+		errs = append(errs, fmt.Sprintf(s, v...))
+	}
+	fileExists := func(field string, path string) {
+		if path == "" {
+			fail("%s must be set", field)
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			fail("%s '%s' can't be read: %v", field, path, err)
+		}
+	}
+	if c.Mode != "prod" && c.Mode != "dev" {
+		fail("'mode' must be set to either 'dev' or 'prod'; value '%s' is not a valid mode", c.Mode)
+	}
+	ports := map[string]uint16{
+		"api.port": c.API.Port,
+	}
+	if c.UI.Enable {
+		ports["ui.port"] = c.UI.Port
+	}
+	if c.GRPC.Enable {
+		ports["grpc.port"] = c.GRPC.Port
+	}
+	if c.Redis.Enable {
+		ports["redis.port"] = c.Redis.Port
+	}
+	if c.Mode == "prod" {
+		ports["cluster.port"] = c.Cluster.Port
+		ports["cluster.syncport"] = c.Cluster.SyncPort
+	}
+	used := map[uint16]string{}
+	for _, name := range []string{"api.port", "ui.port", "grpc.port", "redis.port", "cluster.port", "cluster.syncport"} {
+		port, ok := ports[name]
+		if !ok {
+			continue
+		}
+		if port == 0 {
+			fail("%s must be between 1 and 65535", name)
+			continue
+		}
+		if other, ok := used[port]; ok && !(name == "ui.port" && other == "api.port") {
+			fail("%s and %s can't both use port %v", other, name, port)
+		}
+		used[port] = name
+	}
+	if c.KV.DBPath == "" {
+		fail("kv.dbpath must be set")
+	}
+	if c.KV.DBTimeout <= 0 {
+		fail("kv.dbtimeout must be greater than 0")
+	}
+	if c.KV.DBOpenRetries < 0 {
+		fail("kv.dbopenretries can't be negative")
+	}
+	if c.KV.FreelistType != string(bbolt.FreelistArrayType) && c.KV.FreelistType != string(bbolt.FreelistMapType) {
+		fail("kv.freelisttype must be one of '%s' or '%s'", bbolt.FreelistArrayType, bbolt.FreelistMapType)
+	}
+	if c.KV.CompactThreshold < 0 || c.KV.CompactThreshold >= 1 {
+		fail("kv.compactthreshold must be at least 0 and less than 1")
+	}
+	if c.KV.CoalesceWindow < 0 {
+		fail("kv.coalescewindow can't be negative")
+	}
+	if c.KV.ReadBatchWindow < 0 {
+		fail("kv.readbatchwindow can't be negative")
+	}
+	if c.KV.UpdateWorkers < 1 {
+		fail("kv.updateworkers must be at least 1")
+	}
+	if err := checkLockTTL(c.KV.LockTTL); err != nil {
+		fail("kv.lockttl: %v", err)
+	}
+	if c.KV.SnapshotInterval < 0 {
+		fail("kv.snapshotinterval can't be negative")
+	}
+	if c.KV.SnapshotInterval > 0 && c.KV.SnapshotDir == "" {
+		fail("kv.snapshotdir must be set when kv.snapshotinterval is set")
+	}
+	if c.KV.SnapshotRetention < 0 {
+		fail("kv.snapshotretention can't be negative")
+	}
+	if c.KV.WriteTimeout <= 0 {
+		fail("kv.writetimeout must be greater than 0")
+	}
+	if c.KV.WriteRetries < 0 {
+		fail("kv.writeretries can't be negative")
+	}
+	if c.KV.HistoryRetention < 0 {
+		fail("kv.historyretention can't be negative")
+	}
+	if c.KV.AuditRetention < 0 {
+		fail("kv.auditretention can't be negative")
+	}
+	if c.KV.MaxTreeDepth <= 0 {
+		fail("kv.maxtreedepth must be greater than 0")
+	}
+	if c.KV.SearchLimit <= 0 {
+		fail("kv.searchlimit must be greater than 0")
+	}
+	if c.KV.SearchTimeout <= 0 {
+		fail("kv.searchtimeout must be greater than 0")
+	}
+	if c.KV.ValueSearchInterval < 0 {
+		fail("kv.valuesearchinterval can't be negative")
+	}
+	for prefix, name := range c.KV.KeyPrefixes {
+		if name == "" {
+			fail("kv.keyprefixes entry '%s' must name a key", prefix)
+		}
+		if strings.HasPrefix(name, nsPrefix) {
+			fail("kv.keyprefixes entry '%s' can't name a namespace key", prefix)
+		}
+	}
+	if c.KV.UnsealThreshold != 0 || c.KV.UnsealShares != 0 {
+		if c.KV.UnsealThreshold < 1 || c.KV.UnsealThreshold > c.KV.UnsealShares || c.KV.UnsealShares > 255 {
+			fail("kv.unsealthreshold must be between 1 and kv.unsealshares, which can be at most 255")
+		}
+	}
+	if net.ParseIP(c.API.BindAddress) == nil {
+		fail("api.bindaddress '%s' must be an IP address", c.API.BindAddress)
+	}
+	for _, p := range c.API.TrustedProxies {
+		if _, err := parseTrustedProxy(p); err != nil {
+			fail("api.trustedproxies: %v", err)
+		}
+	}
+	if c.API.MaxQueries <= 0 {
+		fail("api.maxqueries must be greater than 0")
+	}
+	if c.API.QueryWorkers <= 0 {
+		fail("api.queryworkers must be greater than 0")
+	}
+	if c.Perf.BufferSize == 0 {
+		fail("performance.buffersize must be greater than 0")
+	}
+	if c.Perf.EnableHTTPLogs && c.Perf.LogBufferSize <= 0 {
+		fail("performance.logbuffersize must be greater than 0")
+	}
+	if _, ok := logLevels[c.Log.Level]; !ok {
+		fail("log.level must be one of debug, info, warn or error")
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format must be text or json")
+	}
+	if c.Log.Output == "" {
+		fail("log.output must be set")
 	}
-	c := &Config{
+	if c.Tracing.Enable && c.Tracing.Endpoint == "" {
+		fail("tracing.endpoint must be set when tracing is enabled")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sampleratio must be between 0 and 1")
+	}
+	if c.SSL.Enable {
+		fileExists("ssl.certificate", c.SSL.Certificate)
+		fileExists("ssl.key", c.SSL.Key)
+		if c.SSL.CACertificate != "" {
+			fileExists("ssl.cacertificate", c.SSL.CACertificate)
+		}
+	} else if c.SSL.CACertificate != "" {
+		fail("ssl.cacertificate needs ssl.enable to be set")
+	}
+	if !messageCodecs[c.Cluster.Compression] {
+		fail("cluster.compression must be none, gzip or snappy")
+	}
+	if c.Cluster.CompressionThreshold < 0 {
+		fail("cluster.compressionthreshold can't be negative")
+	}
+	if c.Cluster.CACertificate != "" {
+		fileExists("cluster.cacertificate", c.Cluster.CACertificate)
+		fileExists("cluster.certificate", c.Cluster.Certificate)
+		fileExists("cluster.key", c.Cluster.Key)
+	}
+	if discoveryMethods[c.Cluster.Discovery] == nil {
+		fail("cluster.discovery must be static, dns or kubernetes")
+	} else if c.Cluster.Discovery != "static" && c.Cluster.DiscoveryName == "" {
+		fail("cluster.discoveryname must be set for %s discovery", c.Cluster.Discovery)
+	}
+	if c.Mode == "prod" {
+		if c.Cluster.DiscoveryHost == "" && len(c.Cluster.Seeds) == 0 {
+			fail("cluster.discoveryhost or cluster.seeds must be set in prod mode")
+		}
+		if c.KV.UnsealThreshold == 0 {
+			fail("kv.unsealshares and kv.unsealthreshold must be set in prod mode, nodes start sealed and are unsealed with unseal shares")
+		}
+		if !c.SSL.Enable {
+			// cluster sync always runs over TLS
+			fileExists("ssl.certificate", c.SSL.Certificate)
+			fileExists("ssl.key", c.SSL.Key)
+		}
+	}
+	if c.Plugin.CallTimeout <= 0 {
+		fail("plugin.calltimeout must be greater than 0")
+	}
+	if c.API.Authentication && c.Auth.Provider == "none" {
+		fail("api.authentication can't be enabled when auth.provider is 'none'")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with the fields tagged redact
+// blanked out
+func (c *Config) Redacted() *Config {
+	cp := *c
+	redactFields(reflect.ValueOf(&cp).Elem())
+	return &cp
+}
+
+func redactFields(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			redactFields(f)
+		case f.Kind() == reflect.String && f.String() != "" && v.Type().Field(i).Tag.Get("redact") == "true":
+			f.SetString("[REDACTED]")
+		}
+	}
+}
+
+// defaultConfig returns the config a node runs with when nothing is
+// set
+func defaultConfig() *Config {
+	return &Config{
 		Mode: "dev",
 		Cluster: ClusterConfig{
-			Port:          2000,
-			Host:          "",
-			DiscoveryHost: "127.0.0.1:2000",
-			SyncPort:      1999,
+			Port:                 2000,
+			Host:                 "",
+			DiscoveryHost:        "127.0.0.1:2000",
+			SyncPort:             1999,
+			Discovery:            "static",
+			Seeds:                []string{},
+			Compression:          "none",
+			CompressionThreshold: 1024,
 		},
 		KV: KVConfig{
-			Encryption: true,
-			DBPath:     "kv.db",
+			Encryption:          true,
+			DBPath:              "kv.db",
+			DBTimeout:           30 * time.Second,
+			DBOpenRetries:       3,
+			FreelistType:        string(bbolt.FreelistMapType),
+			SnapshotInterval:    0,
+			SnapshotDir:         "snapshots/",
+			SnapshotRetention:   5,
+			HistoryRetention:    10,
+			AuditRetention:      90 * 24 * time.Hour,
+			WriteTimeout:        5 * time.Second,
+			WriteRetries:        3,
+			LockTTL:             5 * time.Minute,
+			UpdateWorkers:       1,
+			MaxTreeDepth:        100,
+			SearchLimit:         1000,
+			SearchTimeout:       5 * time.Second,
+			ValueSearch:         false,
+			ValueSearchInterval: 10 * time.Second,
 		},
 		API: APIConfig{
 			Enable:         true,
 			Port:           2001,
+			BindAddress:    "0.0.0.0",
 			Authentication: true,
 			EnableMetrics:  true,
+			MaxQueries:     1000,
+			QueryWorkers:   16,
+			SecretReaders:  []string{},
+			TrustedProxies: []string{},
+			ExposeEnv:      false,
+		},
+		GRPC: GRPCConfig{
+			Enable: false,
+			Port:   2002,
+		},
+		Redis: RedisConfig{
+			Enable: false,
+			Port:   6379,
 		},
 		UI: UIConfig{
 			Enable:         true,
-			Port:           443,
+			Port:           2001,
 			Authentication: true,
 		},
 		SSL: SSLConfig{
-			Enable:      true,
-			Certificate: "",
-			Key:         "",
+			Enable:        true,
+			Certificate:   "",
+			Key:           "",
+			CACertificate: "",
 		},
 		Perf: PerfConfig{
 			EnableMetrics:  true,
 			EnableHTTPLogs: true,
 			BufferSize:     4096,
+			LogBufferSize:  1000,
+		},
+		Log: LoggerConfig{
+			Level:  "info",
+			Format: "text",
+			Output: "stdout",
+		},
+		Tracing: TracingConfig{
+			Enable:      false,
+			Endpoint:    "http://127.0.0.1:4318/v1/traces",
+			SampleRatio: 1.0,
 		},
 		Plugin: PluginAppConfig{
 			PluginPath:    "./plugins.d/",
 			AllowUnsigned: true,
 			Blacklist:     []string{},
 			SocketPrefix:  "/tmp/",
+			CallTimeout:   30 * time.Second,
 		},
 	}
+}
+
+// readConfig builds a config from the defaults, config file,
+// environment and flags
+func readConfig() (*Config, error) {
+	id, err := machineid.ID()
+	if err != nil {
+		return &Config{}, err
+	}
+	c := defaultConfig()
 	v := viper.New()
 	v.SetConfigName("config.yaml")
 	v.SetConfigType("yaml")
@@ -77,19 +387,121 @@ func getConfig() (*Config, error) {
 	}
 	err = v.Unmarshal(&c)
 	if err != nil {
-		return c, nil
+		return c, err
 	}
 	if c.Cluster.Host == "" {
 		c.Cluster.Host = getIP("1.1.1.1:53")
 	}
-	if c.Mode != "prod" && c.Mode != "dev" {
-		os.Stderr.WriteString("'mode' must be set to either 'dev' or 'prod'; value '" + c.Mode + "' is not a valid mode.\n")
-		os.Exit(2)
-	}
-	fmt.Printf("%+v\n", c)
 	return c, nil
 }
 
+// reloadable lists the config fields that can be changed
+// without restarting the node
+var reloadable = map[string]bool{
+	"KV.CompactThreshold":    true,
+	"KV.CoalesceWindow":      true,
+	"KV.ReadBatchWindow":     true,
+	"KV.LockTTL":             true,
+	"KV.SnapshotInterval":    true,
+	"KV.SnapshotDir":         true,
+	"KV.SnapshotRetention":   true,
+	"KV.HistoryRetention":    true,
+	"KV.AuditRetention":      true,
+	"KV.WriteTimeout":        true,
+	"KV.WriteRetries":        true,
+	"KV.MaxTreeDepth":        true,
+	"KV.SearchLimit":         true,
+	"KV.SearchTimeout":       true,
+	"KV.ValueSearch":         true,
+	"KV.ValueSearchInterval": true,
+	"Log.Level":              true,
+	"Log.Format":             true,
+	"API.MaxQueries":         true,
+	"API.QueryWorkers":       true,
+	"API.SecretReaders":      true,
+	// messages say how they're encoded, so peers can differ
+	"Cluster.Compression":          true,
+	"Cluster.CompressionThreshold": true,
+}
+
+// liveConfig holds the running config. A reload publishes a new Config
+// instead of changing the one in use, so a reader sees either the old
+// config or the new one, never half of each.
+type liveConfig struct {
+	v atomic.Value
+}
+
+func newLiveConfig(c *Config) *liveConfig {
+	l := &liveConfig{}
+	l.v.Store(c)
+	return l
+}
+
+// config returns the running config. It mustn't be changed; a caller
+// that reads a field more than once and needs the same answer should
+// hold on to what it returns.
+func (l *liveConfig) config() *Config {
+	return l.v.Load().(*Config)
+}
+
+// reloadConfig re-reads the config and applies the fields that are
+// safe to change at runtime. Nothing is applied if the new config
+// can't be read.
+func (app *Cave) reloadConfig() error {
+	next, err := readConfig()
+	if err != nil {
+		return err
+	}
+	err = next.Validate()
+	if err != nil {
+		return err
+	}
+	cur := *app.config()
+	applied, restart := diffConfig(reflect.ValueOf(&cur).Elem(), reflect.ValueOf(next).Elem(), "")
+	for _, f := range restart {
+		app.Logger.WarnF(nil, "Config field %s changed but requires restart, leaving it unchanged", f)
+	}
+	for _, f := range applied {
+		app.Logger.InfoF(nil, "Config field %s reloaded", f)
+	}
+	app.liveConfig.v.Store(&cur)
+	if app.KV != nil {
+		select {
+		case app.KV.reload <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+// diffConfig copies reloadable fields from next into cur, a copy of the
+// running config, and returns the names of the fields it applied and
+// the ones that need a restart
+func diffConfig(cur reflect.Value, next reflect.Value, path string) (applied []string, restart []string) {
+	for i := 0; i < cur.NumField(); i++ {
+		name := cur.Type().Field(i).Name
+		if path != "" {
+			name = path + "." + name
+		}
+		if cur.Field(i).Kind() == reflect.Struct {
+			a, r := diffConfig(cur.Field(i), next.Field(i), name)
+			applied = append(applied, a...)
+			restart = append(restart, r...)
+			continue
+		}
+		if reflect.DeepEqual(cur.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		if reloadable[name] {
+			cur.Field(i).Set(next.Field(i))
+			applied = append(applied, name)
+			continue
+		}
+		restart = append(restart, name)
+	}
+	return applied, restart
+}
+
 func bindFlags(nodeid string) (*pflag.FlagSet, error) {
 	fs := pflag.NewFlagSet("Cave", pflag.ExitOnError)
 	fs.SortFlags = true
@@ -99,26 +511,82 @@ func bindFlags(nodeid string) (*pflag.FlagSet, error) {
 	fs.String("cluster.discoveryhost", "127.0.0.1:2000", "Host/IP to announce its presenece to")
 	fs.String("cluster.host", "", "Host/IP to advertise when connecting to the cluster")
 	fs.Uint16("cluster.syncport", 1999, "Port to send cluster sync data to")
+	fs.String("cluster.discovery", "static", "How to find seeds to join the cluster through: static, dns or kubernetes")
+	fs.StringSlice("cluster.seeds", []string{}, "Addresses of nodes to join through, alongside the discovery host")
+	fs.String("cluster.discoveryname", "", "SRV record name for dns discovery, or headless service name for kubernetes discovery")
+	fs.Bool("cluster.readonly", false, "Run as a read-only replica that refuses writes from clients")
+	fs.String("cluster.leader", "", "Address of the node that read-only replicas forward writes to")
+	fs.String("cluster.cacertificate", "", "Path to the cluster CA certificate; when set, peers must present a certificate signed by it")
+	fs.String("cluster.certificate", "", "Path to this node's cluster certificate")
+	fs.String("cluster.key", "", "Path to this node's cluster certificate private key")
+	fs.String("cluster.compression", "none", "Codec for compressing cluster messages: none, gzip or snappy")
+	fs.Int("cluster.compressionthreshold", 1024, "Smallest message data in bytes that's compressed")
 	fs.Bool("kv.encryption", true, "Enable encrypted values in the key-value store")
+	fs.Bool("kv.encryptatrest", false, "Encrypt every value at rest with the shared key, not just secrets")
 	fs.String("kv.dbpath", "kv.db", "Path to save the key-value store if disk persistance is enable")
+	fs.Duration("kv.dbtimeout", 30*time.Second, "How long to wait for the lock on the database file when opening it")
+	fs.Int("kv.dbopenretries", 3, "How many more times to try opening the database while another process has it locked")
+	fs.String("kv.freelisttype", "hashmap", "bbolt freelist type, 'hashmap' or 'array'")
+	fs.Bool("kv.nosync", false, "Skip the fsync after each write. Faster, but a crash or power loss can lose or corrupt recent writes")
+	fs.Bool("kv.nofreelistsync", false, "Don't write the freelist to disk. Faster writes, slower opens after a crash")
+	fs.Int("kv.mmapflags", 0, "Extra flags for mmapping the database, such as MAP_POPULATE (0x8000) on Linux")
+	fs.Float64("kv.compactthreshold", 0, "Compact the database when free pages make up more than this share of the file, 0 disables it")
+	fs.Duration("kv.lockttl", 5*time.Minute, "How long a lock is held when the caller doesn't give a TTL, between 1s and 24h")
+	fs.Duration("kv.readbatchwindow", 0, "Collect reads for this long and run them in one transaction, 0 disables it")
+	fs.Int("kv.updateworkers", 1, "How many updates from peers to apply at once; updates to the same key are always applied in order")
+	fs.Duration("kv.coalescewindow", 0, "Collect updates from peers for this long and apply only the last write to each key, 0 disables it")
+	fs.Duration("kv.snapshotinterval", 0, "How often to snapshot the key-value store, 0 disables snapshots")
+	fs.String("kv.snapshotdir", "snapshots/", "Directory to write key-value store snapshots to")
+	fs.Int("kv.snapshotretention", 5, "Number of snapshots to keep, 0 keeps all of them")
+	fs.Int("kv.historyretention", 10, "Number of previous versions to keep for each key, 0 disables history")
+	fs.Duration("kv.auditretention", 90*24*time.Hour, "How long audit trail entries are kept, 0 keeps them forever")
+	fs.Duration("kv.writetimeout", 5*time.Second, "How long a write waits for the database before it's retried")
+	fs.Int("kv.writeretries", 3, "Number of times a write is retried before it fails")
+	fs.Int("kv.maxtreedepth", 100, "How many buckets deep a tree read goes before the rest is truncated")
+	fs.Int("kv.searchlimit", 1000, "Most keys a key search returns")
+	fs.Duration("kv.searchtimeout", 5*time.Second, "How long a key search runs before it returns what it has found")
+	fs.Bool("kv.valuesearch", false, "Allow searching keys by value, which reads the whole key space")
+	fs.Bool("kv.namespacekeys", false, "Encrypt each namespace's secrets with its own keyring key")
+	fs.Int("kv.unsealshares", 0, "Split the key the shared key is sealed with into this many unseal shares, handed out by /api/v1/system/init. Required in prod mode")
+	fs.Int("kv.unsealthreshold", 0, "How many unseal shares it takes to unseal the shared key")
+	fs.Duration("kv.valuesearchinterval", 10*time.Second, "Least time between two value searches")
 	fs.Bool("api.enable", true, "Enable the REST API")
 	fs.Uint16("api.port", 2001, "Port for the REST API to listen on")
+	fs.String("api.bindaddress", "0.0.0.0", "IP address for the REST API to listen on, 0.0.0.0 for every interface")
 	fs.Bool("api.authentication", true, "Enable authentication on the REST API")
 	fs.Bool("api.enablemetrics", true, "Enable Prometheus metrics endpoint")
+	fs.Int("api.maxqueries", 1000, "Maximum number of operations allowed in a single multi-query request")
+	fs.Int("api.queryworkers", 16, "Number of operations from a multi-query request to run at once")
+	fs.StringSlice("api.trustedproxies", []string{}, "IPs or CIDR ranges of proxies trusted to report the client address in X-Forwarded-For or X-Real-IP")
+	fs.StringSlice("api.secretreaders", []string{}, "Token identities allowed to read secrets in plaintext, empty allows any authenticated client")
+	fs.Bool("api.exposeenv", false, "Include the environment, with secrets redacted, in the system info endpoint")
+	fs.Bool("grpc.enable", false, "Enable the gRPC server")
+	fs.Uint16("grpc.port", 2002, "Port for the gRPC server to listen on")
+	fs.Bool("redis.enable", false, "Enable the Redis protocol listener")
+	fs.Uint16("redis.port", 6379, "Port for the Redis protocol listener")
 	fs.Bool("ui.enable", true, "Enable the embedded web UI")
-	fs.Uint16("ui.port", 443, "Port for the embedded web UI to listen on")
+	fs.Uint16("ui.port", 2001, "Port for the embedded web UI to listen on, the API's port serves it from the API server")
 	fs.Bool("ui.authentication", true, "Enable authentication for the embedded web UI")
 	fs.Bool("ssl.enable", true, "Enable SSL for the REST API and embedded web UI")
 	fs.String("ssl.certificate", "", "Path to the SSL certificate to use")
 	fs.String("ssl.key", "", "Path to the SSL private key to use")
+	fs.String("ssl.cacertificate", "", "Path to a CA certificate; when set, API clients must present a certificate signed by it")
 	fs.Bool("performance.enablemetrics", true, "Enable Prometheus metrics endpoint and collection")
 	fs.Bool("performance.enablehttplogs", true, "Enable an HTTP endpoint for getting logs")
 	fs.Uint64("performance.buffersize", 4096, "Internal buffer size")
+	fs.Int("performance.logbuffersize", 1000, "Number of recent logs kept for the logs endpoint")
+	fs.String("log.level", "info", "Least severe level to log: debug, info, warn or error")
+	fs.String("log.format", "text", "Log format, text or json")
+	fs.String("log.output", "stdout", "Where to write logs: stdout, stderr or a file path")
+	fs.Bool("tracing.enable", false, "Send OpenTelemetry traces to an OTLP collector")
+	fs.String("tracing.endpoint", "http://127.0.0.1:4318/v1/traces", "OTLP/HTTP traces URL of the collector")
+	fs.Float64("tracing.sampleratio", 1.0, "Share of new traces to record, from 0 to 1")
 	fs.String("auth.provider", "token", "Authentication method selection (token, basic, none)")
 	fs.String("plugin.pluginpath", "./plugins.d/", "Path to the plugins.d directory")
 	fs.Bool("plugin.allowunsigned", true, "Allow unsigned plugins to be run")
 	fs.StringSlice("plugin.blacklist", []string{}, "Disallow certain plugins from running by plugin name")
 	fs.String("plugin.socketprefix", "/tmp/", "Prefix for creating new socket fd's")
+	fs.Duration("plugin.calltimeout", 30*time.Second, "How long to wait on a plugin API call before giving up")
 	err := fs.Parse(os.Args[1:])
 	if err != nil {
 		return fs, err
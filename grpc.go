@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GRPC serves the KV store over gRPC, as described in cave.proto
+type GRPC struct {
+	*liveConfig
+
+	app       *Cave
+	log       *Log
+	terminate chan bool
+	kv        *KV
+	server    *grpc.Server
+}
+
+// NewGRPC sets up the gRPC server
+func NewGRPC(app *Cave) (*GRPC, error) {
+	g := &GRPC{
+		app:        app,
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		terminate:  make(chan bool),
+		kv:         app.KV,
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(g.authUnary),
+		grpc.StreamInterceptor(g.authStream),
+	}
+	if g.config().SSL.Enable {
+		config, err := apiTLSConfig(g.config().SSL)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	g.server = grpc.NewServer(opts...)
+	g.server.RegisterService(&kvServiceDesc, g)
+	return g, nil
+}
+
+// Start starts the gRPC server
+func (g *GRPC) Start() {
+	go g.watch()
+	addr := fmt.Sprintf("0.0.0.0:%v", g.config().GRPC.Port)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		g.log.Error(nil, err)
+		return
+	}
+	g.log.InfoF(nil, "gRPC listening on %s", addr)
+	g.log.Error(nil, g.server.Serve(lis))
+}
+
+func (g *GRPC) watch() {
+	<-g.terminate
+	done := make(chan bool)
+	go func() {
+		g.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		// watch streams only end when their clients hang up
+		g.server.Stop()
+	}
+}
+
+// authenticate checks the bearer token in the call's metadata when
+// API authentication is on, and tags the context with the requester and
+// whether it may decrypt secrets
+func (g *GRPC) authenticate(ctx context.Context) (context.Context, error) {
+	if !g.config().API.Authentication {
+		addr := "unknown"
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		ctx = withRequester(ctx, "anonymous@"+addr)
+		return context.WithValue(ctx, decryptKey, true), nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) == 0 || !strings.HasPrefix(auth[0], "Bearer ") {
+		return ctx, status.Error(codes.Unauthenticated, "Missing bearer token")
+	}
+	tok, err := g.app.TokenStore.Find(strings.TrimPrefix(auth[0], "Bearer "))
+	if err != nil || time.Now().Before(tok.IssueTime) || time.Now().After(tok.ExpireTime) {
+		return ctx, status.Error(codes.Unauthenticated, "Invalid or expired token")
+	}
+	ctx = withRequester(ctx, tok.UID)
+	return context.WithValue(ctx, decryptKey, secretReader(g.config().API, tok.UID)), nil
+}
+
+func (g *GRPC) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *GRPC) authStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := g.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authedStream carries the authenticated context into a stream handler
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
+
+// rpcPrefix returns the top-level bucket for a namespace, or the
+// default key space when it's empty
+func rpcPrefix(namespace string) (string, error) {
+	if namespace == "" {
+		return "kv", nil
+	}
+	prefix, err := namespaceBucket(namespace)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return prefix, nil
+}
+
+// writable rejects writes to a read-only replica
+func (g *GRPC) writable() error {
+	if g.app.Cluster.ReadOnly() {
+		return status.Error(codes.Unavailable, errReadOnly.Message)
+	}
+	return nil
+}
+
+// rpcError maps KV errors onto gRPC status codes
+func rpcError(err error) error {
+	var serr *SchemaError
+	switch {
+	case errors.As(err, &serr), errors.Is(err, ErrLockTTL):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrWriteContention), errors.Is(err, ErrLockQuorum), errors.Is(err, ErrSealed), errors.Is(err, ErrNamespaceSealed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrNoNamespaceKey):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, bbolt.ErrBucketNotFound), errors.Is(err, ErrKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (g *GRPC) get(ctx context.Context, req *rpcGetRequest) (*rpcGetResponse, error) {
+	prefix, err := rpcPrefix(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if req.Secret && !mayDecrypt(ctx) {
+		return nil, status.Error(codes.PermissionDenied, errNoDecrypt.Message)
+	}
+	obj, err := g.kv.GetObjectCtx(ctx, req.Key, prefix)
+	if err != nil {
+		g.log.Error(nil, err)
+		return nil, rpcError(err)
+	}
+	if len(obj.Data) == 0 {
+		return nil, status.Error(codes.NotFound, "Key "+req.Key+" does not exist")
+	}
+	data := obj.Data
+	if req.Secret {
+		data, err = g.kv.Decrypt(obj)
+		if errors.Is(err, ErrSealed) || errors.Is(err, ErrNamespaceSealed) {
+			return nil, rpcError(err)
+		}
+		if err != nil {
+			g.log.Error(nil, err)
+			return nil, status.Error(codes.Internal, "Unable to decrypt "+req.Key+": "+err.Error())
+		}
+	}
+	res := &rpcGetResponse{
+		Value:       data,
+		Secret:      obj.Secret,
+		ContentType: blobType(obj.ContentType, data),
+		LastUpdated: obj.LastUpdated.UnixNano(),
+	}
+	for _, l := range obj.Locks {
+		res.Locks = append(res.Locks, newRPCLock(l, req.Namespace))
+	}
+	return res, nil
+}
+
+func (g *GRPC) put(ctx context.Context, req *rpcPutRequest) (*rpcPutResponse, error) {
+	if err := g.writable(); err != nil {
+		return nil, err
+	}
+	prefix, err := rpcPrefix(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	err = g.kv.PutCtx(ctx, req.Key, req.Value, prefix, req.Secret)
+	if err != nil {
+		g.log.Error(nil, err)
+		return nil, rpcError(err)
+	}
+	return &rpcPutResponse{}, nil
+}
+
+func (g *GRPC) delete(ctx context.Context, req *rpcDeleteRequest) (*rpcDeleteResponse, error) {
+	if err := g.writable(); err != nil {
+		return nil, err
+	}
+	prefix, err := rpcPrefix(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(req.Key, "/") {
+		err = g.kv.DeleteBucketCtx(ctx, req.Key, prefix)
+	} else {
+		err = g.kv.DeleteKeyCtx(ctx, req.Key, prefix)
+	}
+	if err != nil {
+		g.log.Error(nil, err)
+		return nil, rpcError(err)
+	}
+	return &rpcDeleteResponse{}, nil
+}
+
+func (g *GRPC) lock(ctx context.Context, req *rpcLockRequest) (*rpcLock, error) {
+	if err := g.writable(); err != nil {
+		return nil, err
+	}
+	prefix, err := rpcPrefix(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	// the TTL is in seconds, and one too large to convert to a
+	// duration can't be in range anyway
+	if req.TTL < 0 || req.TTL > int64(maxLockTTL/time.Second) {
+		return nil, rpcError(fmt.Errorf("%w: %ds isn't between %v and %v", ErrLockTTL, req.TTL, minLockTTL, maxLockTTL))
+	}
+	l, err := g.kv.LockTTL(req.Key, prefix, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		g.log.Error(nil, err)
+		return nil, rpcError(err)
+	}
+	return newRPCLock(l, req.Namespace), nil
+}
+
+// watchKeys streams the changes under the requested path until the
+// client hangs up or the server stops
+func (g *GRPC) watchKeys(req *rpcWatchRequest, stream grpc.ServerStream) error {
+	prefix, err := rpcPrefix(req.Namespace)
+	if err != nil {
+		return err
+	}
+	updates, stop := g.kv.Watch(req.Key, prefix)
+	defer stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case kvu := <-updates:
+			err := stream.SendMsg(&rpcUpdate{
+				UpdateType:  kvu.UpdateType,
+				Key:         kvu.Key,
+				Namespace:   req.Namespace,
+				Value:       kvu.Value.Data,
+				Secret:      kvu.Value.Secret,
+				ContentType: kvu.Value.ContentType,
+				LastUpdated: kvu.Value.LastUpdated.UnixNano(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// kvServiceDesc registers the cave.v1.KV service. It takes the place
+// of protoc-generated code, so it has to match cave.proto.
+var kvServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cave.v1.KV",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Get", Handler: kvGetRPC},
+		{MethodName: "Put", Handler: kvPutRPC},
+		{MethodName: "Delete", Handler: kvDeleteRPC},
+		{MethodName: "Lock", Handler: kvLockRPC},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Watch", Handler: kvWatchRPC, ServerStreams: true},
+	},
+	Metadata: "cave.proto",
+}
+
+// unaryRPC decodes a call's request into req and runs fn on it
+// through the server's interceptor
+func unaryRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor, method string, req interface{}, fn grpc.UnaryHandler) (interface{}, error) {
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return fn(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/cave.v1.KV/" + method}
+	return interceptor(ctx, req, info, fn)
+}
+
+func kvGetRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return unaryRPC(srv, ctx, dec, interceptor, "Get", new(rpcGetRequest), func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*GRPC).get(ctx, req.(*rpcGetRequest))
+	})
+}
+
+func kvPutRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return unaryRPC(srv, ctx, dec, interceptor, "Put", new(rpcPutRequest), func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*GRPC).put(ctx, req.(*rpcPutRequest))
+	})
+}
+
+func kvDeleteRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return unaryRPC(srv, ctx, dec, interceptor, "Delete", new(rpcDeleteRequest), func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*GRPC).delete(ctx, req.(*rpcDeleteRequest))
+	})
+}
+
+func kvLockRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return unaryRPC(srv, ctx, dec, interceptor, "Lock", new(rpcLockRequest), func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*GRPC).lock(ctx, req.(*rpcLockRequest))
+	})
+}
+
+func kvWatchRPC(srv interface{}, stream grpc.ServerStream) error {
+	req := new(rpcWatchRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(*GRPC).watchKeys(req, stream)
+}
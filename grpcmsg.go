@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The gRPC messages from cave.proto. They're kept by hand rather than
+// generated, and the protobuf runtime encodes them from the struct
+// tags, so the field numbers here have to match the .proto file.
+
+type rpcGetRequest struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Secret    bool   `protobuf:"varint,3,opt,name=secret,proto3" json:"secret,omitempty"`
+}
+
+type rpcGetResponse struct {
+	Value       []byte     `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Secret      bool       `protobuf:"varint,2,opt,name=secret,proto3" json:"secret,omitempty"`
+	ContentType string     `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	LastUpdated int64      `protobuf:"varint,4,opt,name=last_updated,json=lastUpdated,proto3" json:"last_updated,omitempty"`
+	Locks       []*rpcLock `protobuf:"bytes,5,rep,name=locks,proto3" json:"locks,omitempty"`
+}
+
+type rpcPutRequest struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Value     []byte `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	Secret    bool   `protobuf:"varint,4,opt,name=secret,proto3" json:"secret,omitempty"`
+}
+
+type rpcPutResponse struct{}
+
+type rpcDeleteRequest struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+}
+
+type rpcDeleteResponse struct{}
+
+type rpcWatchRequest struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+}
+
+type rpcUpdate struct {
+	UpdateType  string `protobuf:"bytes,1,opt,name=update_type,json=updateType,proto3" json:"update_type,omitempty"`
+	Key         string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace   string `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Value       []byte `protobuf:"bytes,4,opt,name=value,proto3" json:"value,omitempty"`
+	Secret      bool   `protobuf:"varint,5,opt,name=secret,proto3" json:"secret,omitempty"`
+	ContentType string `protobuf:"bytes,6,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	LastUpdated int64  `protobuf:"varint,7,opt,name=last_updated,json=lastUpdated,proto3" json:"last_updated,omitempty"`
+}
+
+type rpcLockRequest struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	TTL       int64  `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+}
+
+type rpcLock struct {
+	Key         string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Namespace   string `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	LockID      string `protobuf:"bytes,3,opt,name=lock_id,json=lockId,proto3" json:"lock_id,omitempty"`
+	NodeID      string `protobuf:"bytes,4,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	NodeAddress string `protobuf:"bytes,5,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	ClaimTime   int64  `protobuf:"varint,6,opt,name=claim_time,json=claimTime,proto3" json:"claim_time,omitempty"`
+	ExpireTime  int64  `protobuf:"varint,7,opt,name=expire_time,json=expireTime,proto3" json:"expire_time,omitempty"`
+}
+
+func (m *rpcGetRequest) Reset()         { *m = rpcGetRequest{} }
+func (m *rpcGetRequest) String() string { return proto.CompactTextString(m) }
+func (*rpcGetRequest) ProtoMessage()    {}
+
+func (m *rpcGetResponse) Reset()         { *m = rpcGetResponse{} }
+func (m *rpcGetResponse) String() string { return proto.CompactTextString(m) }
+func (*rpcGetResponse) ProtoMessage()    {}
+
+func (m *rpcPutRequest) Reset()         { *m = rpcPutRequest{} }
+func (m *rpcPutRequest) String() string { return proto.CompactTextString(m) }
+func (*rpcPutRequest) ProtoMessage()    {}
+
+func (m *rpcPutResponse) Reset()         { *m = rpcPutResponse{} }
+func (m *rpcPutResponse) String() string { return proto.CompactTextString(m) }
+func (*rpcPutResponse) ProtoMessage()    {}
+
+func (m *rpcDeleteRequest) Reset()         { *m = rpcDeleteRequest{} }
+func (m *rpcDeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*rpcDeleteRequest) ProtoMessage()    {}
+
+func (m *rpcDeleteResponse) Reset()         { *m = rpcDeleteResponse{} }
+func (m *rpcDeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*rpcDeleteResponse) ProtoMessage()    {}
+
+func (m *rpcWatchRequest) Reset()         { *m = rpcWatchRequest{} }
+func (m *rpcWatchRequest) String() string { return proto.CompactTextString(m) }
+func (*rpcWatchRequest) ProtoMessage()    {}
+
+func (m *rpcUpdate) Reset()         { *m = rpcUpdate{} }
+func (m *rpcUpdate) String() string { return proto.CompactTextString(m) }
+func (*rpcUpdate) ProtoMessage()    {}
+
+func (m *rpcLockRequest) Reset()         { *m = rpcLockRequest{} }
+func (m *rpcLockRequest) String() string { return proto.CompactTextString(m) }
+func (*rpcLockRequest) ProtoMessage()    {}
+
+func (m *rpcLock) Reset()         { *m = rpcLock{} }
+func (m *rpcLock) String() string { return proto.CompactTextString(m) }
+func (*rpcLock) ProtoMessage()    {}
+
+// newRPCLock converts a Lock for the wire
+func newRPCLock(l Lock, namespace string) *rpcLock {
+	return &rpcLock{
+		Key:         l.Key,
+		Namespace:   namespace,
+		LockID:      l.LockID,
+		NodeID:      l.NodeID,
+		NodeAddress: l.NodeAddress,
+		ClaimTime:   l.ClaimTime.UnixNano(),
+		ExpireTime:  l.ExpireTime.UnixNano(),
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ErrVersionNotFound is returned when rolling back to a version that
+// isn't in a key's history
+var ErrVersionNotFound = errors.New("Version not found in key history")
+
+// historyBucket returns the bucket holding the old versions of key,
+// keyed by the time each version was written
+func historyBucket(tx *bbolt.Tx, prefix string, key string, create bool) (*bbolt.Bucket, error) {
+	name := []byte(prefix + "/" + key)
+	if !create {
+		root := tx.Bucket([]byte("_history"))
+		if root == nil {
+			return nil, nil
+		}
+		return root.Bucket(name), nil
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte("_history"))
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists(name)
+}
+
+func versionID(t time.Time) []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(t.UnixNano()))
+	return id
+}
+
+// recordHistory saves prev, the value being overwritten at key, as a
+// version of the key and drops the oldest versions past the retention
+// count. Writes that don't change the value, like taking a lock, are
+// not recorded.
+func (kv *KV) recordHistory(tx *bbolt.Tx, prefix string, key string, prev []byte, next KVObject) error {
+	retention := kv.config().KV.HistoryRetention
+	if retention <= 0 || prev == nil {
+		return nil
+	}
+	old := KVObject{}
+	err := json.Unmarshal(prev, &old)
+	if err != nil {
+		return err
+	}
+	// sealed values are compared as plaintext, since sealing the same
+	// value twice never gives the same bytes
+	old, err = kv.unseal(old)
+	if err != nil {
+		return err
+	}
+	next, err = kv.unseal(next)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(old.Data, next.Data) {
+		return nil
+	}
+	b, err := historyBucket(tx, prefix, key, true)
+	if err != nil {
+		return err
+	}
+	err = b.Put(versionID(old.LastUpdated), prev)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	extra := -retention
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		extra++
+	}
+	for k, _ := c.First(); k != nil && extra > 0; k, _ = c.First() {
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+		extra--
+	}
+	return nil
+}
+
+// GetHistory returns the saved versions of key, oldest first
+func (kv *KV) GetHistory(key string, prefix string) ([]KVObject, error) {
+	start := time.Now()
+	defer kv.doMetrics("get:history", start)
+	versions := []KVObject{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b, err := historyBucket(tx, prefix, key, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			obj := KVObject{}
+			err := json.Unmarshal(v, &obj)
+			if err != nil {
+				return err
+			}
+			obj, err = kv.unseal(obj)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, obj)
+			return nil
+		})
+	})
+	return versions, err
+}
+
+// Rollback restores key to the version written at the given time. The
+// current value is saved to the history like any other overwrite.
+func (kv *KV) Rollback(key string, prefix string, version time.Time) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("rollback", start)
+	defer func() { kv.countError("rollback", err) }()
+	obj := KVObject{}
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		b, err := historyBucket(tx, prefix, key, false)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return ErrVersionNotFound
+		}
+		v := b.Get(versionID(version))
+		if v == nil {
+			return ErrVersionNotFound
+		}
+		return json.Unmarshal(v, &obj)
+	})
+	if err != nil {
+		return err
+	}
+	obj, err = kv.unseal(obj)
+	if err != nil {
+		return err
+	}
+	obj.LastUpdated = time.Now()
+	obj.Locks = []Lock{}
+	return kv.PutObjectCtx(context.Background(), key, obj, prefix, obj.Secret)
+}
+
+// rotateHistory re-encrypts the secrets kept in key histories with
+// shared, the current shared key, to next, so old versions can still
+// be rolled back to after a key rotation
+func (kv *KV) rotateHistory(shared *AESKey, next *AESKey) error {
+	return kv.db.Update(func(tx *bbolt.Tx) error {
+		root := tx.Bucket([]byte("_history"))
+		if root == nil {
+			return nil
+		}
+		return root.ForEach(func(name, _ []byte) error {
+			b := root.Bucket(name)
+			if b == nil {
+				return nil
+			}
+			rotated := map[string][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				obj := KVObject{}
+				err := json.Unmarshal(v, &obj)
+				if err != nil || !(obj.Secret || obj.Sealed) || obj.KeyName != "" {
+					return nil
+				}
+				data, err := decryptJSON(shared, obj.Data)
+				if err != nil {
+					// already rotated, or from before an older rotation
+					return nil
+				}
+				obj.Data, err = encrytJSON(next, data)
+				if err != nil {
+					return err
+				}
+				bobj, err := json.Marshal(obj)
+				if err != nil {
+					return err
+				}
+				rotated[string(k)] = bobj
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range rotated {
+				err = b.Put([]byte(k), v)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
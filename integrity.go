@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// checkDB makes sure the kv and _system buckets can be read, when
+// they're there, scanning their top level with a cursor. A file that
+// doesn't have them yet, like one from an older version or a node that
+// stopped before its first write, is fine since they're created on
+// open. bbolt panics on some corrupt pages, so that's reported as
+// corruption too.
+func checkDB(db *bbolt.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrDatabaseCorrupt, r)
+		}
+	}()
+	return db.View(func(tx *bbolt.Tx) error {
+		for _, name := range []string{"kv", "_system"} {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			}
+		}
+		return nil
+	})
+}
+
+// openChecked opens the database at path and checks it. When it's
+// corrupt and snapshots are turned on, the file is moved aside and
+// replaced with the newest snapshot that passes the same checks.
+func openChecked(path string, options *bbolt.Options, c *Config, log *Log) (*bbolt.DB, error) {
+	f, err := os.Stat(path)
+	existed := err == nil && f.Size() > 0
+	db, err := dbOpen(path, options, c.KV.DBOpenRetries, log)
+	if err == nil && existed {
+		err = checkDB(db)
+		if err != nil {
+			dbClose(db)
+		}
+	}
+	if err == nil || !existed || !errors.Is(err, ErrDatabaseCorrupt) {
+		return db, err
+	}
+	log.ErrorF(nil, "Database %s is corrupt: %v", path, err)
+	if c.KV.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("%w, and snapshots are turned off so there's none to fall back to", err)
+	}
+	snap, serr := latestGoodSnapshot(c.KV.SnapshotDir)
+	if serr != nil {
+		return nil, fmt.Errorf("%w, and no snapshot could be used: %v", err, serr)
+	}
+	aside := fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	serr = os.Rename(path, aside)
+	if serr != nil {
+		return nil, serr
+	}
+	serr = copyFile(snap, path)
+	if serr != nil {
+		return nil, serr
+	}
+	log.WarnF(nil, "Restored database %s from snapshot %s, the corrupt file was kept as %s", path, snap, aside)
+	return dbOpen(path, options, c.KV.DBOpenRetries, log)
+}
+
+// latestGoodSnapshot returns the newest snapshot in dir that opens and
+// passes checkDB
+func latestGoodSnapshot(dir string) (string, error) {
+	snaps, err := listSnapshots(dir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		db, err := bbolt.Open(snaps[i], 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+		if err != nil {
+			continue
+		}
+		err = checkDB(db)
+		db.Close()
+		if err == nil {
+			return snaps[i], nil
+		}
+	}
+	return "", fmt.Errorf("no usable snapshots in %s", dir)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// knownPeerTTL is how long a peer is remembered after it last answered
+// a ping
+const knownPeerTTL = 24 * time.Hour
+
+// knownPeersKey is where the peers a node has seen are kept in the
+// _system bucket, as a map of address to when each last answered
+var knownPeersKey = []byte("peers")
+
+// loadKnownPeers reads the peers this node saw before it restarted, so
+// it can rejoin through them when the discovery host is down. The KV
+// store isn't open yet when the cluster starts, so the file is opened
+// read-only just long enough to read them.
+func (c *Cluster) loadKnownPeers() map[string]time.Time {
+	known := map[string]time.Time{}
+	path := dbFile(c.config())
+	if inMemory(c.config()) {
+		return known
+	}
+	if _, err := os.Stat(path); err != nil {
+		return known
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		c.log.Error(nil, err)
+		return known
+	}
+	defer db.Close()
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system"))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(knownPeersKey)
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &known)
+	})
+	if err != nil {
+		c.log.Error(nil, err)
+	}
+	return freshPeers(known, c.advertiseHost)
+}
+
+// freshPeers drops self and the peers that haven't answered within
+// knownPeerTTL from known
+func freshPeers(known map[string]time.Time, self string) map[string]time.Time {
+	for addr, seen := range known {
+		if addr == self || time.Since(seen) > knownPeerTTL {
+			delete(known, addr)
+		}
+	}
+	return known
+}
+
+// rejoinKnownPeer pings the peers from before a restart and returns the
+// address of the first one that answers, or "" if none do
+func (c *Cluster) rejoinKnownPeer(known map[string]time.Time) string {
+	addrs := []string{}
+	for addr := range known {
+		addrs = append(addrs, addr)
+	}
+	return c.firstAnswer(addrs)
+}
+
+// saveKnownPeers records the peers that answered the last round of
+// pings, keeping the others until they age out
+func (c *Cluster) saveKnownPeers(alive []node) {
+	if !c.app.KVInit || inMemory(c.config()) {
+		return
+	}
+	now := time.Now()
+	err := c.app.KV.update(context.Background(), "peers", func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system"))
+		known := map[string]time.Time{}
+		if v := b.Get(knownPeersKey); v != nil {
+			// a value that can't be read is started over
+			_ = json.Unmarshal(v, &known)
+		}
+		for _, p := range alive {
+			known[p.Address] = now
+		}
+		data, err := json.Marshal(freshPeers(known, c.advertiseHost))
+		if err != nil {
+			return err
+		}
+		return b.Put(knownPeersKey, data)
+	})
+	if err != nil {
+		c.log.Error(nil, err)
+	}
+}
@@ -1,35 +1,110 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/denisbrodbeck/machineid"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // KV type
 type KV struct {
+	// generation, modified and lockCount are updated atomically and
+	// kept first so they stay 64-bit aligned
+	generation uint64
+	modified   int64
+	// lockCount is the number of unexpired locks as of the last count
+	lockCount int64
+
+	*liveConfig
+
 	app       *Cave
 	terminate chan bool
-	config    *Config
 	events    chan Message
 	updates   chan Message
 	sync      chan Message
-	db        *bbolt.DB
+	db        *kvDB
 	dbPath    string
 	log       *Log
 	options   *bbolt.Options
 	crypto    *Crypto
+	// the shared key, nil while sealed, and the key a rotation in
+	// progress is moving to. Read them with keys().
 	sharedkey *AESKey
+	nextkey   *AESKey
+	keyLock   sync.RWMutex
+	rotating  sync.Mutex
 	metrics   map[string]interface{}
+	reload    chan bool
+	writer    chan bool
 	Service   interface{}
+
+	// compiled value schemas by path prefix
+	schemas    map[string]compiledSchema
+	schemaLock sync.Mutex
+
+	// lock proposals this node has voted for, by prefix and key
+	proposals    map[string]proposal
+	proposalLock sync.Mutex
+
+	// the update epochs accepted from each peer
+	epochs    map[string]*epochWindow
+	epochLock sync.Mutex
+
+	// subscribers to key changes
+	watchers  map[*watcher]struct{}
+	watchLock sync.RWMutex
+
+	// secret reads waiting to be added to the audit trail
+	auditQueue []auditJob
+	auditing   bool
+	auditLock  sync.Mutex
+
+	// when the last value search started
+	lastValueSearch time.Time
+	valueSearchLock sync.Mutex
+
+	// keyspaces with their own label on the keyspace op counter
+	keyspaces    map[string]bool
+	keyspaceLock sync.Mutex
+
+	// signals the outbox that events were queued
+	outboxReady chan bool
+	// how far each peer has got through the outbox, the last index
+	// sent to any peer and the last one deleted
+	outboxPeers   map[string]*outboxPeer
+	outboxHead    uint64
+	outboxDeleted uint64
+	outboxLock    sync.Mutex
+	// signals that locks were taken or released
+	locksChanged chan bool
+	// how far this node has applied each peer's writes
+	applied *appliedIndexes
+	// reads waiting to share a transaction
+	readBatch *readBatch
+	readLock  sync.Mutex
+	readers   int32
 }
 
 // KVUpdate type
@@ -37,6 +112,13 @@ type KVUpdate struct {
 	UpdateType string   `json:"update_type"`
 	Key        string   `json:"key"`
 	Value      KVObject `json:"value"`
+	Prefix     string   `json:"prefix,omitempty"`
+	// Index is the sending node's write index for puts and deletes,
+	// which peers track for read-your-writes. Previous is the index of
+	// the update the sender sent this peer before it, so the peer can
+	// tell when one went missing.
+	Index    uint64 `json:"index,omitempty"`
+	Previous uint64 `json:"previous,omitempty"`
 }
 
 ////////////////////////// IMPLEMENT ///////////////////////
@@ -47,7 +129,17 @@ type KVObject struct {
 	Secret      bool      `json:"secret"`
 	Data        []byte    `json:"data"`
 	Locks       []Lock    `json:"locks"`
-	Plaintext   bool      `json:"plaintext;omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	KeyName     string    `json:"key_name,omitempty"`
+	// Sealed marks a value that isn't a secret but is encrypted at rest
+	// with the shared key
+	Sealed bool `json:"sealed,omitempty"`
+	// ExpiresAt is when a value written with a TTL stops being
+	// readable and is deleted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// TTL is how long the value lives after it's written or
+	// heartbeated
+	TTL time.Duration `json:"ttl,omitempty"`
 }
 
 // Lock object
@@ -65,26 +157,41 @@ type Lock struct {
 
 func newKV(app *Cave) (*KV, error) {
 	kv := &KV{
-		app:       app,
-		terminate: make(chan bool),
-		config:    app.Config,
-		updates:   app.updates,
-		log:       app.Logger,
-		dbPath:    app.Config.KV.DBPath,
-		crypto:    app.Crypto,
-		metrics:   kvmetrics(),
+		app:        app,
+		terminate:  make(chan bool),
+		liveConfig: app.liveConfig,
+		updates:    app.updates,
+		log:        app.Logger,
+		dbPath:     dbFile(app.config()),
+		crypto:     app.Crypto,
+		metrics:    kvmetrics(app.config().API.EnableMetrics),
+		reload:     make(chan bool, 1),
+		writer:     make(chan bool, 1),
+		schemas:    map[string]compiledSchema{},
+		proposals:  map[string]proposal{},
+		epochs:     map[string]*epochWindow{},
+		watchers:   map[*watcher]struct{}{},
+		keyspaces:  map[string]bool{},
+
+		outboxReady:  make(chan bool, 1),
+		outboxPeers:  map[string]*outboxPeer{},
+		locksChanged: make(chan bool, 1),
+		applied:      newAppliedIndexes(),
 	}
+	// start from the clock so generations don't repeat across restarts
+	kv.generation = uint64(time.Now().UnixNano())
+	kv.modified = time.Now().UnixNano()
 	start := time.Now()
 	defer kv.doMetrics("startup", start)
-	kv.options = &bbolt.Options{
-		Timeout:      30 * time.Second,
-		FreelistType: "hashmap",
+	kv.options = dbOptions(kv.config())
+	if inMemory(kv.config()) {
+		os.Remove(kv.dbPath)
 	}
-	db, err := dbOpen(kv.dbPath, kv.options)
+	db, err := openChecked(kv.dbPath, kv.options, kv.config(), kv.log)
 	if err != nil {
 		return kv, err
 	}
-	kv.db = db
+	kv.db = &kvDB{db: db}
 	kv.db.Update(func(tx *bbolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("kv"))
 		if err != nil {
@@ -94,58 +201,211 @@ func newKV(app *Cave) (*KV, error) {
 		if err != nil {
 			return err
 		}
-		return nil
+		return indexAudit(tx)
 	})
-	key, err := kv.crypto.UnsealSharedKey(kv.crypto.privkey)
-	if err != nil {
+	if kv.crypto.threshold > 0 {
+		init, err := kv.unsealInit()
+		if err != nil {
+			return kv, err
+		}
+		// a key that doesn't open with the machine ID was sealed with
+		// shares handed out by a peer before this node joined
+		_, err = kv.crypto.unsealKey(sharedKeyPath, kv.crypto.privkey)
+		kv.crypto.initialised = init != nil || (err != nil && !os.IsNotExist(err))
+	}
+	// only dev mode nodes start unsealed
+	kv.crypto.sealed = kv.config().Mode != "dev"
+	key, err := kv.crypto.UnsealSharedKey()
+	if err == ErrSealed && kv.crypto.initialised {
+		kv.log.WarnF(nil, "The shared key is sealed, %d unseal shares have to be given to /api/v1/system/unseal before secrets can be used", kv.crypto.threshold)
+	} else if err == ErrSealed {
+		kv.log.Warn(nil, "The shared key is sealed and no unseal shares have been handed out yet, get them from /api/v1/system/init")
+	} else if err != nil {
 		return kv, err
 	}
 	kv.sharedkey = key
+	next, err := kv.crypto.unsealKey(pendingKeyPath, kv.crypto.sealingKey())
+	if key != nil && err == nil {
+		kv.log.Warn(nil, "A shared key rotation was interrupted, run it again to finish")
+		kv.nextkey = next
+	}
 	return kv, nil
 }
 
-func kvmetrics() map[string]interface{} {
+// ErrUnknownKey is returned when a secret names a key that isn't in the keyring
+var ErrUnknownKey = errors.New("Encryption key is not in the keyring")
+
+// ErrInvalidBackup is returned when an uploaded backup can't be restored
+var ErrInvalidBackup = errors.New("Invalid backup file")
+
+// ErrWriteContention is returned when a write couldn't get the database
+// after every retry
+var ErrWriteContention = errors.New("Database is too busy to accept the write, try again later")
+
+// ErrBadSignature is returned for cluster messages that weren't signed
+// with the shared key
+var ErrBadSignature = errors.New("Dropped a cluster message with a missing or invalid signature")
+
+// ErrReplayedMessage is returned for updates from a peer that aren't
+// newer than the last one accepted from it
+var ErrReplayedMessage = errors.New("Dropped a duplicate or replayed cluster message")
+
+// ErrDatabaseLocked is returned when the database file stayed locked
+// by another process. It's safe to wait for that process to exit.
+var ErrDatabaseLocked = errors.New("Database file is locked by another process")
+
+// ErrDatabaseCorrupt is returned when the database file can't be read
+// as a bbolt database. It has to be restored from a snapshot or backup.
+var ErrDatabaseCorrupt = errors.New("Database file is corrupt or not a bbolt database")
+
+// ErrUnknownLock is returned when a key doesn't hold the given lock
+var ErrUnknownLock = errors.New("Lock is not held on the key")
+
+// ErrLockTTL is returned for a lock TTL outside of minLockTTL and
+// maxLockTTL
+var ErrLockTTL = errors.New("Lock TTL is out of range")
+
+const (
+	minLockTTL = time.Second
+	maxLockTTL = 24 * time.Hour
+)
+
+// checkLockTTL makes sure a lock TTL is within bounds
+func checkLockTTL(ttl time.Duration) error {
+	if ttl < minLockTTL || ttl > maxLockTTL {
+		return fmt.Errorf("%w: %v isn't between %v and %v", ErrLockTTL, ttl, minLockTTL, maxLockTTL)
+	}
+	return nil
+}
+
+// kvmetrics makes the KV metrics, only registering them to be scraped
+// when metrics are enabled
+func kvmetrics(enabled bool) map[string]interface{} {
+	f := promauto.With(nil)
+	if enabled {
+		f = promauto.With(prometheus.DefaultRegisterer)
+	}
 	return map[string]interface{}{
-		"pagefree": promauto.NewGauge(prometheus.GaugeOpts{
+		"pagefree": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_freelist_pages_free",
 			Help: "Total number of free pages on the freelist",
 		}),
-		"pagepending": promauto.NewGauge(prometheus.GaugeOpts{
+		"pagepending": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_freelist_pages_pending",
 			Help: "Total number of pending pages on the freelist",
 		}),
-		"pagealloc": promauto.NewGauge(prometheus.GaugeOpts{
+		"pagealloc": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_freelist_bytes_total",
 			Help: "Total bytes allocted in free pages",
 		}),
-		"pageuse": promauto.NewGauge(prometheus.GaugeOpts{
+		"pageuse": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_freelist_bytes_used",
 			Help: "Total bytes used in the freelist",
 		}),
-		"tx_tot": promauto.NewGauge(prometheus.GaugeOpts{
+		"tx_tot": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_tx_count",
 			Help: "Total number of started read transactions",
 		}),
-		"tx_open": promauto.NewGauge(prometheus.GaugeOpts{
+		"tx_open": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_db_tx_open",
 			Help: "Number of currently open read transactions",
 		}),
-		"transaction_time": promauto.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "cave_kv_transaction_time_ms",
-			Help: "Duration of transactions by type",
+		"transaction_time": f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cave_kv_transaction_time_ms",
+			Help:    "Duration of transactions by type in ms (histogram; previously a gauge of the last duration)",
+			Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
 		}, []string{"type"}),
-		"dbsize": promauto.NewGauge(prometheus.GaugeOpts{
+		"dbsize": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_size_bytes",
 			Help: "Size in bytes of the database on disk",
 		}),
-		"kv_q": promauto.NewGauge(prometheus.GaugeOpts{
+		"kv_q": f.NewGauge(prometheus.GaugeOpts{
 			Name: "cave_kv_update_queue_size",
 			Help: "Length of the KV update queue",
 		}),
+		"kv_q_saturation": f.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_kv_update_queue_saturation_ratio",
+			Help: "How full the KV update queue is, from 0 to 1",
+		}),
+		"compactions": f.NewCounter(prometheus.CounterOpts{
+			Name: "cave_kv_compactions_total",
+			Help: "Number of times the database was compacted",
+		}),
+		"keyspace_ops": f.NewCounterVec(prometheus.CounterOpts{
+			Name: "cave_kv_keyspace_ops_total",
+			Help: "Number of key gets, puts and deletes by the first segment of the key, or namespace",
+		}, []string{"op", "keyspace"}),
+		"outbox": f.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_kv_outbox_backlog",
+			Help: "Number of updates waiting to be sent to every peer",
+		}),
+		"updates_coalesced": f.NewCounter(prometheus.CounterOpts{
+			Name: "cave_kv_updates_coalesced_total",
+			Help: "Number of updates from peers skipped because a later update replaced them",
+		}),
+		"write_retries": f.NewCounterVec(prometheus.CounterOpts{
+			Name: "cave_kv_write_retries_total",
+			Help: "Number of times a write was retried because the database was busy or unavailable",
+		}, []string{"type"}),
+		"locks_active": f.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_kv_locks_active",
+			Help: "Number of locks currently held by this node",
+		}),
+		"lock_acquisitions": f.NewCounterVec(prometheus.CounterOpts{
+			Name: "cave_kv_lock_acquisitions_total",
+			Help: "Number of lock attempts by result (success or failure)",
+		}, []string{"result"}),
+		"read_batch_size": f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cave_kv_read_batch_size",
+			Help:    "Number of reads that shared a transaction when read batching is on",
+			Buckets: []float64{1, 2, 4, 8, 16, 32, 64, 128},
+		}),
+		"lock_wait": f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cave_kv_lock_wait_seconds",
+			Help:    "Time taken to acquire a lock in seconds",
+			Buckets: prometheus.DefBuckets,
+		}),
+		"watch_dropped": f.NewCounter(prometheus.CounterOpts{
+			Name: "cave_kv_watch_updates_dropped_total",
+			Help: "Number of key updates dropped because a watcher fell behind",
+		}),
+		"messages_rejected": f.NewCounterVec(prometheus.CounterOpts{
+			Name: "cave_kv_messages_rejected_total",
+			Help: "Number of cluster messages dropped for a bad signature or a replayed epoch, by type",
+		}, []string{"type"}),
+		"op_errors": f.NewCounterVec(prometheus.CounterOpts{
+			Name: "cave_kv_operation_errors_total",
+			Help: "Number of failed KV operations by type",
+		}, []string{"type"}),
+		"snapshot_time": f.NewGauge(prometheus.GaugeOpts{
+			Name: "cave_kv_snapshot_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful scheduled snapshot",
+		}),
+	}
+}
+
+// dbOptions returns the bbolt options set in the config
+func dbOptions(c *Config) *bbolt.Options {
+	options := &bbolt.Options{
+		Timeout:        c.KV.DBTimeout,
+		FreelistType:   bbolt.FreelistType(c.KV.FreelistType),
+		NoSync:         c.KV.NoSync,
+		NoFreelistSync: c.KV.NoFreelistSync,
+		MmapFlags:      c.KV.MmapFlags,
 	}
+	if inMemory(c) {
+		// nothing survives a restart, so skip the fsyncs
+		options.NoSync = true
+		options.NoFreelistSync = true
+	}
+	return options
 }
 
-func dbOpen(path string, options *bbolt.Options) (*bbolt.DB, error) {
+// dbOpen opens the database at path. Timing out on the file lock
+// usually means another process, like the node being replaced in a
+// rolling restart, still has it open, so that's retried with backoff
+// up to retries more times.
+func dbOpen(path string, options *bbolt.Options, retries int, log *Log) (*bbolt.DB, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		p := strings.Split(path, "/")
 		if len(p) > 1 {
@@ -157,11 +417,23 @@ func dbOpen(path string, options *bbolt.Options) (*bbolt.DB, error) {
 			}
 		}
 	}
-	db, err := bbolt.Open(path, 0755, options)
-	if err != nil {
-		return db, err
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		db, err := bbolt.Open(path, 0755, options)
+		switch {
+		case err == nil:
+			return db, nil
+		case err == bbolt.ErrInvalid, err == bbolt.ErrVersionMismatch, err == bbolt.ErrChecksum:
+			return nil, fmt.Errorf("%w: %s: %v", ErrDatabaseCorrupt, path, err)
+		case err != bbolt.ErrTimeout:
+			return nil, err
+		case attempt >= retries:
+			return nil, fmt.Errorf("%w: %s is still locked after %d attempts", ErrDatabaseLocked, path, attempt+1)
+		}
+		log.WarnF(nil, "Database %s is locked by another process, retrying in %s (attempt %d of %d)", path, backoff, attempt+1, retries+1)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	return db, nil
 }
 
 func dbClose(db *bbolt.DB) error {
@@ -172,65 +444,439 @@ func dbClose(db *bbolt.DB) error {
 	return nil
 }
 
+// kvDB is the open database behind a lock, so it can be swapped for a
+// restored, compacted or synced copy while requests are using it.
+// Transactions hold the read lock, so one mustn't be started from
+// inside another or it can deadlock behind a waiting swap.
+type kvDB struct {
+	lock sync.RWMutex
+	db   *bbolt.DB
+}
+
+// View runs fn in a read-only transaction
+func (d *kvDB) View(fn func(*bbolt.Tx) error) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.db.View(fn)
+}
+
+// Update runs fn in a read-write transaction
+func (d *kvDB) Update(fn func(*bbolt.Tx) error) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.db.Update(fn)
+}
+
+// Stats returns the database's statistics
+func (d *kvDB) Stats() bbolt.Stats {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.db.Stats()
+}
+
+// Info returns the database's page size and mmap address
+func (d *kvDB) Info() *bbolt.Info {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.db.Info()
+}
+
+// Close closes the database
+func (d *kvDB) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return dbClose(d.db)
+}
+
+// swapDB replaces the database with the file at src. Requests wait
+// while the files are swapped. The outbox keeps counting from where it
+// was, so a file from a peer or a backup doesn't reuse write indexes.
+// The old file is kept until the new one has opened, and put back and
+// reopened if it doesn't, so a failed swap leaves the node on the
+// database it had.
+func (kv *KV) swapDB(src string) error {
+	d := kv.db
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seq, err := outboxSequence(d.db)
+	if err != nil {
+		return err
+	}
+	err = dbClose(d.db)
+	if err != nil {
+		return err
+	}
+	old := kv.dbPath + ".old"
+	err = os.Rename(kv.dbPath, old)
+	if err != nil {
+		return kv.reopenDB(err)
+	}
+	err = os.Rename(src, kv.dbPath)
+	if err != nil {
+		os.Rename(old, kv.dbPath)
+		return kv.reopenDB(err)
+	}
+	db, err := dbOpen(kv.dbPath, kv.options, kv.config().KV.DBOpenRetries, kv.log)
+	if err == nil {
+		err = keepOutboxSequence(db, seq)
+		if err != nil {
+			dbClose(db)
+		}
+	}
+	if err != nil {
+		os.Rename(old, kv.dbPath)
+		return kv.reopenDB(err)
+	}
+	d.db = db
+	os.Remove(old)
+	return nil
+}
+
+// reopenDB opens the database again after a failed swap and returns
+// the error that stopped it. It must be called with the handle locked.
+func (kv *KV) reopenDB(cause error) error {
+	db, err := dbOpen(kv.dbPath, kv.options, kv.config().KV.DBOpenRetries, kv.log)
+	if err != nil {
+		return fmt.Errorf("%v, and the old database couldn't be reopened: %w", cause, err)
+	}
+	kv.db.db = db
+	return cause
+}
+
+// Restore replaces the live database with the bbolt file read from r.
+// The file is checked before the current database is closed, including
+// that its keyring and secrets open with this node's shared key, so a
+// backup that can't be used never replaces the live database. Peers are
+// asked to resync from this node once it's in place.
+func (kv *KV) Restore(r io.Reader) error {
+	start := time.Now()
+	defer kv.doMetrics("system:restore", start)
+	if shared, _ := kv.keys(); shared == nil {
+		return ErrSealed
+	}
+	tmp := kv.dbPath + ".restore"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = kv.validateBackup(tmp)
+	if err != nil {
+		return err
+	}
+	err = kv.swapDB(tmp)
+	if err != nil {
+		return err
+	}
+	// keyring keys from the old database may not be in the new one
+	kv.crypto.forgetKeys()
+	kv.changed()
+	kv.log.Warn(nil, "Database restored from backup")
+	return kv.app.Cluster.Resync()
+}
+
+// validateBackup checks that the file at path is a cave database whose
+// keyring keys and secrets can be opened with the shared key
+func (kv *KV) validateBackup(path string) error {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bbolt.Tx) error {
+		for _, name := range []string{"kv", "_system"} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("%w: missing the %s bucket", ErrInvalidBackup, name)
+			}
+		}
+		keyring := map[string]*AESKey{}
+		if b := tx.Bucket([]byte("_system")).Bucket([]byte("keyring")); b != nil {
+			err := b.ForEach(func(name, v []byte) error {
+				if bytes.HasPrefix(name, []byte(nsPrefix)) {
+					// wrapped with the namespace's own unseal key
+					if key := kv.crypto.cachedKey(string(name)); key != nil {
+						keyring[string(name)] = key
+					}
+					return nil
+				}
+				data, err := kv.decrypt(v)
+				if err != nil {
+					return fmt.Errorf("%w: keyring key %s can't be opened with this node's shared key", ErrInvalidBackup, name)
+				}
+				var key *AESKey
+				if err := json.Unmarshal(data, &key); err != nil {
+					return fmt.Errorf("%w: keyring key %s: %v", ErrInvalidBackup, name, err)
+				}
+				keyring[string(name)] = key
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, prefix := range kvPrefixes(tx) {
+			err := walkObjects(tx.Bucket([]byte(prefix)), "", func(key string, obj KVObject) error {
+				if !obj.Secret && !obj.Sealed {
+					return nil
+				}
+				var err error
+				if obj.KeyName == "" {
+					_, err = kv.decrypt(obj.Data)
+				} else if k := keyring[obj.KeyName]; k != nil {
+					_, err = decryptJSON(k, obj.Data)
+				} else if strings.HasPrefix(obj.KeyName, nsPrefix) {
+					// a sealed namespace can't be checked
+					return nil
+				} else {
+					err = fmt.Errorf("%w: %s", ErrUnknownKey, obj.KeyName)
+				}
+				if err != nil {
+					return fmt.Errorf("%w: %s can't be opened with this node's keys: %v", ErrInvalidBackup, key, err)
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, ErrInvalidBackup) {
+				err = fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // start func
 func (kv *KV) start() {
 	err := kv.app.Plugins.mgr.RPC.RegisterName("kv", kv)
 	if err != nil {
 		panic(err)
 	}
+	stop := make(chan bool)
+	go kv.snapshotter(stop)
+	go kv.expirer(stop)
+	go kv.compactor(stop)
+	go kv.auditPruner(stop)
+	go kv.queueMetrics(stop)
+	go kv.outbox(stop)
+	go kv.lockCounter(stop)
+	pool := newUpdatePool(kv, kv.config().KV.UpdateWorkers)
 	for {
-		go kv.metrics["kv_q"].(prometheus.Gauge).Set(float64(len(kv.updates)))
 		select {
 		case <-kv.terminate:
+			close(stop)
+			pool.stop()
+			if inMemory(kv.config()) {
+				kv.db.Close()
+				os.Remove(kv.dbPath)
+			}
 			return
 		case msg := <-kv.updates:
-			err := kv.handleUpdate(msg)
+			for _, u := range kv.coalesce(msg) {
+				pool.dispatch(u)
+			}
+		}
+	}
+}
+
+// queueMetrics reports the update queue length once a second
+func (kv *KV) queueMetrics(stop chan bool) {
+	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			kv.metrics["kv_q"].(prometheus.Gauge).Set(float64(len(kv.updates)))
+			kv.metrics["kv_q_saturation"].(prometheus.Gauge).Set(float64(len(kv.updates)) / float64(cap(kv.updates)))
+		}
+	}
+}
+
+// snapshotter takes a snapshot every SnapshotInterval. The interval is
+// re-read whenever the config is reloaded.
+func (kv *KV) snapshotter(stop chan bool) {
+	for {
+		var t *time.Timer
+		var tick <-chan time.Time
+		if kv.config().KV.SnapshotInterval > 0 {
+			t = time.NewTimer(kv.config().KV.SnapshotInterval)
+			tick = t.C
+		}
+		select {
+		case <-stop:
+			if t != nil {
+				t.Stop()
+			}
+			return
+		case <-kv.reload:
+			if t != nil {
+				t.Stop()
+			}
+		case <-tick:
+			if !kv.app.Cluster.IsLeader() {
+				// the leader takes snapshots for the cluster
+				continue
+			}
+			_, err := kv.Snapshot()
 			if err != nil {
 				kv.log.Error(nil, err)
 			}
-		default:
-			time.Sleep(10 * time.Millisecond)
 		}
 	}
 }
 
-func (kv *KV) handleUpdate(msg Message) error {
+// Snapshot writes a timestamped copy of the database into the
+// snapshot directory and prunes snapshots beyond the retention count.
+func (kv *KV) Snapshot() (string, error) {
 	start := time.Now()
-	defer kv.doMetrics("handle:update", start)
-	var kvu KVUpdate
-	err := json.Unmarshal(msg.Data, &kvu)
+	defer kv.doMetrics("system:snapshot", start)
+	dir := kv.config().KV.SnapshotDir
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
-		return err
+		return "", err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("kv-%s.db", time.Now().UTC().Format("20060102T150405Z")))
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(name, 0600)
+	})
+	if err != nil {
+		return "", err
+	}
+	go kv.metrics["snapshot_time"].(prometheus.Gauge).SetToCurrentTime()
+	kv.log.DebugF(nil, "Wrote snapshot %s", name)
+	retain := kv.config().KV.SnapshotRetention
+	if retain <= 0 {
+		return name, nil
+	}
+	snaps, err := listSnapshots(dir)
+	if err != nil {
+		return name, err
+	}
+	for len(snaps) > retain {
+		err = os.Remove(snaps[0])
+		if err != nil {
+			return name, err
+		}
+		snaps = snaps[1:]
+	}
+	return name, nil
+}
+
+// listSnapshots returns the snapshots in dir, oldest first
+func listSnapshots(dir string) ([]string, error) {
+	snaps, err := filepath.Glob(filepath.Join(dir, "kv-*.db"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(snaps)
+	return snaps, nil
+}
+
+// admitUpdate checks that an update from a peer is new, and decodes
+// it. Its signature has been checked when it arrived. Each of a peer's
+// epochs is admitted once, so updates are admitted in the order they
+// arrive even when they're applied in parallel.
+func (kv *KV) admitUpdate(msg Message) (kvu KVUpdate, err error) {
+	err = kv.checkEpoch(msg)
+	if err != nil {
+		return kvu, err
 	}
+	err = json.Unmarshal(msg.Data, &kvu)
+	if err != nil {
+		return kvu, err
+	}
+	if kvu.Prefix == "" {
+		// sent by a node from before namespaces
+		kvu.Prefix = "kv"
+	}
+	return kvu, nil
+}
+
+// handleUpdate applies an admitted update from a peer
+func (kv *KV) handleUpdate(msg Message, kvu KVUpdate) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("handle:update", start)
+	prefix := kvu.Prefix
+	kv.log.DebugF(forRequest("KV", msg.RequestID), "Applying %s %s from %s", kvu.UpdateType, kvu.Key, msg.Origin)
+	// continue the trace of the write that sent the update
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Trace))
+	ctx, span := tracer.Start(ctx, "kv.apply "+kvu.UpdateType, trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("kv.key", kvu.Key), attribute.String("cluster.origin", msg.Origin)))
+	defer func() { endSpan(span, err) }()
+	ctx = withRequestID(withRequester(ctx, "peer:"+msg.Origin), msg.RequestID)
 	switch kvu.UpdateType {
 	case "put:key":
-		err := kv.PutObject(kvu.Key, kvu.Value, "kv", kvu.Value.Secret, false)
+		err := kv.PutObjectCtx(ctx, kvu.Key, kvu.Value, prefix, kvu.Value.Secret, false)
 		if err != nil {
 			return err
 		}
 	case "delete:key":
-		err := kv.DeleteKey(kvu.Key, "kv", false)
+		err := kv.DeleteKeyCtx(ctx, kvu.Key, prefix, false)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	case "create:bucket":
+		err := kv.CreateBucketCtx(ctx, kvu.Key, prefix, false)
 		if err != nil {
 			return err
 		}
 	case "delete:bucket":
-		err := kv.DeleteBucket(kvu.Key, "kv", false)
+		err := kv.DeleteBucketCtx(ctx, kvu.Key, prefix, false)
+		if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+	case "delete:namespace":
+		err := kv.DeleteNamespace(kvu.Key, false)
+		if err != nil {
+			return err
+		}
+	case "put:keyring":
+		err := kv.putWrappedKey(ctx, kvu.Key, kvu.Value.Data, false)
+		if err != nil {
+			return err
+		}
+	case "put:unseal":
+		err := kv.putUnsealInit(ctx, kvu.Value.Data, false)
+		if err != nil {
+			return err
+		}
+	case "put:schema":
+		err := kv.PutSchema(kvu.Key, kvu.Value.Data, false)
+		if err != nil {
+			return err
+		}
+	case "delete:schema":
+		err := kv.DeleteSchema(kvu.Key, false)
 		if err != nil {
 			return err
 		}
 	case "lock:create":
-		_, err := kv.Lock(kvu.Key, "kv", false)
+		_, err := kv.Lock(kvu.Key, prefix, false)
 		if err != nil {
 			return err
 		}
 	case "lock:delete":
+		// force unlocks are sent as the key's new value now, this is
+		// for peers that still send them on their own
 		var l Lock
 		err = json.Unmarshal(kvu.Value.Data, &l)
 		if err != nil {
 			return err
 		}
-		err = kv.Unlock(l, false)
-		if err != nil {
+		err = kv.ForceUnlock(l.Key, prefix, l.LockID, false)
+		if err != nil && err != ErrUnknownLock && err != ErrKeyNotFound {
 			return err
 		}
 	default:
@@ -240,29 +886,126 @@ func (kv *KV) handleUpdate(msg Message) error {
 	return nil
 }
 
-func (kv *KV) handleSync(msg Message) error {
-	kv.log.Pretty(msg)
-	return nil
+// checkEpoch accepts an update only if no other update from the same
+// origin had its epoch, and it's no more than epochWindowSize behind
+// the newest one accepted from there
+func (kv *KV) checkEpoch(msg Message) error {
+	kv.epochLock.Lock()
+	w, seen := kv.epochs[msg.Origin]
+	if !seen {
+		w = &epochWindow{}
+		kv.epochs[msg.Origin] = w
+	}
+	ok := w.accept(msg.Epoch)
+	last := w.max
+	kv.epochLock.Unlock()
+	if ok {
+		return nil
+	}
+	go kv.metrics["messages_rejected"].(*prometheus.CounterVec).WithLabelValues(msg.DataType).Inc()
+	return fmt.Errorf("%w: %s %s from %s has epoch %d, which was already seen or is too old, newest is %d", ErrReplayedMessage, msg.DataType, msg.ID, msg.Origin, msg.Epoch, last)
 }
 
-func (kv *KV) handleEvent(msg Message) error {
-	kv.log.Pretty(msg)
-	return nil
+// epochWindowSize is how many epochs back from the newest one from a
+// peer its messages are still accepted, for messages that arrive out
+// of order
+const epochWindowSize = 1024
+
+// epochWindow is the replay window for one peer: its newest epoch, and
+// which of the epochWindowSize before it have been seen. Bit i of seen
+// is set once the epoch i before max has been.
+type epochWindow struct {
+	max  uint64
+	seen [epochWindowSize / 64]uint64
+}
+
+// accept reports whether epoch hasn't been seen and is new enough to
+// take, and records it when it is
+func (w *epochWindow) accept(epoch uint64) bool {
+	if epoch > w.max {
+		w.shift(epoch - w.max)
+		w.max = epoch
+		w.seen[0] |= 1
+		return true
+	}
+	d := w.max - epoch
+	if d >= epochWindowSize || w.seen[d/64]&(1<<(d%64)) != 0 {
+		return false
+	}
+	w.seen[d/64] |= 1 << (d % 64)
+	return true
+}
+
+// shift moves the window n epochs forward
+func (w *epochWindow) shift(n uint64) {
+	if n >= epochWindowSize {
+		w.seen = [epochWindowSize / 64]uint64{}
+		return
+	}
+	words, bits := int(n/64), n%64
+	for i := len(w.seen) - 1; i >= 0; i-- {
+		var v uint64
+		if j := i - words; j >= 0 {
+			v = w.seen[j] << bits
+			if bits > 0 && j > 0 {
+				v |= w.seen[j-1] >> (64 - bits)
+			}
+		}
+		w.seen[i] = v
+	}
+}
+
+// sign signs a message for the cluster with the shared key, or with
+// the replacement key while a key rotation is running
+func (kv *KV) sign(msg *Message) {
+	shared, next := kv.keys()
+	if next != nil {
+		signMessage(next, msg)
+		return
+	}
+	if shared == nil {
+		// sealed, peers that check will drop it
+		return
+	}
+	signMessage(shared, msg)
+}
+
+// verify checks a message from a peer was signed with the shared key,
+// or with the replacement key while a key rotation is running
+func (kv *KV) verify(msg Message) error {
+	shared, next := kv.keys()
+	if verifyMessage(shared, &msg) || verifyMessage(next, &msg) {
+		return nil
+	}
+	go kv.metrics["messages_rejected"].(*prometheus.CounterVec).WithLabelValues(msg.DataType).Inc()
+	return fmt.Errorf("%w: %s %s from %s", ErrBadSignature, msg.DataType, msg.ID, msg.Origin)
 }
 
 func (kv *KV) emitEvent(t string, key string, value KVObject) error {
+	return kv.emitUpdate(t, "kv", key, value)
+}
+
+// emitUpdate sends an update for a key under prefix to the cluster
+func (kv *KV) emitUpdate(t string, prefix string, key string, value KVObject) error {
+	return kv.emitUpdateCtx(context.Background(), t, prefix, key, value)
+}
+
+// emitUpdateCtx is emitUpdate for the API request in ctx
+func (kv *KV) emitUpdateCtx(ctx context.Context, t string, prefix string, key string, value KVObject) error {
 	start := time.Now()
 	defer kv.doMetrics("emit:event", start)
 	k := KVUpdate{
 		UpdateType: t,
 		Key:        key,
 		Value:      value,
+		Prefix:     prefix,
 	}
 	update, err := json.Marshal(k)
 	if err != nil {
 		return err
 	}
-	err = kv.app.Cluster.Emit("update", update, "KVUpdate")
+	kv.log.DebugF(forRequest("KV", requestIDFrom(ctx)), "Sending %s %s", t, key)
+	err = kv.app.Cluster.EmitCtx(ctx, "update", update, "KVUpdate")
 	if err != nil {
 		return err
 	}
@@ -282,7 +1025,7 @@ func parsePath(path string) (buckets []string, key string) {
 func (kv *KV) doMetrics(tx string, start time.Time) {
 	go func() {
 		diff := time.Now().Sub(start)
-		kv.metrics["transaction_time"].(*prometheus.GaugeVec).WithLabelValues(tx).Set(float64(diff.Milliseconds()))
+		kv.metrics["transaction_time"].(*prometheus.HistogramVec).WithLabelValues(tx).Observe(float64(diff.Microseconds()) / 1000)
 		stats := kv.db.Stats()
 		kv.metrics["pagefree"].(prometheus.Gauge).Set(float64(stats.FreePageN))
 		kv.metrics["pagepending"].(prometheus.Gauge).Set(float64(stats.PendingPageN))
@@ -290,11 +1033,126 @@ func (kv *KV) doMetrics(tx string, start time.Time) {
 		kv.metrics["pageuse"].(prometheus.Gauge).Set(float64(stats.FreelistInuse))
 		kv.metrics["tx_tot"].(prometheus.Gauge).Set(float64(stats.TxN))
 		kv.metrics["tx_open"].(prometheus.Gauge).Set(float64(stats.OpenTxN))
-		f, _ := os.Stat(kv.config.KV.DBPath)
+		f, _ := os.Stat(kv.dbPath)
 		kv.metrics["dbsize"].(prometheus.Gauge).Set(float64(f.Size()))
 	}()
 }
 
+// KVStats is a snapshot of the database and update queue
+type KVStats struct {
+	FreePages      int   `json:"free_pages"`
+	PendingPages   int   `json:"pending_pages"`
+	FreeAlloc      int   `json:"free_alloc_bytes"`
+	FreelistInuse  int   `json:"freelist_inuse_bytes"`
+	TxCount        int   `json:"tx_count"`
+	OpenTx         int   `json:"open_tx"`
+	Size           int64 `json:"size_bytes"`
+	UpdateQueue    int   `json:"update_queue"`
+	UpdateQueueCap int   `json:"update_queue_capacity"`
+	ActiveLocks    int   `json:"active_locks"`
+	Watchers       int   `json:"watchers"`
+}
+
+// Stats returns the same figures as the database metrics. Locks are
+// counted by lockCounter rather than here, so the count can be up to
+// lockCountInterval old.
+func (kv *KV) Stats() (KVStats, error) {
+	stats := kv.db.Stats()
+	f, err := os.Stat(kv.dbPath)
+	if err != nil {
+		return KVStats{}, err
+	}
+	kv.watchLock.RLock()
+	watchers := len(kv.watchers)
+	kv.watchLock.RUnlock()
+	return KVStats{
+		FreePages:      stats.FreePageN,
+		PendingPages:   stats.PendingPageN,
+		FreeAlloc:      stats.FreeAlloc,
+		FreelistInuse:  stats.FreelistInuse,
+		TxCount:        stats.TxN,
+		OpenTx:         stats.OpenTxN,
+		Size:           f.Size(),
+		UpdateQueue:    len(kv.updates),
+		UpdateQueueCap: cap(kv.updates),
+		ActiveLocks:    int(atomic.LoadInt64(&kv.lockCount)),
+		Watchers:       watchers,
+	}, nil
+}
+
+func (kv *KV) countError(op string, err error) {
+	if err != nil {
+		go kv.metrics["op_errors"].(*prometheus.CounterVec).WithLabelValues(op).Inc()
+	}
+}
+
+// keyspaceLabelLimit caps the distinct keyspace labels on the
+// per-keyspace op counter. Keyspaces past the cap are counted as
+// __other__.
+const keyspaceLabelLimit = 100
+
+// countKeyspaceOp counts an op by keyspace: the first segment of the
+// key in the default key space, or the namespace
+func (kv *KV) countKeyspaceOp(op string, prefix string, key string) {
+	space := prefix
+	if prefix == "kv" {
+		space = strings.SplitN(strings.TrimPrefix(key, "/"), "/", 2)[0]
+	}
+	kv.keyspaceLock.Lock()
+	if !kv.keyspaces[space] {
+		if len(kv.keyspaces) < keyspaceLabelLimit {
+			kv.keyspaces[space] = true
+		} else {
+			space = "__other__"
+		}
+	}
+	kv.keyspaceLock.Unlock()
+	go kv.metrics["keyspace_ops"].(*prometheus.CounterVec).WithLabelValues(op, space).Inc()
+}
+
+// update runs fn in a write transaction. Writes wait up to
+// WriteTimeout for their turn, and a write that times out, or finds the
+// database closed while it's being restored or synced, is retried with
+// exponential backoff up to WriteRetries times before giving up with
+// ErrWriteContention.
+func (kv *KV) update(ctx context.Context, op string, fn func(*bbolt.Tx) error) (err error) {
+	ctx, span := tracer.Start(ctx, "bbolt.update", trace.WithAttributes(attribute.String("kv.op", op)))
+	defer func() { endSpan(span, err) }()
+	backoff := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		t := time.NewTimer(kv.config().KV.WriteTimeout)
+		var err error
+		select {
+		case kv.writer <- true:
+			t.Stop()
+			err = kv.db.Update(fn)
+			<-kv.writer
+			if w := writeIndexFrom(ctx); err == nil && w != nil && w.pending > w.committed {
+				w.committed = w.pending
+			}
+			if err != bbolt.ErrDatabaseNotOpen {
+				return err
+			}
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if attempt >= kv.config().KV.WriteRetries {
+			return ErrWriteContention
+		}
+		kv.metrics["write_retries"].(*prometheus.CounterVec).WithLabelValues(op).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
 func (kv *KV) getBuckets(tx *bbolt.Tx, buckets []string, prefix string, create bool) (*bbolt.Bucket, string, error) {
 	start := time.Now()
 	defer kv.doMetrics("get:buckets", start)
@@ -302,6 +1160,17 @@ func (kv *KV) getBuckets(tx *bbolt.Tx, buckets []string, prefix string, create b
 	var name string
 	name = prefix
 	bkt = tx.Bucket([]byte(prefix))
+	if bkt == nil {
+		// namespaces are created by their first write
+		if !create {
+			return nil, prefix, fmt.Errorf("Bucket %s does not exist: %w", prefix, bbolt.ErrBucketNotFound)
+		}
+		var err error
+		bkt, err = tx.CreateBucketIfNotExists([]byte(prefix))
+		if err != nil {
+			return nil, prefix, err
+		}
+	}
 	if len(buckets) == 0 {
 		return bkt, prefix, nil
 	}
@@ -315,7 +1184,7 @@ func (kv *KV) getBuckets(tx *bbolt.Tx, buckets []string, prefix string, create b
 		} else {
 			bkt = bkt.Bucket([]byte(b))
 			if bkt == nil {
-				return nil, b, fmt.Errorf("Bucket " + b + " does not exist")
+				return nil, b, fmt.Errorf("Bucket %s does not exist: %w", b, bbolt.ErrBucketNotFound)
 			}
 		}
 		name = b
@@ -325,56 +1194,148 @@ func (kv *KV) getBuckets(tx *bbolt.Tx, buckets []string, prefix string, create b
 
 //Put function
 func (kv *KV) Put(key string, value []byte, prefix string, secret bool, e ...bool) error {
-	isPlain := func(b []byte) bool {
-		var js json.RawMessage
-		return json.Unmarshal(value, &js) != nil
-	}(value)
-	return kv.PutObject(key, KVObject{
-		LastUpdated: time.Now(),
-		Secret:      secret,
-		Data: func() []byte {
-			if isPlain {
-				return value
-			}
-			return json.RawMessage(value)
-		}(),
-		Locks:     []Lock{},
-		Plaintext: isPlain,
-	}, prefix, secret, e...)
+	return kv.PutCtx(context.Background(), key, value, prefix, secret, e...)
 }
 
-// PutObject value
-func (kv *KV) PutObject(key string, value KVObject, prefix string, secret bool, e ...bool) error {
-	start := time.Now()
-	defer kv.doMetrics("put:key", start)
-	emit := true
-	if len(e) > 0 {
-		emit = e[0]
+// PutCtx is Put on behalf of the requester in ctx
+func (kv *KV) PutCtx(ctx context.Context, key string, value []byte, prefix string, secret bool, e ...bool) error {
+	obj, err := kv.newObject(key, prefix, value, secret)
+	if err != nil {
+		return err
+	}
+	return kv.PutObjectCtx(ctx, key, obj, prefix, secret, e...)
+}
+
+// newObject wraps a value for storage at key, encrypting it if it's
+// a secret
+func (kv *KV) newObject(key string, prefix string, value []byte, secret bool) (KVObject, error) {
+	err := kv.validate(key, value)
+	if err != nil {
+		return KVObject{}, err
+	}
+	// detect the type before encrypting so secrets keep the type of
+	// their plaintext
+	ctype := contentType(value)
+	keyName := ""
+	if secret {
+		keyName = kv.keyName(prefix, key)
+		data, err := kv.encryptWith(keyName, value)
+		if err != nil {
+			return KVObject{}, err
+		}
+		value = data
+	}
+	return KVObject{
+		LastUpdated: time.Now(),
+		Secret:      secret,
+		Data:        value,
+		Locks:       []Lock{},
+		ContentType: ctype,
+		KeyName:     keyName,
+	}, nil
+}
+
+// contentType returns the MIME type of a value being stored. Values
+// that aren't JSON or readable text are treated as binary.
+func contentType(b []byte) string {
+	if json.Valid(b) {
+		return "application/json"
+	}
+	if !utf8.Valid(b) {
+		return "application/octet-stream"
+	}
+	for _, r := range string(b) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=UTF-8"
+}
+
+// PutObject value
+func (kv *KV) PutObject(key string, value KVObject, prefix string, secret bool, e ...bool) error {
+	return kv.PutObjectCtx(context.Background(), key, value, prefix, secret, e...)
+}
+
+// PutObjectCtx is PutObject on behalf of the requester in ctx. Writes
+// of secrets are added to the audit trail in the same transaction.
+func (kv *KV) PutObjectCtx(ctx context.Context, key string, value KVObject, prefix string, secret bool, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("put:key", start)
+	defer func() { kv.countError("put:key", err) }()
+	kv.countKeyspaceOp("put:key", prefix, key)
+	ctx, span := startSpan(ctx, "kv.put", prefix, key)
+	defer func() { endSpan(span, err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
 	}
 	buckets, k := parsePath(key)
+	plain := value
+	value, err = kv.seal(value)
+	if err != nil {
+		return err
+	}
 	bobj, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
-	err = kv.db.Update(func(tx *bbolt.Tx) error {
+	var created []string
+	err = kv.update(ctx, "put:key", func(tx *bbolt.Tx) error {
+		created = missingBuckets(tx, buckets, prefix)
 		b, _, err := kv.getBuckets(tx, buckets, prefix, true)
 		if err != nil {
 			return err
 		}
+		old := b.Get([]byte(k))
+		if d := diffFrom(ctx); d != nil {
+			*d, err = kv.diffObjects(key, old, &plain)
+			if err != nil {
+				return err
+			}
+		}
+		err = kv.recordHistory(tx, prefix, key, old, value)
+		if err != nil {
+			return err
+		}
 		err = b.Put([]byte(k), bobj)
 		if err != nil {
 			return err
 		}
+		if value.Secret {
+			err = kv.appendAudit(tx, "put:key", prefix, key, requesterFrom(ctx))
+			if err != nil {
+				return err
+			}
+		}
+		if emit {
+			err = kv.queueCreated(ctx, tx, prefix, created)
+			if err == nil {
+				err = kv.queueEvent(ctx, tx, "put:key", prefix, key, value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if isDryRun(ctx) {
+			return errDryRun
+		}
 		return nil
 	})
+	if err == errDryRun {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	kv.changed()
+	kv.bucketsCreated(prefix, created)
+	kv.publish("put:key", prefix, key, plain)
 	if emit {
-		err = kv.emitEvent("put:key", key, value)
-		if err != nil {
-			return err
-		}
+		kv.wakeOutbox()
 	}
 	return nil
 }
@@ -388,13 +1349,179 @@ func (kv *KV) Get(key string, prefix string) ([]byte, error) {
 	return o.Data, nil
 }
 
+// Batch applies the PUT and DELETE operations in ops in a single
+// transaction. Either every operation is applied or, if any of them
+// fails, none are. Keys ending in a slash are deleted as buckets, and
+// deleting a key that doesn't exist does nothing.
+func (kv *KV) Batch(ctx context.Context, ops []QueryObject, prefix string) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("batch", start)
+	defer func() { kv.countError("batch", err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	// objects are built up front since encrypting with a new named
+	// key needs its own write transaction
+	plain := make([]KVObject, len(ops))
+	objs := make([]KVObject, len(ops))
+	for i, q := range ops {
+		switch strings.ToUpper(q.Verb) {
+		case "PUT", "POST":
+			plain[i], err = kv.newObject(q.Key, prefix, []byte(q.Value), q.Secret)
+			if err == nil {
+				objs[i], err = kv.seal(plain[i])
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", q.Verb, q.Key, err)
+			}
+		case "DELETE":
+		default:
+			return fmt.Errorf("Verb %s is not a valid operation", q.Verb)
+		}
+	}
+	var created []string
+	var applied []KVUpdate
+	err = kv.update(ctx, "batch", func(tx *bbolt.Tx) error {
+		created = nil
+		applied = nil
+		for i, q := range ops {
+			// a cancelled batch is rolled back like a failed one
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := len(created)
+			u, err := kv.batchOp(ctx, tx, prefix, q, objs[i], &created)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", q.Verb, q.Key, err)
+			}
+			if u == nil {
+				continue
+			}
+			err = kv.queueCreated(ctx, tx, prefix, created[n:])
+			if err == nil {
+				err = kv.queueEvent(ctx, tx, u.UpdateType, prefix, u.Key, u.Value)
+			}
+			if err != nil {
+				return err
+			}
+			u.Value = plain[i]
+			applied = append(applied, *u)
+		}
+		if isDryRun(ctx) {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kv.changed()
+	kv.bucketsCreated(prefix, created)
+	for _, u := range applied {
+		kv.publish(u.UpdateType, prefix, u.Key, u.Value)
+	}
+	kv.wakeOutbox()
+	return nil
+}
+
+// batchOp applies one operation of a batch in tx and returns the update
+// it makes, or nil when it changes nothing. The update's value is the
+// object as it's stored.
+func (kv *KV) batchOp(ctx context.Context, tx *bbolt.Tx, prefix string, q QueryObject, obj KVObject, created *[]string) (*KVUpdate, error) {
+	if strings.ToUpper(q.Verb) == "DELETE" {
+		if strings.HasSuffix(q.Key, "/") {
+			key := strings.TrimSuffix(q.Key, "/")
+			buckets, k := parsePath(key)
+			b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+			if err == nil {
+				err = b.DeleteBucket([]byte(k))
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &KVUpdate{UpdateType: "delete:bucket", Key: key}, nil
+		}
+		buckets, k := parsePath(q.Key)
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if err != nil {
+			return nil, err
+		}
+		if b.Get([]byte(k)) == nil {
+			return nil, nil
+		}
+		err = b.Delete([]byte(k))
+		if err != nil {
+			return nil, err
+		}
+		return &KVUpdate{UpdateType: "delete:key", Key: q.Key}, nil
+	}
+	buckets, k := parsePath(q.Key)
+	bobj, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	*created = append(*created, missingBuckets(tx, buckets, prefix)...)
+	b, _, err := kv.getBuckets(tx, buckets, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+	err = kv.recordHistory(tx, prefix, q.Key, b.Get([]byte(k)), obj)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Put([]byte(k), bobj)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Secret {
+		err = kv.appendAudit(tx, "put:key", prefix, q.Key, requesterFrom(ctx))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &KVUpdate{UpdateType: "put:key", Key: q.Key, Value: obj}, nil
+}
+
+// ApplyWrite runs a single PUT or DELETE query. Keys ending in a
+// slash are deleted as buckets.
+func (kv *KV) ApplyWrite(ctx context.Context, prefix string, q QueryObject) error {
+	switch strings.ToUpper(q.Verb) {
+	case "PUT", "POST":
+		return kv.PutCtx(ctx, q.Key, []byte(q.Value), prefix, q.Secret)
+	case "DELETE":
+		if strings.HasSuffix(q.Key, "/") {
+			return kv.DeleteBucketCtx(ctx, q.Key, prefix)
+		}
+		return kv.DeleteKeyCtx(ctx, q.Key, prefix)
+	default:
+		return fmt.Errorf("Verb %s is not a valid operation", q.Verb)
+	}
+}
+
 // GetObject function
 func (kv *KV) GetObject(key string, prefix string) (KVObject, error) {
+	return kv.GetObjectCtx(context.Background(), key, prefix)
+}
+
+// GetObjectCtx is GetObject on behalf of the requester in ctx. Reads
+// of secrets are added to the audit trail.
+func (kv *KV) GetObjectCtx(ctx context.Context, key string, prefix string) (obj KVObject, err error) {
 	start := time.Now()
 	defer kv.doMetrics("get:key", start)
+	defer func() { kv.countError("get:key", err) }()
+	kv.countKeyspaceOp("get:key", prefix, key)
+	ctx, span := startSpan(ctx, "kv.get", prefix, key)
+	defer func() { endSpan(span, err) }()
+	if err = ctx.Err(); err != nil {
+		return obj, err
+	}
 	buckets, k := parsePath(key)
 	bobj := []byte{}
-	err := kv.db.View(func(tx *bbolt.Tx) error {
+	_, view := tracer.Start(ctx, "bbolt.view")
+	err = kv.view(func(tx *bbolt.Tx) error {
 		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
 		if err != nil {
 			return err
@@ -403,19 +1530,40 @@ func (kv *KV) GetObject(key string, prefix string) (KVObject, error) {
 		bobj = v
 		return nil
 	})
-	var obj KVObject
+	endSpan(view, err)
 	err = json.Unmarshal(bobj, &obj)
+	if err != nil {
+		return obj, err
+	}
+	if obj.expired(time.Now()) {
+		// reads as missing until the sweeper deletes it
+		return KVObject{}, nil
+	}
+	obj, err = kv.unseal(obj)
+	if err != nil {
+		return obj, err
+	}
+	if obj.Secret {
+		err = kv.audit("get:key", prefix, key, requesterFrom(ctx))
+	}
 	return obj, err
-
 }
 
 // GetKeys gets keys from a bucket
 func (kv *KV) GetKeys(key string, prefix string) ([]string, error) {
+	return kv.GetKeysCtx(context.Background(), key, prefix)
+}
+
+// GetKeysCtx is GetKeys that gives up if ctx is done
+func (kv *KV) GetKeysCtx(ctx context.Context, key string, prefix string) ([]string, error) {
 	start := time.Now()
 	defer kv.doMetrics("get:keys", start)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	buckets, k := parsePath(key)
 	var keys []string
-	err := kv.db.View(func(tx *bbolt.Tx) error {
+	err := kv.view(func(tx *bbolt.Tx) error {
 		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
 		if err != nil {
 			return err
@@ -426,6 +1574,9 @@ func (kv *KV) GetKeys(key string, prefix string) ([]string, error) {
 		} else {
 			bkt = b.Bucket([]byte(k))
 		}
+		if bkt == nil {
+			return fmt.Errorf("Bucket %s does not exist: %w", k, bbolt.ErrBucketNotFound)
+		}
 		c := bkt.Cursor()
 		txKeys := []string{}
 		for ea, _ := c.First(); ea != nil; ea, _ = c.Next() {
@@ -442,147 +1593,1227 @@ func (kv *KV) GetKeys(key string, prefix string) ([]string, error) {
 	return keys, err
 }
 
-// DeleteKey function
-func (kv *KV) DeleteKey(key string, prefix string, e ...bool) error {
+// ScanCtx returns the objects stored under p, read in one transaction.
+// The bucket part of p is searched for keys and buckets whose names
+// start with the rest of it, so "app/" matches everything in the app
+// bucket and "app/db" everything in it starting with "db". Matching
+// buckets are searched all the way down. Reads of secrets are added to
+// the audit trail.
+func (kv *KV) ScanCtx(ctx context.Context, p string, prefix string) (map[string]KVObject, error) {
 	start := time.Now()
-	defer kv.doMetrics("delete:key", start)
-	emit := true
-	if len(e) > 0 {
-		emit = e[0]
+	defer kv.doMetrics("scan:keys", start)
+	objs, err := kv.scan(ctx, p, prefix)
+	if err != nil {
+		return nil, err
 	}
-	buckets, k := parsePath(key)
-	err := kv.db.Update(func(tx *bbolt.Tx) error {
-		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+	for k, obj := range objs {
+		obj, err = kv.unseal(obj)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = b.Delete([]byte(k))
+		objs[k] = obj
+		if obj.Secret {
+			err = kv.audit("get:key", prefix, k, requesterFrom(ctx))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return objs, nil
+}
+
+// scan returns the unexpired objects under p as they're stored, see
+// ScanCtx
+func (kv *KV) scan(ctx context.Context, p string, prefix string) (map[string]KVObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dir := p[:strings.LastIndex(p, "/")+1]
+	stem := []byte(p[len(dir):])
+	buckets, k := parsePath(dir)
+	now := time.Now()
+	objs := map[string]KVObject{}
+	err := kv.view(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
 		if err != nil {
 			return err
 		}
+		if k != "" {
+			b = b.Bucket([]byte(k))
+		}
+		if b == nil {
+			return fmt.Errorf("Bucket %s does not exist: %w", k, bbolt.ErrBucketNotFound)
+		}
+		c := b.Cursor()
+		for name, v := c.Seek(stem); name != nil && bytes.HasPrefix(name, stem); name, v = c.Next() {
+			if v == nil {
+				err = scanBucket(ctx, b.Bucket(name), dir+string(name)+"/", now, objs)
+			} else {
+				err = scanValue(dir+string(name), v, now, objs)
+			}
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	if emit {
-		err = kv.emitEvent("delete:key", key, KVObject{})
+	return objs, err
+}
+
+// scanBucket adds the unexpired objects in bkt and the buckets under it
+// to objs, with path in front of their keys
+func scanBucket(ctx context.Context, bkt *bbolt.Bucket, path string, now time.Time, objs map[string]KVObject) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bkt.ForEach(func(name []byte, v []byte) error {
+		if v == nil {
+			return scanBucket(ctx, bkt.Bucket(name), path+string(name)+"/", now, objs)
+		}
+		return scanValue(path+string(name), v, now, objs)
+	})
+}
+
+// scanValue adds the object in v to objs at key unless it has expired
+func scanValue(key string, v []byte, now time.Time, objs map[string]KVObject) error {
+	obj := KVObject{}
+	err := json.Unmarshal(v, &obj)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if !obj.expired(now) {
+		objs[key] = obj
+	}
+	return nil
+}
+
+// CountKeys counts the keys in a bucket. When recursive is set,
+// keys in nested buckets are included in the count.
+func (kv *KV) CountKeys(key string, prefix string, recursive bool) (int, error) {
+	return kv.CountKeysCtx(context.Background(), key, prefix, recursive)
+}
+
+// CountKeysCtx is CountKeys that gives up if ctx is done
+func (kv *KV) CountKeysCtx(ctx context.Context, key string, prefix string, recursive bool) (int, error) {
+	start := time.Now()
+	defer kv.doMetrics("count:keys", start)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	buckets, k := parsePath(key)
+	count := 0
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
 		if err != nil {
 			return err
 		}
-	}
-	return err
+		bkt := b
+		if k != "" {
+			bkt = b.Bucket([]byte(k))
+			if bkt == nil {
+				return fmt.Errorf("Bucket %s does not exist: %w", k, bbolt.ErrBucketNotFound)
+			}
+		}
+		if recursive {
+			count = countBucket(bkt)
+			return nil
+		}
+		c := bkt.Cursor()
+		for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+			if v != nil {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
 }
 
-// DeleteBucket function
-func (kv *KV) DeleteBucket(key string, prefix string, e ...bool) error {
+// DeleteKey function
+func (kv *KV) DeleteKey(key string, prefix string, e ...bool) error {
+	return kv.DeleteKeyCtx(context.Background(), key, prefix, e...)
+}
+
+// DeleteKeyCtx is DeleteKey that gives up if ctx is done
+func (kv *KV) DeleteKeyCtx(ctx context.Context, key string, prefix string, e ...bool) (err error) {
 	start := time.Now()
-	defer kv.doMetrics("delete:bucket", start)
+	defer kv.doMetrics("delete:key", start)
+	defer func() { kv.countError("delete:key", err) }()
+	kv.countKeyspaceOp("delete:key", prefix, key)
+	ctx, span := startSpan(ctx, "kv.delete", prefix, key)
+	defer func() { endSpan(span, err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	emit := true
 	if len(e) > 0 {
 		emit = e[0]
 	}
 	buckets, k := parsePath(key)
-	err := kv.db.Update(func(tx *bbolt.Tx) error {
+	err = kv.update(ctx, "delete:key", func(tx *bbolt.Tx) error {
 		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
 		if err != nil {
 			return err
 		}
-		err = b.DeleteBucket([]byte(k))
-		if err != nil {
+		old := b.Get([]byte(k))
+		if d := diffFrom(ctx); d != nil {
+			*d, err = kv.diffObjects(key, old, nil)
+			if err != nil {
+				return err
+			}
+		}
+		if isDryRun(ctx) {
+			return errDryRun
+		}
+		if old == nil {
+			return ErrKeyNotFound
+		}
+		err = b.Delete([]byte(k))
+		if err != nil || !emit {
 			return err
 		}
-		return nil
+		return kv.queueEvent(ctx, tx, "delete:key", prefix, key, KVObject{})
 	})
+	if err == errDryRun {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kv.changed()
+	kv.publish("delete:key", prefix, key, KVObject{})
 	if emit {
-		err = kv.emitEvent("delete:bucket", key, KVObject{})
-		if err != nil {
-			return err
-		}
+		kv.wakeOutbox()
 	}
-	return err
+	return nil
 }
 
-// GetTree gets the db tree from the specified root to n-depth.
-// If root is not given, it returns the entire db tree.
-func (kv *KV) GetTree(prefix string) (map[string]interface{}, error) {
+// CreateBucket creates the bucket at key along with any buckets above
+// it that don't exist yet
+func (kv *KV) CreateBucket(key string, prefix string, e ...bool) error {
+	return kv.CreateBucketCtx(context.Background(), key, prefix, e...)
+}
+
+// CreateBucketCtx is CreateBucket on behalf of the requester in ctx
+func (kv *KV) CreateBucketCtx(ctx context.Context, key string, prefix string, e ...bool) (err error) {
 	start := time.Now()
-	defer kv.doMetrics("get:tree", start)
-	tree := map[string]interface{}{}
-	buckets, k := parsePath("")
-	if k != "" {
-		buckets = append(buckets, k)
+	defer kv.doMetrics("create:bucket", start)
+	defer func() { kv.countError("create:bucket", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
 	}
-	err := kv.db.View(func(tx *bbolt.Tx) error {
-		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
-		if err != nil {
+	key = strings.Trim(key, "/")
+	if key == "" {
+		return fmt.Errorf("Bucket name is required")
+	}
+	buckets := strings.Split(key, "/")
+	var created []string
+	err = kv.update(ctx, "create:bucket", func(tx *bbolt.Tx) error {
+		created = missingBuckets(tx, buckets, prefix)
+		_, _, err := kv.getBuckets(tx, buckets, prefix, true)
+		if err != nil || !emit {
 			return err
 		}
-		tree = enumerateBucket(b)
-		return nil
+		return kv.queueCreated(ctx, tx, prefix, created)
 	})
 	if err != nil {
-		return tree, err
+		return err
 	}
-	return tree, nil
+	kv.changed()
+	kv.bucketsCreated(prefix, created)
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
 }
 
-func enumerateBucket(bkt *bbolt.Bucket) map[string]interface{} {
-	c := bkt.Cursor()
-	tree := map[string]interface{}{}
-	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
-		isBucket := bkt.Bucket(ea)
-		if isBucket != nil {
-			tree[string(ea[:])] = enumerateBucket(isBucket)
-		} else {
-			tree[string(ea[:])] = json.RawMessage(v)
+// missingBuckets returns the paths of the buckets in buckets that
+// don't exist yet, outermost first
+func missingBuckets(tx *bbolt.Tx, buckets []string, prefix string) []string {
+	var missing []string
+	bkt := tx.Bucket([]byte(prefix))
+	for i, b := range buckets {
+		if bkt != nil {
+			bkt = bkt.Bucket([]byte(b))
+		}
+		if bkt == nil {
+			missing = append(missing, strings.Join(buckets[:i+1], "/"))
 		}
 	}
-	return tree
+	return missing
 }
 
-// Lock function
-func (kv *KV) Lock(key string, prefix string, e ...bool) (Lock, error) {
-	start := time.Now()
-	defer kv.doMetrics("lock:create", start)
-	id, err := machineid.ID()
-	l := Lock{
-		Key:         key,
-		Prefix:      prefix,
-		LockID:      uuid.New().String(),
+// queueCreated queues a create:bucket in tx for each bucket a write
+// created, so peers see empty buckets too
+func (kv *KV) queueCreated(ctx context.Context, tx *bbolt.Tx, prefix string, created []string) error {
+	for _, path := range created {
+		err := kv.queueEvent(ctx, tx, "create:bucket", prefix, path, KVObject{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketsCreated tells watchers about the buckets a write created
+func (kv *KV) bucketsCreated(prefix string, created []string) {
+	for _, path := range created {
+		kv.publish("create:bucket", prefix, path, KVObject{})
+	}
+}
+
+// DeleteBucket function
+func (kv *KV) DeleteBucket(key string, prefix string, e ...bool) error {
+	return kv.DeleteBucketCtx(context.Background(), key, prefix, e...)
+}
+
+// DeleteBucketCtx is DeleteBucket that gives up if ctx is done
+func (kv *KV) DeleteBucketCtx(ctx context.Context, key string, prefix string, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("delete:bucket", start)
+	defer func() { kv.countError("delete:bucket", err) }()
+	ctx, span := startSpan(ctx, "kv.delete_bucket", prefix, key)
+	defer func() { endSpan(span, err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	// "app/db/" names the db bucket itself
+	key = strings.TrimSuffix(key, "/")
+	buckets, k := parsePath(key)
+	err = kv.update(ctx, "delete:bucket", func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if err != nil {
+			return err
+		}
+		err = b.DeleteBucket([]byte(k))
+		if err != nil {
+			return err
+		}
+		if emit {
+			err = kv.queueEvent(ctx, tx, "delete:bucket", prefix, key, KVObject{})
+			if err != nil {
+				return err
+			}
+		}
+		if d := diffFrom(ctx); d != nil {
+			*d = ValueDiff{Key: key + "/", Op: "delete", Changes: []DiffChange{}}
+		}
+		if isDryRun(ctx) {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kv.changed()
+	kv.publish("delete:bucket", prefix, key, KVObject{})
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// changed bumps the generation after a write to the store
+func (kv *KV) changed() {
+	atomic.StoreInt64(&kv.modified, time.Now().UnixNano())
+	atomic.AddUint64(&kv.generation, 1)
+}
+
+// Generation returns a counter that increases on every write to the
+// store, along with the time of the last write
+func (kv *KV) Generation() (uint64, time.Time) {
+	return atomic.LoadUint64(&kv.generation), time.Unix(0, atomic.LoadInt64(&kv.modified))
+}
+
+// treeTruncated marks a bucket in a tree that was nested too deeply to
+// be enumerated
+const treeTruncated = "_truncated"
+
+// GetTree gets the db tree from the specified root to n-depth.
+// If root is not given, it returns the entire db tree. Buckets nested
+// deeper than kv.max_tree_depth are replaced with a truncation marker,
+// and truncated is set.
+func (kv *KV) GetTree(prefix string) (tree map[string]interface{}, truncated bool, err error) {
+	return kv.GetTreeCtx(context.Background(), prefix)
+}
+
+// GetTreeCtx is GetTree that gives up if ctx is done
+func (kv *KV) GetTreeCtx(ctx context.Context, prefix string) (tree map[string]interface{}, truncated bool, err error) {
+	start := time.Now()
+	defer kv.doMetrics("get:tree", start)
+	tree = map[string]interface{}{}
+	if err := ctx.Err(); err != nil {
+		return tree, false, err
+	}
+	buckets, k := parsePath("")
+	if k != "" {
+		buckets = append(buckets, k)
+	}
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if err != nil {
+			return err
+		}
+		tree, err = kv.enumerateBucket(b, kv.config().KV.MaxTreeDepth, &truncated)
+		return err
+	})
+	if err != nil {
+		return tree, truncated, err
+	}
+	return tree, truncated, nil
+}
+
+// treeRecord is a single key written by StreamTree. A bucket nested
+// too deeply to be streamed is written as a record for its path, with
+// Truncated set and no value.
+type treeRecord struct {
+	Path      string          `json:"path"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// StreamTree writes every key under prefix to w as newline-delimited
+// JSON, one record per key, without building the whole tree in memory.
+func (kv *KV) StreamTree(prefix string, w io.Writer) error {
+	return kv.StreamTreeCtx(context.Background(), prefix, w)
+}
+
+// StreamTreeCtx is StreamTree that stops writing once ctx is done, such
+// as when the client reading the stream goes away
+func (kv *KV) StreamTreeCtx(ctx context.Context, prefix string, w io.Writer) error {
+	start := time.Now()
+	defer kv.doMetrics("stream:tree", start)
+	enc := json.NewEncoder(w)
+	return kv.db.View(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, []string{}, prefix, false)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		return kv.streamBucket(ctx, b, "", kv.config().KV.MaxTreeDepth, enc)
+	})
+}
+
+func (kv *KV) streamBucket(ctx context.Context, bkt *bbolt.Bucket, path string, depth int, enc *json.Encoder) error {
+	c := bkt.Cursor()
+	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if v == nil {
+			if nested := bkt.Bucket(ea); nested != nil {
+				if depth <= 0 {
+					err := enc.Encode(treeRecord{Path: path + string(ea) + "/", Truncated: true})
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				err := kv.streamBucket(ctx, nested, path+string(ea)+"/", depth-1, enc)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		value, err := kv.unsealRaw(v)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(treeRecord{Path: path + string(ea), Value: value})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enumerateBucket builds the tree of bkt, going at most depth buckets
+// deeper. Buckets past that are replaced with a truncation marker and
+// truncated is set.
+func (kv *KV) enumerateBucket(bkt *bbolt.Bucket, depth int, truncated *bool) (map[string]interface{}, error) {
+	c := bkt.Cursor()
+	tree := map[string]interface{}{}
+	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+		isBucket := bkt.Bucket(ea)
+		if isBucket != nil && depth <= 0 {
+			tree[string(ea[:])] = map[string]interface{}{treeTruncated: true}
+			*truncated = true
+		} else if isBucket != nil {
+			sub, err := kv.enumerateBucket(isBucket, depth-1, truncated)
+			if err != nil {
+				return nil, err
+			}
+			tree[string(ea[:])] = sub
+		} else {
+			value, err := kv.unsealRaw(v)
+			if err != nil {
+				return nil, err
+			}
+			tree[string(ea[:])] = value
+		}
+	}
+	return tree, nil
+}
+
+func countBucket(bkt *bbolt.Bucket) int {
+	c := bkt.Cursor()
+	count := 0
+	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+		if v == nil {
+			if nested := bkt.Bucket(ea); nested != nil {
+				count += countBucket(nested)
+			}
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Lock takes a lock on key for kv.lock_ttl
+func (kv *KV) Lock(key string, prefix string, e ...bool) (l Lock, err error) {
+	return kv.LockTTL(key, prefix, 0, e...)
+}
+
+// LockTTL takes a lock on key that expires after ttl, or kv.lock_ttl
+// when ttl is 0
+func (kv *KV) LockTTL(key string, prefix string, ttl time.Duration, e ...bool) (l Lock, err error) {
+	start := time.Now()
+	defer kv.doMetrics("lock:create", start)
+	defer func() { kv.countError("lock:create", err) }()
+	defer func() { kv.lockMetrics(start, err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	if ttl == 0 {
+		ttl = kv.config().KV.LockTTL
+	}
+	err = checkLockTTL(ttl)
+	if err != nil {
+		return l, err
+	}
+	id, err := machineid.ID()
+	l = Lock{
+		Key:         key,
+		Prefix:      prefix,
+		LockID:      uuid.New().String(),
 		NodeID:      id,
 		NodeAddress: kv.app.Cluster.node.Addr(),
 		ClaimTime:   time.Now(),
-		ExpireTime:  time.Now().Add(5 * time.Minute),
+		ExpireTime:  time.Now().Add(ttl),
 	}
 	obj, err := kv.GetObject(key, prefix)
-	if err != nil {
-		return l, err
+	var serr *json.SyntaxError
+	if errors.As(err, &serr) || errors.Is(err, bbolt.ErrBucketNotFound) || (err == nil && len(obj.Data) == 0) {
+		// nothing stored at the key, or it has expired
+		return l, ErrKeyNotFound
 	}
-	obj.Locks = append(obj.Locks, l)
-	err = kv.PutObject(key, obj, prefix, obj.Secret, true)
 	if err != nil {
 		return l, err
 	}
-	return l, nil
+	if emit {
+		err = kv.clusterLock(l)
+		if err != nil {
+			return l, err
+		}
+	}
+	err = kv.updateLocks(context.Background(), "lock:create", key, prefix, emit, func(locks []Lock) ([]Lock, error) {
+		return append(locks, l), nil
+	})
+	return l, err
 }
 
 // Unlock function
-func (kv *KV) Unlock(lock Lock, e ...bool) error {
+func (kv *KV) Unlock(lock Lock, e ...bool) (err error) {
 	start := time.Now()
 	defer kv.doMetrics("lock:delete", start)
-	obj, err := kv.GetObject(lock.Key, lock.Prefix)
+	defer func() { kv.countError("lock:delete", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	err = kv.updateLocks(context.Background(), "lock:delete", lock.Key, lock.Prefix, emit, func(locks []Lock) ([]Lock, error) {
+		_, locks, err := withoutLock(locks, lock.LockID)
+		return locks, err
+	})
+	if err != nil {
+		return err
+	}
+	kv.wakeLockCounter()
+	return nil
+}
+
+// ForceUnlock removes a lock from key whoever holds it and whether or
+// not it has expired. It's meant for clearing locks left by a node that
+// died, so every use is logged.
+func (kv *KV) ForceUnlock(key string, prefix string, lockID string, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("lock:force-delete", start)
+	defer func() { kv.countError("lock:force-delete", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	var lock Lock
+	err = kv.updateLocks(context.Background(), "lock:force-delete", key, prefix, emit, func(locks []Lock) ([]Lock, error) {
+		var err error
+		lock, locks, err = withoutLock(locks, lockID)
+		return locks, err
+	})
+	if err != nil {
+		return err
+	}
+	kv.log.WarnF(nil, "Force released lock %s on %s held by node %s (%s) since %s", lockID, key, lock.NodeID, lock.NodeAddress, lock.ClaimTime.Format(time.RFC3339))
+	kv.wakeLockCounter()
+	return nil
+}
+
+// withoutLock returns the lock with ID id and locks without it, or
+// ErrUnknownLock when it isn't there
+func withoutLock(locks []Lock, id string) (Lock, []Lock, error) {
+	for i, l := range locks {
+		if l.LockID == id {
+			return l, append(locks[:i:i], locks[i+1:]...), nil
+		}
+	}
+	return Lock{}, locks, ErrUnknownLock
+}
+
+// updateLocks replaces the locks on key with what fn returns. Like
+// modify, the key is read and written in one transaction, so a write
+// made to it in between isn't lost. The key has to exist and not have
+// expired.
+func (kv *KV) updateLocks(ctx context.Context, op string, key string, prefix string, emit bool, fn func([]Lock) ([]Lock, error)) error {
+	buckets, k := parsePath(key)
+	var obj KVObject
+	err := kv.update(ctx, op, func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if errors.Is(err, bbolt.ErrBucketNotFound) {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		old := b.Get([]byte(k))
+		if old == nil {
+			return ErrKeyNotFound
+		}
+		obj = KVObject{}
+		err = json.Unmarshal(old, &obj)
+		if err != nil {
+			return err
+		}
+		if obj.expired(time.Now()) {
+			return ErrKeyNotFound
+		}
+		obj.Locks, err = fn(obj.Locks)
+		if err != nil {
+			return err
+		}
+		bobj, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		err = kv.recordHistory(tx, prefix, key, old, obj)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(k), bobj)
+		if err != nil || !emit {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "put:key", prefix, key, obj)
+	})
+	if err != nil {
+		return err
+	}
+	kv.changed()
+	if plain, err := kv.unseal(obj); err == nil {
+		kv.publish("put:key", prefix, key, plain)
+	}
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// ListLocks returns every unexpired lock held on a key, across the
+// default key space and all namespaces
+func (kv *KV) ListLocks() ([]Lock, error) {
+	start := time.Now()
+	defer kv.doMetrics("get:locks", start)
+	return kv.storedLocks(start)
+}
+
+// storedLocks returns every lock stored that's unexpired at now
+func (kv *KV) storedLocks(now time.Time) ([]Lock, error) {
+	locks := []Lock{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		for _, prefix := range kvPrefixes(tx) {
+			err := collectLocks(tx.Bucket([]byte(prefix)), now, &locks)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return locks, err
+}
+
+func collectLocks(bkt *bbolt.Bucket, now time.Time, locks *[]Lock) error {
+	if bkt == nil {
+		return nil
+	}
+	return bkt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return collectLocks(bkt.Bucket(k), now, locks)
+		}
+		obj := KVObject{}
+		err := json.Unmarshal(v, &obj)
+		if err != nil {
+			return err
+		}
+		for _, l := range obj.Locks {
+			if l.ExpireTime.After(now) {
+				*locks = append(*locks, l)
+			}
+		}
+		return nil
+	})
+}
+
+// lockMetrics records the outcome of a lock attempt that began at start
+func (kv *KV) lockMetrics(start time.Time, err error) {
+	wait := time.Since(start).Seconds()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	go func() {
+		kv.metrics["lock_acquisitions"].(*prometheus.CounterVec).WithLabelValues(result).Inc()
+		if err == nil {
+			kv.metrics["lock_wait"].(prometheus.Histogram).Observe(wait)
+		}
+	}()
+	if err == nil {
+		kv.wakeLockCounter()
+	}
+}
+
+// lockCountInterval is how often the locks this node holds are counted
+// again, so locks that expire drop out of the count
+const lockCountInterval = 10 * time.Second
+
+// countLocks sets the locks_active gauge to the number of unexpired
+// locks stored that this node holds, and lockCount to the number held
+// by any node
+func (kv *KV) countLocks() error {
+	locks, err := kv.storedLocks(time.Now())
+	if err != nil {
+		return err
+	}
+	id, err := machineid.ID()
 	if err != nil {
 		return err
 	}
-	index := -1
-	for idx, l := range obj.Locks {
-		if l.LockID == lock.LockID {
-			index = idx
-			break
+	held := 0
+	for _, l := range locks {
+		if l.NodeID == id {
+			held++
+		}
+	}
+	kv.metrics["locks_active"].(prometheus.Gauge).Set(float64(held))
+	atomic.StoreInt64(&kv.lockCount, int64(len(locks)))
+	return nil
+}
+
+// wakeLockCounter has the locks counted again after a lock was taken or
+// released
+func (kv *KV) wakeLockCounter() {
+	select {
+	case kv.locksChanged <- true:
+	default:
+	}
+}
+
+// lockCounter keeps the locks_active gauge up to date until stop is
+// closed
+func (kv *KV) lockCounter(stop chan bool) {
+	t := time.NewTicker(lockCountInterval)
+	defer t.Stop()
+	for {
+		err := kv.countLocks()
+		if err != nil {
+			kv.log.Error(nil, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-kv.locksChanged:
+		}
+	}
+}
+
+// encrypt seals a value for storage as a secret. While a key rotation
+// is running new secrets are written with the replacement key.
+func (kv *KV) encrypt(v interface{}) ([]byte, error) {
+	shared, next := kv.keys()
+	if shared == nil {
+		return nil, ErrSealed
+	}
+	if next != nil {
+		return encrytJSON(next, v)
+	}
+	return encrytJSON(shared, v)
+}
+
+// decrypt opens a secret with the shared key, falling back to the
+// replacement key while a key rotation is running
+func (kv *KV) decrypt(b []byte) ([]byte, error) {
+	shared, next := kv.keys()
+	if shared == nil {
+		return nil, ErrSealed
+	}
+	data, err := decryptJSON(shared, b)
+	if err != nil && next != nil {
+		return decryptJSON(next, b)
+	}
+	return data, err
+}
+
+// keys returns the shared key, nil while the node is sealed, and the
+// key a rotation in progress is moving to
+func (kv *KV) keys() (shared *AESKey, next *AESKey) {
+	kv.keyLock.RLock()
+	defer kv.keyLock.RUnlock()
+	return kv.sharedkey, kv.nextkey
+}
+
+// setKeys replaces the shared key and the rotation's replacement key
+func (kv *KV) setKeys(shared *AESKey, next *AESKey) {
+	kv.keyLock.Lock()
+	defer kv.keyLock.Unlock()
+	kv.sharedkey = shared
+	kv.nextkey = next
+}
+
+// setNextKey sets the key a rotation is moving to
+func (kv *KV) setNextKey(next *AESKey) {
+	kv.keyLock.Lock()
+	defer kv.keyLock.Unlock()
+	kv.nextkey = next
+}
+
+// seal encrypts a value that isn't a secret with the shared key when
+// encryption at rest is turned on
+func (kv *KV) seal(obj KVObject) (KVObject, error) {
+	if !kv.config().KV.EncryptAtRest || obj.Secret || obj.Sealed {
+		return obj, nil
+	}
+	data, err := kv.encrypt(obj.Data)
+	if err != nil {
+		return obj, err
+	}
+	obj.Data = data
+	obj.Sealed = true
+	return obj, nil
+}
+
+// unseal returns obj with its value decrypted if it was sealed. Sealed
+// values are always opened, even with encryption at rest turned off,
+// so turning it off doesn't strand existing data.
+func (kv *KV) unseal(obj KVObject) (KVObject, error) {
+	if !obj.Sealed {
+		return obj, nil
+	}
+	data, err := kv.decrypt(obj.Data)
+	if err != nil {
+		return obj, fmt.Errorf("unable to unseal value: %w", err)
+	}
+	obj.Data = data
+	obj.Sealed = false
+	return obj, nil
+}
+
+// unsealRaw unseals a stored object without decoding it when it isn't
+// sealed
+func (kv *KV) unsealRaw(v []byte) (json.RawMessage, error) {
+	if !bytes.Contains(v, []byte(`"sealed":true`)) {
+		return json.RawMessage(v), nil
+	}
+	obj := KVObject{}
+	err := json.Unmarshal(v, &obj)
+	if err != nil {
+		return nil, err
+	}
+	obj, err = kv.unseal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+// Decrypt opens a secret object with the key it was written with
+func (kv *KV) Decrypt(obj KVObject) ([]byte, error) {
+	if obj.KeyName == "" {
+		return kv.decrypt(obj.Data)
+	}
+	key, err := kv.namedKey(obj.KeyName, false)
+	if err != nil {
+		return nil, err
+	}
+	return decryptJSON(key, obj.Data)
+}
+
+func (kv *KV) encryptWith(name string, v interface{}) ([]byte, error) {
+	if name == "" {
+		return kv.encrypt(v)
+	}
+	key, err := kv.namedKey(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return encrytJSON(key, v)
+}
+
+// keyName returns the keyring key used for secrets at path. With
+// kv.namespacekeys on, secrets in a namespace use the namespace's own
+// key, named after its bucket and created with InitNamespaceKey.
+// Otherwise the longest matching prefix from the config is picked. An
+// empty name means the shared key.
+func (kv *KV) keyName(prefix string, path string) string {
+	if kv.config().KV.NamespaceKeys && strings.HasPrefix(prefix, nsPrefix) {
+		return prefix
+	}
+	name := ""
+	match := -1
+	for p, n := range kv.config().KV.KeyPrefixes {
+		if strings.HasPrefix(path, p) && len(p) > match {
+			name = n
+			match = len(p)
+		}
+	}
+	return name
+}
+
+// namedKey looks up a key in the keyring. Keys are stored in the
+// _system bucket wrapped with the shared key. If create is set, a
+// missing key is generated and sent to the rest of the cluster.
+// Namespace keys are never created here and have to be unsealed first.
+func (kv *KV) namedKey(name string, create bool) (*AESKey, error) {
+	if name == "" {
+		shared, _ := kv.keys()
+		if shared == nil {
+			return nil, ErrSealed
 		}
+		return shared, nil
 	}
-	obj.Locks = append(obj.Locks[:index], obj.Locks[index+1:]...)
-	err = kv.PutObject(lock.Key, obj, lock.Prefix, obj.Secret, true)
+	if key := kv.crypto.cachedKey(name); key != nil {
+		return key, nil
+	}
+	kv.crypto.keyLock.Lock()
+	defer kv.crypto.keyLock.Unlock()
+	var wrapped []byte
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("keyring"))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			wrapped = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(name, nsPrefix) {
+		// namespace keys are wrapped with their own unseal key and only
+		// ever opened by UnsealNamespace
+		ns := strings.TrimPrefix(name, nsPrefix)
+		if wrapped == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoNamespaceKey, ns)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceSealed, ns)
+	}
+	if wrapped == nil {
+		if !create {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, name)
+		}
+		return kv.createKey(name)
+	}
+	b, err := kv.decrypt(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	var key *AESKey
+	err = json.Unmarshal(b, &key)
+	if err != nil {
+		return nil, err
+	}
+	kv.crypto.keyring[name] = key
+	return key, nil
+}
+
+// createKey must be called with the keyring lock held
+func (kv *KV) createKey(name string) (*AESKey, error) {
+	key, err := newAESKey()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := kv.encrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	err = kv.putWrappedKey(context.Background(), name, wrapped, true)
+	if err != nil {
+		return nil, err
+	}
+	kv.crypto.keyring[name] = key
+	kv.log.InfoF(nil, "Created keyring key %s", name)
+	return key, nil
+}
+
+// putWrappedKey stores a wrapped keyring key, queueing it for peers in
+// the same transaction when emit is set
+func (kv *KV) putWrappedKey(ctx context.Context, name string, wrapped []byte, emit bool) error {
+	err := kv.update(ctx, "put:keyring", func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket([]byte("_system")).CreateBucketIfNotExists([]byte("keyring"))
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(name), wrapped)
+		if err != nil || !emit {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "put:keyring", "kv", name, KVObject{
+			LastUpdated: time.Now(),
+			Data:        wrapped,
+		})
+	})
 	if err != nil {
 		return err
 	}
+	if emit {
+		kv.wakeOutbox()
+	}
 	return nil
 }
+
+// rewrapKeyring wraps every keyring key wrapped with shared with the
+// new shared key. Namespace keys have their own unseal keys and are
+// left alone.
+func (kv *KV) rewrapKeyring(shared *AESKey, next *AESKey) error {
+	ctx := context.Background()
+	err := kv.update(ctx, "rotate:keyring", func(tx *bbolt.Tx) error {
+		rewrapped := map[string][]byte{}
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("keyring"))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for name, v := c.First(); name != nil; name, v = c.Next() {
+			if bytes.HasPrefix(name, []byte(nsPrefix)) {
+				continue
+			}
+			data, err := decryptJSON(shared, v)
+			if err != nil {
+				if _, nerr := decryptJSON(next, v); nerr == nil {
+					continue
+				}
+				return fmt.Errorf("Keyring key %s can't be decrypted with the current or new key", name)
+			}
+			wrapped, err := encrytJSON(next, data)
+			if err != nil {
+				return err
+			}
+			rewrapped[string(name)] = wrapped
+		}
+		for name, wrapped := range rewrapped {
+			err := b.Put([]byte(name), wrapped)
+			if err != nil {
+				return err
+			}
+			err = kv.queueEvent(ctx, tx, "put:keyring", "kv", name, KVObject{
+				LastUpdated: time.Now(),
+				Data:        wrapped,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kv.wakeOutbox()
+	return nil
+}
+
+// RotateSharedKey re-encrypts every secret with a new shared key.
+// The new key is sealed to disk before any secret is touched and
+// secrets already using it are skipped, so an interrupted rotation
+// can be finished by running it again.
+func (kv *KV) RotateSharedKey() error {
+	start := time.Now()
+	defer kv.doMetrics("system:rotatekey", start)
+	kv.rotating.Lock()
+	defer kv.rotating.Unlock()
+	shared, _ := kv.keys()
+	if shared == nil {
+		return ErrSealed
+	}
+	next, err := kv.crypto.unsealKey(pendingKeyPath, kv.crypto.sealingKey())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		next, err = newAESKey()
+		if err != nil {
+			return err
+		}
+		err = kv.crypto.sealKey(pendingKeyPath, next, kv.crypto.sealingKey())
+		if err != nil {
+			return err
+		}
+	} else {
+		kv.log.Info(nil, "Resuming interrupted shared key rotation")
+	}
+	kv.setNextKey(next)
+	err = kv.app.Cluster.SendKey(next, "sync:nextkey")
+	if err != nil {
+		return err
+	}
+	paths := map[string][]string{}
+	total := 0
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		for _, prefix := range kvPrefixes(tx) {
+			paths[prefix] = secretPaths(tx.Bucket([]byte(prefix)), "")
+			total += len(paths[prefix])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	batch := 100
+	for prefix, keys := range paths {
+		for i := 0; i < len(keys); i += batch {
+			end := i + batch
+			if end > len(keys) {
+				end = len(keys)
+			}
+			err := kv.rotateBatch(prefix, keys[i:end], shared, next)
+			if err != nil {
+				return err
+			}
+			kv.wakeOutbox()
+		}
+	}
+	err = kv.rotateHistory(shared, next)
+	if err != nil {
+		return err
+	}
+	err = kv.rewrapKeyring(shared, next)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(pendingKeyPath, sharedKeyPath)
+	if err != nil {
+		return err
+	}
+	kv.setKeys(next, nil)
+	kv.log.InfoF(nil, "Rotated shared key, re-encrypted %v secrets", total)
+	return kv.app.Cluster.SendKey(next, "sync:rotatekey")
+}
+
+// rotateBatch re-encrypts a batch of secrets under prefix with next,
+// queueing each for peers in the same transaction
+func (kv *KV) rotateBatch(prefix string, paths []string, shared *AESKey, next *AESKey) error {
+	ctx := context.Background()
+	return kv.update(ctx, "rotate:key", func(tx *bbolt.Tx) error {
+		for _, p := range paths {
+			buckets, k := parsePath(p)
+			b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+			if err != nil {
+				// deleted since the walk
+				continue
+			}
+			v := b.Get([]byte(k))
+			if v == nil {
+				continue
+			}
+			var obj KVObject
+			err = json.Unmarshal(v, &obj)
+			if err != nil || !(obj.Secret || obj.Sealed) || obj.KeyName != "" {
+				// keyring secrets keep their key, only the key is rewrapped
+				continue
+			}
+			data, err := decryptJSON(shared, obj.Data)
+			if err != nil {
+				if _, nerr := decryptJSON(next, obj.Data); nerr == nil {
+					// already rotated
+					continue
+				}
+				return fmt.Errorf("Secret %s can't be decrypted with the current or new key", p)
+			}
+			obj.Data, err = encrytJSON(next, data)
+			if err != nil {
+				return err
+			}
+			obj.LastUpdated = time.Now()
+			bobj, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(k), bobj)
+			if err != nil {
+				return err
+			}
+			err = kv.queueEvent(ctx, tx, "put:key", prefix, p, obj)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// secretPaths returns the path of every secret and sealed value
+// under bkt
+func secretPaths(bkt *bbolt.Bucket, path string) []string {
+	paths := []string{}
+	c := bkt.Cursor()
+	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+		if v == nil {
+			if nested := bkt.Bucket(ea); nested != nil {
+				paths = append(paths, secretPaths(nested, path+string(ea)+"/")...)
+			}
+			continue
+		}
+		var obj KVObject
+		if json.Unmarshal(v, &obj) == nil && (obj.Secret || obj.Sealed) {
+			paths = append(paths, path+string(ea))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestContentType(t *testing.T) {
+	cases := map[string]string{
+		`{"a": 1}`:       "application/json",
+		`[1, 2]`:         "application/json",
+		`42`:             "application/json",
+		"plain text":     "text/plain; charset=UTF-8",
+		"two\nlines\t!":  "text/plain; charset=UTF-8",
+		"\x00\x01binary": "application/octet-stream",
+		"\xff\xfe":       "application/octet-stream",
+	}
+	for value, want := range cases {
+		if got := contentType([]byte(value)); got != want {
+			t.Errorf("contentType(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestPutStoresContentType(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	cases := map[string]string{
+		"contenttype/json":   `{"name": "cave"}`,
+		"contenttype/text":   "hello",
+		"contenttype/binary": "\x00\x01\x02",
+	}
+	for key, value := range cases {
+		err := kv.PutCtx(ctx, key, []byte(value), "kv", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := kv.GetObjectCtx(ctx, key, "kv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := contentType([]byte(value)); obj.ContentType != want {
+			t.Errorf("%s stored as %q, want %q", key, obj.ContentType, want)
+		}
+	}
+}
+
+func TestSecretKeepsPlaintextContentType(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	err := kv.PutCtx(ctx, "contenttype/secret", []byte("not json"), "kv", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := kv.GetObjectCtx(ctx, "contenttype/secret", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ContentType != "text/plain; charset=UTF-8" {
+		t.Errorf("secret stored as %q, want the type of its plaintext", obj.ContentType)
+	}
+}
+
+func TestGetReturnsContentType(t *testing.T) {
+	cases := map[string]string{
+		"contenttype/api/json": `{"name": "cave"}`,
+		"contenttype/api/text": "hello",
+	}
+	for key, value := range cases {
+		rec := request("POST", "/api/v1/kv/"+key, strings.NewReader(value))
+		if rec.Code != 200 {
+			t.Fatalf("put %s: %d %s", key, rec.Code, rec.Body)
+		}
+		rec = request("GET", "/api/v1/kv/"+key, nil)
+		if rec.Code != 200 {
+			t.Fatalf("get %s: %d %s", key, rec.Code, rec.Body)
+		}
+		if got, want := rec.Header().Get("Content-Type"), contentType([]byte(value)); got != want {
+			t.Errorf("%s served as %q, want %q", key, got, want)
+		}
+		if rec.Body.String() != value {
+			t.Errorf("%s = %q, want %q", key, rec.Body, value)
+		}
+	}
+}
+
+func TestBatchDeletes(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	for _, key := range []string{"batch/keep", "batch/gone", "batch/sub/a"} {
+		if err := kv.PutCtx(ctx, key, []byte("v"), "kv", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := kv.Batch(withDryRun(ctx), []QueryObject{
+		{Verb: "DELETE", Key: "batch/gone"},
+		{Verb: "DELETE", Key: "batch/sub/"},
+	}, "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.GetObjectCtx(ctx, "batch/gone", "kv"); err != nil {
+		t.Errorf("dry run deleted batch/gone: %v", err)
+	}
+	err = kv.Batch(ctx, []QueryObject{
+		{Verb: "DELETE", Key: "batch/gone"},
+		{Verb: "DELETE", Key: "batch/missing"},
+		{Verb: "DELETE", Key: "batch/sub/"},
+	}, "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.GetObjectCtx(ctx, "batch/gone", "kv"); err == nil {
+		t.Error("batch/gone wasn't deleted")
+	}
+	if _, err := kv.GetObjectCtx(ctx, "batch/sub/a", "kv"); err == nil {
+		t.Error("batch/sub/ wasn't deleted")
+	}
+	if _, err := kv.GetObjectCtx(ctx, "batch/keep", "kv"); err != nil {
+		t.Errorf("batch/keep: %v", err)
+	}
+}
+
+func TestLockKeepsConcurrentWrites(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	if err := kv.PutCtx(ctx, "locks/counter", []byte("0"), "kv", false); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := kv.IncrementCtx(ctx, "locks/counter", "kv", 1); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	locks := []Lock{}
+	for i := 0; i < 10; i++ {
+		l := Lock{Key: "locks/counter", Prefix: "kv", LockID: fmt.Sprint(i), ExpireTime: time.Now().Add(time.Minute)}
+		err := kv.updateLocks(ctx, "lock:create", l.Key, l.Prefix, false, func(held []Lock) ([]Lock, error) {
+			return append(held, l), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		locks = append(locks, l)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	obj, err := kv.GetObjectCtx(ctx, "locks/counter", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Data) != "50" {
+		t.Errorf("counter is %s after locking, want 50", obj.Data)
+	}
+	if len(obj.Locks) != len(locks) {
+		t.Errorf("%d locks stored, want %d", len(obj.Locks), len(locks))
+	}
+	for _, l := range locks {
+		if err := kv.Unlock(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.Unlock(locks[0]); err != ErrUnknownLock {
+		t.Errorf("second unlock: %v", err)
+	}
+}
+
+func TestEpochWindow(t *testing.T) {
+	w := &epochWindow{}
+	base := uint64(time.Now().UnixNano())
+	// out of order, within the window
+	order := []uint64{}
+	for i := uint64(0); i < 1000; i++ {
+		order = append(order, base+(i*7919)%1000)
+	}
+	for _, e := range order {
+		if !w.accept(e) {
+			t.Fatalf("epoch %d wasn't accepted the first time", e-base)
+		}
+	}
+	for _, e := range order {
+		if w.accept(e) {
+			t.Fatalf("epoch %d was accepted twice", e-base)
+		}
+	}
+	newest := base + 999 + epochWindowSize
+	if !w.accept(newest) {
+		t.Fatal("newer epoch wasn't accepted")
+	}
+	if w.accept(base + 999) {
+		t.Error("epoch older than the window was accepted")
+	}
+	if !w.accept(newest-epochWindowSize+1) || w.accept(newest-epochWindowSize+1) {
+		t.Error("oldest epoch in the window wasn't accepted exactly once")
+	}
+}
+
+func TestEncryptAtRest(t *testing.T) {
+	kv := testApp.KV
+	if kv.config().KV.EncryptAtRest {
+		t.Fatal("values are encrypted at rest by default")
+	}
+	if err := kv.Put("atrest/plain", []byte("hello"), "kv", false); err != nil {
+		t.Fatal(err)
+	}
+	if v := kv.storedValue("kv", "atrest/plain"); v.Value.Sealed {
+		t.Error("value was encrypted at rest with kv.encryptatrest off")
+	}
+	cur := *kv.config()
+	on := cur
+	on.KV.EncryptAtRest = true
+	kv.liveConfig.v.Store(&on)
+	defer kv.liveConfig.v.Store(&cur)
+	if err := kv.Put("atrest/sealed", []byte("hello"), "kv", false); err != nil {
+		t.Fatal(err)
+	}
+	v := kv.storedValue("kv", "atrest/sealed")
+	if !v.Value.Sealed || string(v.Value.Data) == "hello" {
+		t.Error("value wasn't encrypted at rest with kv.encryptatrest on")
+	}
+	obj, err := kv.GetObject("atrest/sealed", "kv")
+	if err != nil || string(obj.Data) != "hello" {
+		t.Errorf("read back %q, %v", obj.Data, err)
+	}
+}
+
+func TestDeepTreeIsTruncated(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	key := "deeptree/" + strings.Repeat("d/", 10000) + "leaf"
+	if err := kv.PutCtx(ctx, key, []byte("v"), "kv", false); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.DeleteBucketCtx(ctx, "deeptree/", "kv")
+	tree, truncated, err := kv.GetTreeCtx(ctx, "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("a 10,000 deep tree wasn't truncated")
+	}
+	depth := 0
+	node, _ := tree["deeptree"].(map[string]interface{})
+	for node != nil && node[treeTruncated] == nil {
+		node, _ = node["d"].(map[string]interface{})
+		depth++
+	}
+	if max := kv.config().KV.MaxTreeDepth; node == nil || depth > max {
+		t.Errorf("tree went %d buckets deep before the marker, want at most %d", depth, max)
+	}
+	var out strings.Builder
+	if err := kv.StreamTreeCtx(ctx, "kv", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"truncated":true`) {
+		t.Error("streamed tree has no truncated record")
+	}
+}
+
+func TestSearchValuesAuditsSecrets(t *testing.T) {
+	kv := testApp.KV
+	ctx := withRequester(context.Background(), "searcher")
+	if err := kv.PutCtx(ctx, "searchaudit/secret", []byte("needle"), "kv", true); err != nil {
+		t.Fatal(err)
+	}
+	cur := *kv.config()
+	on := cur
+	on.KV.ValueSearch = true
+	kv.liveConfig.v.Store(&on)
+	defer kv.liveConfig.v.Store(&cur)
+	keys, err := kv.SearchValuesCtx(ctx, "needle", "kv", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "searchaudit/secret" {
+		t.Errorf("found %v, want searchaudit/secret", keys)
+	}
+	trail, err := kv.AuditTrail("kv", "searchaudit/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	for _, e := range trail {
+		if e.Operation == "get:key" && e.Requester == "searcher" {
+			reads++
+		}
+	}
+	if reads != 1 {
+		t.Errorf("audit trail %+v, want one read by searcher", trail)
+	}
+}
+
+func TestCompactKeepsData(t *testing.T) {
+	kv := testApp.KV
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("compact/%d", i)
+		if err := kv.PutCtx(ctx, key, []byte("v"), "kv", false); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := kv.DeleteKeyCtx(ctx, key, "kv"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := kv.PutCtx(ctx, "compact/secret", []byte("hidden"), "kv", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kv.GetKeysCtx(ctx, "compact/", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 51 {
+		t.Errorf("%d keys after compacting, want 51", len(keys))
+	}
+	obj, err := kv.GetObjectCtx(ctx, "compact/secret", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := kv.Decrypt(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hidden" {
+		t.Errorf("secret = %q after compacting, want hidden", data)
+	}
+	if err := kv.PutCtx(ctx, "compact/after", []byte("v"), "kv", false); err != nil {
+		t.Errorf("write after compacting: %v", err)
+	}
+}
+
+func TestCheckDBWithoutBuckets(t *testing.T) {
+	db, err := bbolt.Open("checkdb.db", 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("checkdb.db")
+	defer db.Close()
+	if err := checkDB(db); err != nil {
+		t.Errorf("empty database: %v", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("kv"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("{}"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDB(db); err != nil {
+		t.Errorf("database without _system: %v", err)
+	}
+}
+
+func TestOutboxCursors(t *testing.T) {
+	kv := &KV{app: testApp, log: testApp.Logger, outboxPeers: map[string]*outboxPeer{}}
+	from := kv.outboxCursors([]string{"a", "b"}, false)
+	if from["a"] != 0 || from["b"] != 0 {
+		t.Fatalf("new peers start at %v, want 0", from)
+	}
+	if through := kv.outboxSent(map[string]uint64{"a": 5, "b": 3}, 5, 5); through != 0 {
+		t.Errorf("deleting through %d before any acks", through)
+	}
+	kv.outboxPeers["a"].acked = 5
+	kv.outboxPeers["b"].acked = 3
+	if through := kv.outboxSent(nil, 5, 5); through != 3 {
+		t.Errorf("deleting through %d, want the slowest peer's ack 3", through)
+	}
+	from = kv.outboxCursors([]string{"a", "b", "c"}, false)
+	if from["a"] != 5 || from["b"] != 3 || from["c"] != 5 {
+		t.Errorf("cursors %v, want a 5, b 3 and the new peer at 5", from)
+	}
+	kv.outboxPeers["b"].progress = time.Now().Add(-2 * outboxAckTimeout)
+	kv.outboxPeers["b"].sent = 5
+	if from = kv.outboxCursors([]string{"a", "b"}, true); from["b"] != 3 {
+		t.Errorf("b resent from %d, want its last ack 3", from["b"])
+	}
+	if _, ok := kv.outboxPeers["c"]; ok {
+		t.Error("c's cursor was kept after it left")
+	}
+	kv.outboxPeers["b"].acked = 5
+	if through := kv.outboxSent(nil, 5, 8); through != 8 {
+		t.Errorf("deleting through %d, want 8 past another node's events", through)
+	}
+}
+
+func TestAppliedIndexesAreContiguous(t *testing.T) {
+	a := newAppliedIndexes()
+	if a.done("peer", 10, 11) {
+		t.Fatal("11 done before it was applied")
+	}
+	a.finish("peer", 12, 13)
+	if n, _ := a.applied("peer"); n != 10 {
+		t.Errorf("applied %d with 11 and 12 missing, want 10", n)
+	}
+	a.finish("peer", 10, 11)
+	if n, _ := a.applied("peer"); n != 11 {
+		t.Errorf("applied %d, want 11", n)
+	}
+	// 12 failed and is sent again
+	a.finish("peer", 11, 12)
+	if n, _ := a.applied("peer"); n != 13 {
+		t.Errorf("applied %d once the gap was filled, want 13", n)
+	}
+	if !a.done("peer", 12, 13) || !a.done("peer", 0, 5) {
+		t.Error("updates already applied aren't reported done")
+	}
+}
+
+func TestNamespaceKeys(t *testing.T) {
+	kv := testApp.KV
+	cur := *kv.config()
+	on := cur
+	on.KV.NamespaceKeys = true
+	kv.liveConfig.v.Store(&on)
+	defer kv.liveConfig.v.Store(&cur)
+	prefix := nsPrefix + "tenant"
+	err := kv.Put("secret", []byte("hello"), prefix, true)
+	if !errors.Is(err, ErrNoNamespaceKey) {
+		t.Fatalf("secret written to a namespace without a key: %v", err)
+	}
+	unsealKey, err := kv.InitNamespaceKey("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.InitNamespaceKey("tenant"); !errors.Is(err, ErrNamespaceKeyExists) {
+		t.Errorf("namespace key created twice: %v", err)
+	}
+	if err := kv.Put("secret", []byte("hello"), prefix, true); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := kv.GetObject("secret", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the shared key mustn't open the namespace key
+	var wrapped []byte
+	kv.db.View(func(tx *bbolt.Tx) error {
+		wrapped = append([]byte{}, tx.Bucket([]byte("_system")).Bucket([]byte("keyring")).Get([]byte(prefix))...)
+		return nil
+	})
+	if _, err := kv.decrypt(wrapped); err == nil {
+		t.Error("namespace key opens with the shared key")
+	}
+	if err := kv.SealNamespace("tenant"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Decrypt(obj); !errors.Is(err, ErrNamespaceSealed) {
+		t.Errorf("secret decrypted with the namespace sealed: %v", err)
+	}
+	other, err := kv.InitNamespaceKey("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.UnsealNamespace("tenant", other); !errors.Is(err, ErrBadNamespaceKey) {
+		t.Errorf("namespace unsealed with another namespace's key: %v", err)
+	}
+	if err := kv.UnsealNamespace("tenant", unsealKey); err != nil {
+		t.Fatal(err)
+	}
+	data, err := kv.Decrypt(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("decrypted %q, want hello", data)
+	}
+}
+
+func TestInitUnseal(t *testing.T) {
+	kv := testApp.KV
+	c := kv.crypto
+	if _, err := kv.InitUnseal(); !errors.Is(err, ErrSharesOff) {
+		t.Fatalf("shares handed out with unseal shares off: %v", err)
+	}
+	if _, err := kv.Seal(); err != ErrNotInitialised {
+		t.Fatalf("sealed before the unseal shares were handed out: %v", err)
+	}
+	cur := *kv.config()
+	on := cur
+	on.KV.UnsealShares = 3
+	on.KV.UnsealThreshold = 2
+	kv.liveConfig.v.Store(&on)
+	c.threshold = 2
+	shared, _ := kv.keys()
+	defer func() {
+		kv.liveConfig.v.Store(&cur)
+		c.threshold = 0
+		c.initialised = false
+		c.masterkey = nil
+		c.sealed = false
+		c.sharedkey = shared
+		c.sealKey(sharedKeyPath, shared, c.privkey)
+		kv.setKeys(shared, nil)
+		kv.db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("_system")).Delete([]byte(unsealMarker))
+		})
+	}()
+	shares, err := kv.InitUnseal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 3 {
+		t.Fatalf("got %d shares, want 3", len(shares))
+	}
+	if _, err := os.Stat("cluster.key.shares"); !os.IsNotExist(err) {
+		t.Error("unseal shares were written to disk")
+	}
+	if _, err := c.unsealKey(sharedKeyPath, c.privkey); err == nil {
+		t.Error("shared key still opens with the machine ID")
+	}
+	if _, err := kv.InitUnseal(); !errors.Is(err, ErrInitialised) {
+		t.Errorf("shares handed out twice: %v", err)
+	}
+	if _, err := kv.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Unseal(""); err != ErrBadShare {
+		t.Errorf("unsealed without a share: %v", err)
+	}
+	status, err := kv.Unseal(shares[0])
+	if err != nil || !status.Sealed {
+		t.Fatalf("unsealed with one share: %+v, %v", status, err)
+	}
+	status, err = kv.Unseal(shares[2])
+	if err != nil || status.Sealed {
+		t.Fatalf("not unsealed with two shares: %+v, %v", status, err)
+	}
+	if key, _ := kv.keys(); key == nil || !bytes.Equal(key.Pass, shared.Pass) {
+		t.Error("unsealed a different shared key")
+	}
+	if c.sharedkey == nil || !bytes.Equal(c.sharedkey.Pass, shared.Pass) {
+		t.Error("the crypto copy of the shared key wasn't restored")
+	}
+	// a node that missed the shares being handed out
+	c.initialised = false
+	c.masterkey = nil
+	c.sealed = true
+	c.sealKey(sharedKeyPath, shared, c.privkey)
+	kv.setKeys(nil, nil)
+	if _, err := kv.Unseal(shares[0]); err != nil {
+		t.Fatal(err)
+	}
+	status, err = kv.Unseal(shares[1])
+	if err != nil || status.Sealed {
+		t.Fatalf("node that missed init not unsealed: %+v, %v", status, err)
+	}
+	if _, err := c.unsealKey(sharedKeyPath, c.privkey); err == nil {
+		t.Error("shared key not resealed with the unseal shares")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// heartbeatInterval is how often writable nodes announce
+	// themselves as leader candidates
+	heartbeatInterval = 2 * time.Second
+	// leaderTimeout is how long a candidate can go without a
+	// heartbeat before it's dropped and a new leader chosen
+	leaderTimeout = 10 * time.Second
+)
+
+// candidate is a writable node that could be elected leader
+type candidate struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	lastSeen time.Time
+}
+
+// LeaderInfo describes the current cluster leader
+type LeaderInfo struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Self    bool   `json:"self"`
+	Static  bool   `json:"static"`
+}
+
+// elect sends this node's heartbeats and re-runs the election until
+// stop is closed. Every writable node announces itself, and each node
+// picks the candidate with the lowest ID it has heard from recently,
+// so all nodes settle on the same leader without coordinating.
+func (c *Cluster) elect(stop chan bool) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+	for {
+		if !c.ReadOnly() {
+			b, err := json.Marshal(candidate{ID: c.node.ID().ID.String(), Address: c.node.Addr()})
+			if err == nil {
+				err = c.Emit("cluster", b, "leader:heartbeat")
+			}
+			if err != nil {
+				c.log.Error(nil, err)
+			}
+		}
+		c.chooseLeader()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleHeartbeat records a heartbeat from a leader candidate
+func (c *Cluster) handleHeartbeat(msg Message) error {
+	var cand candidate
+	err := json.Unmarshal(msg.Data, &cand)
+	if err != nil {
+		return err
+	}
+	cand.lastSeen = time.Now()
+	c.leaderLock.Lock()
+	c.candidates[cand.ID] = cand
+	c.leaderLock.Unlock()
+	return nil
+}
+
+// chooseLeader elects the live candidate with the lowest node ID. A
+// leader set in the config is always used instead.
+func (c *Cluster) chooseLeader() {
+	if c.config().Cluster.Leader != "" {
+		return
+	}
+	c.leaderLock.Lock()
+	defer c.leaderLock.Unlock()
+	best := candidate{}
+	if !c.ReadOnly() {
+		best = candidate{ID: c.node.ID().ID.String(), Address: c.node.Addr()}
+	}
+	for id, cand := range c.candidates {
+		if time.Since(cand.lastSeen) > leaderTimeout {
+			delete(c.candidates, id)
+			continue
+		}
+		if best.ID == "" || cand.ID < best.ID {
+			best = cand
+		}
+	}
+	if best.Address != c.leader {
+		if best.Address == "" {
+			c.log.Warn(nil, "Lost the cluster leader and no writable node is available")
+		} else {
+			c.log.InfoF(nil, "Elected %s as cluster leader", best.Address)
+		}
+	}
+	c.leader = best.Address
+	c.leaderID = best.ID
+}
+
+// IsLeader reports whether this node is the cluster leader. A node
+// running on its own is always the leader.
+func (c *Cluster) IsLeader() bool {
+	if c.config().Mode == "dev" {
+		return true
+	}
+	return c.Leader() == c.node.Addr()
+}
+
+// LeaderInfo returns the current leader
+func (c *Cluster) LeaderInfo() LeaderInfo {
+	if c.config().Mode == "dev" {
+		return LeaderInfo{Address: c.advertiseHost, Self: true}
+	}
+	c.leaderLock.RLock()
+	defer c.leaderLock.RUnlock()
+	return LeaderInfo{
+		ID:      c.leaderID,
+		Address: c.leader,
+		Self:    c.leader == c.node.Addr(),
+		Static:  c.config().Cluster.Leader != "",
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/perlin-network/noise"
+)
+
+const (
+	// leaveFlushTimeout is how long a leaving node waits for its queued
+	// updates to reach its peers before announcing that it's gone
+	leaveFlushTimeout = 30 * time.Second
+	// departedTTL is how long a peer that left is kept out of the peer
+	// list. A node that restarts comes back with a new ID, so this only
+	// has to outlast the node being stopped.
+	departedTTL = time.Hour
+)
+
+// LeaveResult is the answer to a leave request. Backlog is how many
+// queued updates were still owed to peers when the node left, and
+// Unreached the peers that didn't hear it was leaving.
+type LeaveResult struct {
+	Message   string   `json:"message"`
+	Backlog   int      `json:"backlog"`
+	Unreached []string `json:"unreached"`
+}
+
+// Leaving reports whether this node has left the cluster
+func (c *Cluster) Leaving() bool {
+	return atomic.LoadInt32(&c.leaving) == 1
+}
+
+// ReadOnly reports whether this node passes writes on instead of
+// applying them, because it's a read-only replica, it's leaving the
+// cluster or it can't sign updates while its shared key is sealed
+func (c *Cluster) ReadOnly() bool {
+	return c.config().Cluster.ReadOnly || c.Leaving() || c.app.Crypto.Sealed()
+}
+
+// Leave takes this node out of the cluster. It stops taking writes and
+// standing for leader, sends its queued updates, then tells its peers
+// it's gone so they drop it straight away.
+func (c *Cluster) Leave(ctx context.Context) LeaveResult {
+	atomic.StoreInt32(&c.leaving, 1)
+	c.chooseLeader()
+	c.log.Info(nil, "Leaving the cluster")
+	backlog := c.app.KV.drainOutbox(ctx, leaveFlushTimeout)
+	unreached := c.SendTo(ctx, nil, "cluster", []byte(c.node.ID().ID.String()), "cluster:leave")
+	return LeaveResult{
+		Message:   "Left the cluster, this node can be stopped",
+		Backlog:   backlog,
+		Unreached: unreached,
+	}
+}
+
+// drainOutbox sends queued updates until none are left or timeout
+// passes, and returns how many are left
+func (kv *KV) drainOutbox(ctx context.Context, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		kv.wakeOutbox()
+		backlog, err := kv.outboxBacklog()
+		if err != nil {
+			kv.log.Error(nil, err)
+		}
+		if backlog == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return backlog
+		case <-t.C:
+		}
+	}
+}
+
+// handleLeave drops a peer that announced it's leaving. The sender is
+// taken from the connection rather than the message.
+func (c *Cluster) handleLeave(id noise.ID) {
+	key := id.ID.String()
+	c.departedLock.Lock()
+	c.departed[key] = time.Now()
+	c.departedLock.Unlock()
+	c.peerLock.Lock()
+	c.peers = c.withoutDeparted(c.peers)
+	c.peerLock.Unlock()
+	c.network.Table().Delete(id.ID)
+	c.leaderLock.Lock()
+	delete(c.candidates, key)
+	c.leaderLock.Unlock()
+	c.chooseLeader()
+	c.markPeer(id, false, 0)
+	c.dropSendQueue(id.Address)
+	c.log.InfoF(nil, "%s left the cluster", id.Address)
+}
+
+// withoutDeparted filters peers that recently left the cluster out of
+// peers
+func (c *Cluster) withoutDeparted(peers []noise.ID) []noise.ID {
+	c.departedLock.Lock()
+	defer c.departedLock.Unlock()
+	for key, at := range c.departed {
+		if time.Since(at) > departedTTL {
+			delete(c.departed, key)
+		}
+	}
+	if len(c.departed) == 0 {
+		return peers
+	}
+	kept := []noise.ID{}
+	for _, p := range peers {
+		if _, ok := c.departed[p.ID.String()]; !ok {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// routeClusterLeave takes this node out of the cluster ahead of
+// shutting it down
+func (a *API) routeClusterLeave(c echo.Context) error {
+	if a.config().Mode == "dev" {
+		return c.JSON(400, jsonError{Message: "There is no cluster to leave in dev mode"})
+	}
+	return c.JSON(200, a.app.Cluster.Leave(c.Request().Context()))
+}
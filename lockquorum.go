@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// lockProposalTimeout is how long a node keeps its vote for a lock
+	// proposal, covering the time it takes the winning lock to be
+	// replicated to it
+	lockProposalTimeout = 5 * time.Second
+	// lockProposalRetries is how many times the earliest of several
+	// competing proposals asks again for the votes it's missing
+	lockProposalRetries = 3
+)
+
+// ErrLocked is returned when a key is already locked, or another node
+// won the lock first
+var ErrLocked = errors.New("Key is already locked")
+
+// ErrLockQuorum is returned when too few nodes answered a lock proposal
+// to know whether it won
+var ErrLockQuorum = errors.New("Could not reach a majority of the cluster to take the lock")
+
+// LockVote is a node's answer to a lock proposal. A refusal names the
+// lock the proposal lost to, if the node knows of one.
+type LockVote struct {
+	Ack    bool  `json:"ack"`
+	Holder *Lock `json:"holder,omitempty"`
+}
+
+// proposal is a lock this node has voted for
+type proposal struct {
+	lock  Lock
+	voted time.Time
+}
+
+// lockBeats reports whether a wins a key over b. The earliest claim
+// wins, and ties go to the lowest lock ID.
+func lockBeats(a Lock, b Lock) bool {
+	if a.ClaimTime.Equal(b.ClaimTime) {
+		return a.LockID < b.LockID
+	}
+	return a.ClaimTime.Before(b.ClaimTime)
+}
+
+// clusterLock gets a majority of the cluster, this node included, to
+// agree to l before it's committed. When proposals for a key compete,
+// the losers withdraw and the earliest asks again for the votes it's
+// missing.
+func (kv *KV) clusterLock(l Lock) error {
+	for attempt := 0; ; attempt++ {
+		votes := append(kv.app.Cluster.proposeLock(l), kv.voteLock(l))
+		acks := 0
+		won := true
+		contested := false
+		for _, v := range votes {
+			switch {
+			case v.Ack:
+				acks++
+			case v.Holder != nil:
+				contested = true
+				if !lockBeats(l, *v.Holder) {
+					won = false
+				}
+			}
+		}
+		if acks > len(votes)/2 {
+			return nil
+		}
+		if !won || attempt >= lockProposalRetries {
+			kv.withdrawLock(l)
+			b, err := json.Marshal(l)
+			if err == nil {
+				err = kv.app.Cluster.Emit("cluster", b, "lock:withdraw")
+			}
+			if err != nil {
+				kv.log.Error(nil, err)
+			}
+			if contested {
+				return ErrLocked
+			}
+			return ErrLockQuorum
+		}
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+// voteLock answers a lock proposal. A node only votes for one live
+// proposal per key, and never for a key that's already locked.
+func (kv *KV) voteLock(l Lock) LockVote {
+	obj, err := kv.GetObject(l.Key, l.Prefix)
+	if err == nil {
+		for _, held := range obj.Locks {
+			if held.LockID != l.LockID && held.ExpireTime.After(time.Now()) {
+				return LockVote{Holder: &held}
+			}
+		}
+	}
+	name := l.Prefix + "/" + l.Key
+	kv.proposalLock.Lock()
+	defer kv.proposalLock.Unlock()
+	for k, p := range kv.proposals {
+		if time.Since(p.voted) > lockProposalTimeout {
+			delete(kv.proposals, k)
+		}
+	}
+	if p, ok := kv.proposals[name]; ok && p.lock.LockID != l.LockID {
+		return LockVote{Holder: &p.lock}
+	}
+	kv.proposals[name] = proposal{lock: l, voted: time.Now()}
+	return LockVote{Ack: true}
+}
+
+// withdrawLock drops this node's vote for a lost proposal so a
+// competing one can collect it
+func (kv *KV) withdrawLock(l Lock) {
+	name := l.Prefix + "/" + l.Key
+	kv.proposalLock.Lock()
+	defer kv.proposalLock.Unlock()
+	if p, ok := kv.proposals[name]; ok && p.lock.LockID == l.LockID {
+		delete(kv.proposals, name)
+	}
+}
+
+// proposeLock asks every peer to vote for l. A peer that doesn't
+// answer counts as a refusal.
+func (c *Cluster) proposeLock(l Lock) []LockVote {
+	if c.config().Mode == "dev" {
+		return nil
+	}
+	peers := c.Peers()
+	votes := make([]LockVote, len(peers))
+	data, err := json.Marshal(l)
+	if err != nil {
+		c.log.Error(nil, err)
+		return votes
+	}
+	msg := &Message{
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
+		Data:     data,
+		DataType: "lock:propose",
+		Type:     "lock",
+		ID:       uuid.New().String(),
+		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
+	}
+	c.sign(msg)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Error(nil, err)
+		return votes
+	}
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		if !c.compatible(p) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+			ctx, cancel := context.WithTimeout(context.Background(), lockProposalTimeout/2)
+			defer cancel()
+			reply, err := c.node.Request(ctx, addr, b)
+			if err == nil {
+				err = json.Unmarshal(reply, &votes[i])
+			}
+			if err != nil {
+				c.log.Error(nil, err)
+			}
+		}(i, p.Address)
+	}
+	wg.Wait()
+	return votes
+}
+
+// handleWithdraw drops this node's vote for a proposal its proposer
+// gave up on
+func (c *Cluster) handleWithdraw(msg Message) error {
+	if !c.app.KVInit {
+		return nil
+	}
+	var l Lock
+	err := json.Unmarshal(msg.Data, &l)
+	if err != nil {
+		return err
+	}
+	c.app.KV.withdrawLock(l)
+	return nil
+}
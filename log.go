@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -14,26 +16,64 @@ import (
 
 // Log type
 type Log struct {
+	*liveConfig
+
 	FormatString string
 	c            chan string
 	terminator   chan bool
 	skip         []string
-	logQueue     chan string
-	config       *Config
+	logQueue     *logRing
 	metrics      map[string]interface{}
+	out          io.Writer
+}
+
+// logLevels orders the levels log.level can be set to
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+// LogEntry is a log line in the json format, and what the logs
+// endpoint returns
+type LogEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Source    string    `json:"source"`
+	RequestID string    `json:"request_id,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// requestSource is a log source tagged with the ID of the request the
+// line is about
+type requestSource struct {
+	name string
+	id   string
+}
+
+// forRequest returns a log source that adds a request ID to the line,
+// or just src when there's no ID
+func forRequest(src string, id string) interface{} {
+	if id == "" {
+		return src
+	}
+	return requestSource{name: src, id: id}
 }
 
 // New logger
-func (l Log) New(config *Config) *Log {
+func (l Log) New(live *liveConfig) *Log {
+	config := live.config()
 	log := &Log{
 		FormatString: "%s [ %-5s ] [ %-6s ] %v\n",
 		c:            make(chan string, config.Perf.BufferSize),
 		terminator:   make(chan bool),
-		config:       config,
+		liveConfig:   live,
 		metrics:      map[string]interface{}{},
+		out:          logOutput(config.Log.Output),
 	}
 	if config.Perf.EnableHTTPLogs {
-		log.logQueue = make(chan string, config.Perf.BufferSize)
+		log.logQueue = newLogRing(config.Perf.LogBufferSize)
 	}
 	log.metrics["queue"] = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "cave_log_log_queue_len",
@@ -43,6 +83,10 @@ func (l Log) New(config *Config) *Log {
 		Name: "cave_log_api_queue_len",
 		Help: "The number of logs currently residing in the log API queue",
 	})
+	log.metrics["dropped"] = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cave_log_api_dropped_total",
+		Help: "The number of logs pushed out of the log API buffer by newer ones",
+	})
 	log.metrics["log_counter"] = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "cave_log_logs_written",
 		Help: "The number of logs written to stdout",
@@ -54,6 +98,23 @@ func (l Log) New(config *Config) *Log {
 	return log
 }
 
+// logOutput opens the destination set in log.output, falling back to
+// stdout if a file can't be opened
+func logOutput(output string) io.Writer {
+	switch output {
+	case "", "stdout":
+		return os.Stdout
+	case "stderr":
+		return os.Stderr
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open log file %s, logging to stdout: %v\n", output, err)
+		return os.Stdout
+	}
+	return f
+}
+
 //Start function
 func (l *Log) Start() {
 	for {
@@ -61,45 +122,156 @@ func (l *Log) Start() {
 		case <-l.terminator:
 			// Finish writing logs before quitting
 			for range l.c {
-				fmt.Printf(<-l.c)
+				fmt.Fprint(l.out, <-l.c)
 			}
 			return
 		case m := <-l.c:
-			fmt.Printf(m)
-			if len(l.logQueue) < int(l.config.Perf.BufferSize) {
-				l.logQueue <- m
-			}
+			fmt.Fprint(l.out, m)
 			go l.metrics["log_counter"].(prometheus.Counter).Inc()
 			go l.metrics["queue"].(prometheus.Gauge).Set(float64(len(l.c)))
-			go l.metrics["apiqueue"].(prometheus.Gauge).Set(float64(len(l.logQueue)))
 		default:
 			time.Sleep(10 * time.Millisecond)
 		}
 	}
 }
 
+// logRing keeps the most recent logs for the logs endpoint. Once it's
+// full each new log replaces the oldest one, so writing logs never
+// waits on the endpoint being read.
+type logRing struct {
+	lock    sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+func newLogRing(capacity int) *logRing {
+	return &logRing{entries: make([]LogEntry, capacity)}
+}
+
+// push adds m, reporting whether the oldest log was dropped for it
+func (r *logRing) push(m LogEntry) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.entries) == 0 {
+		return true
+	}
+	dropped := r.full
+	r.entries[r.next] = m
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	return dropped
+}
+
+func (r *logRing) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.full {
+		return len(r.entries)
+	}
+	return r.next
+}
+
+// latest returns up to n of the most recent logs that match, oldest
+// first
+func (r *logRing) latest(n int, match func(LogEntry) bool) []LogEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	size := r.next
+	if r.full {
+		size = len(r.entries)
+	}
+	logs := []LogEntry{}
+	for i := 1; i <= size && len(logs) < n; i++ {
+		e := r.entries[(r.next-i+len(r.entries))%len(r.entries)]
+		if match(e) {
+			logs = append(logs, e)
+		}
+	}
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	return logs
+}
+
 func timestamp() string {
 	return time.Now().Format("2006-01-02 15:04:05.000 MST")
 }
 
+// enabled reports whether logs at lvl are written at the configured
+// level. Setting DEBUG in the environment still turns on debug logs.
+func (l *Log) enabled(lvl string) bool {
+	if lvl == "DEBUG" && os.Getenv("DEBUG") != "" {
+		return true
+	}
+	min, ok := logLevels[l.config().Log.Level]
+	if !ok {
+		min = logLevels["info"]
+	}
+	return severity(lvl) >= min
+}
+
+// severity ranks lvl against logLevels
+func severity(lvl string) int {
+	sev, ok := logLevels[strings.ToLower(lvl)]
+	if !ok {
+		// request and pretty logs are info, fatal ones always go out
+		sev = logLevels["info"]
+		if lvl == "FATAL" {
+			sev = logLevels["error"]
+		}
+	}
+	return sev
+}
+
 func (l *Log) print(lvl string, src interface{}, msg string) {
-	if src == nil {
-		src = "MAIN"
+	if !l.enabled(lvl) {
+		return
+	}
+	name, id := "MAIN", ""
+	switch s := src.(type) {
+	case string:
+		name = s
+	case requestSource:
+		name, id = s.name, s.id
 	}
 	go l.metrics["severity"].(*prometheus.CounterVec).WithLabelValues(lvl).Inc()
-	l.c <- fmt.Sprintf(l.FormatString, timestamp(), lvl, src.(string), msg)
+	entry := LogEntry{
+		Time:      time.Now(),
+		Level:     lvl,
+		Source:    name,
+		RequestID: id,
+		Message:   msg,
+	}
+	if l.logQueue != nil {
+		if l.logQueue.push(entry) {
+			go l.metrics["dropped"].(prometheus.Counter).Inc()
+		}
+		go l.metrics["apiqueue"].(prometheus.Gauge).Set(float64(l.logQueue.len()))
+	}
+	if l.config().Log.Format == "json" {
+		b, _ := json.Marshal(entry)
+		l.c <- string(b) + "\n"
+		return
+	}
+	if id != "" {
+		msg = "[ " + id + " ] " + msg
+	}
+	l.c <- fmt.Sprintf(l.FormatString, timestamp(), lvl, name, msg)
 }
 
 // Debug method
 func (l *Log) Debug(src interface{}, v ...interface{}) {
-	if os.Getenv("DEBUG") != "" {
+	if l.enabled("DEBUG") {
 		l.print("DEBUG", src, fmt.Sprint(v...))
 	}
 }
 
 // DebugF func
 func (l *Log) DebugF(src interface{}, s string, v ...interface{}) {
-	if os.Getenv("DEBUG") != "" {
+	if l.enabled("DEBUG") {
 		l.print("DEBUG", src, fmt.Sprintf(s, v...))
 	}
 }
@@ -174,12 +346,17 @@ func (l *Log) middleware(next echo.HandlerFunc) echo.HandlerFunc {
 				return next(c)
 			}
 		}
+		if !l.enabled("INFO") {
+			return next(c)
+		}
 		c.Response().After(func() {
-			l.print(strings.ToUpper(c.Scheme()), "API", fmt.Sprintf(
-				"%3v %-7s %s",
+			src := forRequest("API", c.Response().Header().Get(echo.HeaderXRequestID))
+			l.print(strings.ToUpper(c.Scheme()), src, fmt.Sprintf(
+				"%3v %-7s %s from %s",
 				c.Response().Status,
 				c.Request().Method,
 				c.Request().RequestURI,
+				c.RealIP(),
 			))
 		})
 		return next(c)
@@ -22,6 +22,16 @@ import (
 //VERSION is the app version
 var VERSION = "v0.0.0-devel"
 
+// COMMIT is the git commit the app was built from
+var COMMIT = "unknown"
+
+// BUILDDATE is when the app was built
+var BUILDDATE = "unknown"
+
+func buildInfo() BuildInfo {
+	return BuildInfo{Version: VERSION, Commit: COMMIT, BuildDate: BUILDDATE}
+}
+
 // CONFIG is a global
 var CONFIG *Config
 
@@ -29,6 +39,9 @@ var CONFIG *Config
 var TERMINATOR map[string]chan bool
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "kv" {
+		os.Exit(runKVCommand(os.Args[2:]))
+	}
 	var p interface{ Stop() }
 	if os.Getenv("PROFILE") != "" {
 		p = profile.Start(profile.ProfilePath("diag/"), profile.MemProfile)
@@ -36,32 +49,43 @@ func main() {
 	}
 	TERMINATOR = map[string]chan bool{}
 	kill := make(chan os.Signal)
-	signal.Notify(kill, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
+	signal.Notify(kill, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go mainMetrics()
 	CONFIG, err := getConfig()
 	if err != nil {
 		panic(err)
 	}
-	log := Log{}.New(CONFIG)
+	live := newLiveConfig(CONFIG)
+	log := Log{}.New(live)
 	TERMINATOR["log"] = log.terminator
 	go log.Start()
 	log.Debug("START", "Logger")
+	log.InfoF(nil, "Starting Cave %s (commit %s, built %s)", VERSION, COMMIT, BUILDDATE)
 	app := &Cave{
-		Config: CONFIG,
-		Logger: log,
+		liveConfig: live,
+		Logger:     log,
 	}
 	crypto, err := newCrypto()
 	if err != nil {
 		panic(err)
 	}
+	crypto.threshold = CONFIG.KV.UnsealThreshold
 	app.Crypto = crypto
+	if app.config().Tracing.Enable {
+		t := NewTracing(app)
+		app.Tracing = t
+		TERMINATOR["tracing"] = t.terminate
+		go t.Start()
+	}
 	cluster, err := newCluster(app)
 	if err != nil {
 		panic(err)
 	}
 	TERMINATOR["cluster"] = cluster.terminate
 	app.Cluster = cluster
-	app.updates = make(chan Message, 4096)
+	app.updates = make(chan Message, app.config().Perf.BufferSize)
 	app.sync = make(chan Message, 4096)
 	app.tokens = make(chan Message, 4096)
 	clusterReady := make(chan bool)
@@ -80,7 +104,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		err = app.Crypto.SealSharedKey(app.Crypto.sharedkey, app.Crypto.privkey, false)
+		err = app.Crypto.SealSharedKey(app.Crypto.sharedkey, app.Crypto.sealingKey(), false)
 		if err != nil {
 			panic(err)
 		}
@@ -117,9 +141,47 @@ func main() {
 	log.Debug("START", "KV")
 	go app.API.Start()
 	log.Debug("START", "API")
+	if app.config().UI.Enable && app.config().UI.Port != app.config().API.Port {
+		ui := NewUI(app, api)
+		TERMINATOR["ui"] = ui.terminate
+		go ui.Start()
+		log.Debug("START", "UI")
+	}
+	if app.config().GRPC.Enable {
+		g, err := NewGRPC(app)
+		if err != nil {
+			panic(err)
+		}
+		app.GRPC = g
+		TERMINATOR["grpc"] = g.terminate
+		go app.GRPC.Start()
+		log.Debug("START", "gRPC")
+	}
+	if app.config().Redis.Enable {
+		r, err := NewRedis(app)
+		if err != nil {
+			panic(err)
+		}
+		app.Redis = r
+		TERMINATOR["redis"] = r.terminate
+		go app.Redis.Start()
+		log.Debug("START", "Redis")
+	}
+	go func() {
+		for range hup {
+			log.Info(nil, "Got SIGHUP, reloading config")
+			err := app.reloadConfig()
+			if err != nil {
+				log.Error(nil, err)
+			}
+		}
+	}()
 	<-kill
 	log.Warn(nil, "Got kill signal from OS, shutting down...")
-	for _, t := range []string{"api", "kv", "cluster", "plugins", "tokens", "log"} {
+	for _, t := range []string{"redis", "grpc", "ui", "api", "kv", "cluster", "plugins", "tokens", "tracing", "log"} {
+		if TERMINATOR[t] == nil {
+			continue
+		}
 		log.Warn(nil, "Shutting down "+t)
 		TERMINATOR[t] <- true
 	}
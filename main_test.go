@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testApp is a dev mode node shared by every test, since its metrics
+// can only be registered once. Tests keep to their own key paths.
+var testApp *Cave
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "cave-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the shared key is kept in the working directory
+	err = os.Chdir(dir)
+	if err == nil {
+		testApp, err = newTestApp()
+	}
+	code := 1
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		code = m.Run()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestApp starts the parts of a dev mode node the tests use, without
+// its listeners
+func newTestApp() (*Cave, error) {
+	config := defaultConfig()
+	config.Log.Level = "error"
+	config.Log.Output = "stderr"
+	config.API.Authentication = false
+	config.Perf.EnableHTTPLogs = false
+	live := newLiveConfig(config)
+	log := Log{}.New(live)
+	go log.Start()
+	app := &Cave{
+		liveConfig: live,
+		Logger:     log,
+	}
+	crypto, err := newCrypto()
+	if err != nil {
+		return nil, err
+	}
+	app.Crypto = crypto
+	app.Cluster, err = newCluster(app)
+	if err != nil {
+		return nil, err
+	}
+	err = crypto.GenerateSharedKey()
+	if err != nil {
+		return nil, err
+	}
+	err = crypto.SealSharedKey(crypto.sharedkey, crypto.sealingKey(), false)
+	if err != nil {
+		return nil, err
+	}
+	app.KV, err = newKV(app)
+	if err != nil {
+		return nil, err
+	}
+	app.KVInit = true
+	app.API, err = NewAPI(app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// request sends a request to the test node's API
+func request(method string, path string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	rec := httptest.NewRecorder()
+	testApp.API.http.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// memoryDBPath selects the in-memory store when set as the db path
+const memoryDBPath = ":memory:"
+
+// inMemory reports whether the KV store is a scratch database that's
+// thrown away on shutdown
+func inMemory(c *Config) bool {
+	return c.Mode == "dev" || c.KV.DBPath == memoryDBPath
+}
+
+// dbFile returns the path of the bbolt file backing the KV store. bbolt
+// needs a file, so the in-memory store is still one, which keeps the
+// same bucket and key semantics. It's put in /dev/shm, which is backed
+// by memory, where that's available and in the temp directory, which
+// usually isn't, otherwise. Either way it's removed on startup and
+// shutdown.
+func dbFile(c *Config) string {
+	if !inMemory(c) {
+		return c.KV.DBPath
+	}
+	dir := "/dev/shm"
+	if s, err := os.Stat(dir); err != nil || !s.IsDir() {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("cave-%d.db", os.Getpid()))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInMemory(t *testing.T) {
+	c := defaultConfig()
+	c.Mode = "prod"
+	c.KV.DBPath = "/var/lib/cave/kv.db"
+	if inMemory(c) || dbFile(c) != c.KV.DBPath {
+		t.Errorf("a db path was kept in memory")
+	}
+	c.KV.DBPath = memoryDBPath
+	if !inMemory(c) {
+		t.Errorf("%s wasn't kept in memory", memoryDBPath)
+	}
+	c.Mode = "dev"
+	c.KV.DBPath = "/var/lib/cave/kv.db"
+	if !inMemory(c) {
+		t.Errorf("dev mode wasn't kept in memory")
+	}
+	dir := filepath.Dir(dbFile(c))
+	if dir != "/dev/shm" && dir != filepath.Clean(os.TempDir()) {
+		t.Errorf("in-memory store put in %s", dir)
+	}
+}
@@ -114,7 +114,12 @@ func mainMetrics() {
 			Name: "cave_host_cpu_load",
 			Help: "Load statistics for the host",
 		}, []string{"interval"}),
+		"build_info": promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cave_build_info",
+			Help: "Always 1, labeled with the version, commit and build date of the running build",
+		}, []string{"version", "commit", "build_date"}),
 	}
+	m["build_info"].(*prometheus.GaugeVec).WithLabelValues(VERSION, COMMIT, BUILDDATE).Set(1)
 	// IMPLEMENT!
 
 	for {
@@ -1218,8 +1223,8 @@ func getDashboard() []byte {
 			"steppedLine": false,
 			"targets": [
 			  {
-				"expr": "avg by (type) (cave_kv_transaction_time_ms)",
-				"legendFormat": "{{type}}",
+				"expr": "histogram_quantile(0.99, sum by (type, le) (rate(cave_kv_transaction_time_ms_bucket[5m])))",
+				"legendFormat": "{{type}} p99",
 				"refId": "A"
 			  }
 			],
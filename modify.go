@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ErrModifySecret is returned when changing a secret in place, which
+// would mean decrypting it inside the write
+var ErrModifySecret = errors.New("Secrets can't be changed in place")
+
+// ErrNotInteger is returned when incrementing a value that isn't an
+// integer, or when the result wouldn't fit in one
+var ErrNotInteger = errors.New("Value is not an integer")
+
+// ErrNotList is returned when appending to a value that isn't a JSON
+// array
+var ErrNotList = errors.New("Value is not a JSON array")
+
+// ErrBadElement is returned when appending something that isn't JSON
+var ErrBadElement = errors.New("Element is not valid JSON")
+
+// errUnchanged is returned by a modify func to leave the value as it
+// is, without a write
+var errUnchanged = errors.New("Value is unchanged")
+
+// modify replaces the value of key with what fn makes of the current
+// one, in a single transaction so no other write on this node can come
+// in between. fn gets nil when the key doesn't exist or has expired,
+// and returns errUnchanged to skip the write.
+// The key keeps its locks and expiry. The new value is queued for peers
+// like any other put.
+func (kv *KV) modify(ctx context.Context, op string, key string, prefix string, fn func(old []byte) ([]byte, error)) (obj KVObject, err error) {
+	start := time.Now()
+	defer kv.doMetrics(op, start)
+	defer func() { kv.countError(op, err) }()
+	kv.countKeyspaceOp(op, prefix, key)
+	ctx, span := startSpan(ctx, "kv.modify", prefix, key)
+	defer func() { endSpan(span, err) }()
+	if err = ctx.Err(); err != nil {
+		return obj, err
+	}
+	buckets, k := parsePath(key)
+	var created []string
+	var value KVObject
+	err = kv.update(ctx, op, func(tx *bbolt.Tx) error {
+		created = missingBuckets(tx, buckets, prefix)
+		b, _, err := kv.getBuckets(tx, buckets, prefix, true)
+		if err != nil {
+			return err
+		}
+		old := b.Get([]byte(k))
+		var prev *KVObject
+		if old != nil {
+			o := KVObject{}
+			err = json.Unmarshal(old, &o)
+			if err != nil {
+				return err
+			}
+			if o.Secret {
+				return ErrModifySecret
+			}
+			if !o.expired(time.Now()) {
+				o, err = kv.unseal(o)
+				if err != nil {
+					return err
+				}
+				prev = &o
+			}
+		}
+		var data []byte
+		if prev != nil {
+			data = prev.Data
+		}
+		data, err = fn(data)
+		if err != nil {
+			return err
+		}
+		obj, err = kv.newObject(key, prefix, data, false)
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			if prev.Locks != nil {
+				obj.Locks = prev.Locks
+			}
+			obj.TTL = prev.TTL
+			obj.ExpiresAt = prev.ExpiresAt
+		}
+		value, err = kv.seal(obj)
+		if err != nil {
+			return err
+		}
+		bobj, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		err = kv.recordHistory(tx, prefix, key, old, value)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(k), bobj)
+		if err != nil {
+			return err
+		}
+		err = kv.queueCreated(ctx, tx, prefix, created)
+		if err != nil {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "put:key", prefix, key, value)
+	})
+	if err == errUnchanged {
+		return obj, nil
+	}
+	if err != nil {
+		return obj, err
+	}
+	kv.changed()
+	kv.bucketsCreated(prefix, created)
+	kv.publish("put:key", prefix, key, obj)
+	kv.wakeOutbox()
+	return obj, nil
+}
+
+// Increment adds delta to the integer stored at key and returns the
+// result. A key that doesn't exist starts at 0.
+func (kv *KV) Increment(key string, prefix string, delta int64) (int64, error) {
+	return kv.IncrementCtx(context.Background(), key, prefix, delta)
+}
+
+// IncrementCtx is Increment on behalf of the requester in ctx
+func (kv *KV) IncrementCtx(ctx context.Context, key string, prefix string, delta int64) (n int64, err error) {
+	_, err = kv.modify(ctx, "incr:key", key, prefix, func(old []byte) ([]byte, error) {
+		n = delta
+		if old != nil {
+			cur, err := strconv.ParseInt(strings.TrimSpace(string(old)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s holds %q", ErrNotInteger, key, old)
+			}
+			n = cur + delta
+			if (delta > 0 && n < cur) || (delta < 0 && n > cur) {
+				return nil, fmt.Errorf("%w: adding %d to %s would overflow", ErrNotInteger, delta, key)
+			}
+		}
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Append adds element to the end of the JSON array stored at key. A
+// key that doesn't exist starts as an empty array.
+func (kv *KV) Append(key string, prefix string, element json.RawMessage) error {
+	return kv.AppendCtx(context.Background(), key, prefix, element, 0)
+}
+
+// AppendCtx is Append on behalf of the requester in ctx. When max is
+// over 0 the oldest elements are dropped to keep at most max.
+func (kv *KV) AppendCtx(ctx context.Context, key string, prefix string, element json.RawMessage, max int) error {
+	if !json.Valid(element) {
+		return ErrBadElement
+	}
+	_, err := kv.modify(ctx, "append:key", key, prefix, func(old []byte) ([]byte, error) {
+		list := []json.RawMessage{}
+		if old != nil {
+			err := json.Unmarshal(old, &list)
+			if err != nil || list == nil {
+				return nil, fmt.Errorf("%w: %s", ErrNotList, key)
+			}
+		}
+		list = append(list, element)
+		if max > 0 && len(list) > max {
+			list = list[len(list)-max:]
+		}
+		return json.Marshal(list)
+	})
+	return err
+}
+
+// SetAdd adds element to the JSON array stored at key unless an equal
+// element is already in it, so adding twice is the same as adding
+// once. Elements are compared as JSON values, so key order and spacing
+// don't matter. It reports whether the array changed.
+func (kv *KV) SetAdd(key string, prefix string, element json.RawMessage) (bool, error) {
+	return kv.setModify(context.Background(), "set:add", key, prefix, element, true)
+}
+
+// SetRemove removes the elements equal to element from the JSON array
+// stored at key. Removing an element that isn't there, or from a key
+// that doesn't exist, does nothing. It reports whether the array
+// changed.
+func (kv *KV) SetRemove(key string, prefix string, element json.RawMessage) (bool, error) {
+	return kv.setModify(context.Background(), "set:remove", key, prefix, element, false)
+}
+
+// SetAddCtx is SetAdd on behalf of the requester in ctx
+func (kv *KV) SetAddCtx(ctx context.Context, key string, prefix string, element json.RawMessage) (bool, error) {
+	return kv.setModify(ctx, "set:add", key, prefix, element, true)
+}
+
+// SetRemoveCtx is SetRemove on behalf of the requester in ctx
+func (kv *KV) SetRemoveCtx(ctx context.Context, key string, prefix string, element json.RawMessage) (bool, error) {
+	return kv.setModify(ctx, "set:remove", key, prefix, element, false)
+}
+
+func (kv *KV) setModify(ctx context.Context, op string, key string, prefix string, element json.RawMessage, add bool) (changed bool, err error) {
+	want, err := setMember(element)
+	if err != nil {
+		return false, ErrBadElement
+	}
+	_, err = kv.modify(ctx, op, key, prefix, func(old []byte) ([]byte, error) {
+		changed = false
+		list := []json.RawMessage{}
+		if old != nil {
+			err := json.Unmarshal(old, &list)
+			if err != nil || list == nil {
+				return nil, fmt.Errorf("%w: %s", ErrNotList, key)
+			}
+		}
+		kept := list[:0]
+		found := false
+		for _, e := range list {
+			m, err := setMember(e)
+			if err != nil {
+				return nil, err
+			}
+			if m == want {
+				found = true
+				if !add {
+					continue
+				}
+			}
+			kept = append(kept, e)
+		}
+		switch {
+		case add && found, !add && !found:
+			return nil, errUnchanged
+		case add:
+			kept = append(kept, element)
+		}
+		changed = true
+		return json.Marshal(kept)
+	})
+	return changed, err
+}
+
+// setMember returns the canonical form of a JSON value, which is the
+// same for equal values
+func setMember(raw json.RawMessage) (string, error) {
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
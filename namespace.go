@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// nsPrefix marks the top-level buckets that hold namespaces
+const nsPrefix = "ns:"
+
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// namespaceBucket returns the top-level bucket for a namespace
+func namespaceBucket(name string) (string, error) {
+	if !validNamespace.MatchString(name) {
+		return "", fmt.Errorf("Namespace '%s' may only contain letters, numbers, '-' and '_'", name)
+	}
+	return nsPrefix + name, nil
+}
+
+// kvPrefixes returns the default key space and every namespace
+func kvPrefixes(tx *bbolt.Tx) []string {
+	prefixes := []string{"kv"}
+	tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte(nsPrefix)) {
+			prefixes = append(prefixes, string(name))
+		}
+		return nil
+	})
+	return prefixes
+}
+
+// ListNamespaces returns the names of every namespace
+func (kv *KV) ListNamespaces() ([]string, error) {
+	names := []string{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		for _, p := range kvPrefixes(tx)[1:] {
+			names = append(names, strings.TrimPrefix(p, nsPrefix))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// DeleteNamespace drops a namespace along with all of its keys and
+// their history, and its keyring key if it has one
+func (kv *KV) DeleteNamespace(name string, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("delete:namespace", start)
+	defer func() { kv.countError("delete:namespace", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	prefix, err := namespaceBucket(name)
+	if err != nil {
+		return err
+	}
+	err = kv.update(context.Background(), "delete:namespace", func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(prefix))
+		if err != nil {
+			return err
+		}
+		if keys := tx.Bucket([]byte("_system")).Bucket([]byte("keyring")); keys != nil {
+			err = keys.Delete([]byte(prefix))
+			if err != nil {
+				return err
+			}
+		}
+		if emit {
+			err = kv.queueEvent(context.Background(), tx, "delete:namespace", prefix, name, KVObject{})
+			if err != nil {
+				return err
+			}
+		}
+		hist := tx.Bucket([]byte("_history"))
+		if hist == nil {
+			return nil
+		}
+		// collect first, buckets can't be deleted while iterating
+		stale := [][]byte{}
+		c := hist.Cursor()
+		for k, _ := c.Seek([]byte(prefix + "/")); k != nil && bytes.HasPrefix(k, []byte(prefix+"/")); k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		for _, k := range stale {
+			err = hist.DeleteBucket(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kv.crypto.forgetKey(prefix)
+	kv.changed()
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// ErrNoNamespaceKey is returned for a secret in a namespace that
+// hasn't had its key created with InitNamespaceKey
+var ErrNoNamespaceKey = errors.New("The namespace has no key, create one with /api/v1/system/crypto/[namespace]/init")
+
+// ErrNamespaceSealed is returned for a secret in a namespace whose key
+// this node hasn't unsealed
+var ErrNamespaceSealed = errors.New("The namespace key is sealed, unseal it with /api/v1/system/crypto/[namespace]/unseal")
+
+// ErrNamespaceKeyExists is returned when creating a namespace key that
+// already exists
+var ErrNamespaceKeyExists = errors.New("The namespace already has a key")
+
+// ErrBadNamespaceKey is returned for an unseal key that doesn't open
+// the namespace key
+var ErrBadNamespaceKey = errors.New("The unseal key doesn't open the namespace key")
+
+// InitNamespaceKey creates the key a namespace's secrets are encrypted
+// with and returns the key it's wrapped with. The unseal key is only
+// ever handed out here, the cluster stores the namespace key wrapped
+// with it and nothing else, so holding the shared key isn't enough to
+// read the namespace's secrets.
+func (kv *KV) InitNamespaceKey(name string) (string, error) {
+	prefix, err := namespaceBucket(name)
+	if err != nil {
+		return "", err
+	}
+	kv.crypto.keyLock.Lock()
+	defer kv.crypto.keyLock.Unlock()
+	exists := false
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		if keys := tx.Bucket([]byte("_system")).Bucket([]byte("keyring")); keys != nil {
+			exists = keys.Get([]byte(prefix)) != nil
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("%w: %s", ErrNamespaceKeyExists, name)
+	}
+	key, err := newAESKey()
+	if err != nil {
+		return "", err
+	}
+	secret := make([]byte, masterKeySize)
+	_, err = io.ReadFull(rand.Reader, secret)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := encrytJSON(masterKey(secret), b)
+	if err != nil {
+		return "", err
+	}
+	err = kv.putWrappedKey(context.Background(), prefix, wrapped, true)
+	if err != nil {
+		return "", err
+	}
+	kv.crypto.keyring[prefix] = key
+	kv.log.InfoF(nil, "Created the key for namespace %s", name)
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// UnsealNamespace opens a namespace's key on this node with the unseal
+// key InitNamespaceKey returned. Every node unseals its own copy.
+func (kv *KV) UnsealNamespace(name string, unsealKey string) error {
+	prefix, err := namespaceBucket(name)
+	if err != nil {
+		return err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(unsealKey))
+	if err != nil || len(secret) != masterKeySize {
+		return ErrBadNamespaceKey
+	}
+	var wrapped []byte
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		if keys := tx.Bucket([]byte("_system")).Bucket([]byte("keyring")); keys != nil {
+			if v := keys.Get([]byte(prefix)); v != nil {
+				wrapped = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if wrapped == nil {
+		return fmt.Errorf("%w: %s", ErrNoNamespaceKey, name)
+	}
+	b, err := decryptJSON(masterKey(secret), wrapped)
+	if err != nil {
+		return ErrBadNamespaceKey
+	}
+	var key *AESKey
+	err = json.Unmarshal(b, &key)
+	if err != nil {
+		return err
+	}
+	kv.crypto.keyLock.Lock()
+	kv.crypto.keyring[prefix] = key
+	kv.crypto.keyLock.Unlock()
+	kv.log.InfoF(nil, "Unsealed the key for namespace %s", name)
+	return nil
+}
+
+// SealNamespace drops a namespace's key from this node's memory, so its
+// secrets can't be read or written here until it's unsealed again
+func (kv *KV) SealNamespace(name string) error {
+	prefix, err := namespaceBucket(name)
+	if err != nil {
+		return err
+	}
+	kv.crypto.forgetKey(prefix)
+	kv.log.InfoF(nil, "Sealed the key for namespace %s", name)
+	return nil
+}
+
+// NamespaceKey says whether a namespace has its own keyring key and
+// whether this node has it unsealed in memory
+type NamespaceKey struct {
+	Namespace string `json:"namespace"`
+	Present   bool   `json:"present"`
+	Unsealed  bool   `json:"unsealed"`
+}
+
+// CryptoStatus describes the keys this node encrypts with
+type CryptoStatus struct {
+	Rotating      bool           `json:"rotating"`
+	NamespaceKeys bool           `json:"namespace_keys"`
+	Keys          []string       `json:"keys"`
+	Namespaces    []NamespaceKey `json:"namespaces"`
+}
+
+// CryptoStatus lists the keyring and which namespaces have their own
+// key. A namespace key is only unsealed on nodes it was created or
+// unsealed on.
+func (kv *KV) CryptoStatus() (CryptoStatus, error) {
+	_, next := kv.keys()
+	status := CryptoStatus{
+		Rotating:      next != nil,
+		NamespaceKeys: kv.config().KV.NamespaceKeys,
+		Keys:          []string{},
+		Namespaces:    []NamespaceKey{},
+	}
+	unsealed := kv.crypto.unsealedKeys()
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		keys := tx.Bucket([]byte("_system")).Bucket([]byte("keyring"))
+		if keys != nil {
+			keys.ForEach(func(name []byte, _ []byte) error {
+				if !bytes.HasPrefix(name, []byte(nsPrefix)) {
+					status.Keys = append(status.Keys, string(name))
+				}
+				return nil
+			})
+		}
+		for _, p := range kvPrefixes(tx)[1:] {
+			status.Namespaces = append(status.Namespaces, NamespaceKey{
+				Namespace: strings.TrimPrefix(p, nsPrefix),
+				Present:   keys != nil && keys.Get([]byte(p)) != nil,
+				Unsealed:  unsealed[p],
+			})
+		}
+		return nil
+	})
+	return status, err
+}
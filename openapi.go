@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The OpenAPI document is assembled from the route list below, and
+// the schemas for request and response bodies are derived from the Go
+// types so they can't drift from what the handlers actually send.
+
+type apiDoc map[string]interface{}
+
+// schemaBuilder turns Go types into OpenAPI schemas, collecting named
+// structs as shared components
+type schemaBuilder struct {
+	components apiDoc
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func (s *schemaBuilder) schema(t reflect.Type) apiDoc {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return apiDoc{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return apiDoc{}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return apiDoc{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return s.ref(t)
+	case reflect.Slice, reflect.Array:
+		return apiDoc{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return apiDoc{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.String:
+		return apiDoc{"type": "string"}
+	case reflect.Bool:
+		return apiDoc{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return apiDoc{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return apiDoc{"type": "number"}
+	}
+	return apiDoc{}
+}
+
+// ref adds a struct to the components and returns a reference to it
+func (s *schemaBuilder) ref(t reflect.Type) apiDoc {
+	ref := apiDoc{"$ref": "#/components/schemas/" + t.Name()}
+	if _, ok := s.components[t.Name()]; ok {
+		return ref
+	}
+	props := apiDoc{}
+	// set before the fields so self-referencing types terminate
+	s.components[t.Name()] = apiDoc{"type": "object", "properties": props}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Interface {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		props[name] = s.schema(f.Type)
+	}
+	return ref
+}
+
+// route describes one operation for the OpenAPI document
+type route struct {
+	method   string
+	path     string
+	summary  string
+	params   []string
+	query    []string
+	body     interface{}
+	response interface{}
+	auth     bool
+}
+
+var kvQuery = []string{"secret", "tree", "count", "history", "stream", "rollback", "ttl", "heartbeat", "dry_run", "diff", "wait", "index", "meta", "incr", "append", "max", "set_add", "set_remove", "lock", "min_index", "consistency"}
+
+// apiRoutes lists the documented operations
+var apiRoutes = []route{
+	{method: "get", path: "/kv/{path}", summary: "Get a key's value, or list a bucket's keys when the path ends in /", params: []string{"path"}, query: kvQuery, response: []string{}},
+	{method: "post", path: "/kv/{path}", summary: "Set a key's value to the request body", params: []string{"path"}, query: kvQuery, body: "raw", response: jsonError{}},
+	{method: "delete", path: "/kv/{path}", summary: "Delete a key, or a whole bucket when the path ends in /", params: []string{"path"}, query: []string{"dry_run", "diff", "lock"}, response: jsonError{}},
+	{method: "delete", path: "/kv/{path}/lock/{lockID}", summary: "Force release a lock", params: []string{"path", "lockID"}, response: jsonError{}, auth: true},
+	{method: "get", path: "/locks", summary: "List the active locks", query: []string{"node"}, response: []Lock{}},
+	{method: "get", path: "/search", summary: "Find keys by name or value", query: []string{"pattern", "nocase", "value", "secret"}, response: []string{}},
+	{method: "get", path: "/ns", summary: "List the namespaces", response: []string{}},
+	{method: "delete", path: "/ns/{namespace}", summary: "Delete a namespace and all of its keys", params: []string{"namespace"}, response: jsonError{}},
+	{method: "get", path: "/ns/{namespace}/kv/{path}", summary: "Get a key in a namespace", params: []string{"namespace", "path"}, query: kvQuery, response: []string{}},
+	{method: "post", path: "/ns/{namespace}/kv/{path}", summary: "Set a key in a namespace", params: []string{"namespace", "path"}, query: kvQuery, body: "raw", response: jsonError{}},
+	{method: "delete", path: "/ns/{namespace}/kv/{path}", summary: "Delete a key or bucket in a namespace", params: []string{"namespace", "path"}, response: jsonError{}},
+	{method: "post", path: "/query", summary: "Run several operations in one request", body: MultiQuery{}, response: MultiQuery{}},
+	{method: "get", path: "/discovery/{service}", summary: "List the live instances registered for a service", params: []string{"service"}, query: []string{"healthy"}, response: []ServiceEntry{}},
+	{method: "get", path: "/cluster/nodes", summary: "List the known cluster nodes", response: []string{}},
+	{method: "get", path: "/cluster/health", summary: "Get the health of each peer", response: []PeerHealth{}},
+	{method: "get", path: "/cluster/leader", summary: "Get the current cluster leader", response: LeaderInfo{}},
+	{method: "post", path: "/cluster/query", summary: "Compare every node's copy of some keys", body: ClusterQuery{}, response: ClusterQueryResult{}, auth: true},
+	{method: "post", path: "/cluster/leave", summary: "Take this node out of the cluster before stopping it", response: LeaveResult{}, auth: true},
+	{method: "get", path: "/perf/logs", summary: "Get the most recent logs", query: []string{"level", "since", "request_id", "limit"}, response: []LogEntry{}},
+	{method: "get", path: "/system/config", summary: "Get the running config", query: []string{"full"}, response: Config{}, auth: true},
+	{method: "get", path: "/system/info", summary: "Get information about the host", auth: true},
+	{method: "get", path: "/system/version", summary: "Get the version of the running build", response: BuildInfo{}},
+	{method: "get", path: "/system/stats", summary: "Get database and queue statistics", response: KVStats{}},
+	{method: "get", path: "/system/backup", summary: "Download a copy of the database", response: "raw", auth: true},
+	{method: "post", path: "/system/restore", summary: "Replace the database with an uploaded backup", body: "raw", response: jsonError{}, auth: true},
+	{method: "get", path: "/system/healthz", summary: "Liveness check", response: jsonError{}},
+	{method: "get", path: "/system/readyz", summary: "Readiness check", response: jsonError{}},
+	{method: "post", path: "/system/compact", summary: "Compact the database file", response: map[string]int64{}, auth: true},
+	{method: "post", path: "/system/rotate-key", summary: "Rotate the shared encryption key", response: jsonError{}, auth: true},
+	{method: "post", path: "/system/init", summary: "Seal the shared key with unseal shares and get the shares, once", response: InitResponse{}, auth: true},
+	{method: "post", path: "/system/unseal", summary: "Give one share towards unsealing the shared key", body: UnsealRequest{}, response: UnsealStatus{}, auth: true},
+	{method: "post", path: "/system/seal", summary: "Drop the shared key from memory until the node is unsealed", response: UnsealStatus{}, auth: true},
+	{method: "get", path: "/system/crypto", summary: "List the keyring and which namespaces have their own key unsealed", response: CryptoStatus{}, auth: true},
+	{method: "post", path: "/system/crypto/{namespace}/init", summary: "Create a namespace's key and get the key that unseals it", params: []string{"namespace"}, response: NamespaceKeyResponse{}, auth: true},
+	{method: "post", path: "/system/crypto/{namespace}/unseal", summary: "Unseal a namespace's key on this node", params: []string{"namespace"}, body: NamespaceUnsealRequest{}, response: jsonError{}, auth: true},
+	{method: "post", path: "/system/crypto/{namespace}/seal", summary: "Drop a namespace's key from this node's memory", params: []string{"namespace"}, response: jsonError{}, auth: true},
+	{method: "get", path: "/system/audit", summary: "Get the secret access audit trail", query: []string{"key", "namespace"}, response: []AuditEntry{}, auth: true},
+	{method: "get", path: "/system/schemas", summary: "List the value schemas by prefix", response: map[string]json.RawMessage{}},
+	{method: "post", path: "/system/schemas/{prefix}", summary: "Register a JSON Schema for values under a prefix", params: []string{"prefix"}, body: "raw", response: jsonError{}, auth: true},
+	{method: "delete", path: "/system/schemas/{prefix}", summary: "Remove the schema for a prefix", params: []string{"prefix"}, response: jsonError{}, auth: true},
+}
+
+// openAPI builds the OpenAPI 3 document for the REST API
+func openAPI() apiDoc {
+	s := &schemaBuilder{components: apiDoc{}}
+	s.schema(reflect.TypeOf(jsonError{}))
+	s.schema(reflect.TypeOf(KVObject{}))
+	s.schema(reflect.TypeOf(QueryObject{}))
+	paths := apiDoc{}
+	for _, r := range apiRoutes {
+		op := apiDoc{"summary": r.summary}
+		params := []apiDoc{}
+		for _, p := range r.params {
+			params = append(params, apiDoc{"name": p, "in": "path", "required": true, "schema": apiDoc{"type": "string"}})
+		}
+		for _, q := range r.query {
+			params = append(params, apiDoc{"name": q, "in": "query", "schema": apiDoc{"type": "string"}})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if r.body != nil {
+			op["requestBody"] = apiDoc{"content": s.content(r.body)}
+		}
+		ok := apiDoc{"description": "OK"}
+		if r.response != nil {
+			ok["content"] = s.content(r.response)
+		}
+		op["responses"] = apiDoc{
+			"200":     ok,
+			"default": apiDoc{"description": "Error", "content": s.content(jsonError{})},
+		}
+		if r.auth {
+			op["security"] = []apiDoc{{"bearer": []string{}}}
+		}
+		path, ok2 := paths[r.path].(apiDoc)
+		if !ok2 {
+			path = apiDoc{}
+			paths[r.path] = path
+		}
+		path[r.method] = op
+	}
+	return apiDoc{
+		"openapi": "3.0.3",
+		"info": apiDoc{
+			"title":   "Cave",
+			"version": VERSION,
+		},
+		"servers": []apiDoc{{"url": strings.TrimSuffix(APIPREFIX, "/")}},
+		"paths":   paths,
+		"components": apiDoc{
+			"schemas": s.components,
+			"securitySchemes": apiDoc{
+				"bearer": apiDoc{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// content describes a body of the given Go value, or of arbitrary
+// bytes for "raw"
+func (s *schemaBuilder) content(v interface{}) apiDoc {
+	if v == "raw" {
+		return apiDoc{"application/octet-stream": apiDoc{"schema": apiDoc{"type": "string", "format": "binary"}}}
+	}
+	return apiDoc{"application/json": apiDoc{"schema": s.schema(reflect.TypeOf(v))}}
+}
+
+func (a *API) routeOpenAPI(c echo.Context) error {
+	return c.JSON(200, openAPI())
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// outboxRetryInterval is how often the outbox is checked for
+	// updates peers haven't acknowledged
+	outboxRetryInterval = time.Second
+	// outboxAckTimeout is how long a peer has to acknowledge updates
+	// before they're sent to it again, from the last one it did
+	outboxAckTimeout = 5 * time.Second
+	// outboxBatchSize is the most updates sent to one peer in a round
+	outboxBatchSize = 256
+	// outboxDeleteBatch is how many updates every peer has to have
+	// acknowledged before they're deleted between retry rounds, so a
+	// write doesn't cost a second commit just to drop its update
+	outboxDeleteBatch = 64
+)
+
+// outboxEvent is an update waiting to be sent to the cluster. It's
+// queued in the transaction that makes the change, so a change can't
+// be committed without its update being sent eventually.
+type outboxEvent struct {
+	Update    KVUpdate          `json:"update"`
+	RequestID string            `json:"request_id,omitempty"`
+	Trace     map[string]string `json:"trace,omitempty"`
+	// Node is the node that queued the event. Events that come in with
+	// another node's database after a sync aren't this node's to send.
+	Node string `json:"node"`
+}
+
+// outboxPeer is how far a peer has got through this node's outbox.
+// Acked is the last index it acknowledged, having applied it and
+// everything before it, and sent the last one sent to it. Progress is
+// when it last acknowledged something, or was first sent something
+// after catching up.
+type outboxPeer struct {
+	acked    uint64
+	sent     uint64
+	progress time.Time
+}
+
+// updateAck acknowledges the updates from Origin a peer has applied, up
+// to and including Index
+type updateAck struct {
+	Origin string `json:"origin"`
+	Index  uint64 `json:"index"`
+}
+
+// outboxBucket returns the bucket of queued events, creating it if
+// needed
+func outboxBucket(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	return tx.Bucket([]byte("_system")).CreateBucketIfNotExists([]byte("outbox"))
+}
+
+// queueEvent adds an update to the outbox in the write transaction tx.
+// Events are keyed by sequence number so they're sent in order, and the
+// sequence number is the write's index.
+func (kv *KV) queueEvent(ctx context.Context, tx *bbolt.Tx, t string, prefix string, key string, value KVObject) error {
+	if kv.config().Mode == "dev" || isDryRun(ctx) {
+		return nil
+	}
+	b, err := outboxBucket(tx)
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	ev, err := json.Marshal(outboxEvent{
+		Update: KVUpdate{
+			UpdateType: t,
+			Key:        key,
+			Value:      value,
+			Prefix:     prefix,
+			Index:      seq,
+		},
+		RequestID: requestIDFrom(ctx),
+		Trace:     carrier,
+		Node:      kv.crypto.id,
+	})
+	if err != nil {
+		return err
+	}
+	if w := writeIndexFrom(ctx); w != nil {
+		w.pending = seq
+	}
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, seq)
+	return b.Put(id, ev)
+}
+
+// wakeOutbox lets the outbox know there are new events to send
+func (kv *KV) wakeOutbox() {
+	select {
+	case kv.outboxReady <- true:
+	default:
+	}
+}
+
+// outbox sends queued events until stop is closed
+func (kv *KV) outbox(stop chan bool) {
+	t := time.NewTicker(outboxRetryInterval)
+	defer t.Stop()
+	retry := false
+	for {
+		err := kv.flushOutbox(retry)
+		if err != nil {
+			kv.log.Error(nil, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-kv.outboxReady:
+			retry = false
+		case <-t.C:
+			retry = true
+		}
+	}
+}
+
+// flushOutbox sends each peer the queued events it hasn't been sent,
+// oldest first, from its own cursor so a slow or unreachable peer
+// doesn't hold up the others. Events a peer doesn't acknowledge within
+// outboxAckTimeout are sent again on a retry round. Events every peer
+// has acknowledged are deleted in batches. Peers that leave the cluster
+// are no longer owed anything; they sync when they rejoin.
+func (kv *KV) flushOutbox(retry bool) error {
+	peers := kv.app.Cluster.peerAddrs()
+	from := kv.outboxCursors(peers, retry)
+	pending := map[string][]outboxEvent{}
+	var last, lastOwn uint64
+	backlog := 0
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("outbox"))
+		if b == nil {
+			return nil
+		}
+		backlog = b.Stats().KeyN
+		c := b.Cursor()
+		if k, _ := c.Last(); k != nil {
+			last = binary.BigEndian.Uint64(k)
+		}
+		for k, v := c.Last(); k != nil && lastOwn == 0; k, v = c.Prev() {
+			var ev outboxEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			if ev.Node == kv.crypto.id {
+				lastOwn = binary.BigEndian.Uint64(k)
+			}
+		}
+		for addr, n := range from {
+			seek := make([]byte, 8)
+			binary.BigEndian.PutUint64(seek, n+1)
+			for k, v := c.Seek(seek); k != nil && len(pending[addr]) < outboxBatchSize; k, v = c.Next() {
+				var ev outboxEvent
+				if err := json.Unmarshal(v, &ev); err != nil {
+					return err
+				}
+				if ev.Node == kv.crypto.id {
+					pending[addr] = append(pending[addr], ev)
+				}
+			}
+		}
+		return nil
+	})
+	kv.metrics["outbox"].(prometheus.Gauge).Set(float64(backlog))
+	if err != nil {
+		return err
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sent := map[string]uint64{}
+	for addr, evs := range pending {
+		wg.Add(1)
+		go func(addr string, evs []outboxEvent) {
+			defer wg.Done()
+			previous := from[addr]
+			for _, ev := range evs {
+				ev.Update.Previous = previous
+				previous = ev.Update.Index
+				if !kv.sendEvent(ev, addr) {
+					return
+				}
+				lock.Lock()
+				sent[addr] = ev.Update.Index
+				lock.Unlock()
+			}
+		}(addr, evs)
+	}
+	wg.Wait()
+	through := kv.outboxSent(sent, lastOwn, last)
+	if through == 0 {
+		return nil
+	}
+	return kv.deleteAcked(through, retry)
+}
+
+// outboxCursors returns the last index sent to each of peers, and drops
+// the cursors of peers that are gone. A peer seen for the first time is
+// only owed the events queued after the last one already sent out, the
+// same as a peer that just synced. On a retry round a peer that's sat
+// on unacknowledged events for outboxAckTimeout is sent them again.
+func (kv *KV) outboxCursors(peers []string, retry bool) map[string]uint64 {
+	kv.outboxLock.Lock()
+	defer kv.outboxLock.Unlock()
+	current := map[string]bool{}
+	from := map[string]uint64{}
+	for _, addr := range peers {
+		current[addr] = true
+		p, ok := kv.outboxPeers[addr]
+		if !ok {
+			p = &outboxPeer{acked: kv.outboxHead, sent: kv.outboxHead, progress: time.Now()}
+			kv.outboxPeers[addr] = p
+		}
+		if retry && p.sent > p.acked && time.Since(p.progress) > outboxAckTimeout {
+			kv.log.WarnF(nil, "%s hasn't acknowledged updates after %d, sending them again", addr, p.acked)
+			p.sent = p.acked
+			p.progress = time.Now()
+		}
+		from[addr] = p.sent
+	}
+	for addr := range kv.outboxPeers {
+		if !current[addr] {
+			delete(kv.outboxPeers, addr)
+		}
+	}
+	return from
+}
+
+// outboxSent records the last index sent to each peer, and returns the
+// index every current peer has acknowledged up to. That's the last
+// index in the outbox when there are no peers, or when every peer has
+// acknowledged the last of this node's own events, since what's left
+// after them came with another node's database.
+func (kv *KV) outboxSent(sent map[string]uint64, lastOwn uint64, last uint64) uint64 {
+	kv.outboxLock.Lock()
+	defer kv.outboxLock.Unlock()
+	for addr, n := range sent {
+		p, ok := kv.outboxPeers[addr]
+		if !ok || n <= p.sent {
+			continue
+		}
+		if p.sent == p.acked {
+			p.progress = time.Now()
+		}
+		p.sent = n
+		if !kv.app.Cluster.sendsAcks(addr) {
+			p.acked = n
+		}
+		if n > kv.outboxHead {
+			kv.outboxHead = n
+		}
+	}
+	through := last
+	for _, p := range kv.outboxPeers {
+		if p.acked < lastOwn && p.acked < through {
+			through = p.acked
+		}
+	}
+	if len(kv.outboxPeers) == 0 && last > kv.outboxHead {
+		kv.outboxHead = last
+	}
+	return through
+}
+
+// deleteAcked deletes the events up to and including through, once
+// there are outboxDeleteBatch of them or on a retry round
+func (kv *KV) deleteAcked(through uint64, retry bool) error {
+	kv.outboxLock.Lock()
+	deleted := kv.outboxDeleted
+	kv.outboxLock.Unlock()
+	if through <= deleted || (!retry && through-deleted < outboxDeleteBatch) {
+		return nil
+	}
+	err := kv.update(context.Background(), "outbox", func(tx *bbolt.Tx) error {
+		b, err := outboxBucket(tx)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= through; k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kv.outboxLock.Lock()
+	if through > kv.outboxDeleted {
+		kv.outboxDeleted = through
+	}
+	kv.outboxLock.Unlock()
+	return nil
+}
+
+// outboxBacklog returns how many events are queued
+func (kv *KV) outboxBacklog() (backlog int, err error) {
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("outbox"))
+		if b != nil {
+			backlog = b.Stats().KeyN
+		}
+		return nil
+	})
+	return backlog, err
+}
+
+// sendEvent sends an event to the peer at addr and reports whether it
+// went
+func (kv *KV) sendEvent(ev outboxEvent, addr string) bool {
+	data, err := json.Marshal(ev.Update)
+	if err != nil {
+		kv.log.Error(nil, err)
+		return false
+	}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(ev.Trace))
+	ctx = withRequestID(ctx, ev.RequestID)
+	kv.log.DebugF(forRequest("KV", ev.RequestID), "Sending %s %s to %s", ev.Update.UpdateType, ev.Update.Key, addr)
+	return len(kv.app.Cluster.SendTo(ctx, []string{addr}, "update", data, "KVUpdate")) == 0
+}
+
+// handleAck moves the cursor of the peer at addr forward to the index
+// it acknowledged. Acks for an address this node no longer has are
+// ignored.
+func (kv *KV) handleAck(addr string, msg Message) error {
+	var ack updateAck
+	err := json.Unmarshal(msg.Data, &ack)
+	if err != nil {
+		return err
+	}
+	if ack.Origin != kv.app.Cluster.node.Addr() {
+		return nil
+	}
+	kv.outboxLock.Lock()
+	defer kv.outboxLock.Unlock()
+	p, ok := kv.outboxPeers[addr]
+	if !ok || ack.Index <= p.acked {
+		return nil
+	}
+	p.acked = ack.Index
+	p.progress = time.Now()
+	if p.sent < p.acked {
+		p.sent = p.acked
+	}
+	return nil
+}
+
+// ackUpdates tells origin how far this node has applied its updates
+func (kv *KV) ackUpdates(origin string) {
+	n, _ := kv.applied.applied(origin)
+	if n == 0 {
+		return
+	}
+	data, err := json.Marshal(updateAck{Origin: origin, Index: n})
+	if err != nil {
+		kv.log.Error(nil, err)
+		return
+	}
+	err = kv.app.Cluster.EmitTo(context.Background(), origin, "cluster", data, "update:ack")
+	if err != nil {
+		kv.log.Error(nil, err)
+	}
+}
+
+// outboxSequence returns the last index the outbox in db handed out
+func outboxSequence(db *bbolt.DB) (seq uint64, err error) {
+	err = db.View(func(tx *bbolt.Tx) error {
+		if s := tx.Bucket([]byte("_system")); s != nil {
+			if b := s.Bucket([]byte("outbox")); b != nil {
+				seq = b.Sequence()
+			}
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// keepOutboxSequence makes the outbox in db hand out indexes after
+// seq, so a database copied from a peer or a backup can't make this
+// node reuse indexes its peers have already acknowledged
+func keepOutboxSequence(db *bbolt.DB, seq uint64) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		s, err := tx.CreateBucketIfNotExists([]byte("_system"))
+		if err != nil {
+			return err
+		}
+		b, err := s.CreateBucketIfNotExists([]byte("outbox"))
+		if err != nil || b.Sequence() >= seq {
+			return err
+		}
+		return b.SetSequence(seq)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/perlin-network/noise"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The peer transport has no TLS of its own, so peers prove themselves
+// after the noise handshake instead: each node signs its noise public
+// key with its cluster certificate's key, and a peer is only trusted
+// once that certificate checks out against the cluster CA. Sync
+// transfers run over TLS with client certificates from the same CA.
+
+// PeerHello is the credential a node presents to its peers
+type PeerHello struct {
+	Certificates [][]byte `json:"certificates"`
+	Signature    []byte   `json:"signature"`
+}
+
+// peerAuth holds this node's cluster certificate and the peers it has
+// verified, by noise public key
+type peerAuth struct {
+	cert    tls.Certificate
+	roots   *x509.CertPool
+	hello   PeerHello
+	trusted map[noise.PublicKey]time.Time
+	lock    sync.RWMutex
+}
+
+// newPeerAuth loads the cluster CA and certificate and signs this
+// node's noise key with it
+func newPeerAuth(config ClusterConfig, id noise.PublicKey) (*peerAuth, error) {
+	cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(config.CACertificate)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.CACertificate)
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("cluster certificate key can't be used for signing")
+	}
+	digest := sha256.Sum256(id[:])
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &peerAuth{
+		cert:    cert,
+		roots:   roots,
+		hello:   PeerHello{Certificates: cert.Certificate, Signature: sig},
+		trusted: map[noise.PublicKey]time.Time{},
+	}, nil
+}
+
+// verifyChain checks that the first certificate in chain was issued by
+// the cluster CA and returns it
+func (p *peerAuth) verifyChain(chain [][]byte) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+	}
+	inter := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		inter.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return certs[0], err
+}
+
+// verify checks a peer's hello against the noise key it connected with
+// and trusts the key until its certificate expires
+func (p *peerAuth) verify(id noise.PublicKey, hello PeerHello) error {
+	cert, err := p.verifyChain(hello.Certificates)
+	if err != nil {
+		return err
+	}
+	algo := x509.UnknownSignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	}
+	err = cert.CheckSignature(algo, id[:], hello.Signature)
+	if err != nil {
+		return fmt.Errorf("node key signature: %w", err)
+	}
+	p.lock.Lock()
+	p.trusted[id] = cert.NotAfter
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *peerAuth) isTrusted(id noise.PublicKey) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	expires, ok := p.trusted[id]
+	return ok && time.Now().Before(expires)
+}
+
+// tlsConfig returns the TLS config for sync transfers, which present
+// this node's certificate and only accept peers signed by the CA
+func (p *peerAuth) tlsConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.cert},
+		ClientCAs:    p.roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		// peers are dialed by IP, so the chain is checked without a
+		// host name below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(chain [][]byte, _ [][]*x509.Certificate) error {
+			_, err := p.verifyChain(chain)
+			return err
+		},
+	}
+}
+
+// authorize makes sure the peer that sent a message holds a certificate
+// from the cluster CA, asking it for its credentials the first time it's
+// seen. Without a cluster CA every peer is accepted.
+func (c *Cluster) authorize(id noise.ID) bool {
+	if c.auth == nil || c.auth.isTrusted(id.ID) {
+		return true
+	}
+	err := c.requestHello(id)
+	if err != nil {
+		go c.metrics["auth_failures"].(prometheus.Counter).Inc()
+		c.log.ErrorF(nil, "Peer %s failed the certificate handshake and its messages will be dropped: %v", id.Address, err)
+		return false
+	}
+	c.log.InfoF(nil, "Peer %s presented a valid cluster certificate", id.Address)
+	return true
+}
+
+func (c *Cluster) requestHello(id noise.ID) error {
+	b, err := json.Marshal(&Message{
+		Epoch:    atomic.LoadUint64(&c.epoch) + 1,
+		DataType: "auth:hello",
+		Type:     "auth",
+		ID:       uuid.New().String(),
+		Origin:   c.node.Addr(),
+		Protocol: protocolVersion,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := c.node.Request(ctx, id.Address, b)
+	if err != nil {
+		return err
+	}
+	var hello PeerHello
+	err = json.Unmarshal(reply, &hello)
+	if err != nil {
+		return err
+	}
+	return c.auth.verify(id.ID, hello)
+}
@@ -16,12 +16,14 @@ import (
 
 //Plugins type
 type Plugins struct {
+	*liveConfig
+
 	mgr       *subrpc.Manager
 	app       *Cave
 	terminate chan bool
-	config    *Config
 	log       *Log
 	metrics   map[string]interface{}
+	timeouts  map[string]time.Duration
 }
 
 // NewPlugins function
@@ -31,12 +33,13 @@ func NewPlugins(app *Cave) (*Plugins, error) {
 		return nil, err
 	}
 	p := &Plugins{
-		mgr:       mgr,
-		app:       app,
-		terminate: make(chan bool),
-		config:    app.Config,
-		log:       app.Logger,
-		metrics:   pluginMetrics(),
+		mgr:        mgr,
+		app:        app,
+		terminate:  make(chan bool),
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		metrics:    pluginMetrics(),
+		timeouts:   map[string]time.Duration{},
 	}
 	plugs, err := pluginList("./plugins.d")
 	if err != nil {
@@ -59,10 +62,21 @@ func NewPlugins(app *Cave) (*Plugins, error) {
 		if err != nil {
 			return nil, err
 		}
+		if i.CallTimeout > 0 {
+			p.timeouts[i.Name] = i.CallTimeout
+		}
 	}
 	return p, nil
 }
 
+// callTimeout returns how long to wait on a call to the named plugin
+func (p *Plugins) callTimeout(name string) time.Duration {
+	if t, ok := p.timeouts[name]; ok {
+		return t
+	}
+	return p.config().Plugin.CallTimeout
+}
+
 // Start function
 func (p *Plugins) Start() {
 	p.log.Debug("PLUGIN", "Starting plugins")
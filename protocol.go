@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/perlin-network/noise"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// protocolVersion is the version of the Message and KVUpdate formats
+// this node speaks, as major.minor. Bump the minor version for changes
+// older nodes can safely ignore and the major version for ones they
+// can't; nodes only talk to peers with the same major version.
+const protocolVersion = "1.2"
+
+// ackProtocol is the first minor version whose nodes acknowledge the
+// updates they apply
+const ackProtocol = 2
+
+// legacyProtocol is assumed for peers that don't send a version, which
+// are the builds from before versions were added
+const legacyProtocol = "1.0"
+
+// parseProtocol splits a major.minor protocol version
+func parseProtocol(v string) (int, int, bool) {
+	parts := strings.SplitN(v, ".", 2)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor := 0
+	if len(parts) == 2 {
+		minor, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	return major, minor, true
+}
+
+// negotiateProtocol returns the version two nodes speaking local and
+// peer talk with, which is the lower of the two, or "" when their major
+// versions differ
+func negotiateProtocol(local string, peer string) string {
+	lmaj, lmin, ok := parseProtocol(local)
+	if !ok {
+		return ""
+	}
+	pmaj, pmin, ok := parseProtocol(peer)
+	if !ok || pmaj != lmaj {
+		return ""
+	}
+	if pmin < lmin {
+		return peer
+	}
+	return local
+}
+
+// checkProtocol records the protocol version of the peer that sent msg
+// and reports whether this node can talk to it. A peer whose version
+// has a different major version is logged once each time its version
+// changes, and its messages are dropped.
+func (c *Cluster) checkProtocol(id noise.ID, msg Message) bool {
+	v := msg.Protocol
+	if v == "" {
+		v = legacyProtocol
+	}
+	negotiated := negotiateProtocol(protocolVersion, v)
+	c.healthLock.Lock()
+	key := id.ID.String()
+	h := c.health[key]
+	changed := h.Protocol != v
+	h.ID = key
+	h.Address = id.Address
+	h.Protocol = v
+	h.Negotiated = negotiated
+	c.health[key] = h
+	c.healthLock.Unlock()
+	if negotiated != "" {
+		return true
+	}
+	go c.metrics["protocol_mismatch"].(prometheus.Counter).Inc()
+	if changed {
+		c.log.ErrorF(nil, "Peer %s speaks protocol %s, which isn't compatible with this node's %s; its messages will be dropped and none will be sent to it", id.Address, v, protocolVersion)
+	}
+	return false
+}
+
+// compatible reports whether messages can be sent to p. Peers that
+// haven't sent anything yet are assumed to be compatible.
+func (c *Cluster) compatible(p noise.ID) bool {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	h, ok := c.health[p.ID.String()]
+	return !ok || h.Protocol == "" || h.Negotiated != ""
+}
+
+// sendsAcks reports whether the peer at addr acknowledges the updates
+// it applies. Peers from before ackProtocol don't, so an update they
+// were sent is taken as applied. Peers that haven't sent anything yet
+// are assumed to.
+func (c *Cluster) sendsAcks(addr string) bool {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	for _, h := range c.health {
+		if h.Address != addr || h.Negotiated == "" {
+			continue
+		}
+		_, minor, ok := parseProtocol(h.Negotiated)
+		return ok && minor >= ackProtocol
+	}
+	return true
+}
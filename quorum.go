@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+)
+
+// quorumReadTimeout is how long a quorum read waits for peers to answer
+const quorumReadTimeout = 2 * time.Second
+
+// ErrReadQuorum is returned when too few nodes answered a quorum read
+var ErrReadQuorum = errors.New("Could not reach a majority of the cluster to read the key")
+
+// PeerRead asks a peer for the value it has stored at a key
+type PeerRead struct {
+	Prefix string `json:"prefix"`
+	Key    string `json:"key"`
+}
+
+// PeerValue is a node's answer to a PeerRead. Value is the object as
+// stored, so values encrypted at rest stay encrypted on the wire.
+type PeerValue struct {
+	Found bool     `json:"found"`
+	Value KVObject `json:"value"`
+	Error string   `json:"error,omitempty"`
+}
+
+// storedValue reads the object at key as it's stored, without
+// unsealing it
+func (kv *KV) storedValue(prefix string, key string) PeerValue {
+	buckets, k := parsePath(key)
+	res := PeerValue{}
+	err := kv.view(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if errors.Is(err, bbolt.ErrBucketNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(k))
+		if v == nil {
+			return nil
+		}
+		err = json.Unmarshal(v, &res.Value)
+		if err != nil {
+			return err
+		}
+		res.Found = !res.Value.expired(time.Now())
+		return nil
+	})
+	if err != nil {
+		return PeerValue{Error: err.Error()}
+	}
+	return res
+}
+
+// QuorumGetObjectCtx reads key from a majority of the cluster, this
+// node included, and returns the newest value any of them has. It's
+// GetObjectCtx in dev mode.
+func (kv *KV) QuorumGetObjectCtx(ctx context.Context, key string, prefix string) (obj KVObject, err error) {
+	if kv.config().Mode == "dev" {
+		return kv.GetObjectCtx(ctx, key, prefix)
+	}
+	start := time.Now()
+	defer kv.doMetrics("get:quorum", start)
+	defer func() { kv.countError("get:quorum", err) }()
+	kv.countKeyspaceOp("get:quorum", prefix, key)
+	ctx, span := startSpan(ctx, "kv.get.quorum", prefix, key)
+	defer func() { endSpan(span, err) }()
+	answers := kv.app.Cluster.readPeers(ctx, PeerRead{Prefix: prefix, Key: key})
+	answers[kv.app.Cluster.node.Addr()] = kv.storedValue(prefix, key)
+	var newest *KVObject
+	n := 0
+	for _, a := range answers {
+		if a.Error != "" {
+			continue
+		}
+		n++
+		if a.Found && (newest == nil || a.Value.LastUpdated.After(newest.LastUpdated)) {
+			v := a.Value
+			newest = &v
+		}
+	}
+	if n <= len(answers)/2 {
+		return obj, ErrReadQuorum
+	}
+	if newest == nil {
+		return obj, nil
+	}
+	obj, err = kv.unseal(*newest)
+	if err != nil {
+		return obj, err
+	}
+	if obj.Secret {
+		err = kv.audit("get:key", prefix, key, requesterFrom(ctx))
+	}
+	return obj, err
+}
+
+// readPeers asks every peer for the value stored at r.Key and returns
+// the answers by peer address, with an error for peers that didn't
+// answer in time
+func (c *Cluster) readPeers(ctx context.Context, r PeerRead) map[string]PeerValue {
+	peers := c.Peers()
+	answers := map[string]PeerValue{}
+	for _, p := range peers {
+		answers[p.Address] = PeerValue{Error: "no answer"}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		c.log.Error(nil, err)
+		return answers
+	}
+	msg := &Message{
+		Data:      data,
+		DataType:  "kv:read",
+		Type:      "kv",
+		ID:        uuid.New().String(),
+		Origin:    c.node.Addr(),
+		Protocol:  protocolVersion,
+		RequestID: requestIDFrom(ctx),
+	}
+	c.sign(msg)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Error(nil, err)
+		return answers
+	}
+	ctx, cancel := context.WithTimeout(ctx, quorumReadTimeout)
+	defer cancel()
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		if !c.compatible(p) {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			go c.metrics["messages_tx"].(*prometheus.CounterVec).WithLabelValues(msg.Type, msg.DataType).Inc()
+			var v PeerValue
+			reply, err := c.node.Request(ctx, addr, b)
+			if err == nil {
+				err = json.Unmarshal(reply, &v)
+			}
+			if err != nil {
+				c.log.ErrorF(forRequest("CLUSTER", msg.RequestID), "Quorum read of %s from %s failed: %v", r.Key, addr, err)
+				v = PeerValue{Error: err.Error()}
+			}
+			lock.Lock()
+			answers[addr] = v
+			lock.Unlock()
+		}(p.Address)
+	}
+	wg.Wait()
+	return answers
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+)
+
+// maxReadBatch is the most reads that share one transaction. A batch
+// that fills up runs right away instead of waiting out the window.
+const maxReadBatch = 128
+
+type readJob struct {
+	fn   func(*bbolt.Tx) error
+	done chan error
+}
+
+type readBatch struct {
+	jobs []readJob
+}
+
+// view runs fn in a read transaction. With kv.read_batch_window set,
+// reads made while others are running are collected for the window and
+// share one transaction, which is opened once the window closes, so
+// every read still sees the store as it was when the read was made or
+// later. A read made on its own runs right away.
+func (kv *KV) view(fn func(*bbolt.Tx) error) error {
+	n := atomic.AddInt32(&kv.readers, 1)
+	defer atomic.AddInt32(&kv.readers, -1)
+	window := kv.config().KV.ReadBatchWindow
+	if window <= 0 || n == 1 {
+		return kv.db.View(fn)
+	}
+	job := readJob{fn: fn, done: make(chan error, 1)}
+	kv.readLock.Lock()
+	b := kv.readBatch
+	if b == nil {
+		b = &readBatch{}
+		kv.readBatch = b
+		time.AfterFunc(window, func() {
+			kv.readLock.Lock()
+			if kv.readBatch != b {
+				// it filled up and already ran
+				kv.readLock.Unlock()
+				return
+			}
+			kv.readBatch = nil
+			kv.readLock.Unlock()
+			kv.runReadBatch(b)
+		})
+	}
+	b.jobs = append(b.jobs, job)
+	if len(b.jobs) >= maxReadBatch {
+		kv.readBatch = nil
+		go kv.runReadBatch(b)
+	}
+	kv.readLock.Unlock()
+	return <-job.done
+}
+
+// runReadBatch runs the reads in b one after another in a single
+// transaction
+func (kv *KV) runReadBatch(b *readBatch) {
+	go kv.metrics["read_batch_size"].(prometheus.Histogram).Observe(float64(len(b.jobs)))
+	ran := 0
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		for _, job := range b.jobs {
+			job.done <- job.fn(tx)
+			ran++
+		}
+		return nil
+	})
+	for _, job := range b.jobs[ran:] {
+		job.done <- err
+	}
+}
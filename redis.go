@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// The Redis listener speaks enough of RESP for clients to use cave as
+// a simple config or feature flag store: GET, SET (with EX/PX), DEL,
+// KEYS and EXISTS against the default key space. Keys are KV paths, so
+// "flags/beta" is the key "beta" in the "flags" bucket.
+
+// redisMaxBulk caps the size of a single argument a client can send
+const redisMaxBulk = 64 << 20
+
+// redisMaxLine caps the length of a command sent inline or of the
+// header lines of one sent as an array
+const redisMaxLine = 64 << 10
+
+// redisMaxArgs caps the number of arguments in a command
+const redisMaxArgs = 1024 * 1024
+
+// Until a connection has logged in its commands are held to these much
+// smaller limits, so a client without a token can't make the server
+// allocate much
+const (
+	redisUnauthedArgs = 10
+	redisUnauthedBulk = 16 << 10
+)
+
+// errProtocol is returned for input that isn't valid RESP
+var errProtocol = errors.New("Protocol error")
+
+// Redis serves the Redis protocol listener
+type Redis struct {
+	*liveConfig
+
+	app       *Cave
+	log       *Log
+	terminate chan bool
+	kv        *KV
+	listener  net.Listener
+}
+
+// NewRedis sets up the Redis protocol listener
+func NewRedis(app *Cave) (*Redis, error) {
+	r := &Redis{
+		app:        app,
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		terminate:  make(chan bool),
+		kv:         app.KV,
+	}
+	addr := fmt.Sprintf("0.0.0.0:%v", r.config().Redis.Port)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.config().SSL.Enable {
+		config, err := apiTLSConfig(r.config().SSL)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		lis = tls.NewListener(lis, config)
+	}
+	r.listener = lis
+	return r, nil
+}
+
+// Start accepts client connections until the listener is shut down
+func (r *Redis) Start() {
+	stopped := make(chan bool)
+	go func() {
+		<-r.terminate
+		close(stopped)
+		r.listener.Close()
+	}()
+	r.log.InfoF(nil, "Redis protocol listening on %s", r.listener.Addr())
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			r.log.Error(nil, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go r.serve(conn)
+	}
+}
+
+// redisConn is a client connection and its login state
+type redisConn struct {
+	w      *bufio.Writer
+	ctx    context.Context
+	authed bool
+}
+
+func (r *Redis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	c := &redisConn{
+		w:      bufio.NewWriter(conn),
+		ctx:    withRequester(context.Background(), "anonymous@"+conn.RemoteAddr().String()),
+		authed: !r.config().API.Authentication,
+	}
+	for {
+		args, err := readCommand(rd, c.authed)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			c.fail("ERR " + err.Error())
+			c.w.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := r.exec(c, args)
+		err = c.w.Flush()
+		if err != nil || quit {
+			return
+		}
+	}
+}
+
+// exec runs one command and reports whether the client asked to quit
+func (r *Redis) exec(c *redisConn, args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "QUIT":
+		c.simple("OK")
+		return true
+	case "PING":
+		if len(args) > 1 {
+			c.bulk([]byte(args[1]))
+		} else {
+			c.simple("PONG")
+		}
+		return false
+	case "AUTH":
+		r.auth(c, args[1:])
+		return false
+	}
+	if !c.authed {
+		c.fail("NOAUTH Authentication required.")
+		return false
+	}
+	switch cmd {
+	case "SELECT":
+		if len(args) != 2 {
+			c.arity(cmd)
+		} else if args[1] != "0" {
+			c.fail("ERR DB index is out of range")
+		} else {
+			c.simple("OK")
+		}
+	case "GET":
+		if len(args) != 2 {
+			c.arity(cmd)
+			return false
+		}
+		obj, err := r.lookup(c.ctx, args[1])
+		if err != nil {
+			c.fail("ERR " + err.Error())
+		} else if obj == nil {
+			c.bulk(nil)
+		} else {
+			c.bulk(obj.Data)
+		}
+	case "SET":
+		r.set(c, args)
+	case "DEL":
+		r.del(c, args)
+	case "EXISTS":
+		if len(args) < 2 {
+			c.arity(cmd)
+			return false
+		}
+		n := 0
+		for _, key := range args[1:] {
+			obj, err := r.lookup(c.ctx, key)
+			if err != nil {
+				c.fail("ERR " + err.Error())
+				return false
+			}
+			if obj != nil {
+				n++
+			}
+		}
+		c.integer(n)
+	case "KEYS":
+		if len(args) != 2 {
+			c.arity(cmd)
+			return false
+		}
+		keys, err := r.keys(args[1])
+		if err != nil {
+			c.fail("ERR " + err.Error())
+			return false
+		}
+		c.array(keys)
+	default:
+		c.fail(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// auth logs the connection in with an API token, sent either alone or
+// after a user name, which is ignored
+func (r *Redis) auth(c *redisConn, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		c.arity("AUTH")
+		return
+	}
+	if !r.config().API.Authentication {
+		c.simple("OK")
+		return
+	}
+	tok, err := r.app.TokenStore.Find(args[len(args)-1])
+	if err != nil || time.Now().Before(tok.IssueTime) || time.Now().After(tok.ExpireTime) {
+		c.fail("WRONGPASS invalid or expired token")
+		return
+	}
+	c.authed = true
+	c.ctx = withRequester(context.Background(), tok.UID)
+	c.simple("OK")
+}
+
+func (r *Redis) set(c *redisConn, args []string) {
+	if len(args) < 3 {
+		c.arity("SET")
+		return
+	}
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) || ttl != 0 {
+			c.fail("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			c.fail("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * time.Millisecond
+		if opt == "EX" {
+			ttl = time.Duration(n) * time.Second
+		}
+		i++
+	}
+	if r.app.Cluster.ReadOnly() {
+		c.fail("READONLY You can't write against a read only replica.")
+		return
+	}
+	var err error
+	if ttl > 0 {
+		err = r.kv.PutTTLCtx(c.ctx, args[1], []byte(args[2]), "kv", false, ttl)
+	} else {
+		err = r.kv.PutCtx(c.ctx, args[1], []byte(args[2]), "kv", false)
+	}
+	if err != nil {
+		c.fail("ERR " + err.Error())
+		return
+	}
+	c.simple("OK")
+}
+
+func (r *Redis) del(c *redisConn, args []string) {
+	if len(args) < 2 {
+		c.arity("DEL")
+		return
+	}
+	if r.app.Cluster.ReadOnly() {
+		c.fail("READONLY You can't write against a read only replica.")
+		return
+	}
+	n := 0
+	for _, key := range args[1:] {
+		obj, err := r.lookup(c.ctx, key)
+		if err != nil {
+			c.fail("ERR " + err.Error())
+			return
+		}
+		if obj == nil {
+			continue
+		}
+		err = r.kv.DeleteKeyCtx(c.ctx, key, "kv")
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			c.fail("ERR " + err.Error())
+			return
+		}
+		n++
+	}
+	c.integer(n)
+}
+
+// lookup reads a key, returning nil if it doesn't exist or has expired
+func (r *Redis) lookup(ctx context.Context, key string) (*KVObject, error) {
+	obj, err := r.kv.GetObjectCtx(ctx, key, "kv")
+	var serr *json.SyntaxError
+	if errors.As(err, &serr) {
+		// nothing stored at the key
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Data) == 0 {
+		return nil, nil
+	}
+	return &obj, nil
+}
+
+// keys returns the paths of the unexpired keys matching a Redis glob
+// pattern
+func (r *Redis) keys(pattern string) ([]string, error) {
+	now := time.Now()
+	keys := []string{}
+	err := r.kv.db.View(func(tx *bbolt.Tx) error {
+		return walkObjects(tx.Bucket([]byte("kv")), "", func(key string, obj KVObject) error {
+			if !obj.expired(now) && globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// readCommand reads a command, either inline or as an array of bulk
+// strings, holding it to the smaller limits for a connection that
+// hasn't logged in unless authed is set
+func readCommand(rd *bufio.Reader, authed bool) ([]string, error) {
+	maxArgs, maxBulk := redisMaxArgs, redisMaxBulk
+	if !authed {
+		maxArgs, maxBulk = redisUnauthedArgs, redisUnauthedBulk
+	}
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		args := strings.Fields(line)
+		if len(args) > maxArgs {
+			return nil, fmt.Errorf("%w: too many arguments", errProtocol)
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string isn't terminated", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most redisMaxLine bytes
+func readLine(rd *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, err := rd.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > redisMaxLine {
+			return "", fmt.Errorf("%w: line too long", errProtocol)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func (c *redisConn) simple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *redisConn) fail(s string) {
+	c.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (c *redisConn) arity(cmd string) {
+	c.fail(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func (c *redisConn) integer(n int) {
+	c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+// bulk writes b as a bulk string, or the nil reply if b is nil
+func (c *redisConn) bulk(b []byte) {
+	if b == nil {
+		c.w.WriteString("$-1\r\n")
+		return
+	}
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *redisConn) array(items []string) {
+	c.w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		c.bulk([]byte(item))
+	}
+}
+
+// globMatch matches name against a Redis glob pattern, which supports
+// *, ?, [abc], [^abc], [a-z] and \ escapes
+func globMatch(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if globMatch(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+			continue
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end >= 0 {
+				if name == "" {
+					return false
+				}
+				class := pattern[1 : end+1]
+				negate := strings.HasPrefix(class, "^")
+				if negate {
+					class = class[1:]
+				}
+				if classMatch(class, name[0]) == negate {
+					return false
+				}
+				pattern, name = pattern[end+2:], name[1:]
+				continue
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if name == "" || name[0] != pattern[0] {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return name == ""
+}
+
+// classMatch reports whether c is in a glob character class
+func classMatch(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if c >= lo && c <= hi {
+			return true
+		}
+	}
+	return false
+}
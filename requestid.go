@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const requestIDKey ctxKey = "request_id"
+
+// validRequestID limits the request IDs taken from clients to ones
+// that are safe to put in log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID returns a context carrying the ID of the API request
+// a KV call is made for
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// requestIDFrom returns the request ID stored in ctx, if there is one
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestID tags each request with the ID in its X-Request-ID header,
+// or a new one, and sends it back in the response. The ID follows the
+// request's writes to the rest of the cluster and is added to their
+// logs on every node.
+func (a *API) requestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		c.SetRequest(c.Request().WithContext(withRequestID(c.Request().Context(), id)))
+		return next(c)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+	"go.etcd.io/bbolt"
+)
+
+// SchemaError is returned when a value doesn't match the schema
+// registered for its path
+type SchemaError struct {
+	Prefix  string   `json:"prefix"`
+	Details []string `json:"details"`
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("value does not match the schema for '%s': %s", e.Prefix, strings.Join(e.Details, "; "))
+}
+
+// compiledSchema caches a parsed schema along with the source it was
+// built from, so a changed schema is noticed and rebuilt
+type compiledSchema struct {
+	raw    string
+	schema *gojsonschema.Schema
+}
+
+func schemaBucket(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	return tx.Bucket([]byte("_system")).CreateBucketIfNotExists([]byte("schemas"))
+}
+
+// compileSchema parses a schema, refusing any $ref that would make
+// the node load a document from a file or URL
+func compileSchema(raw []byte) (*gojsonschema.Schema, error) {
+	var doc interface{}
+	err := json.Unmarshal(raw, &doc)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRefs(doc)
+	if err != nil {
+		return nil, err
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+}
+
+func checkRefs(doc interface{}) error {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" && !strings.HasPrefix(ref, "#") {
+				return fmt.Errorf("schema $ref '%s' must point inside the schema", ref)
+			}
+			err := checkRefs(child)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			err := checkRefs(child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PutSchema registers a JSON Schema that values stored under prefix
+// must match
+func (kv *KV) PutSchema(prefix string, schema []byte, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("put:schema", start)
+	defer func() { kv.countError("put:schema", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	_, err = compileSchema(schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	ctx := context.Background()
+	err = kv.update(ctx, "put:schema", func(tx *bbolt.Tx) error {
+		b, err := schemaBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(prefix), schema)
+		if err != nil || !emit {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "put:schema", "kv", prefix, KVObject{Data: schema})
+	})
+	if err != nil {
+		return err
+	}
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// DeleteSchema removes the schema registered for prefix
+func (kv *KV) DeleteSchema(prefix string, e ...bool) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("delete:schema", start)
+	defer func() { kv.countError("delete:schema", err) }()
+	emit := true
+	if len(e) > 0 {
+		emit = e[0]
+	}
+	ctx := context.Background()
+	err = kv.update(ctx, "delete:schema", func(tx *bbolt.Tx) error {
+		b, err := schemaBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = b.Delete([]byte(prefix))
+		if err != nil || !emit {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "delete:schema", "kv", prefix, KVObject{})
+	})
+	if err != nil {
+		return err
+	}
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// GetSchemas returns every registered schema by prefix
+func (kv *KV) GetSchemas() (map[string]json.RawMessage, error) {
+	schemas := map[string]json.RawMessage{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("schemas"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			schemas[string(k)] = append(json.RawMessage{}, v...)
+			return nil
+		})
+	})
+	return schemas, err
+}
+
+// validate checks a JSON value against the schema with the longest
+// prefix matching key. Values that aren't JSON aren't checked.
+func (kv *KV) validate(key string, value []byte) error {
+	if contentType(value) != "application/json" {
+		return nil
+	}
+	prefix := ""
+	var raw []byte
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("_system")).Bucket([]byte("schemas"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(key, string(k)) && (raw == nil || len(k) > len(prefix)) {
+				prefix = string(k)
+				raw = append([]byte{}, v...)
+			}
+			return nil
+		})
+	})
+	if err != nil || raw == nil {
+		return err
+	}
+	kv.schemaLock.Lock()
+	cached, ok := kv.schemas[prefix]
+	if !ok || cached.raw != string(raw) {
+		s, err := compileSchema(raw)
+		if err != nil {
+			kv.schemaLock.Unlock()
+			return err
+		}
+		cached = compiledSchema{raw: string(raw), schema: s}
+		kv.schemas[prefix] = cached
+	}
+	kv.schemaLock.Unlock()
+	res, err := cached.schema.Validate(gojsonschema.NewBytesLoader(value))
+	if err != nil {
+		return err
+	}
+	if res.Valid() {
+		return nil
+	}
+	serr := &SchemaError{Prefix: prefix}
+	for _, e := range res.Errors() {
+		serr.Details = append(serr.Details, e.String())
+	}
+	return serr
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.etcd.io/bbolt"
+)
+
+// ErrSearchLimit is returned alongside the first kv.search_limit
+// matches when a search finds more than that
+var ErrSearchLimit = errors.New("Search result limit reached")
+
+// ErrValueSearchOff is returned by SearchValues unless
+// kv.value_search is turned on
+var ErrValueSearchOff = errors.New("Value search is turned off")
+
+// ErrSearchRateLimited is returned when a value search is started
+// within kv.value_search_interval of the last one
+var ErrSearchRateLimited = errors.New("A value search ran too recently, try again later")
+
+// FindKeys returns the full path of every key matching a shell-style
+// glob, such as "app/*/config". Wildcards don't match "/", so each
+// level of the pattern matches one level of buckets.
+func (kv *KV) FindKeys(pattern string, prefix string) ([]string, error) {
+	return kv.FindKeysCtx(context.Background(), pattern, prefix, false)
+}
+
+// FindKeysCtx is FindKeys that gives up if ctx is done, optionally
+// ignoring case. The keys found so far are returned with the error
+// when the search is cut short by ctx or the result limit.
+func (kv *KV) FindKeysCtx(ctx context.Context, pattern string, prefix string, fold bool) (keys []string, err error) {
+	start := time.Now()
+	defer kv.doMetrics("find:keys", start)
+	defer func() { kv.countError("find:keys", err) }()
+	pattern = strings.TrimPrefix(pattern, "/")
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	keys = []string{}
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, []string{}, prefix, false)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return nil
+		}
+		s := keySearch{
+			ctx:      ctx,
+			segments: strings.Split(pattern, "/"),
+			fold:     fold,
+			limit:    kv.config().KV.SearchLimit,
+			now:      start,
+			keys:     &keys,
+		}
+		return s.walk(b, "", 0)
+	})
+	return keys, err
+}
+
+// keySearch is the state of a FindKeys cursor walk
+type keySearch struct {
+	ctx      context.Context
+	segments []string
+	fold     bool
+	limit    int
+	now      time.Time
+	keys     *[]string
+}
+
+// walk matches the keys in bkt against the pattern segment at depth,
+// only descending into buckets whose name matches that segment
+func (s keySearch) walk(bkt *bbolt.Bucket, path string, depth int) error {
+	last := depth == len(s.segments)-1
+	c := bkt.Cursor()
+	for ea, v := c.First(); ea != nil; ea, v = c.Next() {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if !s.match(depth, string(ea)) {
+			continue
+		}
+		if v == nil {
+			nested := bkt.Bucket(ea)
+			if nested == nil || last {
+				continue
+			}
+			err := s.walk(nested, path+string(ea)+"/", depth+1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !last {
+			continue
+		}
+		obj := KVObject{}
+		err := json.Unmarshal(v, &obj)
+		if err != nil {
+			return err
+		}
+		if obj.expired(s.now) {
+			continue
+		}
+		if len(*s.keys) >= s.limit {
+			return ErrSearchLimit
+		}
+		*s.keys = append(*s.keys, path+string(ea))
+	}
+	return nil
+}
+
+func (s keySearch) match(depth int, name string) bool {
+	if s.fold {
+		name = strings.ToLower(name)
+	}
+	ok, _ := path.Match(s.segments[depth], name)
+	return ok
+}
+
+// SearchValues returns the full path of every key whose value contains
+// substring. Secrets are only decrypted and searched when
+// secretsIncluded is set, so callers have to check the requester may
+// read them, and each one decrypted is added to the audit trail. Every value in the key space is read, so it's meant for
+// admins tracking down a value, not for regular lookups; it has to be
+// turned on with kv.value_search and runs at most once per
+// kv.value_search_interval.
+func (kv *KV) SearchValues(substring string, prefix string, secretsIncluded bool) ([]string, error) {
+	return kv.SearchValuesCtx(context.Background(), substring, prefix, secretsIncluded)
+}
+
+// SearchValuesCtx is SearchValues that gives up if ctx is done. The keys
+// found so far are returned with the error when the search is cut short
+// by ctx or the result limit.
+func (kv *KV) SearchValuesCtx(ctx context.Context, substring string, prefix string, secretsIncluded bool) (keys []string, err error) {
+	start := time.Now()
+	defer kv.doMetrics("search:values", start)
+	defer func() { kv.countError("search:values", err) }()
+	if !kv.config().KV.ValueSearch {
+		return nil, ErrValueSearchOff
+	}
+	err = kv.claimValueSearch(start)
+	if err != nil {
+		return nil, err
+	}
+	want := []byte(substring)
+	keys = []string{}
+	// secrets are decrypted once the transaction is closed, since
+	// fetching a keyring key and auditing the read both need their own
+	type secret struct {
+		key string
+		obj KVObject
+	}
+	secrets := []secret{}
+	err = kv.db.View(func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, []string{}, prefix, false)
+		if err != nil {
+			return err
+		}
+		return walkObjects(b, "", func(key string, obj KVObject) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if obj.expired(start) {
+				return nil
+			}
+			if obj.Secret {
+				if secretsIncluded {
+					secrets = append(secrets, secret{key, obj})
+				}
+				return nil
+			}
+			obj, err = kv.unseal(obj)
+			if err != nil {
+				return err
+			}
+			if !bytes.Contains(obj.Data, want) {
+				return nil
+			}
+			if len(keys) >= kv.config().KV.SearchLimit {
+				return ErrSearchLimit
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return keys, err
+	}
+	for _, s := range secrets {
+		if err := ctx.Err(); err != nil {
+			return keys, err
+		}
+		data, err := kv.Decrypt(s.obj)
+		if err != nil {
+			return keys, err
+		}
+		err = kv.audit("get:key", prefix, s.key, requesterFrom(ctx))
+		if err != nil {
+			return keys, err
+		}
+		if !bytes.Contains(data, want) {
+			continue
+		}
+		if len(keys) >= kv.config().KV.SearchLimit {
+			return keys, ErrSearchLimit
+		}
+		keys = append(keys, s.key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// claimValueSearch records a value search starting now, unless the last
+// one started too recently
+func (kv *KV) claimValueSearch(now time.Time) error {
+	kv.valueSearchLock.Lock()
+	defer kv.valueSearchLock.Unlock()
+	if !kv.lastValueSearch.IsZero() && now.Sub(kv.lastValueSearch) < kv.config().KV.ValueSearchInterval {
+		return ErrSearchRateLimited
+	}
+	kv.lastValueSearch = now
+	return nil
+}
+
+func (a *API) routeSearch(c echo.Context) error {
+	pattern := c.QueryParam("pattern")
+	value := c.QueryParam("value")
+	if (pattern == "") == (value == "") {
+		return c.JSON(400, jsonError{Message: "Either pattern or value is required"})
+	}
+	secret := c.QueryParam("secret") == "true"
+	if secret && !a.canDecrypt(c) {
+		return c.JSON(403, errNoDecrypt)
+	}
+	ctx := withRequester(c.Request().Context(), a.requester(c))
+	ctx, cancel := context.WithTimeout(ctx, a.config().KV.SearchTimeout)
+	defer cancel()
+	var keys []string
+	var err error
+	if value != "" {
+		keys, err = a.kv.SearchValuesCtx(ctx, value, "kv", secret)
+	} else {
+		keys, err = a.kv.FindKeysCtx(ctx, pattern, "kv", c.QueryParam("nocase") == "true")
+	}
+	switch {
+	case errors.Is(err, path.ErrBadPattern):
+		return c.JSON(400, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrValueSearchOff):
+		return c.JSON(403, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrSearchRateLimited):
+		return c.JSON(429, jsonError{Message: err.Error()})
+	case errors.Is(err, ErrSearchLimit):
+		c.Response().Header().Set("Warning", fmt.Sprintf("199 cave \"Only the first %d matches were returned\"", a.config().KV.SearchLimit))
+	case errors.Is(err, context.DeadlineExceeded):
+		c.Response().Header().Set("Warning", fmt.Sprintf("199 cave \"Search timed out after %s, results are incomplete\"", a.config().KV.SearchTimeout))
+	case err != nil:
+		a.log.Error(nil, err)
+		return c.JSON(500, jsonError{Message: err.Error()})
+	}
+	return c.JSON(200, keys)
+}
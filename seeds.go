@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// seedLookupTimeout bounds one round of seed discovery
+const seedLookupTimeout = 5 * time.Second
+
+// seedFinder resolves the seed addresses a node dials to join the
+// cluster
+type seedFinder func(ctx context.Context, c ClusterConfig) ([]string, error)
+
+// discoveryMethods are the values cluster.discovery can be set to
+var discoveryMethods = map[string]seedFinder{
+	"static":     staticSeeds,
+	"dns":        srvSeeds,
+	"kubernetes": kubernetesSeeds,
+}
+
+// staticSeeds returns the discovery host and the configured seeds
+func staticSeeds(ctx context.Context, c ClusterConfig) ([]string, error) {
+	seeds := []string{}
+	if c.DiscoveryHost != "" {
+		seeds = append(seeds, c.DiscoveryHost)
+	}
+	return append(seeds, c.Seeds...), nil
+}
+
+// srvSeeds looks up the DNS SRV records at cluster.discovery_name,
+// e.g. _cave._tcp.example.com
+func srvSeeds(ctx context.Context, c ClusterConfig) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", c.DiscoveryName)
+	if err != nil {
+		return nil, err
+	}
+	seeds := []string{}
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return seeds, nil
+}
+
+// kubernetesSeeds looks up the pods behind the headless service at
+// cluster.discovery_name, e.g. cave.default.svc.cluster.local. Every
+// pod is expected to listen on this node's cluster port.
+func kubernetesSeeds(ctx context.Context, c ClusterConfig) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, c.DiscoveryName)
+	if err != nil {
+		return nil, err
+	}
+	seeds := []string{}
+	for _, ip := range ips {
+		seeds = append(seeds, net.JoinHostPort(ip, strconv.Itoa(int(c.Port))))
+	}
+	return seeds, nil
+}
+
+// findSeeds resolves seeds with the configured discovery method. When
+// a dynamic method fails or finds nothing, the discovery host and
+// static seeds are used instead. It returns the method that found them.
+func (c *Cluster) findSeeds() (string, []string) {
+	method := c.config().Cluster.Discovery
+	ctx, cancel := context.WithTimeout(context.Background(), seedLookupTimeout)
+	defer cancel()
+	seeds, err := discoveryMethods[method](ctx, c.config().Cluster)
+	if err == nil && len(seeds) == 0 {
+		err = fmt.Errorf("no seeds found")
+	}
+	if err != nil && method != "static" {
+		c.log.WarnF(nil, "%s discovery of %s failed, falling back to static seeds: %v", method, c.config().Cluster.DiscoveryName, err)
+		method = "static"
+		seeds, _ = staticSeeds(ctx, c.config().Cluster)
+	}
+	c.log.DebugF(nil, "%s discovery found %s", method, strings.Join(seeds, ", "))
+	return method, seeds
+}
+
+// firstAnswer pings addrs in turn and returns the first one that
+// answers, or "" if none do
+func (c *Cluster) firstAnswer(addrs []string) string {
+	for _, addr := range addrs {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		_, err := c.node.Ping(ctx, addr)
+		cancel()
+		if err == nil {
+			return addr
+		}
+	}
+	return ""
+}
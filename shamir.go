@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// masterKeySize is the size of the key the shared key is sealed with
+// when unseal shares are turned on
+const masterKeySize = 32
+
+// ErrSealed is returned for anything that needs the shared key while
+// the node is sealed
+var ErrSealed = errors.New("The shared key is sealed, unseal it with /api/v1/system/unseal")
+
+// ErrBadShare is returned for an unseal share that isn't one
+var ErrBadShare = errors.New("Not an unseal share")
+
+// ErrBadShares is returned when enough shares were given but they
+// don't rebuild the key the shared key is sealed with
+var ErrBadShares = errors.New("The unseal shares don't open the shared key, start again")
+
+// ErrSharesOff is returned when initialising unseal shares with them
+// turned off
+var ErrSharesOff = errors.New("Unseal shares are turned off, set kv.unsealshares and kv.unsealthreshold")
+
+// ErrInitialised is returned when the unseal shares have already been
+// handed out
+var ErrInitialised = errors.New("The unseal shares have already been handed out")
+
+// ErrNotInitialised is returned for unsealing or sealing a node before
+// the unseal shares have been handed out
+var ErrNotInitialised = errors.New("No unseal shares have been handed out yet, get them from /api/v1/system/init")
+
+// unsealMarker is the _system key recording that the cluster's shared
+// key is sealed with unseal shares
+const unsealMarker = "unseal"
+
+// unsealInit is stored at unsealMarker. SealedKey is the shared key
+// sealed with the master key. A node whose shared key is still sealed
+// with the machine ID takes shares as genuine only if the master key
+// they rebuild opens SealedKey to the same shared key, which nobody
+// without the shared key could have made, so the record doesn't have
+// to come from a trusted peer.
+type unsealInit struct {
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+	SealedKey []byte `json:"sealed_key"`
+}
+
+// gf256 exp and log tables for the field used by AES, with 3 as the
+// generator
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// multiply by 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return exp, log
+}()
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret splits secret into n shares, any k of which rebuild it.
+// Each share is a point on a random polynomial of degree k-1 per byte
+// of the secret, with its x coordinate as the last byte.
+func splitSecret(secret []byte, n int, k int) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, fmt.Errorf("Can't split a secret into %d shares needing %d", n, k)
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coeffs := make([]byte, k)
+	for j, s := range secret {
+		coeffs[0] = s
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][len(secret)]
+			// Horner's rule
+			y := byte(0)
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			shares[i][j] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares rebuilds a secret from shares made by splitSecret
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrBadShare
+	}
+	size := len(shares[0]) - 1
+	xs := map[byte]bool{}
+	for _, s := range shares {
+		x := s[len(s)-1]
+		if len(s)-1 != size || x == 0 || xs[x] {
+			return nil, ErrBadShare
+		}
+		xs[x] = true
+	}
+	secret := make([]byte, size)
+	for i, si := range shares {
+		// the Lagrange basis polynomial for share i, at x = 0
+		xi := si[size]
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				xj := sj[size]
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+		for b := 0; b < size; b++ {
+			secret[b] ^= gfMul(si[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// masterKey makes the key the shared key is sealed with from the
+// secret the unseal shares are split from
+func masterKey(secret []byte) *AESKey {
+	sum := sha256.Sum256(secret)
+	return &AESKey{
+		Key:       sum[:12],
+		NonceSize: 12,
+		Pass:      secret,
+	}
+}
+
+// parseShare decodes an unseal share as handed out to operators
+func parseShare(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != masterKeySize+1 || b[masterKeySize] == 0 {
+		return nil, ErrBadShare
+	}
+	return b, nil
+}
+
+// InitUnseal makes the master key the shared key is sealed with from
+// now on and returns its unseal shares. The shares are only ever handed
+// out here and aren't written anywhere. The shared key, and any key
+// from an interrupted rotation, is resealed with the master key, and
+// a node that started sealed is unsealed with it. The master key never
+// leaves the node; peers reseal their keys the first time they're
+// unsealed with the shares.
+func (kv *KV) InitUnseal() ([]string, error) {
+	c := kv.crypto
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	if c.threshold == 0 {
+		return nil, ErrSharesOff
+	}
+	if c.initialised {
+		return nil, ErrInitialised
+	}
+	if len(kv.unsealMarkers()) > 0 {
+		return nil, ErrInitialised
+	}
+	shared, next := kv.keys()
+	var err error
+	if shared == nil {
+		// still sealed with the machine ID
+		shared, next, err = c.openKeys(c.privkey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	n := kv.config().KV.UnsealShares
+	secret := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	shares, err := splitSecret(secret, n, c.threshold)
+	if err != nil {
+		return nil, err
+	}
+	master := masterKey(secret)
+	err = c.resealKeys(shared, next, master)
+	if err != nil {
+		return nil, err
+	}
+	if c.isSealed() {
+		err = kv.unsealWith(master)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.masterkey = master
+	c.initialised = true
+	sealed, err := sealAESKey(shared, master)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(unsealInit{
+		Shares:    n,
+		Threshold: c.threshold,
+		SealedKey: sealed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = kv.putUnsealInit(context.Background(), data, true)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, s := range shares {
+		lines = append(lines, base64.StdEncoding.EncodeToString(s))
+	}
+	kv.log.WarnF(nil, "Handed out %d unseal shares, any %d of them unseal the shared key", n, c.threshold)
+	return lines, nil
+}
+
+// openKeys opens the shared key, and the key from an interrupted
+// rotation if there is one, with sealing
+func (c *Crypto) openKeys(sealing *AESKey) (shared *AESKey, next *AESKey, err error) {
+	shared, err = c.unsealKey(sharedKeyPath, sealing)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err = c.unsealKey(pendingKeyPath, sealing)
+	if err != nil {
+		next = nil
+	}
+	return shared, next, nil
+}
+
+// resealKeys seals the shared key, and next if a rotation is running,
+// with sealing
+func (c *Crypto) resealKeys(shared *AESKey, next *AESKey, sealing *AESKey) error {
+	if next != nil {
+		err := c.sealKey(pendingKeyPath, next, sealing)
+		if err != nil {
+			return err
+		}
+	}
+	return c.sealKey(sharedKeyPath, shared, sealing)
+}
+
+// unsealInit returns the record of the unseal shares being handed out,
+// or nil if they haven't been
+func (kv *KV) unsealInit() (*unsealInit, error) {
+	var init *unsealInit
+	v := kv.unsealMarker()
+	if v == nil {
+		return nil, nil
+	}
+	err := json.Unmarshal(v, &init)
+	return init, err
+}
+
+// unsealMarker returns the stored record of the unseal shares being
+// handed out, or nil
+func (kv *KV) unsealMarker() json.RawMessage {
+	var v json.RawMessage
+	kv.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte("_system")).Get([]byte(unsealMarker)); b != nil {
+			v = append(json.RawMessage{}, b...)
+		}
+		return nil
+	})
+	return v
+}
+
+// unsealMarkers returns this node's record of the unseal shares being
+// handed out or, if it has none, the ones its peers have
+func (kv *KV) unsealMarkers() [][]byte {
+	if v := kv.unsealMarker(); v != nil {
+		return [][]byte{v}
+	}
+	return kv.app.Cluster.unsealMarkers()
+}
+
+// putUnsealInit stores the record of the unseal shares being handed
+// out, queueing it for peers in the same transaction when emit is set
+func (kv *KV) putUnsealInit(ctx context.Context, data []byte, emit bool) error {
+	err := kv.update(ctx, "put:unseal", func(tx *bbolt.Tx) error {
+		err := tx.Bucket([]byte("_system")).Put([]byte(unsealMarker), data)
+		if err != nil || !emit {
+			return err
+		}
+		return kv.queueEvent(ctx, tx, "put:unseal", "kv", unsealMarker, KVObject{
+			LastUpdated: time.Now(),
+			Data:        data,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if emit {
+		kv.wakeOutbox()
+	}
+	return nil
+}
+
+// UnsealStatus is how far along unsealing the shared key is
+type UnsealStatus struct {
+	Sealed      bool `json:"sealed"`
+	Initialised bool `json:"initialised"`
+	Threshold   int  `json:"threshold"`
+	Progress    int  `json:"progress"`
+}
+
+// unsealStatus must be called with the seal lock held
+func (c *Crypto) unsealStatus() UnsealStatus {
+	return UnsealStatus{
+		Sealed:      c.isSealed(),
+		Initialised: c.initialised,
+		Threshold:   c.threshold,
+		Progress:    len(c.shares),
+	}
+}
+
+// Unseal adds an unseal share. Once enough have been given the master
+// key is rebuilt from them and the shared key, along with any key
+// from an interrupted rotation, is unsealed with it. Until the shares
+// have been handed out there's nothing to unseal with. A node that
+// missed them being handed out reseals its key with them first. The node then
+// pulls a fresh copy of the database, since it couldn't check the
+// updates peers sent while it was sealed.
+func (kv *KV) Unseal(share string) (UnsealStatus, error) {
+	c := kv.crypto
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	if !c.isSealed() {
+		return c.unsealStatus(), nil
+	}
+	var markers [][]byte
+	if !c.initialised {
+		markers = kv.unsealMarkers()
+		if len(markers) == 0 {
+			return c.unsealStatus(), ErrNotInitialised
+		}
+	}
+	b, err := parseShare(share)
+	if err != nil {
+		return c.unsealStatus(), err
+	}
+	for _, s := range c.shares {
+		if s[masterKeySize] == b[masterKeySize] {
+			// already given
+			return c.unsealStatus(), nil
+		}
+	}
+	c.shares = append(c.shares, b)
+	if len(c.shares) < c.threshold {
+		return c.unsealStatus(), nil
+	}
+	secret, err := combineShares(c.shares)
+	c.shares = nil
+	if err != nil {
+		return c.unsealStatus(), err
+	}
+	master := masterKey(secret)
+	if c.initialised {
+		err = kv.unsealWith(master)
+	} else {
+		err = kv.catchUp(master, markers)
+	}
+	if err != nil {
+		return c.unsealStatus(), ErrBadShares
+	}
+	return c.unsealStatus(), nil
+}
+
+// catchUp reseals a shared key still sealed with the machine ID with
+// the master key and unseals it, once one of the records of the shares
+// being handed out shows the master key is genuine. It must be called
+// with the seal lock held.
+func (kv *KV) catchUp(master *AESKey, markers [][]byte) error {
+	c := kv.crypto
+	shared, next, err := c.openKeys(c.privkey)
+	if err != nil {
+		return err
+	}
+	var marker []byte
+	for _, m := range markers {
+		var init unsealInit
+		if json.Unmarshal(m, &init) != nil {
+			continue
+		}
+		key, err := openAESKey(init.SealedKey, master)
+		if err == nil && bytes.Equal(key.Pass, shared.Pass) {
+			marker = m
+			break
+		}
+	}
+	if marker == nil {
+		return ErrBadShares
+	}
+	err = c.resealKeys(shared, next, master)
+	if err != nil {
+		return err
+	}
+	if kv.unsealMarker() == nil {
+		err = kv.putUnsealInit(context.Background(), marker, false)
+		if err != nil {
+			return err
+		}
+	}
+	kv.log.Info(nil, "Resealed the shared key with the key the unseal shares rebuild")
+	return kv.unsealWith(master)
+}
+
+// unsealWith opens the shared key with the master key the unseal
+// shares rebuild. Updates the node dropped while it was sealed, having
+// no key to check them with, weren't acknowledged, so peers send them
+// again from their outboxes without a resync. It must be called with
+// the seal lock held.
+func (kv *KV) unsealWith(master *AESKey) error {
+	c := kv.crypto
+	key, next, err := c.openKeys(master)
+	if err != nil {
+		return err
+	}
+	c.masterkey = master
+	c.initialised = true
+	c.sharedkey = key
+	kv.setKeys(key, next)
+	c.sealed = false
+	kv.log.Info(nil, "Unsealed the shared key")
+	return nil
+}
+
+// Seal drops the shared key and every other key from memory. Until
+// the node is unsealed again it can't read or write secrets, or sign
+// the writes it would pass on to the leader, while the database stays
+// open for other reads. A node can't be sealed before the unseal
+// shares have been handed out, since nothing could unseal it again.
+func (kv *KV) Seal() (UnsealStatus, error) {
+	c := kv.crypto
+	c.sealLock.Lock()
+	defer c.sealLock.Unlock()
+	if !c.initialised {
+		return c.unsealStatus(), ErrNotInitialised
+	}
+	kv.rotating.Lock()
+	defer kv.rotating.Unlock()
+	c.sealed = true
+	c.masterkey = nil
+	c.sharedkey = nil
+	c.shares = nil
+	kv.setKeys(nil, nil)
+	c.forgetKeys()
+	kv.log.Warn(nil, "Sealed the shared key")
+	return c.unsealStatus(), nil
+}
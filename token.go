@@ -13,9 +13,10 @@ import (
 
 // TokenStore manages cluster tokens
 type TokenStore struct {
+	*liveConfig
+
 	app       *Cave
 	terminate chan bool
-	config    *Config
 	tokens    chan Message
 	log       *Log
 	metrics   map[string]interface{}
@@ -26,14 +27,14 @@ type TokenStore struct {
 // NewTokenStore function
 func NewTokenStore(app *Cave) (*TokenStore, error) {
 	t := &TokenStore{
-		app:       app,
-		config:    app.Config,
-		log:       app.Logger,
-		terminate: make(chan bool),
-		tokens:    app.tokens,
-		metrics:   tokenMetrics(),
-		lock:      sync.Mutex{},
-		store:     map[string]Token{},
+		app:        app,
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		terminate:  make(chan bool),
+		tokens:     app.tokens,
+		metrics:    tokenMetrics(),
+		lock:       sync.Mutex{},
+		store:      map[string]Token{},
 	}
 	return t, nil
 }
@@ -249,7 +250,7 @@ func (t *TokenStore) emit() error {
 	defer func() {
 		t.metrics["timings"].(*prometheus.GaugeVec).WithLabelValues("emit").Set(float64(time.Now().Sub(start).Milliseconds()))
 	}()
-	if t.config.Mode == "dev" {
+	if t.config().Mode == "dev" {
 		return nil
 	}
 	t.lock.Lock()
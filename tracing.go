@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts every span. Until tracing is set up it's the global
+// no-op tracer, so instrumented code doesn't have to check whether
+// tracing is on.
+var tracer = otel.Tracer("github.com/yeticloud/cave")
+
+// Tracing exports spans to an OTLP collector
+type Tracing struct {
+	provider  *sdktrace.TracerProvider
+	log       *Log
+	terminate chan bool
+}
+
+// NewTracing sets up the global tracer to send spans to the OTLP/HTTP
+// endpoint in the config
+func NewTracing(app *Cave) *Tracing {
+	exporter := &otlpExporter{
+		endpoint: app.config().Tracing.Endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "cave"),
+		attribute.String("service.instance.id", app.Crypto.id),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(app.config().Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return &Tracing{
+		provider:  provider,
+		log:       app.Logger,
+		terminate: make(chan bool),
+	}
+}
+
+// Start flushes the spans that haven't been sent yet on shutdown
+func (t *Tracing) Start() {
+	<-t.terminate
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := t.provider.Shutdown(ctx)
+	if err != nil {
+		t.log.Error(nil, err)
+	}
+}
+
+// trace starts a span for each request, continuing the trace in its
+// traceparent header if it has one
+func (a *API) trace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("http.request_id", requestIDFrom(ctx)),
+			),
+		)
+		defer span.End()
+		c.SetRequest(r.WithContext(ctx))
+		err := next(c)
+		status := c.Response().Status
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 500 || err != nil {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// startSpan starts a span for a KV call on a key
+func startSpan(ctx context.Context, name string, prefix string, key string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("kv.prefix", prefix),
+		attribute.String("kv.key", key),
+	))
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// otlpExporter sends spans to a collector with OTLP over HTTP, using
+// the JSON encoding so it doesn't need the generated OTLP protobufs
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Events       []otlpEvent    `json:"events,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	Name       string         `json:"name"`
+	Time       string         `json:"timeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// ExportSpans sends a batch of finished spans to the collector
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	scopes := map[string]*otlpScopeSpans{}
+	order := []string{}
+	for _, s := range spans {
+		name := s.InstrumentationScope().Name
+		scope, ok := scopes[name]
+		if !ok {
+			scope = &otlpScopeSpans{Scope: otlpScope{Name: name, Version: s.InstrumentationScope().Version}}
+			scopes[name] = scope
+			order = append(order, name)
+		}
+		scope.Spans = append(scope.Spans, newOTLPSpan(s))
+	}
+	rs := otlpResourceSpans{Resource: otlpResource{Attributes: otlpAttributes(spans[0].Resource().Attributes())}}
+	for _, name := range order {
+		rs.ScopeSpans = append(rs.ScopeSpans, *scopes[name])
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Trace collector at %s returned %s", e.endpoint, res.Status)
+	}
+	return nil
+}
+
+// Shutdown is a no-op, there's no connection to close
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func newOTLPSpan(s sdktrace.ReadOnlySpan) otlpSpan {
+	span := otlpSpan{
+		TraceID:    s.SpanContext().TraceID().String(),
+		SpanID:     s.SpanContext().SpanID().String(),
+		Name:       s.Name(),
+		Kind:       int(s.SpanKind()),
+		Start:      strconv.FormatInt(s.StartTime().UnixNano(), 10),
+		End:        strconv.FormatInt(s.EndTime().UnixNano(), 10),
+		Attributes: otlpAttributes(s.Attributes()),
+	}
+	if s.Parent().IsValid() {
+		span.ParentSpanID = s.Parent().SpanID().String()
+	}
+	for _, ev := range s.Events() {
+		span.Events = append(span.Events, otlpEvent{
+			Name:       ev.Name,
+			Time:       strconv.FormatInt(ev.Time.UnixNano(), 10),
+			Attributes: otlpAttributes(ev.Attributes),
+		})
+	}
+	// OTLP numbers its status codes the other way round from otel
+	switch s.Status().Code {
+	case codes.Ok:
+		span.Status = otlpStatus{Code: 1}
+	case codes.Error:
+		span.Status = otlpStatus{Code: 2, Message: s.Status().Description}
+	}
+	return span
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch a.Value.Type() {
+		case attribute.BOOL:
+			v = map[string]interface{}{"boolValue": a.Value.AsBool()}
+		case attribute.INT64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(a.Value.AsInt64(), 10)}
+		case attribute.FLOAT64:
+			v = map[string]interface{}{"doubleValue": a.Value.AsFloat64()}
+		default:
+			v = map[string]interface{}{"stringValue": a.Value.Emit()}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: string(a.Key), Value: v})
+	}
+	return kvs
+}
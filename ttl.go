@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// expirySweepInterval is how often the leader deletes expired keys.
+// Expired keys read as missing in the meantime.
+const expirySweepInterval = time.Second
+
+// ErrKeyNotFound is returned when heartbeating or deleting a key that
+// doesn't exist, or heartbeating one that has already expired
+var ErrKeyNotFound = errors.New("Key does not exist")
+
+// ErrNoTTL is returned when heartbeating a key that wasn't written with
+// a TTL
+var ErrNoTTL = errors.New("Key was not written with a TTL")
+
+// expired reports whether an object's TTL has run out
+func (o KVObject) expired(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
+
+// PutTTL sets a value that expires after ttl
+func (kv *KV) PutTTL(key string, value []byte, prefix string, secret bool, ttl time.Duration, e ...bool) error {
+	return kv.PutTTLCtx(context.Background(), key, value, prefix, secret, ttl, e...)
+}
+
+// PutTTLCtx is PutTTL on behalf of the requester in ctx
+func (kv *KV) PutTTLCtx(ctx context.Context, key string, value []byte, prefix string, secret bool, ttl time.Duration, e ...bool) error {
+	obj, err := kv.newObject(key, prefix, value, secret)
+	if err != nil {
+		return err
+	}
+	expires := obj.LastUpdated.Add(ttl)
+	obj.ExpiresAt = &expires
+	obj.TTL = ttl
+	return kv.PutObjectCtx(ctx, key, obj, prefix, secret, e...)
+}
+
+// Heartbeat pushes a key's expiry back to a full TTL from now without
+// touching its value. A key whose TTL has already lapsed can't be
+// revived this way; it has to be written again.
+func (kv *KV) Heartbeat(key string, prefix string) (err error) {
+	start := time.Now()
+	defer kv.doMetrics("heartbeat:key", start)
+	defer func() { kv.countError("heartbeat:key", err) }()
+	buckets, k := parsePath(key)
+	obj := KVObject{}
+	err = kv.update(context.Background(), "heartbeat:key", func(tx *bbolt.Tx) error {
+		b, _, err := kv.getBuckets(tx, buckets, prefix, false)
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(k))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		err = json.Unmarshal(v, &obj)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if obj.expired(now) {
+			return ErrKeyNotFound
+		}
+		if obj.TTL <= 0 {
+			return ErrNoTTL
+		}
+		expires := now.Add(obj.TTL)
+		obj.ExpiresAt = &expires
+		// stored as-is, so a sealed value stays sealed
+		bobj, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(k), bobj)
+		if err != nil {
+			return err
+		}
+		return kv.queueEvent(context.Background(), tx, "put:key", prefix, key, obj)
+	})
+	if err != nil {
+		return err
+	}
+	kv.changed()
+	kv.wakeOutbox()
+	return nil
+}
+
+// expiredKey is a key found past its TTL by the sweeper
+type expiredKey struct {
+	prefix string
+	key    string
+}
+
+// expirer deletes expired keys on the leader, which replicates the
+// deletes to the rest of the cluster. Watchers see each one as a
+// delete:key, so keys kept alive by heartbeats drop out when their
+// owner stops sending them.
+func (kv *KV) expirer(stop chan bool) {
+	t := time.NewTicker(expirySweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if !kv.app.Cluster.IsLeader() {
+				continue
+			}
+			err := kv.sweepExpired()
+			if err != nil {
+				kv.log.Error(nil, err)
+			}
+		}
+	}
+}
+
+// sweepExpired deletes every key whose TTL has run out
+func (kv *KV) sweepExpired() error {
+	start := time.Now()
+	keys := []expiredKey{}
+	err := kv.db.View(func(tx *bbolt.Tx) error {
+		for _, prefix := range kvPrefixes(tx) {
+			err := walkObjects(tx.Bucket([]byte(prefix)), "", func(key string, obj KVObject) error {
+				if obj.expired(start) {
+					keys = append(keys, expiredKey{prefix: prefix, key: key})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	defer kv.doMetrics("delete:expired", start)
+	for _, k := range keys {
+		// a peer may have deleted it first
+		err := kv.DeleteKey(k.key, k.prefix)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+	kv.log.DebugF(nil, "Deleted %d expired keys", len(keys))
+	return nil
+}
+
+// walkObjects calls fn with the full path and stored object of every
+// key under bkt, including those in nested buckets. Objects are passed
+// as stored, so sealed values are still sealed.
+func walkObjects(bkt *bbolt.Bucket, path string, fn func(string, KVObject) error) error {
+	if bkt == nil {
+		return nil
+	}
+	return bkt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return walkObjects(bkt.Bucket(k), path+string(k)+"/", fn)
+		}
+		obj := KVObject{}
+		err := json.Unmarshal(v, &obj)
+		if err != nil {
+			return err
+		}
+		return fn(path+string(k), obj)
+	})
+}
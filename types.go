@@ -6,81 +6,211 @@ import (
 	"time"
 )
 
-// Config type defines the file configuration data
+// Config type defines the file configuration data. Fields tagged
+// redact are hidden from the config endpoint unless the full config is
+// asked for.
 type Config struct {
 	Mode    string          `yaml:"mode"`
 	Cluster ClusterConfig   `yaml:"cluster"`
 	KV      KVConfig        `yaml:"kv"`
 	API     APIConfig       `yaml:"api"`
+	GRPC    GRPCConfig      `yaml:"grpc"`
+	Redis   RedisConfig     `yaml:"redis"`
 	UI      UIConfig        `yaml:"ui"`
 	SSL     SSLConfig       `yaml:"ssl"`
 	Perf    PerfConfig      `yaml:"performance"`
+	Log     LoggerConfig    `yaml:"log"`
+	Tracing TracingConfig   `yaml:"tracing"`
 	Auth    AuthConfig      `yaml:"auth"`
 	Plugin  PluginAppConfig `yaml:"plugin"`
 }
 
 // Cave struct wraps all the app functions
 type Cave struct {
-	Config     *Config
+	*liveConfig
 	Logger     *Log
 	Cluster    *Cluster
 	KV         *KV
 	KVInit     bool
 	API        *API
+	GRPC       *GRPC
+	Redis      *Redis
 	Crypto     *Crypto
 	Plugins    *Plugins
 	TokenStore *TokenStore
+	Tracing    *Tracing
 	updates    chan Message
 	sync       chan Message
 	tokens     chan Message
-	sharedKey  *AESKey
 }
 
-//ClusterConfig type holds the cluster interface objects.
+// ClusterConfig type holds the cluster interface objects.
 type ClusterConfig struct {
 	Port          uint16 `yaml:"port"`
 	DiscoveryHost string `yaml:"discovery_host"`
 	Host          string `yaml:"host"`
 	SyncPort      uint16 `yaml:"sync_port"`
+	// Discovery is how seeds to join through are found: static uses
+	// DiscoveryHost and Seeds, dns the SRV records at DiscoveryName and
+	// kubernetes the pods behind the headless service DiscoveryName
+	Discovery     string   `yaml:"discovery"`
+	Seeds         []string `yaml:"seeds"`
+	DiscoveryName string   `yaml:"discovery_name"`
+	// ReadOnly nodes serve reads and apply updates from the cluster
+	// but refuse writes from clients
+	ReadOnly bool `yaml:"read_only"`
+	// Leader is the address of the node writes are forwarded to by
+	// nodes that can't apply them
+	Leader string `yaml:"leader"`
+	// CACertificate turns on certificate authentication between peers.
+	// Every node then needs a Certificate and Key signed by this CA.
+	CACertificate string `yaml:"ca_certificate"`
+	Certificate   string `yaml:"certificate"`
+	Key           string `yaml:"key" redact:"true"`
+	// Compression is the codec used for message data of at least
+	// CompressionThreshold bytes: none, gzip or snappy
+	Compression          string `yaml:"compression"`
+	CompressionThreshold int    `yaml:"compression_threshold"`
 }
 
-//KVConfig type holds the key-value engine objects.
+// KVConfig type holds the key-value engine objects.
 type KVConfig struct {
-	Encryption bool   `yaml:"enable_encryption"`
-	DBPath     string `yaml:"db_path"`
+	Encryption        bool          `yaml:"enable_encryption"`
+	EncryptAtRest     bool          `yaml:"encrypt_at_rest"`
+	DBPath            string        `yaml:"db_path"`
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval"`
+	SnapshotDir       string        `yaml:"snapshot_dir"`
+	SnapshotRetention int           `yaml:"snapshot_retention"`
+	HistoryRetention  int           `yaml:"history_retention"`
+	AuditRetention    time.Duration `yaml:"audit_retention"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	WriteRetries      int           `yaml:"write_retries"`
+	// bbolt options, see https://pkg.go.dev/go.etcd.io/bbolt#Options
+	DBTimeout      time.Duration `yaml:"db_timeout"`
+	DBOpenRetries  int           `yaml:"db_open_retries"`
+	FreelistType   string        `yaml:"freelist_type"`
+	NoSync         bool          `yaml:"no_sync"`
+	NoFreelistSync bool          `yaml:"no_freelist_sync"`
+	MmapFlags      int           `yaml:"mmap_flags"`
+	// CompactThreshold is the share of the database file that can be
+	// free pages before it's compacted, 0 turns compaction off
+	CompactThreshold float64 `yaml:"compact_threshold"`
+	// CoalesceWindow is how long updates from peers are collected so
+	// repeated writes to a key can be applied once, 0 turns it off
+	CoalesceWindow time.Duration `yaml:"coalesce_window"`
+	// LockTTL is how long a lock is held when the caller doesn't say
+	LockTTL time.Duration `yaml:"lock_ttl"`
+	// UpdateWorkers is how many updates from peers are applied at once
+	UpdateWorkers int `yaml:"update_workers"`
+	// ReadBatchWindow is how long reads are collected to share one
+	// transaction, 0 turns it off
+	ReadBatchWindow time.Duration `yaml:"read_batch_window"`
+	// MaxTreeDepth is how many buckets deep a tree read goes before
+	// the rest is truncated
+	MaxTreeDepth int `yaml:"max_tree_depth"`
+	// SearchLimit and SearchTimeout cap how many keys a search
+	// returns and how long it runs
+	SearchLimit   int           `yaml:"search_limit"`
+	SearchTimeout time.Duration `yaml:"search_timeout"`
+	// ValueSearch turns on searching by value, which reads every
+	// key, and ValueSearchInterval is the least time between two
+	ValueSearch         bool          `yaml:"value_search"`
+	ValueSearchInterval time.Duration `yaml:"value_search_interval"`
+	// KeyPrefixes maps key path prefixes to the name of the
+	// keyring key their secrets are encrypted with
+	KeyPrefixes map[string]string `yaml:"key_prefixes"`
+	// NamespaceKeys gives each namespace its own keyring key for its
+	// secrets
+	NamespaceKeys bool `yaml:"namespace_keys"`
+	// UnsealShares and UnsealThreshold turn on sealing the shared key
+	// with a master key split into UnsealShares shares, any
+	// UnsealThreshold of which unseal it. The shares are handed out by
+	// /api/v1/system/init. 0, only allowed in dev mode, seals it with a
+	// key derived from the machine ID.
+	UnsealShares    int `yaml:"unseal_shares"`
+	UnsealThreshold int `yaml:"unseal_threshold"`
 }
 
-//APIConfig type holds the API engine objects
+// APIConfig type holds the API engine objects
 type APIConfig struct {
 	Enable         bool   `yaml:"enable"`
 	Port           uint16 `yaml:"port"`
+	BindAddress    string `yaml:"bind_address"`
 	Authentication bool   `yaml:"authentication"`
 	EnableMetrics  bool   `yaml:"enable_metrics"`
+	MaxQueries     int    `yaml:"max_queries"`
+	QueryWorkers   int    `yaml:"query_workers"`
+	// SecretReaders are the token identities allowed to read secrets
+	// in plaintext. Empty allows any authenticated client.
+	SecretReaders []string `yaml:"secret_readers"`
+	// TrustedProxies are the IPs or CIDR ranges of proxies whose
+	// X-Forwarded-For and X-Real-IP headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// ExposeEnv adds the node's environment, with secret-looking
+	// variables redacted, to the system info endpoint
+	ExposeEnv bool `yaml:"expose_env"`
 }
 
-//UIConfig struct holds the UI engine objects
+// GRPCConfig holds the gRPC server config. It shares the REST API's
+// authentication and SSL settings.
+type GRPCConfig struct {
+	Enable bool   `yaml:"enable"`
+	Port   uint16 `yaml:"port"`
+}
+
+// RedisConfig holds the Redis protocol listener config. It shares the
+// REST API's authentication and SSL settings.
+type RedisConfig struct {
+	Enable bool   `yaml:"enable"`
+	Port   uint16 `yaml:"port"`
+}
+
+// UIConfig struct holds the UI engine objects
 type UIConfig struct {
 	Enable         bool   `yaml:"enable"`
 	Port           uint16 `yaml:"port"`
 	Authentication bool   `yaml:"authentication"`
 }
 
-//LoggerConfig handles all the logging facilities
+// LoggerConfig handles all the logging facilities
 type LoggerConfig struct {
+	// Level is the least severe level written: debug, info, warn or
+	// error. Request logs are info.
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+	// Output is stdout, stderr or the path of a file to append to
+	Output string `yaml:"output"`
 }
 
-//SSLConfig holds the SSL configuration
+// TracingConfig holds the OpenTelemetry tracing settings
+type TracingConfig struct {
+	Enable bool `yaml:"enable"`
+	// Endpoint is the OTLP/HTTP traces URL of the collector
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the share of new traces recorded, from 0 to 1.
+	// Traces started by a caller or a peer keep their sampling decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// SSLConfig holds the SSL configuration
 type SSLConfig struct {
 	Enable      bool   `yaml:"enable"`
-	Certificate string `yaml:"ssl_certificate"`
-	Key         string `yaml:"ssl_key"`
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key" redact:"true"`
+	// CACertificate turns on client certificate verification for the
+	// REST API, accepting only clients signed by this CA
+	CACertificate string `yaml:"ca_certificate"`
 }
 
-//PerfConfig holds performance configs
+// PerfConfig holds performance configs
 type PerfConfig struct {
 	EnableMetrics  bool   `yaml:"enable_metrics"`
 	EnableHTTPLogs bool   `yaml:"enable_http_logs"`
 	BufferSize     uint64 `yaml:"buffer_size"`
+	// LogBufferSize is how many of the most recent logs are kept for
+	// the logs endpoint
+	LogBufferSize int `yaml:"log_buffer_size"`
 }
 
 // AuthConfig type
@@ -90,10 +220,11 @@ type AuthConfig struct {
 
 // PluginAppConfig type
 type PluginAppConfig struct {
-	PluginPath    string   `yaml:"plugin_path"`
-	AllowUnsigned bool     `yaml:"allow_unsigned"`
-	Blacklist     []string `yaml:"blacklist"`
-	SocketPrefix  string   `yaml:"socket_prefix"`
+	PluginPath    string        `yaml:"plugin_path"`
+	AllowUnsigned bool          `yaml:"allow_unsigned"`
+	Blacklist     []string      `yaml:"blacklist"`
+	SocketPrefix  string        `yaml:"socket_prefix"`
+	CallTimeout   time.Duration `yaml:"call_timeout"`
 }
 
 // Message type represents a message on the wire
@@ -104,6 +235,36 @@ type Message struct {
 	Origin   string `json:"origin"`
 	Data     []byte `json:"data"`
 	DataType string `json:"data_type"`
+	// Signature is an HMAC of the message made with the shared key
+	Signature []byte `json:"signature,omitempty"`
+	// RequestID is the ID of the API request that caused the message.
+	// It's only used in logs, so it isn't signed.
+	RequestID string `json:"request_id,omitempty"`
+	// Trace carries the trace context of the span that sent the
+	// message. Like RequestID it isn't signed.
+	Trace map[string]string `json:"trace,omitempty"`
+	// Encoding is the codec Data was compressed with after signing,
+	// empty when it wasn't
+	Encoding string `json:"encoding,omitempty"`
+	// Protocol is the protocol version of the sender. It isn't signed,
+	// so older nodes can still verify the message.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// ForwardedWrite is a client write passed to the leader by a node
+// that can't apply it itself
+type ForwardedWrite struct {
+	Hops      int         `json:"hops"`
+	Prefix    string      `json:"prefix"`
+	Query     QueryObject `json:"query"`
+	Requester string      `json:"requester"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// ForwardResult is the leader's answer to a ForwardedWrite
+type ForwardResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
 type node struct {
@@ -112,6 +273,20 @@ type node struct {
 	Distance time.Duration
 }
 
+// PeerHealth type holds the last known reachability of a peer
+type PeerHealth struct {
+	ID       string        `json:"id"`
+	Address  string        `json:"address"`
+	Alive    bool          `json:"alive"`
+	LastSeen time.Time     `json:"last_seen"`
+	Latency  time.Duration `json:"latency"`
+	// Protocol is the protocol version the peer last sent, and
+	// Negotiated the one this node talks to it with, empty when the
+	// two aren't compatible
+	Protocol   string `json:"protocol,omitempty"`
+	Negotiated string `json:"negotiated,omitempty"`
+}
+
 // PluginConfig type
 type PluginConfig struct {
 	Name         string                 `yaml:"name"`
@@ -122,6 +297,7 @@ type PluginConfig struct {
 	Env          map[string]string      `yaml:"env"`
 	Config       map[string]interface{} `yaml:"config"`
 	StartupDelay int                    `yaml:"startup_delay"`
+	CallTimeout  time.Duration          `yaml:"call_timeout"`
 }
 
 // APIRequest type
@@ -150,13 +326,31 @@ type MultiQuery struct {
 	Query       []QueryObject `json:"query"`
 	QueryErrors bool          `json:"query_errors"`
 	Error       error         `json:"error"`
+	// Atomic applies every PUT and DELETE in one transaction, so
+	// either all of them succeed or none do
+	Atomic bool `json:"atomic"`
+	// Namespace runs the queries in a namespace instead of the
+	// default key space
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // QueryObject type
 type QueryObject struct {
+	Index  int    `json:"index"`
 	Key    string `json:"key"`
 	Verb   string `json:"verb"`
 	Value  string `json:"value"`
 	Secret bool   `json:"secret"`
 	Error  string `json:"error"`
+	// Prefix selects the keys for SCAN and COUNT
+	Prefix  string            `json:"prefix,omitempty"`
+	Results map[string]string `json:"results,omitempty"`
+	Count   *int              `json:"count,omitempty"`
+}
+
+// BuildInfo type describes the running build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
 }
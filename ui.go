@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	rice "github.com/GeertJohan/go.rice"
+	"github.com/labstack/echo/v4"
+)
+
+// UI serves the web UI on its own port when ui.port differs from
+// api.port
+type UI struct {
+	*liveConfig
+
+	app       *Cave
+	log       *Log
+	terminate chan bool
+	http      *echo.Echo
+}
+
+// uiRoutes mounts the embedded UI files on e
+func uiRoutes(e *echo.Echo) {
+	fs := rice.MustFindBox("./ui/").HTTPBox()
+	e.GET("/", echo.WrapHandler(http.FileServer(fs)))
+	e.GET("/ui/*", echo.WrapHandler(http.StripPrefix("/ui/", http.FileServer(fs))))
+}
+
+// NewUI sets up the UI server. The UI calls the API with relative
+// URLs, so the read-only API routes it uses are answered here too, by
+// passing them to the API server with its authentication and logging.
+func NewUI(app *Cave, api *API) *UI {
+	u := &UI{
+		app:        app,
+		liveConfig: app.liveConfig,
+		log:        app.Logger,
+		terminate:  make(chan bool),
+		http:       echo.New(),
+	}
+	u.http.HideBanner = true
+	u.http.HidePort = true
+	uiRoutes(u.http)
+	u.http.GET(KVPREFIX+"*", echo.WrapHandler(api.http))
+	u.http.GET(APIPREFIX+"cluster/nodes", echo.WrapHandler(api.http))
+	return u
+}
+
+// Start serves the UI until it's terminated
+func (u *UI) Start() {
+	go func() {
+		<-u.terminate
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := u.http.Shutdown(ctx)
+		if err != nil {
+			u.log.Error(nil, err)
+		}
+	}()
+	addr := fmt.Sprintf("0.0.0.0:%v", u.config().UI.Port)
+	if !u.config().SSL.Enable {
+		u.log.InfoF(nil, "UI listening on http://%s", addr)
+		u.log.Error(nil, u.http.Start(addr))
+		return
+	}
+	config, err := apiTLSConfig(u.config().SSL)
+	if err != nil {
+		u.log.Error(nil, err)
+		return
+	}
+	s := u.http.TLSServer
+	s.Addr = addr
+	s.TLSConfig = config
+	u.log.InfoF(nil, "UI listening on https://%s", addr)
+	u.log.Error(nil, u.http.StartServer(s))
+}
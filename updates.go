@@ -0,0 +1,119 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyedUpdates are the update types that only touch one key. They're
+// applied in parallel with updates to other keys; anything else waits
+// for the updates before it to finish and is applied on its own.
+var keyedUpdates = map[string]bool{
+	"put:key":     true,
+	"delete:key":  true,
+	"lock:create": true,
+	"lock:delete": true,
+}
+
+// updateJob is an update to apply, along with the updates to the same
+// key it replaced when they were coalesced, which count as applied
+// once it is
+type updateJob struct {
+	msg      Message
+	kvu      KVUpdate
+	replaced []updateJob
+}
+
+// updatePool applies updates from peers with kv.update_workers
+// goroutines. Each key is always handled by the same worker, so two
+// updates to one key are applied in the order they arrived.
+type updatePool struct {
+	kv      *KV
+	workers []chan updateJob
+	pending sync.WaitGroup
+}
+
+func newUpdatePool(kv *KV, n int) *updatePool {
+	if n < 1 {
+		n = 1
+	}
+	p := &updatePool{kv: kv}
+	for i := 0; i < n; i++ {
+		jobs := make(chan updateJob, 64)
+		p.workers = append(p.workers, jobs)
+		go p.work(jobs)
+	}
+	return p
+}
+
+func (p *updatePool) work(jobs chan updateJob) {
+	for job := range jobs {
+		p.apply(job)
+		p.pending.Done()
+	}
+}
+
+func (p *updatePool) apply(job updateJob) {
+	err := p.kv.handleUpdate(job.msg, job.kvu)
+	if err != nil {
+		// not counted as applied, so the peer sends it again
+		p.kv.log.Error(forRequest("KV", job.msg.RequestID), err)
+		return
+	}
+	origins := map[string]bool{}
+	for _, j := range append(job.replaced, job) {
+		if j.kvu.Index > 0 {
+			p.kv.applied.finish(j.msg.Origin, j.kvu.Previous, j.kvu.Index)
+			origins[j.msg.Origin] = true
+		}
+	}
+	for origin := range origins {
+		p.kv.ackUpdates(origin)
+	}
+}
+
+// dispatch admits an update and the ones it replaced, and hands it to
+// the worker for its key
+func (p *updatePool) dispatch(u coalescedUpdate) {
+	job := updateJob{}
+	for _, msg := range u.replaced {
+		kvu, err := p.kv.admitUpdate(msg)
+		if err != nil {
+			p.kv.log.Error(forRequest("KV", msg.RequestID), err)
+			continue
+		}
+		if kvu.Index > 0 {
+			job.replaced = append(job.replaced, updateJob{msg: msg, kvu: kvu})
+		}
+	}
+	msg := u.msg
+	kvu, err := p.kv.admitUpdate(msg)
+	if err != nil {
+		p.kv.log.Error(forRequest("KV", msg.RequestID), err)
+		return
+	}
+	if kvu.Index > 0 && p.kv.applied.done(msg.Origin, kvu.Previous, kvu.Index) {
+		// sent again because the ack didn't make it back
+		p.kv.ackUpdates(msg.Origin)
+		return
+	}
+	job.msg = msg
+	job.kvu = kvu
+	if !keyedUpdates[kvu.UpdateType] {
+		p.pending.Wait()
+		p.apply(job)
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(kvu.Prefix + "\x00" + kvu.Key))
+	p.pending.Add(1)
+	p.workers[h.Sum32()%uint32(len(p.workers))] <- job
+}
+
+// stop waits for the queued updates to be applied and ends the workers
+func (p *updatePool) stop() {
+	p.pending.Wait()
+	for _, jobs := range p.workers {
+		close(jobs)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// watchBuffer is how many updates a watcher can fall behind by before
+// it starts missing them
+const watchBuffer = 256
+
+// watcher receives the changes made to keys under a path
+type watcher struct {
+	prefix  string
+	path    string
+	updates chan KVUpdate
+}
+
+// Watch subscribes to changes to keys under path in prefix, whether
+// they're made on this node or replicated from a peer. The returned
+// function ends the subscription and closes the channel. A watcher
+// that falls too far behind misses updates rather than holding up
+// writes.
+func (kv *KV) Watch(path string, prefix string) (<-chan KVUpdate, func()) {
+	w := &watcher{
+		prefix:  prefix,
+		path:    path,
+		updates: make(chan KVUpdate, watchBuffer),
+	}
+	kv.watchLock.Lock()
+	kv.watchers[w] = struct{}{}
+	kv.watchLock.Unlock()
+	var once sync.Once
+	return w.updates, func() {
+		once.Do(func() {
+			kv.watchLock.Lock()
+			delete(kv.watchers, w)
+			kv.watchLock.Unlock()
+			close(w.updates)
+		})
+	}
+}
+
+// publish sends a change to the watchers of its key. Deleting a bucket
+// also reaches the watchers of paths inside it.
+func (kv *KV) publish(t string, prefix string, key string, value KVObject) {
+	kvu := KVUpdate{
+		UpdateType: t,
+		Key:        key,
+		Value:      value,
+		Prefix:     prefix,
+	}
+	kv.watchLock.RLock()
+	defer kv.watchLock.RUnlock()
+	for w := range kv.watchers {
+		if w.prefix != prefix {
+			continue
+		}
+		if !strings.HasPrefix(key, w.path) && !(t == "delete:bucket" && strings.HasPrefix(w.path, key)) {
+			continue
+		}
+		select {
+		case w.updates <- kvu:
+		default:
+			go kv.metrics["watch_dropped"].(prometheus.Counter).Inc()
+		}
+	}
+}